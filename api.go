@@ -0,0 +1,606 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wperron/depgraph/constellation"
+	"github.com/wperron/depgraph/deno"
+	"github.com/wperron/depgraph/internal/httputil"
+)
+
+// adminTokenEnv is the environment variable holding the token expected in the
+// Authorization header of requests made to the admin endpoints
+const adminTokenEnv = "ANDROMEDA_ADMIN_TOKEN"
+
+// reindexing is set to 1 while a re-index operation is running
+var reindexing int32
+
+// reindexingModules holds the names of the modules being re-crawled
+var reindexingModules sync.Map
+
+// adminOnly rejects any request that doesn't carry the admin token as a bearer
+// token. If no admin token is configured, all admin requests are rejected.
+func adminOnly(next http.Handler) http.Handler {
+	token := os.Getenv(adminTokenEnv)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := r.Header.Get("Authorization")
+		if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+token)) != 1 {
+			httputil.WriteJSON(w, http.StatusUnauthorized, map[string]string{"status": "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reindexHandler wipes DGraph and DynamoDB and starts a full crawl in the
+// background. Only one re-index can run at any given time.
+func reindexHandler(ctx context.Context, crawler *deno.XQueuedCrawler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			httputil.WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"status": "method_not_allowed"})
+			return
+		}
+
+		if !atomic.CompareAndSwapInt32(&reindexing, 0, 1) {
+			httputil.WriteJSON(w, http.StatusConflict, map[string]string{"status": "reindex_in_progress"})
+			return
+		}
+
+		go func() {
+			defer atomic.StoreInt32(&reindexing, 0)
+			if err := reindex(ctx, crawler); err != nil {
+				slog.Error("reindex failed", "error", err)
+				return
+			}
+			slog.Info("reindex completed")
+		}()
+
+		httputil.WriteJSON(w, http.StatusAccepted, map[string]string{"status": "reindex_started"})
+	}
+}
+
+// reindex wipes the data of the previous crawls and crawls every module again.
+// The data is only wiped once the running crawl is finished.
+func reindex(ctx context.Context, crawler *deno.XQueuedCrawler) error {
+	var resetErr error
+	errs := crawler.Recrawl(ctx, func(ctx context.Context) error {
+		if resetErr = resetIndex(ctx, crawler); resetErr == nil {
+			slog.Info("reindex: starting full crawl")
+		}
+		return resetErr
+	})
+	for e := range errs {
+		if e != resetErr {
+			slog.Error("reindex crawl error", "error", e)
+		}
+	}
+	return resetErr
+}
+
+// resetIndex drops the graph and clears the DynamoDB tables and the ETags so
+// that nothing from the previous crawls is skipped
+func resetIndex(ctx context.Context, crawler *deno.XQueuedCrawler) error {
+	slog.Info("reindex: dropping all data from dgraph")
+	if err := constellation.DropAll(ctx); err != nil {
+		return fmt.Errorf("failed to drop dgraph data: %s", err)
+	}
+
+	if err := constellation.InitSchema(ctx); err != nil {
+		return fmt.Errorf("failed to initialize schema: %s", err)
+	}
+
+	slog.Info("reindex: clearing dynamodb tables")
+	if err := constellation.ClearEntries(ctx); err != nil {
+		return fmt.Errorf("failed to clear dynamodb entries: %s", err)
+	}
+	if err := clearIndexed(ctx); err != nil {
+		return fmt.Errorf("failed to clear indexed versions: %s", err)
+	}
+
+	crawler.ClearETags()
+	return nil
+}
+
+type reindexModuleRequest struct {
+	Name  string `json:"name"`
+	Force bool   `json:"force"`
+}
+
+// reindexModuleHandler re-crawls a single module in the background. When force
+// is set, versions outside of the incremental crawl window are crawled too.
+func reindexModuleHandler(ctx context.Context, crawler *deno.XQueuedCrawler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			httputil.WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"status": "method_not_allowed"})
+			return
+		}
+
+		var req reindexModuleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+			httputil.WriteJSON(w, http.StatusBadRequest, map[string]string{"status": "invalid_request"})
+			return
+		}
+
+		if _, loaded := reindexingModules.LoadOrStore(req.Name, true); loaded {
+			httputil.WriteJSON(w, http.StatusConflict, map[string]string{"status": "already_in_progress"})
+			return
+		}
+
+		go func() {
+			defer reindexingModules.Delete(req.Name)
+			if err := crawler.CrawlModule(ctx, req.Name, req.Force); err != nil {
+				slog.Error("reindex of module failed", "module_name", req.Name, "error", err)
+				return
+			}
+			slog.Info("reindex of module queued", "module_name", req.Name)
+		}()
+
+		httputil.WriteJSON(w, http.StatusAccepted, map[string]string{"status": "queued"})
+	}
+}
+
+type backupRequest struct {
+	Destination string `json:"destination"`
+}
+
+// backupHandler starts a backup of the DGraph cluster to the destination of
+// the request
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		httputil.WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"status": "method_not_allowed"})
+		return
+	}
+
+	var req backupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Destination == "" {
+		httputil.WriteJSON(w, http.StatusBadRequest, map[string]string{"status": "invalid_request"})
+		return
+	}
+
+	if err := constellation.TriggerBackup(r.Context(), req.Destination); err != nil {
+		slog.Error("failed to trigger backup", "destination", req.Destination, "error", err)
+		httputil.WriteJSON(w, http.StatusBadGateway, map[string]string{"status": "backup_failed"})
+		return
+	}
+
+	httputil.WriteJSON(w, http.StatusOK, map[string]string{
+		"status":      "backup_initiated",
+		"destination": req.Destination,
+	})
+}
+
+const (
+	defaultTopModulesLimit = 20
+	maxTopModulesLimit     = 100
+)
+
+// topModulesHandler returns the most popular modules ranked by the metric
+// query parameter, either stars (default) or dependents. The results are
+// paginated with the limit and offset query parameters.
+func topModulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		httputil.WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"status": "method_not_allowed"})
+		return
+	}
+
+	query := r.URL.Query()
+	limit, err := httputil.IntParam(query.Get("limit"), defaultTopModulesLimit)
+	if err != nil || limit <= 0 || limit > maxTopModulesLimit {
+		httputil.WriteJSON(w, http.StatusBadRequest, map[string]string{"status": "invalid_limit"})
+		return
+	}
+	offset, err := httputil.IntParam(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		httputil.WriteJSON(w, http.StatusBadRequest, map[string]string{"status": "invalid_offset"})
+		return
+	}
+
+	var mods []constellation.Module
+	switch metric := query.Get("metric"); metric {
+	case "", "stars":
+		mods, err = constellation.TopModulesByStars(r.Context(), limit, offset)
+	case "dependents":
+		mods, err = constellation.TopModulesByDependentCount(r.Context(), limit, offset)
+	default:
+		httputil.WriteJSON(w, http.StatusBadRequest, map[string]string{"status": "invalid_metric"})
+		return
+	}
+	if err != nil {
+		slog.Error("failed to get top modules", "error", err)
+		httputil.WriteJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+		return
+	}
+
+	if mods == nil {
+		mods = []constellation.Module{}
+	}
+	httputil.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"modules": mods,
+		"limit":   limit,
+		"offset":  offset,
+	})
+}
+
+const (
+	defaultGraphDepth = 3
+	maxGraphDepth     = 10
+)
+
+// cytoscapeHandler streams the dependency graph of a module's entrypoint in the
+// Cytoscape.js JSON format. The module query parameter is either a module name
+// or the specifier of the root file.
+func cytoscapeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		httputil.WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"status": "method_not_allowed"})
+		return
+	}
+
+	query := r.URL.Query()
+	module := query.Get("module")
+	if module == "" {
+		httputil.WriteJSON(w, http.StatusBadRequest, map[string]string{"status": "invalid_module"})
+		return
+	}
+	depth, err := httputil.IntParam(query.Get("depth"), defaultGraphDepth)
+	if err != nil || depth < 0 || depth > maxGraphDepth {
+		httputil.WriteJSON(w, http.StatusBadRequest, map[string]string{"status": "invalid_depth"})
+		return
+	}
+
+	root := module
+	if u, err := url.Parse(module); err != nil || !u.IsAbs() {
+		root, err = constellation.ModuleEntrypoint(r.Context(), module)
+		if err != nil {
+			slog.Warn("failed to resolve module", "module_name", module, "error", err)
+			httputil.WriteJSON(w, http.StatusNotFound, map[string]string{"status": "not_found"})
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := constellation.ExportCytoscape(r.Context(), root, depth, w); err != nil {
+		slog.Error("failed to export graph", "specifier", root, "error", err)
+		httputil.WriteJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+	}
+}
+
+// moduleGraphHandler returns the dependency tree of a module's entrypoint as
+// nested JSON at /api/v1/modules/{name}/graph. The version query parameter
+// defaults to the latest version and the depth is capped to maxDepth.
+func moduleGraphHandler(maxDepth int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			httputil.WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"status": "method_not_allowed"})
+			return
+		}
+
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/modules/"), "/graph")
+		if name == "" || strings.Contains(name, "/") || !strings.HasSuffix(r.URL.Path, "/graph") {
+			httputil.WriteJSON(w, http.StatusNotFound, map[string]string{"status": "not_found"})
+			return
+		}
+
+		query := r.URL.Query()
+		depth, err := httputil.IntParam(query.Get("depth"), defaultGraphDepth)
+		if err != nil || depth < 0 {
+			httputil.WriteJSON(w, http.StatusBadRequest, map[string]string{"status": "invalid_depth"})
+			return
+		}
+		if depth > maxDepth {
+			depth = maxDepth
+		}
+
+		var root string
+		if version := query.Get("version"); version != "" {
+			root = constellation.VersionEntrypoint(name, version)
+		} else if root, err = constellation.ModuleEntrypoint(r.Context(), name); err != nil {
+			slog.Warn("failed to resolve module", "module_name", name, "error", err)
+			httputil.WriteJSON(w, http.StatusNotFound, map[string]string{"status": "not_found"})
+			return
+		}
+
+		tree, err := constellation.QueryDependencyTree(r.Context(), root, depth)
+		if err != nil {
+			slog.Error("failed to query the dependency tree", "specifier", root, "error", err)
+			httputil.WriteJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+			return
+		}
+		if tree == nil {
+			httputil.WriteJSON(w, http.StatusNotFound, map[string]string{"status": "not_found"})
+			return
+		}
+
+		// the graph of an indexed version doesn't change
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Vary", "Accept-Encoding")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			httputil.WriteJSON(w, http.StatusOK, tree)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusOK)
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		if err := json.NewEncoder(gz).Encode(tree); err != nil {
+			slog.Error("failed to encode response", "error", err)
+		}
+	}
+}
+
+// defaultImpactDepth is the number of hops followed to find the consumers of a
+// specifier when the depth query parameter isn't set
+const defaultImpactDepth = 5
+
+// impactHandler returns the names of the modules that import the specifier
+// query parameter, directly or transitively
+func impactHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		httputil.WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"status": "method_not_allowed"})
+		return
+	}
+
+	query := r.URL.Query()
+	specifier := query.Get("specifier")
+	if u, err := url.Parse(specifier); err != nil || !u.IsAbs() {
+		httputil.WriteJSON(w, http.StatusBadRequest, map[string]string{"status": "invalid_specifier"})
+		return
+	}
+	depth, err := httputil.IntParam(query.Get("depth"), defaultImpactDepth)
+	if err != nil || depth < 1 || depth > maxGraphDepth {
+		httputil.WriteJSON(w, http.StatusBadRequest, map[string]string{"status": "invalid_depth"})
+		return
+	}
+
+	modules, err := constellation.QueryTransitiveConsumers(r.Context(), specifier, depth)
+	if err != nil {
+		slog.Error("failed to query the consumers", "specifier", specifier, "error", err)
+		httputil.WriteJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+		return
+	}
+
+	httputil.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"specifier": specifier,
+		"modules":   modules,
+	})
+}
+
+// exportPageSize is the number of File nodes fetched from DGraph per page when
+// exporting the whole graph
+var exportPageSize = 1000
+
+// exportHandler exports every File node of the graph. The ndjson format
+// (default) writes one file per line and flushes the response after every
+// page, the cytoscape format is buffered. The X-Total-Nodes header holds the
+// number of File nodes when the export started.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		httputil.WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"status": "method_not_allowed"})
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+	if format != "ndjson" && format != "cytoscape" {
+		httputil.WriteJSON(w, http.StatusBadRequest, map[string]string{"status": "invalid_format"})
+		return
+	}
+
+	total, err := constellation.CountFiles(r.Context())
+	if err != nil {
+		slog.Error("failed to count files", "error", err)
+		httputil.WriteJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+		return
+	}
+	w.Header().Set("X-Total-Nodes", strconv.Itoa(total))
+
+	if format == "cytoscape" {
+		var buf bytes.Buffer
+		if err := constellation.ExportAllCytoscape(r.Context(), exportPageSize, &buf); err != nil {
+			slog.Error("failed to export graph", "error", err)
+			httputil.WriteJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(buf.Bytes())
+		return
+	}
+
+	// the status can't change once the first page is written, errors past
+	// that point are only logged
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	err = constellation.ExportFiles(r.Context(), exportPageSize, func(page []constellation.File) error {
+		for _, f := range page {
+			if err := enc.Encode(f); err != nil {
+				return err
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("failed to export graph", "error", err)
+	}
+}
+
+const (
+	defaultLeavesLimit = 50
+	maxLeavesLimit     = 1000
+)
+
+// leavesHandler returns at most limit files that don't depend on any other
+// file
+func leavesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		httputil.WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"status": "method_not_allowed"})
+		return
+	}
+
+	limit, err := httputil.IntParam(r.URL.Query().Get("limit"), defaultLeavesLimit)
+	if err != nil || limit <= 0 || limit > maxLeavesLimit {
+		httputil.WriteJSON(w, http.StatusBadRequest, map[string]string{"status": "invalid_limit"})
+		return
+	}
+
+	files, err := constellation.QueryLeafFiles(r.Context(), limit)
+	if err != nil {
+		slog.Error("failed to get leaf files", "error", err)
+		httputil.WriteJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+		return
+	}
+
+	if files == nil {
+		files = []constellation.File{}
+	}
+	httputil.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"files": files,
+		"limit": limit,
+	})
+}
+
+// defaultStaleDays is the age in days after which a module version is stale
+// when the days query parameter isn't set
+const defaultStaleDays = 30
+
+// staleModulesHandler lists the module versions uploaded and last indexed more
+// than the days query parameter ago
+func staleModulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		httputil.WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"status": "method_not_allowed"})
+		return
+	}
+
+	days, err := httputil.IntParam(r.URL.Query().Get("days"), defaultStaleDays)
+	if err != nil || days <= 0 {
+		httputil.WriteJSON(w, http.StatusBadRequest, map[string]string{"status": "invalid_days"})
+		return
+	}
+
+	mods, err := constellation.ModuleVersionAge(r.Context(), time.Duration(days)*24*time.Hour)
+	if err != nil {
+		slog.Error("failed to get stale modules", "error", err)
+		httputil.WriteJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+		return
+	}
+
+	if mods == nil {
+		mods = []constellation.Module{}
+	}
+	httputil.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"modules": mods,
+		"days":    days,
+	})
+}
+
+// healthHandler reports the number of modules and versions indexed in the graph
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	modules, err := constellation.CountModules(r.Context())
+	if err != nil {
+		slog.Error("health check failed", "error", err)
+		httputil.WriteJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+		return
+	}
+
+	versions, err := constellation.CountVersions(r.Context())
+	if err != nil {
+		slog.Error("health check failed", "error", err)
+		httputil.WriteJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+		return
+	}
+
+	httputil.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"status":     "ok",
+		"modules":    modules,
+		"versions":   versions,
+		"build_info": buildInfo(),
+	})
+}
+
+// readinessTimeout bounds each dependency check of the readiness probe
+var readinessTimeout = 2 * time.Second
+
+// healthzHandler is the liveness probe, it succeeds as long as the process
+// can serve requests
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	httputil.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// startedOnly answers with a 503 until started is set, once the process is
+// connected to its dependencies and every handler of next is registered
+func startedOnly(started *int32, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(started) == 0 {
+			httputil.WriteJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "starting"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readyzHandler is the readiness probe. It runs every check concurrently and
+// returns a 503 listing the dependencies whose check failed.
+func readyzHandler(checks map[string]func(context.Context) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var mu sync.Mutex
+		unavailable := []string{}
+		wg := &sync.WaitGroup{}
+		for name, check := range checks {
+			wg.Add(1)
+			go func(name string, check func(context.Context) error) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+				defer cancel()
+				if err := check(ctx); err != nil {
+					slog.Warn("readiness check failed", "dependency", name, "error", err)
+					mu.Lock()
+					unavailable = append(unavailable, name)
+					mu.Unlock()
+				}
+			}(name, check)
+		}
+		wg.Wait()
+
+		if len(unavailable) > 0 {
+			sort.Strings(unavailable)
+			httputil.WriteJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+				"status":      "unavailable",
+				"unavailable": unavailable,
+			})
+			return
+		}
+		httputil.WriteJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/dgo/v2/protos/api"
+	"github.com/wperron/depgraph/constellation"
+	"github.com/wperron/depgraph/deno"
+)
+
+// pagedTxn serves the File nodes 0x1 to 0x<files> one page at a time
+type pagedTxn struct {
+	files int
+}
+
+func (p pagedTxn) QueryWithVars(ctx context.Context, q string, vars map[string]string) (*api.Response, error) {
+	if strings.Contains(q, "count(uid)") {
+		return &api.Response{Json: []byte(fmt.Sprintf(`{"q": [{"count": %d}]}`, p.files))}, nil
+	}
+
+	first, _ := strconv.Atoi(vars["$first"])
+	after, _ := strconv.ParseInt(strings.TrimPrefix(vars["$after"], "0x"), 16, 64)
+	var page []constellation.File
+	for i := int(after) + 1; i <= p.files && len(page) < first; i++ {
+		page = append(page, constellation.File{
+			Uid:       fmt.Sprintf("0x%x", i),
+			Specifier: fmt.Sprintf("https://deno.land/x/mod/%d.ts", i),
+		})
+	}
+	b, _ := json.Marshal(map[string][]constellation.File{"q": page})
+	return &api.Response{Json: b}, nil
+}
+
+func (p pagedTxn) Mutate(ctx context.Context, mu *api.Mutation) (*api.Response, error) {
+	return &api.Response{}, nil
+}
+func (p pagedTxn) Commit(ctx context.Context) error  { return nil }
+func (p pagedTxn) Discard(ctx context.Context) error { return nil }
+
+// flushRecorder records the number of lines written when Flush is called
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes []int
+}
+
+func (f *flushRecorder) Flush() {
+	f.flushes = append(f.flushes, bytes.Count(f.Body.Bytes(), []byte("\n")))
+	f.ResponseRecorder.Flush()
+}
+
+func TestExportHandlerNDJSON(t *testing.T) {
+	defer constellation.UseTxn(func() constellation.Txn { return pagedTxn{files: 5} })()
+	orig := exportPageSize
+	exportPageSize = 2
+	defer func() { exportPageSize = orig }()
+
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	exportHandler(rec, httptest.NewRequest("GET", "/api/v1/graph/export", nil))
+
+	if rec.Code != 200 {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("X-Total-Nodes"); got != "5" {
+		t.Errorf("expected X-Total-Nodes to be 5, got %q", got)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/x-ndjson" {
+		t.Errorf("unexpected content type %q", got)
+	}
+
+	expected := []int{2, 4, 5}
+	if fmt.Sprint(rec.flushes) != fmt.Sprint(expected) {
+		t.Errorf("expected flushes after %v lines, got %v", expected, rec.flushes)
+	}
+
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("expected 5 lines, got %d", len(lines))
+	}
+	var f constellation.File
+	if err := json.Unmarshal([]byte(lines[4]), &f); err != nil || f.Uid != "0x5" {
+		t.Errorf("expected the last line to be file 0x5, got %s", lines[4])
+	}
+}
+
+func TestExportHandlerInvalidFormat(t *testing.T) {
+	rec := httptest.NewRecorder()
+	exportHandler(rec, httptest.NewRequest("GET", "/api/v1/graph/export?format=dot", nil))
+
+	if rec.Code != 400 {
+		t.Errorf("expected status 400, got %d", rec.Code)
+	}
+}
+
+// staticTxn returns the same JSON response to every query and records the
+// variables of the last one
+type staticTxn struct {
+	json string
+	vars map[string]string
+}
+
+func (s *staticTxn) QueryWithVars(ctx context.Context, q string, vars map[string]string) (*api.Response, error) {
+	s.vars = vars
+	return &api.Response{Json: []byte(s.json)}, nil
+}
+
+func (s *staticTxn) Mutate(ctx context.Context, mu *api.Mutation) (*api.Response, error) {
+	return &api.Response{}, nil
+}
+func (s *staticTxn) Commit(ctx context.Context) error  { return nil }
+func (s *staticTxn) Discard(ctx context.Context) error { return nil }
+
+func TestModuleGraphHandlerGzip(t *testing.T) {
+	txn := &staticTxn{json: `{"q": [{
+		"uid": "0x1",
+		"specifier": "https://deno.land/x/oak@v6.5.0/mod.ts",
+		"depends_on": [{"uid": "0x2", "specifier": "https://deno.land/x/oak@v6.5.0/deps.ts"}]
+	}]}`}
+	defer constellation.UseTxn(func() constellation.Txn { return txn })()
+
+	req := httptest.NewRequest("GET", "/api/v1/modules/oak/graph?version=v6.5.0&depth=3", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	moduleGraphHandler(5)(rec, req)
+
+	if rec.Code != 200 {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "public, max-age=60" {
+		t.Errorf("unexpected Cache-Control %q", got)
+	}
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("expected a gzip response, got Content-Encoding %q", got)
+	}
+	if got := txn.vars["$specifier"]; got != "https://deno.land/x/oak@v6.5.0/mod.ts" {
+		t.Errorf("unexpected root specifier %s", got)
+	}
+
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("invalid gzip body: %s", err)
+	}
+	var tree constellation.File
+	if err := json.NewDecoder(gz).Decode(&tree); err != nil {
+		t.Fatalf("invalid JSON body: %s", err)
+	}
+	if tree.Uid != "0x1" || len(tree.DependsOn) != 1 || tree.DependsOn[0].Uid != "0x2" {
+		t.Errorf("unexpected tree: %+v", tree)
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	orig := readinessTimeout
+	readinessTimeout = 10 * time.Millisecond
+	defer func() { readinessTimeout = orig }()
+
+	checks := map[string]func(context.Context) error{
+		"dgraph":   func(ctx context.Context) error { return nil },
+		"dynamodb": func(ctx context.Context) error { return fmt.Errorf("unreachable") },
+		"sqs":      func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() },
+	}
+
+	rec := httptest.NewRecorder()
+	readyzHandler(checks)(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != 503 {
+		t.Fatalf("expected status 503, got %d", rec.Code)
+	}
+
+	var resp struct {
+		Unavailable []string `json:"unavailable"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(resp.Unavailable, ",") != "dynamodb,sqs" {
+		t.Errorf("expected dynamodb and sqs to be unavailable, got %v", resp.Unavailable)
+	}
+
+	delete(checks, "dynamodb")
+	delete(checks, "sqs")
+	rec = httptest.NewRecorder()
+	readyzHandler(checks)(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != 200 {
+		t.Errorf("expected status 200, got %d", rec.Code)
+	}
+}
+
+func TestStartedOnly(t *testing.T) {
+	var started int32
+	handler := startedOnly(&started, http.HandlerFunc(healthzHandler))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "starting") {
+		t.Errorf("expected a 503 while starting, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	atomic.StoreInt32(&started, 1)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected the handler to be served once started, got %d", rec.Code)
+	}
+}
+
+// pathClient answers every request with a 404 and records the paths requested
+type pathClient struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (c *pathClient) DoRequest(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paths = append(c.paths, req.URL.Path)
+	return &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(strings.NewReader("{}"))}, nil
+}
+
+func TestAdminOnly(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	cases := []struct {
+		token    string
+		header   string
+		expected int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"", "Bearer ", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "secret", http.StatusUnauthorized},
+		{"secret", "Bearer secret", http.StatusNoContent},
+	}
+	for _, c := range cases {
+		t.Setenv(adminTokenEnv, c.token)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/admin/reindex", nil)
+		if c.header != "" {
+			req.Header.Set("Authorization", c.header)
+		}
+		rec := httptest.NewRecorder()
+		adminOnly(next).ServeHTTP(rec, req)
+		if rec.Code != c.expected {
+			t.Errorf("token %q, header %q: expected status %d, got %d", c.token, c.header, c.expected, rec.Code)
+		}
+	}
+}
+
+func TestReindexModuleHandler(t *testing.T) {
+	q := deno.NewChanQueue(1)
+	crawler, err := deno.NewXQueuedCrawler(&q)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	client := &pathClient{}
+	crawler.Client = client
+	handler := reindexModuleHandler(context.Background(), crawler)
+
+	cases := []struct {
+		method   string
+		body     string
+		expected int
+	}{
+		{http.MethodGet, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "not json", http.StatusBadRequest},
+		{http.MethodPost, `{"force": true}`, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(c.method, "/api/v1/admin/reindex-module", strings.NewReader(c.body)))
+		if rec.Code != c.expected {
+			t.Errorf("%s %q: expected status %d, got %d", c.method, c.body, c.expected, rec.Code)
+		}
+	}
+
+	// a module already being re-crawled is rejected
+	reindexingModules.Store("oak", true)
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/api/v1/admin/reindex-module", strings.NewReader(`{"name": "oak"}`)))
+	reindexingModules.Delete("oak")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected status 409, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/api/v1/admin/reindex-module", strings.NewReader(`{"name": "oak"}`)))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", rec.Code)
+	}
+
+	// the module is crawled in the background and released once done
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := reindexingModules.Load("oak"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the re-crawl of oak to finish")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if len(client.paths) == 0 || !strings.Contains(client.paths[0], "oak") {
+		t.Errorf("expected oak to be crawled, got requests %v", client.paths)
+	}
+}
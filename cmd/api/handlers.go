@@ -0,0 +1,217 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/wperron/depgraph/constellation"
+	"github.com/wperron/depgraph/internal/httputil"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// envelope wraps every response. NextCursor is only set on paginated
+// responses that have more results, Error only on failed requests.
+type envelope struct {
+	Data       interface{} `json:"data"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// fileNode is a File node with its direct edges in both directions
+type fileNode struct {
+	Uid        string               `json:"uid"`
+	Specifier  string               `json:"specifier"`
+	DependsOn  []constellation.File `json:"depends_on"`
+	Dependents []constellation.File `json:"dependents"`
+}
+
+// listModulesHandler returns a page of the indexed modules at /modules. The
+// cursor query parameter is the next_cursor of the previous page.
+func listModulesHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	limit, err := httputil.IntParam(query.Get("limit"), defaultPageSize)
+	if err != nil || limit <= 0 || limit > maxPageSize {
+		writeError(w, http.StatusBadRequest, "invalid_limit")
+		return
+	}
+	cursor := query.Get("cursor")
+	if cursor != "" && !validCursor(cursor) {
+		writeError(w, http.StatusBadRequest, "invalid_cursor")
+		return
+	}
+
+	mods, err := constellation.ListModules(r.Context(), limit, cursor)
+	if err != nil {
+		slog.Error("failed to list modules", "error", err)
+		writeError(w, http.StatusServiceUnavailable, "unavailable")
+		return
+	}
+
+	resp := envelope{Data: mods}
+	if mods == nil {
+		resp.Data = []constellation.Module{}
+	}
+	if len(mods) == limit {
+		resp.NextCursor = mods[len(mods)-1].Uid
+	}
+	httputil.WriteJSON(w, http.StatusOK, resp)
+}
+
+// moduleHandler routes the requests made under /modules/{name}
+func moduleHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/modules/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		moduleMetadata(w, r, parts[0])
+	case len(parts) == 3 && parts[0] != "" && parts[1] != "" && parts[2] == "deps":
+		versionDependencies(w, r, parts[0], parts[1])
+	case len(parts) == 3 && parts[0] != "" && parts[1] != "" && parts[2] == "dependents":
+		versionDependents(w, r, parts[0], parts[1])
+	default:
+		writeError(w, http.StatusNotFound, "not_found")
+	}
+}
+
+// moduleMetadata returns the module with its versions
+func moduleMetadata(w http.ResponseWriter, r *http.Request, name string) {
+	m, err := constellation.QueryModuleByName(r.Context(), name)
+	if err != nil {
+		slog.Error("failed to query module", "module_name", name, "error", err)
+		writeError(w, http.StatusServiceUnavailable, "unavailable")
+		return
+	}
+	if m == nil {
+		writeError(w, http.StatusNotFound, "not_found")
+		return
+	}
+	httputil.WriteJSON(w, http.StatusOK, envelope{Data: m})
+}
+
+// versionDependencies returns the files imported by the entrypoint of the
+// module version
+func versionDependencies(w http.ResponseWriter, r *http.Request, name, version string) {
+	root := constellation.VersionEntrypoint(name, version)
+	files, err := constellation.QueryNeighbourhood(r.Context(), root, 1)
+	if err != nil {
+		slog.Error("failed to query the dependencies", "module_name", name, "version", version, "specifier", root, "error", err)
+		writeError(w, http.StatusServiceUnavailable, "unavailable")
+		return
+	}
+	if len(files) == 0 {
+		writeError(w, http.StatusNotFound, "not_found")
+		return
+	}
+
+	deps := files[0].DependsOn
+	if deps == nil {
+		deps = []constellation.File{}
+	}
+	httputil.WriteJSON(w, http.StatusOK, envelope{Data: deps})
+}
+
+// versionDependents returns the files importing the entrypoint of the module
+// version
+func versionDependents(w http.ResponseWriter, r *http.Request, name, version string) {
+	root := constellation.VersionEntrypoint(name, version)
+	exists, _, err := constellation.NodeExists(r.Context(), root)
+	if err != nil {
+		slog.Error("failed to look up entrypoint", "module_name", name, "version", version, "specifier", root, "error", err)
+		writeError(w, http.StatusServiceUnavailable, "unavailable")
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "not_found")
+		return
+	}
+
+	dependents, err := constellation.QueryDependents(r.Context(), root)
+	if err != nil {
+		slog.Error("failed to query the dependents", "module_name", name, "version", version, "specifier", root, "error", err)
+		writeError(w, http.StatusServiceUnavailable, "unavailable")
+		return
+	}
+	httputil.WriteJSON(w, http.StatusOK, envelope{Data: dependents})
+}
+
+// specifierHandler returns the File node of the url query parameter with its
+// direct dependencies and dependents at /specifier
+func specifierHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	specifier := r.URL.Query().Get("url")
+	if u, err := url.Parse(specifier); err != nil || !u.IsAbs() {
+		writeError(w, http.StatusBadRequest, "invalid_url")
+		return
+	}
+
+	files, err := constellation.QueryNeighbourhood(r.Context(), specifier, 1)
+	if err != nil {
+		slog.Error("failed to query the dependencies", "specifier", specifier, "error", err)
+		writeError(w, http.StatusServiceUnavailable, "unavailable")
+		return
+	}
+	if len(files) == 0 {
+		writeError(w, http.StatusNotFound, "not_found")
+		return
+	}
+
+	dependents, err := constellation.QueryDependents(r.Context(), specifier)
+	if err != nil {
+		slog.Error("failed to query the dependents", "specifier", specifier, "error", err)
+		writeError(w, http.StatusServiceUnavailable, "unavailable")
+		return
+	}
+
+	node := fileNode{
+		Uid:        files[0].Uid,
+		Specifier:  files[0].Specifier,
+		DependsOn:  files[0].DependsOn,
+		Dependents: dependents,
+	}
+	if node.DependsOn == nil {
+		node.DependsOn = []constellation.File{}
+	}
+	httputil.WriteJSON(w, http.StatusOK, envelope{Data: node})
+}
+
+// allowGet rejects the request with a 405 unless it is a GET
+func allowGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+		return false
+	}
+	return true
+}
+
+// validCursor reports whether the cursor is a DGraph uid
+func validCursor(cursor string) bool {
+	if !strings.HasPrefix(cursor, "0x") {
+		return false
+	}
+	_, err := strconv.ParseUint(strings.TrimPrefix(cursor, "0x"), 16, 64)
+	return err == nil
+}
+
+// writeError writes the error code in the envelope with the given status
+func writeError(w http.ResponseWriter, status int, code string) {
+	httputil.WriteJSON(w, status, envelope{Error: code})
+}
@@ -0,0 +1,106 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dgraph-io/dgo/v2/protos/api"
+	"github.com/wperron/depgraph/constellation"
+)
+
+// routedTxn answers every query with the fixture of the first key found in the
+// query text
+type routedTxn map[string]string
+
+func (r routedTxn) QueryWithVars(ctx context.Context, q string, vars map[string]string) (*api.Response, error) {
+	for k, v := range r {
+		if strings.Contains(q, k) {
+			return &api.Response{Json: []byte(v)}, nil
+		}
+	}
+	return &api.Response{Json: []byte(`{"q": []}`)}, nil
+}
+
+func (r routedTxn) Mutate(ctx context.Context, mu *api.Mutation) (*api.Response, error) {
+	return &api.Response{}, nil
+}
+func (r routedTxn) Commit(ctx context.Context) error  { return nil }
+func (r routedTxn) Discard(ctx context.Context) error { return nil }
+
+func TestListModulesCursor(t *testing.T) {
+	txn := routedTxn{"type(Module)": `{"q": [{"uid": "0x1", "name": "oak"}, {"uid": "0x2", "name": "opine"}]}`}
+	defer constellation.UseTxn(func() constellation.Txn { return txn })()
+
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/modules?limit=2", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+
+	var resp struct {
+		Data       []constellation.Module `json:"data"`
+		NextCursor string                 `json:"next_cursor"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Data) != 2 || resp.NextCursor != "0x2" {
+		t.Errorf("expected 2 modules and cursor 0x2, got %d and %q", len(resp.Data), resp.NextCursor)
+	}
+
+	rec = httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/modules?cursor=oak", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid cursor, got %d", rec.Code)
+	}
+}
+
+func TestSpecifierHandler(t *testing.T) {
+	txn := routedTxn{
+		"~depends_on": `{"q": [{"~depends_on": [{"uid": "0x3", "specifier": "https://deno.land/x/opine/deps.ts"}]}]}`,
+		"@recurse":    `{"q": [{"uid": "0x1", "specifier": "https://deno.land/x/oak/mod.ts", "depends_on": [{"uid": "0x2", "specifier": "https://deno.land/std/http/mod.ts"}]}]}`,
+	}
+	defer constellation.UseTxn(func() constellation.Txn { return txn })()
+
+	rec := httptest.NewRecorder()
+	target := "/specifier?url=https://deno.land/x/oak/mod.ts"
+	newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+
+	var resp struct {
+		Data fileNode `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data.Uid != "0x1" || len(resp.Data.DependsOn) != 1 || len(resp.Data.Dependents) != 1 {
+		t.Errorf("unexpected node %+v", resp.Data)
+	}
+}
+
+func TestModuleHandlerNotFound(t *testing.T) {
+	defer constellation.UseTxn(func() constellation.Txn { return routedTxn{} })()
+
+	for _, path := range []string{"/modules/oak", "/modules/oak/v1.0.0/deps", "/modules/oak/v1.0.0/other"} {
+		rec := httptest.NewRecorder()
+		newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status 404, got %d", path, rec.Code)
+		}
+
+		var resp envelope
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Error != "not_found" || resp.Data != nil {
+			t.Errorf("%s: expected a not_found error envelope, got %+v", path, resp)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+
+// Command api serves a read-only REST API over the dependency graph indexed by
+// the crawler.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/wperron/depgraph/config"
+	"github.com/wperron/depgraph/constellation"
+)
+
+var addr = flag.String("addr", ":8080", "address the API server listens on")
+var logLevel = flag.String("log-level", "info", "minimum level of the logs: debug, info, warn or error")
+
+func main() {
+	config.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid log level %q: %s\n", *logLevel, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	slog.Info("start.")
+
+	appCfg, err := config.LoadConfig(flag.CommandLine)
+	if err != nil {
+		slog.Error("failed to load config", "error", err)
+		os.Exit(1)
+	}
+	if err := appCfg.Validate(); err != nil {
+		slog.Error("invalid config", "error", err)
+		os.Exit(1)
+	}
+	constellation.SetQueryTimeout(appCfg.Dgraph.QueryTimeout)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dgraphCfg := constellation.DGraphConfig{
+		Addresses:   appCfg.Dgraph.AlphaAddresses,
+		TLSCertFile: appCfg.Dgraph.TLSCertFile,
+		TLSKeyFile:  appCfg.Dgraph.TLSKeyFile,
+		CAFile:      appCfg.Dgraph.CAFile,
+		MaxRetries:  appCfg.Dgraph.ConnectRetries,
+		AdminURL:    appCfg.Dgraph.AdminURL,
+	}
+	if err := constellation.InitDGraph(ctx, dgraphCfg); err != nil {
+		slog.Error("failed to connect to dgraph", "error", err)
+		os.Exit(1)
+	}
+
+	srv := &http.Server{Addr: *addr, Handler: newMux()}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		s := <-sig
+		slog.Info("received signal, shutting down", "signal", s.String())
+
+		shutdownCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("failed to shut down the server", "error", err)
+		}
+	}()
+
+	slog.Info("serving the API", "addr", *addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("failed to serve the API", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("done.")
+}
+
+// newMux returns the mux routing the API endpoints
+func newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/modules", listModulesHandler)
+	mux.HandleFunc("/modules/", moduleHandler)
+	mux.HandleFunc("/specifier", specifierHandler)
+	return mux
+}
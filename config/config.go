@@ -0,0 +1,473 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds the parameters of the constellation and deno packages
+type Config struct {
+	AWS      AWSConfig      `yaml:"aws"`
+	Dgraph   DgraphConfig   `yaml:"dgraph"`
+	DynamoDB DynamoDBConfig `yaml:"dynamodb"`
+	SQS      SQSConfig      `yaml:"sqs"`
+	Crawler  CrawlerConfig  `yaml:"crawler"`
+	DenoInfo DenoInfoConfig `yaml:"deno_info"`
+	Debug    DebugConfig    `yaml:"debug"`
+	API      APIConfig      `yaml:"api"`
+
+	FeatureFlags FeatureFlags `yaml:"feature_flags"`
+}
+
+// envPrefix is the prefix of the environment variables overriding the config
+// fields, e.g. ANDROMEDA_SQS_QUEUE_URL
+const envPrefix = "ANDROMEDA_"
+
+// envAliases maps the environment variables kept as shorter aliases to the
+// variable of their field, which wins when both are set
+var envAliases = map[string]string{
+	"ANDROMEDA_DYNAMO_TABLE": "ANDROMEDA_DYNAMODB_TABLE_NAME",
+}
+
+// flagAliases maps the command line flags kept as shorter aliases to the flag
+// of their field, which wins when both are set
+var flagAliases = map[string]string{
+	"dynamo-ttl-days": "dynamodb-ttl-days",
+}
+
+// featureFlagEnvPrefix is the prefix of the environment variables overriding
+// the feature flags, e.g. ANDROMEDA_FF_PARALLEL_INSERT_FILES=true
+const featureFlagEnvPrefix = "ANDROMEDA_FF_"
+
+// FeatureFlags enable experimental pipeline stages
+type FeatureFlags struct {
+	ParallelInsertFiles bool `yaml:"parallel_insert_files"`
+	// DGraphUpsert looks up in DGraph the files missing from DynamoDB before
+	// they are mutated so that no duplicate node is created, on by default
+	DGraphUpsert     bool `yaml:"dgraph_upsert"`
+	IncrementalCrawl bool `yaml:"incremental_crawl"`
+	// SkipIndexedVersions skips the versions recorded in the indexed_versions
+	// DynamoDB table by a previous run
+	SkipIndexedVersions bool `yaml:"skip_indexed_versions"`
+	// ConditionalRequests skips the modules whose versions haven't changed
+	// since they were last crawled by this process
+	ConditionalRequests bool `yaml:"conditional_requests"`
+}
+
+// Active returns the state of every flag keyed by its YAML name
+func (f FeatureFlags) Active() map[string]bool {
+	out := make(map[string]bool)
+	v := reflect.ValueOf(f)
+	for i := 0; i < v.NumField(); i++ {
+		out[yamlName(v.Type().Field(i))] = v.Field(i).Bool()
+	}
+	return out
+}
+
+// applyEnv overrides the flags with the value of their environment variable
+func (f *FeatureFlags) applyEnv() error {
+	v := reflect.ValueOf(f).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := featureFlagEnvPrefix + strings.ToUpper(yamlName(v.Type().Field(i)))
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %s", name, err)
+		}
+		v.Field(i).SetBool(b)
+	}
+	return nil
+}
+
+// AWSConfig holds the parameters shared by the AWS clients
+type AWSConfig struct {
+	// Region is the default region of the DynamoDB and SQS clients
+	Region string `yaml:"region"`
+}
+
+// DgraphConfig holds the parameters of the DGraph client
+type DgraphConfig struct {
+	// AlphaAddresses are the alpha servers, if empty the DGRAPH_ALPHA
+	// environment variable or localhost:9080 is used
+	AlphaAddresses  []string      `yaml:"alpha_addresses,omitempty"`
+	QueryTimeout    time.Duration `yaml:"query_timeout"`
+	MutationTimeout time.Duration `yaml:"mutation_timeout"`
+	ConnectRetries  int           `yaml:"connect_retries"`
+	TLSCertFile     string        `yaml:"tls_cert_file"`
+	TLSKeyFile      string        `yaml:"tls_key_file"`
+	CAFile          string        `yaml:"ca_file"`
+	// AdminURL is the HTTP GraphQL admin endpoint used to trigger backups
+	AdminURL string `yaml:"admin_url"`
+	// InsertWorkers is the number of DenoInfo inserted in parallel when the
+	// parallel_insert_files feature flag is set
+	InsertWorkers int `yaml:"insert_workers"`
+	// InsertBatchSize is the number of DenoInfo whose files are inserted in a
+	// single transaction, 0 or 1 commits every DenoInfo on its own
+	InsertBatchSize int `yaml:"insert_batch_size"`
+}
+
+// DynamoDBConfig holds the parameters of the DynamoDB specifier cache
+type DynamoDBConfig struct {
+	TableName string `yaml:"table_name"`
+	Endpoint  string `yaml:"endpoint"`
+	// CacheSize is reserved for an in-memory cache of the entries, nothing
+	// reads it yet
+	CacheSize int `yaml:"cache_size"`
+	// Region overrides the default AWS region for the table
+	Region string `yaml:"region"`
+	// TTLDays is the number of days after which the entries expire, 0 keeps
+	// them forever
+	TTLDays int `yaml:"ttl_days"`
+	// IndexedVersionsTable records the indexed versions when the
+	// skip_indexed_versions feature flag is set
+	IndexedVersionsTable string `yaml:"indexed_versions_table"`
+}
+
+// SQSConfig holds the parameters of the SQS queue
+type SQSConfig struct {
+	QueueURL        string `yaml:"queue_url"`
+	Endpoint        string `yaml:"endpoint"`
+	DLQUrl          string `yaml:"dlq_url"`
+	LongPollSeconds int    `yaml:"long_poll_seconds"`
+	// Region overrides the default AWS region for the queue
+	Region string `yaml:"region"`
+}
+
+// CrawlerConfig holds the parameters of the deno.land crawler
+type CrawlerConfig struct {
+	ThrottleRatePerSecond int `yaml:"throttle_rate_per_second"`
+	Concurrency           int `yaml:"concurrency"`
+	// MaxVersions and MaxFilesPerVersion skip the modules that are too large
+	// to be indexed, 0 means no limit
+	MaxVersions        int `yaml:"max_versions"`
+	MaxFilesPerVersion int `yaml:"max_files_per_version"`
+	// SpecifierBlocklist and SpecifierBlocklistFile list the glob patterns of
+	// the specifiers that are never passed to `deno info`
+	SpecifierBlocklist     []string `yaml:"specifier_blocklist,omitempty"`
+	SpecifierBlocklistFile string   `yaml:"specifier_blocklist_file"`
+}
+
+// DenoInfoConfig holds the parameters of the `deno info` subprocesses
+type DenoInfoConfig struct {
+	Timeout time.Duration `yaml:"timeout"`
+	// Workers is the number of files of a module passed to `deno info` in
+	// parallel
+	Workers int `yaml:"workers"`
+	// CacheTTL is how long the output of `deno info` is reused for a
+	// specifier, 0 disables the cache
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+// DebugConfig holds the parameters of the debugging tools
+type DebugConfig struct {
+	PprofServerAddr string `yaml:"pprof_server_addr"`
+	// LogLevel is the minimum level of the logs: debug, info, warn or error.
+	// The --log-level flag takes precedence.
+	LogLevel string `yaml:"log_level"`
+}
+
+// APIConfig holds the parameters of the HTTP API
+type APIConfig struct {
+	// GraphMaxDepth caps the depth of the dependency trees returned by the
+	// module graph endpoint
+	GraphMaxDepth int `yaml:"graph_max_depth"`
+}
+
+// Default returns the configuration used when no config file is provided
+func Default() Config {
+	return Config{
+		AWS: AWSConfig{
+			Region: "us-east-1",
+		},
+		Dgraph: DgraphConfig{
+			ConnectRetries: 10,
+			AdminURL:       "http://localhost:8080/admin",
+			InsertWorkers:  4,
+		},
+		DynamoDB: DynamoDBConfig{
+			TableName:            "andromeda-test-4",
+			TTLDays:              30,
+			IndexedVersionsTable: "indexed_versions",
+		},
+		SQS: SQSConfig{
+			QueueURL:        "https://sqs.us-east-1.amazonaws.com/831183038069/andromeda-test-1",
+			LongPollSeconds: 20,
+		},
+		Crawler: CrawlerConfig{
+			ThrottleRatePerSecond: 1,
+			Concurrency:           20,
+		},
+		DenoInfo: DenoInfoConfig{
+			Workers: 4,
+		},
+		Debug: DebugConfig{
+			PprofServerAddr: ":6060",
+			LogLevel:        "info",
+		},
+		API: APIConfig{
+			GraphMaxDepth: 5,
+		},
+		FeatureFlags: FeatureFlags{
+			DGraphUpsert: true,
+		},
+	}
+}
+
+// Load reads the YAML config file at path, if any, and applies the overrides
+// set in the environment. Fields absent from both keep their default value.
+func Load(path string) (Config, error) {
+	cfg := Default()
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		if err := yaml.Unmarshal(b, &cfg); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return Config{}, err
+	}
+	if err := cfg.FeatureFlags.applyEnv(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// RegisterFlags defines the --config flag on fs, along with a flag overriding
+// every field of every section but the feature flags, named after the section
+// and field YAML names, e.g. --sqs-queue-url, and their aliases
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.String("config", "", "path to the YAML config file")
+	forEachField(func(section, field reflect.StructField) {
+		name := flagName(section, field)
+		fs.String(name, "", fmt.Sprintf("overrides %s.%s", yamlName(section), yamlName(field)))
+	})
+	for alias, target := range flagAliases {
+		fs.String(alias, "", fmt.Sprintf("alias of --%s", target))
+	}
+}
+
+// LoadConfig loads the config file named by the --config flag and applies the
+// overrides set in the environment, then the ones set on the command line. The
+// flags must be registered with RegisterFlags and fs must be parsed.
+func LoadConfig(fs *flag.FlagSet) (Config, error) {
+	path := ""
+	if f := fs.Lookup("config"); f != nil {
+		path = f.Value.String()
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	set := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+	for alias, target := range flagAliases {
+		if _, ok := set[target]; !ok {
+			if raw, ok := set[alias]; ok {
+				set[target] = raw
+			}
+		}
+	}
+
+	v := reflect.ValueOf(&cfg).Elem()
+	var flagErr error
+	forEachField(func(section, field reflect.StructField) {
+		name := flagName(section, field)
+		raw, ok := set[name]
+		if !ok || flagErr != nil {
+			return
+		}
+		if err := setField(v.FieldByIndex(section.Index).FieldByIndex(field.Index), raw); err != nil {
+			flagErr = fmt.Errorf("invalid value for --%s: %s", name, err)
+		}
+	})
+	if flagErr != nil {
+		return Config{}, flagErr
+	}
+	return cfg, nil
+}
+
+// forEachField calls fn with every field of every section but the feature
+// flags
+func forEachField(fn func(section, field reflect.StructField)) {
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		section := t.Field(i)
+		if section.Type == reflect.TypeOf(FeatureFlags{}) {
+			continue
+		}
+		for j := 0; j < section.Type.NumField(); j++ {
+			fn(section, section.Type.Field(j))
+		}
+	}
+}
+
+func flagName(section, field reflect.StructField) string {
+	return strings.ReplaceAll(yamlName(section)+"-"+yamlName(field), "_", "-")
+}
+
+// applyEnv overrides the fields of every section but the feature flags with
+// the value of their environment variable, named after the section and field
+// YAML names, e.g. ANDROMEDA_DGRAPH_ALPHA_ADDRESSES, or one of its aliases.
+// Lists are comma separated.
+func (c *Config) applyEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Type == reflect.TypeOf(FeatureFlags{}) {
+			continue
+		}
+
+		section := v.Field(i)
+		for j := 0; j < section.NumField(); j++ {
+			name := envPrefix + strings.ToUpper(yamlName(t.Field(i))+"_"+yamlName(section.Type().Field(j)))
+			raw, ok := os.LookupEnv(name)
+			if !ok {
+				name, raw, ok = lookupEnvAlias(name)
+			}
+			if !ok {
+				continue
+			}
+			if err := setField(section.Field(j), raw); err != nil {
+				return fmt.Errorf("invalid value for %s: %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// lookupEnvAlias returns the name and value of an alias of the environment
+// variable that is set
+func lookupEnvAlias(name string) (string, string, bool) {
+	for alias, target := range envAliases {
+		if target != name {
+			continue
+		}
+		if raw, ok := os.LookupEnv(alias); ok {
+			return alias, raw, true
+		}
+	}
+	return "", "", false
+}
+
+func setField(f reflect.Value, raw string) error {
+	switch {
+	case f.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+	case f.Kind() == reflect.String:
+		f.SetString(raw)
+	case f.Kind() == reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(n))
+	case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String:
+		f.Set(reflect.ValueOf(strings.Split(raw, ",")))
+	default:
+		return fmt.Errorf("unsupported field type %s", f.Type())
+	}
+	return nil
+}
+
+// Validate checks that the values of the configuration are usable
+func (c Config) Validate() error {
+	if c.Debug.LogLevel != "" {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(c.Debug.LogLevel)); err != nil {
+			return fmt.Errorf("invalid debug.log_level %q", c.Debug.LogLevel)
+		}
+	}
+	if c.Dgraph.QueryTimeout < 0 || c.Dgraph.MutationTimeout < 0 {
+		return fmt.Errorf("dgraph timeouts must not be negative")
+	}
+	if c.DynamoDB.TableName == "" {
+		return fmt.Errorf("dynamodb.table_name must not be empty")
+	}
+	if c.DynamoDB.TTLDays < 0 {
+		return fmt.Errorf("dynamodb.ttl_days must not be negative")
+	}
+	if c.AWS.Region == "" {
+		return fmt.Errorf("aws.region must not be empty")
+	}
+	if c.SQS.QueueURL == "" {
+		return fmt.Errorf("sqs.queue_url must not be empty")
+	}
+	if c.SQS.LongPollSeconds < 0 || c.SQS.LongPollSeconds > 20 {
+		return fmt.Errorf("sqs.long_poll_seconds must be between 0 and 20")
+	}
+	if c.Crawler.ThrottleRatePerSecond <= 0 {
+		return fmt.Errorf("crawler.throttle_rate_per_second must be positive")
+	}
+	if c.Crawler.Concurrency < 0 || c.DenoInfo.Workers < 0 || c.DenoInfo.Timeout < 0 || c.DenoInfo.CacheTTL < 0 {
+		return fmt.Errorf("crawler.concurrency, deno_info.workers, deno_info.timeout and deno_info.cache_ttl must not be negative")
+	}
+	if c.Crawler.MaxVersions < 0 || c.Crawler.MaxFilesPerVersion < 0 {
+		return fmt.Errorf("crawler.max_versions and crawler.max_files_per_version must not be negative")
+	}
+	if c.API.GraphMaxDepth < 0 {
+		return fmt.Errorf("api.graph_max_depth must not be negative")
+	}
+	if (c.Dgraph.TLSCertFile == "") != (c.Dgraph.TLSKeyFile == "") {
+		return fmt.Errorf("dgraph.tls_cert_file and dgraph.tls_key_file must be set together")
+	}
+	if c.Dgraph.InsertWorkers < 0 || c.Dgraph.ConnectRetries < 0 || c.Dgraph.InsertBatchSize < 0 {
+		return fmt.Errorf("dgraph.insert_workers, dgraph.connect_retries and dgraph.insert_batch_size must not be negative")
+	}
+	return nil
+}
+
+// Diff returns the YAML paths of the top level sections and fields that
+// differ between the two configurations, e.g. `crawler.concurrency`
+func Diff(a, b Config) []string {
+	var out []string
+	av, bv := reflect.ValueOf(a), reflect.ValueOf(b)
+	t := av.Type()
+	for i := 0; i < t.NumField(); i++ {
+		section := t.Field(i)
+		as, bs := av.Field(i), bv.Field(i)
+		for j := 0; j < section.Type.NumField(); j++ {
+			if !reflect.DeepEqual(as.Field(j).Interface(), bs.Field(j).Interface()) {
+				out = append(out, yamlName(section)+"."+yamlName(section.Type.Field(j)))
+			}
+		}
+	}
+	return out
+}
+
+func yamlName(f reflect.StructField) string {
+	tag := f.Tag.Get("yaml")
+	for i := 0; i < len(tag); i++ {
+		if tag[i] == ',' {
+			return tag[:i]
+		}
+	}
+	if tag == "" {
+		return f.Name
+	}
+	return tag
+}
@@ -0,0 +1,243 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestConfigRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  Config
+	}{
+		{"default", Default()},
+		{"empty", Config{}},
+		{"full", Config{
+			AWS: AWSConfig{
+				Region: "ca-central-1",
+			},
+			Dgraph: DgraphConfig{
+				AlphaAddresses:  []string{"alpha-1:9080", "alpha-2:9080"},
+				QueryTimeout:    5 * time.Second,
+				MutationTimeout: 1500 * time.Millisecond,
+				ConnectRetries:  3,
+				TLSCertFile:     "/etc/andromeda/client.crt",
+				TLSKeyFile:      "/etc/andromeda/client.key",
+				CAFile:          "/etc/andromeda/ca.crt",
+				AdminURL:        "http://alpha-1:8080/admin",
+				InsertWorkers:   16,
+			},
+			DynamoDB: DynamoDBConfig{
+				TableName: "andromeda-prod",
+				Endpoint:  "http://localhost:4566",
+				CacheSize: 10000,
+				Region:    "us-west-2",
+				TTLDays:   7,
+			},
+			SQS: SQSConfig{
+				QueueURL:        "https://sqs.us-east-1.amazonaws.com/123456789012/andromeda",
+				Endpoint:        "http://localhost:4566",
+				DLQUrl:          "https://sqs.us-east-1.amazonaws.com/123456789012/andromeda-dlq",
+				LongPollSeconds: 20,
+				Region:          "eu-west-1",
+			},
+			Crawler: CrawlerConfig{
+				ThrottleRatePerSecond: 5,
+				Concurrency:           50,
+				MaxVersions:           500,
+				MaxFilesPerVersion:    10000,
+				SpecifierBlocklist:    []string{"https://deno.land/x/broken@*/*"},
+			},
+			DenoInfo: DenoInfoConfig{
+				Timeout: 2 * time.Minute,
+				Workers: 8,
+			},
+			Debug: DebugConfig{
+				PprofServerAddr: "localhost:6061",
+			},
+			API: APIConfig{
+				GraphMaxDepth: 8,
+			},
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b, err := yaml.Marshal(c.cfg)
+			if err != nil {
+				t.Fatalf("failed to marshal config: %s", err)
+			}
+
+			var actual Config
+			if err := yaml.Unmarshal(b, &actual); err != nil {
+				t.Fatalf("failed to unmarshal config: %s", err)
+			}
+
+			if !reflect.DeepEqual(actual, c.cfg) {
+				t.Errorf("expected %+v, got %+v", c.cfg, actual)
+			}
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := Default()
+	b := Default()
+	b.Crawler.Concurrency = 100
+	b.SQS.QueueURL = "https://example.com/queue"
+
+	expected := []string{"sqs.queue_url", "crawler.concurrency"}
+	if actual := Diff(a, b); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+func TestLoadFeatureFlagsFromEnv(t *testing.T) {
+	os.Setenv("ANDROMEDA_FF_PARALLEL_INSERT_FILES", "true")
+	defer os.Unsetenv("ANDROMEDA_FF_PARALLEL_INSERT_FILES")
+
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := map[string]bool{
+		"parallel_insert_files": true,
+		"dgraph_upsert":         true,
+		"incremental_crawl":     false,
+		"skip_indexed_versions": false,
+		"conditional_requests":  false,
+	}
+	if actual := cfg.FeatureFlags.Active(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+
+	os.Setenv("ANDROMEDA_FF_PARALLEL_INSERT_FILES", "maybe")
+	if _, err := Load(""); err == nil {
+		t.Errorf("expected an error for an invalid flag value")
+	}
+}
+
+func TestLoadFromEnv(t *testing.T) {
+	env := map[string]string{
+		"ANDROMEDA_DGRAPH_ALPHA_ADDRESSES": "alpha-1:9080,alpha-2:9080",
+		"ANDROMEDA_DGRAPH_QUERY_TIMEOUT":   "5s",
+		"ANDROMEDA_DYNAMODB_ENDPOINT":      "http://localstack:4566",
+		"ANDROMEDA_SQS_QUEUE_URL":          "http://localstack:4566/000000000000/andromeda",
+		"ANDROMEDA_CRAWLER_CONCURRENCY":    "5",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := Default()
+	expected.Dgraph.AlphaAddresses = []string{"alpha-1:9080", "alpha-2:9080"}
+	expected.Dgraph.QueryTimeout = 5 * time.Second
+	expected.DynamoDB.Endpoint = "http://localstack:4566"
+	expected.SQS.QueueURL = "http://localstack:4566/000000000000/andromeda"
+	expected.Crawler.Concurrency = 5
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("expected %+v, got %+v", expected, cfg)
+	}
+
+	os.Setenv("ANDROMEDA_CRAWLER_CONCURRENCY", "many")
+	if _, err := Load(""); err == nil {
+		t.Errorf("expected an error for an invalid int value")
+	}
+}
+
+func TestLoadFromEnvAlias(t *testing.T) {
+	os.Setenv("ANDROMEDA_DYNAMO_TABLE", "andromeda-staging")
+	defer os.Unsetenv("ANDROMEDA_DYNAMO_TABLE")
+
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cfg.DynamoDB.TableName != "andromeda-staging" {
+		t.Errorf("expected andromeda-staging, got %s", cfg.DynamoDB.TableName)
+	}
+
+	os.Setenv("ANDROMEDA_DYNAMODB_TABLE_NAME", "andromeda-prod")
+	defer os.Unsetenv("ANDROMEDA_DYNAMODB_TABLE_NAME")
+
+	cfg, err = Load("")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cfg.DynamoDB.TableName != "andromeda-prod" {
+		t.Errorf("expected andromeda-prod, got %s", cfg.DynamoDB.TableName)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	file := Default()
+	file.AWS.Region = "eu-west-1"
+	file.DynamoDB.TableName = "from-file"
+	file.SQS.QueueURL = "from-file"
+	b, err := yaml.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile(t.TempDir(), "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(b)
+	f.Close()
+
+	os.Setenv("ANDROMEDA_DYNAMODB_TABLE_NAME", "from-env")
+	defer os.Unsetenv("ANDROMEDA_DYNAMODB_TABLE_NAME")
+	os.Setenv("ANDROMEDA_SQS_QUEUE_URL", "from-env")
+	defer os.Unsetenv("ANDROMEDA_SQS_QUEUE_URL")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterFlags(fs)
+	if err := fs.Parse([]string{"--config", f.Name(), "--sqs-queue-url", "from-flag", "--dynamodb-ttl-days", "7"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(fs)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cfg.AWS.Region != "eu-west-1" || cfg.DynamoDB.TableName != "from-env" || cfg.SQS.QueueURL != "from-flag" || cfg.DynamoDB.TTLDays != 7 {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+	if cfg.Crawler.Concurrency != Default().Crawler.Concurrency {
+		t.Errorf("expected the default concurrency, got %d", cfg.Crawler.Concurrency)
+	}
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterFlags(fs)
+	if err := fs.Parse([]string{"--dynamo-ttl-days", "14"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = LoadConfig(fs)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cfg.DynamoDB.TTLDays != 14 {
+		t.Errorf("expected --dynamo-ttl-days to set 14 days, got %d", cfg.DynamoDB.TTLDays)
+	}
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterFlags(fs)
+	fs.Parse([]string{"--crawler-concurrency", "many"})
+	if _, err := LoadConfig(fs); err == nil {
+		t.Errorf("expected an error for an invalid int flag")
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package constellation
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/wperron/depgraph/deno"
+)
+
+// cycleDetectionDepth is the number of depends_on hops followed by
+// DetectCycles, longer cycles aren't reported
+const cycleDetectionDepth = 10
+
+// DetectCycles returns the dependency cycles reachable from the files of the
+// versions of the Module node with the uid within cycleDetectionDepth hops.
+// Each cycle is the ordered list of the specifiers forming it, starting with
+// the file the cycle was entered from.
+func DetectCycles(ctx context.Context, moduleUID string) ([][]string, error) {
+	if !uidPattern.MatchString(moduleUID) {
+		return nil, fmt.Errorf("invalid uid %q", moduleUID)
+	}
+
+	// loop: true is required to see the edges going back to a visited node
+	q := fmt.Sprintf(`{
+		var(func: uid(%s)) {
+			version {
+				f as file_specifier
+			}
+		}
+		q(func: uid(f)) @recurse(depth: %d, loop: true) {
+			uid
+			specifier
+			depends_on
+		}
+	}`, moduleUID, cycleDetectionDepth)
+
+	var resp struct {
+		Q []File `json:"q"`
+	}
+	if err := runQuery(ctx, q, nil, &resp); err != nil {
+		return nil, fmt.Errorf("failed to query the dependencies of %s: %s", moduleUID, err)
+	}
+
+	// flatten the nested result into an adjacency list keyed by specifier
+	graph := make(map[string][]string)
+	var walk func(files []File)
+	walk = func(files []File) {
+		for _, f := range files {
+			if _, ok := graph[f.Specifier]; !ok {
+				graph[f.Specifier] = []string{}
+			}
+			for _, d := range f.DependsOn {
+				if !contains(graph[f.Specifier], d.Specifier) {
+					graph[f.Specifier] = append(graph[f.Specifier], d.Specifier)
+				}
+			}
+			walk(f.DependsOn)
+		}
+	}
+	walk(resp.Q)
+
+	var roots []string
+	for _, f := range resp.Q {
+		roots = append(roots, f.Specifier)
+	}
+	return findCycles(graph, roots), nil
+}
+
+// infoCycles returns the dependency cycles among the files of the DenoInfo
+func infoCycles(info deno.DenoInfo) [][]string {
+	graph := make(map[string][]string, len(info.Files))
+	roots := make([]string, 0, len(info.Files))
+	for specifier, f := range info.Files {
+		graph[specifier] = f.Deps
+		roots = append(roots, specifier)
+	}
+	// iterate in a stable order so the cycles are reported the same way
+	sort.Strings(roots)
+	return findCycles(graph, roots)
+}
+
+// newCycles returns the dependency cycles among the files of the DenoInfo that
+// go through one of the mutated files. The edges of the other files were
+// already in the graph, so were the cycles made only of them.
+func newCycles(info deno.DenoInfo, mutated map[string]bool) [][]string {
+	var cycles [][]string
+	for _, cycle := range infoCycles(info) {
+		for _, specifier := range cycle {
+			if mutated[canonicalSpecifier(specifier)] {
+				cycles = append(cycles, cycle)
+				break
+			}
+		}
+	}
+	return cycles
+}
+
+// findCycles runs a depth-first search of the graph from each root and
+// returns one cycle per back edge. The same cycle reached from different
+// entry points is only reported once.
+func findCycles(graph map[string][]string, roots []string) [][]string {
+	const (
+		unvisited = iota
+		inProgress
+		done
+	)
+	state := make(map[string]int)
+	var stack []string
+	seen := make(map[string]bool)
+	cycles := [][]string{}
+
+	var visit func(node string)
+	visit = func(node string) {
+		state[node] = inProgress
+		stack = append(stack, node)
+		for _, dep := range graph[node] {
+			switch state[dep] {
+			case unvisited:
+				visit(dep)
+			case inProgress:
+				// back edge, the cycle is the stack from dep to node
+				var cycle []string
+				for i := len(stack) - 1; i >= 0; i-- {
+					if stack[i] == dep {
+						cycle = append([]string{}, stack[i:]...)
+						break
+					}
+				}
+				if key := cycleKey(cycle); !seen[key] {
+					seen[key] = true
+					cycles = append(cycles, cycle)
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[node] = done
+	}
+
+	for _, r := range roots {
+		if state[r] == unvisited {
+			visit(r)
+		}
+	}
+	return cycles
+}
+
+// cycleKey identifies a cycle regardless of the node it starts from
+func cycleKey(cycle []string) string {
+	if len(cycle) == 0 {
+		return ""
+	}
+	min := 0
+	for i := range cycle {
+		if cycle[i] < cycle[min] {
+			min = i
+		}
+	}
+	rotated := append(append([]string{}, cycle[min:]...), cycle[:min]...)
+	return strings.Join(rotated, "\n")
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package constellation
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/wperron/depgraph/deno"
+)
+
+func TestInfoCycles(t *testing.T) {
+	info := deno.DenoInfo{
+		Module: "a.ts",
+		Files: map[string]deno.FileEntry{
+			"a.ts": {Deps: []string{"b.ts", "d.ts"}},
+			"b.ts": {Deps: []string{"c.ts"}},
+			"c.ts": {Deps: []string{"a.ts"}},
+			"d.ts": {Deps: []string{"d.ts"}},
+			"e.ts": {Deps: []string{"b.ts"}},
+		},
+	}
+
+	cycles := infoCycles(info)
+	expected := [][]string{{"a.ts", "b.ts", "c.ts"}, {"d.ts"}}
+	if fmt.Sprint(cycles) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, cycles)
+	}
+}
+
+func TestNewCycles(t *testing.T) {
+	info := deno.DenoInfo{
+		Module: "https://deno.land/x/a/mod.ts",
+		Files: map[string]deno.FileEntry{
+			"https://deno.land/x/a/mod.ts":  {Deps: []string{"https://deno.land/x/a/deps.ts", "https://deno.land/x/b/mod.ts"}},
+			"https://deno.land/x/a/deps.ts": {Deps: []string{"https://deno.land/x/a/mod.ts"}},
+			"https://deno.land/x/b/mod.ts":  {Deps: []string{"https://deno.land/x/b/mod.ts"}},
+		},
+	}
+
+	// the self import of b was already in the graph
+	cycles := newCycles(info, map[string]bool{"https://deno.land/x/a/deps.ts": true})
+	expected := [][]string{{"https://deno.land/x/a/deps.ts", "https://deno.land/x/a/mod.ts"}}
+	if fmt.Sprint(cycles) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, cycles)
+	}
+
+	if cycles := newCycles(info, map[string]bool{}); len(cycles) != 0 {
+		t.Errorf("expected no new cycle without mutated files, got %v", cycles)
+	}
+}
+
+func TestDetectCycles(t *testing.T) {
+	// loop: true repeats the nodes of the cycle until the depth limit
+	f := withFixture(t, `{"q": [{
+		"uid": "0x1",
+		"specifier": "https://deno.land/x/oak/mod.ts",
+		"depends_on": [{
+			"uid": "0x2",
+			"specifier": "https://deno.land/x/oak/deps.ts",
+			"depends_on": [{
+				"uid": "0x1",
+				"specifier": "https://deno.land/x/oak/mod.ts",
+				"depends_on": [{"uid": "0x2", "specifier": "https://deno.land/x/oak/deps.ts"}]
+			}]
+		}]
+	}]}`)
+
+	cycles, err := DetectCycles(context.Background(), "0x1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := [][]string{{"https://deno.land/x/oak/mod.ts", "https://deno.land/x/oak/deps.ts"}}
+	if fmt.Sprint(cycles) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, cycles)
+	}
+	if !strings.Contains(f.query, "loop: true") {
+		t.Errorf("expected a looping recurse, got query:\n%s", f.query)
+	}
+	if !strings.Contains(f.query, "f as file_specifier") || !strings.Contains(f.query, "uid(f)") {
+		t.Errorf("expected the files of the module versions to be recursed, got query:\n%s", f.query)
+	}
+
+	if _, err := DetectCycles(context.Background(), "0x1) { uid } }"); err == nil {
+		t.Error("expected an error for an invalid uid")
+	}
+}
@@ -3,23 +3,53 @@ package constellation
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dgraph-io/dgo/v2"
 	"github.com/dgraph-io/dgo/v2/protos/api"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/wperron/depgraph/deno"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 )
 
 var client *dgo.Dgraph
+
+// adminURL is the GraphQL admin endpoint of an alpha server
+var adminURL string
+
+// per-operation timeouts stored as nanoseconds, a zero value means no timeout
+// other than the one of the context passed by the caller
+var queryTimeout int64
+var mutationTimeout int64
 var trxCounter prometheus.Counter
 var mutationsCounter prometheus.Counter
 var commitLatency prometheus.Histogram
+var txnConflictCounter prometheus.Counter
+var nodeExistenceCounter *prometheus.CounterVec
+var moduleUIDCacheHits prometheus.Counter
+var cyclesDetected prometheus.Counter
+
+// ItemsAbandoned counts the pipeline items dropped because the context was
+// cancelled, labeled by pipeline stage
+var ItemsAbandoned *prometheus.CounterVec
 
 func init() {
 	trxCounter = prometheus.NewCounter(
@@ -43,7 +73,44 @@ func init() {
 		},
 	)
 
-	prometheus.MustRegister(trxCounter, mutationsCounter, commitLatency)
+	txnConflictCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dgraph_txn_conflict_total",
+			Help: "A counter for transactions aborted because of a conflict in DGraph",
+		},
+	)
+
+	nodeExistenceCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dgraph_node_existence_check_total",
+			Help: "A counter of file node existence checks, labeled by whether the mutation was skipped",
+		},
+		[]string{"result"},
+	)
+
+	ItemsAbandoned = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pipeline_items_abandoned_total",
+			Help: "A counter of pipeline items abandoned because of a context cancellation",
+		},
+		[]string{"stage"},
+	)
+
+	moduleUIDCacheHits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "constellation_module_uid_cache_hits_total",
+			Help: "A counter of modules found in the module uid cache by InsertModules",
+		},
+	)
+
+	cyclesDetected = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cycles_detected_total",
+			Help: "A counter of dependency cycles found in the files inserted by InsertFiles",
+		},
+	)
+
+	prometheus.MustRegister(trxCounter, mutationsCounter, commitLatency, txnConflictCounter, nodeExistenceCounter, moduleUIDCacheHits, ItemsAbandoned, cyclesDetected)
 }
 
 type File struct {
@@ -58,269 +125,2517 @@ type Module struct {
 	Name        string          `json:"name,omitempty"`
 	Stars       int             `json:"stars,omitempty"`
 	Description string          `json:"description,omitempty"`
+	Owner       string          `json:"owner,omitempty"`
+	Repository  string          `json:"repository,omitempty"`
+	Tags        []string        `json:"tags,omitempty"`
+	Unlisted    bool            `json:"unlisted,omitempty"`
+	License     string          `json:"license,omitempty"`
 	Version     []ModuleVersion `json:"version,omitempty"`
 	DType       []string        `json:"dgraph.type,omitempty"`
+
+	// DependentCount is only set by TopModulesByDependentCount
+	DependentCount int `json:"dependent_count,omitempty"`
 }
 
 type ModuleVersion struct {
 	Uid           string `json:"uid,omitempty"`
 	ModuleVersion string `json:"module_version,omitempty"`
-	README        string `json:"README,omitempty"`
+	// UploadedAt is nil if the CDN didn't return an upload time
+	UploadedAt    *time.Time `json:"module_version_uploaded_at,omitempty"`
+	LastIndexedAt time.Time  `json:"last_indexed_at,omitempty"`
+	README        string     `json:"README,omitempty"`
+	Files         []File     `json:"file_specifier,omitempty"`
+	DType         []string   `json:"dgraph.type,omitempty"`
 }
 
-func init() {
-	// TODO(wperron): parameterize alpha URL
-	log.Println("connecting to the dgraph cluster")
-	d, err := grpc.Dial("localhost:9080", grpc.WithInsecure())
+// uploadedAt returns the upload time of the version, or the zero time if it
+// isn't known
+func (v ModuleVersion) uploadedAt() time.Time {
+	if v.UploadedAt == nil {
+		return time.Time{}
+	}
+	return *v.UploadedAt
+}
+
+// FileDiff lists the files added, removed and modified between two versions of
+// a module. Files are identified by their path relative to the module version
+// root, a file is modified if its set of dependencies changed.
+type FileDiff struct {
+	AddedFiles    []string `json:"added_files"`
+	RemovedFiles  []string `json:"removed_files"`
+	ModifiedFiles []string `json:"modified_files"`
+}
+
+const (
+	// DefaultConnectRetries is the number of connectivity checks made by
+	// InitDGraph before giving up
+	DefaultConnectRetries = 10
+
+	// pingTimeout is the deadline of a single connectivity check
+	pingTimeout = 5 * time.Second
+)
+
+// connectRetryInterval is the time waited between two connectivity checks
+var connectRetryInterval = 3 * time.Second
+
+// DGraphConfig holds the connection parameters of the DGraph cluster
+type DGraphConfig struct {
+	// Addresses of the alpha servers
+	Addresses []string
+	// TLSCertFile and TLSKeyFile are the client certificate and key, the
+	// connection is in plaintext if TLSCertFile is empty
+	TLSCertFile string
+	TLSKeyFile  string
+	// CAFile is the certificate of the CA that signed the alpha certificates,
+	// the system roots are used if it is empty
+	CAFile string
+	// MaxRetries is the number of connectivity checks made before giving up,
+	// DefaultConnectRetries if 0
+	MaxRetries int
+	// AdminURL is the HTTP GraphQL admin endpoint of an alpha server, e.g.
+	// http://localhost:8080/admin
+	AdminURL string
+}
+
+// DefaultAlphaAddress is the alpha server used when no address is configured
+// and the DGRAPH_ALPHA environment variable isn't set
+const DefaultAlphaAddress = "localhost:9080"
+
+// AlphaAddress returns addr, or the value of the DGRAPH_ALPHA environment
+// variable if addr is empty, or DefaultAlphaAddress if both are empty
+func AlphaAddress(addr string) string {
+	if addr != "" {
+		return addr
+	}
+	if env := os.Getenv("DGRAPH_ALPHA"); env != "" {
+		return env
+	}
+	return DefaultAlphaAddress
+}
+
+// InitDGraph creates the client of the DGraph cluster and waits until the
+// cluster answers a query, retrying up to cfg.MaxRetries times. If no address
+// is configured, the one returned by AlphaAddress is used.
+func InitDGraph(ctx context.Context, cfg DGraphConfig) error {
+	if len(cfg.Addresses) == 0 {
+		cfg.Addresses = []string{AlphaAddress("")}
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = DefaultConnectRetries
+	}
+
+	opt, err := dialOption(cfg)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("connecting to the dgraph cluster", "addresses", cfg.Addresses)
+	if err := dial(cfg.Addresses, opt); err != nil {
+		return err
+	}
+	adminURL = cfg.AdminURL
+
+	return waitForDGraph(ctx, cfg.MaxRetries, ping)
+}
+
+// dial replaces the client with one connected to the alpha servers at addrs
+func dial(addrs []string, opt grpc.DialOption) error {
+	clients := make([]api.DgraphClient, 0, len(addrs))
+	for _, addr := range addrs {
+		d, err := grpc.Dial(addr, opt)
+		if err != nil {
+			return fmt.Errorf("failed to dial the alpha server at %s: %s", addr, err)
+		}
+		clients = append(clients, api.NewDgraphClient(d))
+	}
+	client = dgo.NewDgraphClient(clients...)
+	return nil
+}
+
+// tlsFromEnv reports whether the DGRAPH_TLS environment variable asks for the
+// alpha servers to be reached over TLS
+func tlsFromEnv() bool {
+	v, _ := strconv.ParseBool(os.Getenv("DGRAPH_TLS"))
+	return v
+}
+
+// dialOption returns the transport credentials of the connections to the
+// alpha servers
+func dialOption(cfg DGraphConfig) (grpc.DialOption, error) {
+	tlsCfg, err := tlsConfig(cfg)
 	if err != nil {
-		log.Fatalf("failed to dial the alpha server at localhost:9080: %s\n", err)
+		return nil, err
+	}
+	if tlsCfg == nil {
+		return insecureDialOption()
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg)), nil
+}
+
+// tlsConfig returns the TLS configuration of the connections to the alpha
+// servers, or nil for plaintext connections. Without a client certificate,
+// the connection is only encrypted if DGRAPH_TLS is true.
+func tlsConfig(cfg DGraphConfig) (*tls.Config, error) {
+	if cfg.TLSCertFile == "" && !tlsFromEnv() {
+		return nil, nil
+	}
+
+	tlsCfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the dgraph client certificate: %s", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the dgraph CA certificate: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", cfg.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	return tlsCfg, nil
+}
+
+// ping runs a minimal query against the cluster
+func ping(ctx context.Context) error {
+	pctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	_, err := client.NewReadOnlyTxn().Query(pctx, `{ q(func: has(dgraph.type), first: 1) { uid } }`)
+	return err
+}
+
+// waitForDGraph calls ping until it succeeds, at most maxRetries times
+func waitForDGraph(ctx context.Context, maxRetries int, ping func(ctx context.Context) error) error {
+	if maxRetries <= 0 {
+		maxRetries = 1
+	}
+
+	var err error
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		if err = ping(ctx); err == nil {
+			return nil
+		}
+		slog.Warn("dgraph cluster not reachable", "attempt", attempt, "max_retries", maxRetries, "error", err)
+		if attempt == maxRetries {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(connectRetryInterval):
+		}
 	}
+	return fmt.Errorf("dgraph cluster not reachable after %d attempts: %s", maxRetries, err)
+}
+
+// SetQueryTimeout sets the maximum duration of every DGraph query
+func SetQueryTimeout(d time.Duration) {
+	atomic.StoreInt64(&queryTimeout, int64(d))
+}
+
+// SetMutationTimeout sets the maximum duration of every DGraph mutation and
+// commit
+func SetMutationTimeout(d time.Duration) {
+	atomic.StoreInt64(&mutationTimeout, int64(d))
+}
+
+// fileUpsert is set when the files missing from DynamoDB are looked up in
+// DGraph before they are mutated, see SetFileUpsert
+var fileUpsert int32 = 1
+
+// SetFileUpsert enables or disables looking up in DGraph the files missing
+// from DynamoDB before they are mutated. Without the lookup, a file without an
+// entry always gets a new node, even if DGraph already has one for it.
+func SetFileUpsert(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&fileUpsert, v)
+}
+
+// withTimeout wraps the context with the timeout if it is set
+func withTimeout(ctx context.Context, timeout *int64) (context.Context, context.CancelFunc) {
+	d := time.Duration(atomic.LoadInt64(timeout))
+	if d <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, d)
+}
 
-	client = dgo.NewDgraphClient(api.NewDgraphClient(d))
+// migration upgrades the schema of the cluster from Version-1 to Version
+type migration struct {
+	Version     int
+	Description string
+	Apply       func(ctx context.Context) error
+}
+
+// migrations are applied in order by InitSchema, each one only once. A new
+// migration must be appended with the next version and SchemaVersion bumped.
+var migrations = []migration{
+	{
+		Version:     1,
+		Description: "initial schema",
+		// TODO(wperron) review schema, I don't like the current Module and
+		//   ModuleVersion types, feels like theres a more 'graph-y' way to
+		//   express these types.
+		Apply: func(ctx context.Context) error {
+			return alterSchema(ctx, `
+				type Module {
+					name
+					description
+					stars
+					owner
+					repository
+					tags
+					unlisted
+					license
+					version
+				}
+				type ModuleVersion {
+					module_version
+					module_version_uploaded_at
+					README
+					file_specifier
+				}
+				type File {
+					specifier
+					depends_on
+				}
+				type SchemaVersion {
+					schema_version
+				}
+				name: string @index(term, fulltext, trigram) .
+				description: string @index(term, fulltext, trigram) .
+				stars: int @index(int) .
+				owner: string @index(exact) .
+				repository: string .
+				tags: [string] @index(exact) .
+				unlisted: bool .
+				license: string @index(exact) .
+				version: [uid] @reverse .
+				module_version: string @index(term, fulltext, trigram) .
+				module_version_uploaded_at: datetime .
+				README: string @index(term, fulltext, trigram) .
+				file_specifier: [uid] @reverse .
+				specifier: string @index(term, fulltext, trigram) .
+				depends_on: [uid] @reverse .
+				schema_version: int .
+			`)
+		},
+	},
+	{
+		Version:     2,
+		Description: "track when module versions were last indexed and index upload times by day",
+		Apply: func(ctx context.Context) error {
+			return alterSchema(ctx, `
+				type ModuleVersion {
+					module_version
+					module_version_uploaded_at
+					last_indexed_at
+					README
+					file_specifier
+				}
+				module_version_uploaded_at: datetime @index(day) .
+				last_indexed_at: datetime @index(day) .
+			`)
+		},
+	},
+	{
+		Version:     3,
+		Description: "detect concurrent creations of the same file node",
+		// the transactions of parallel workers creating a node for the same
+		// specifier now conflict, the aborted one is retried and finds the
+		// node committed by the other
+		Apply: func(ctx context.Context) error {
+			return alterSchema(ctx, `
+				specifier: string @index(hash, term, fulltext, trigram) @upsert .
+			`)
+		},
+	},
+}
 
-	// Drop all data including schema from the dgraph instance. Useful for PoC
-	//log.Println("dropping existing data in the dgraph cluster")
-	//err = client.Alter(context.Background(), &api.Operation{DropOp: api.Operation_ALL})
-	//if err != nil {
-	//	log.Fatalf("error while cleaning the dgraph instance: %s\n", err)
-	//}
+// alterSchema applies the schema DDL to the cluster, tests replace it to
+// record the statements instead
+var alterSchema = func(ctx context.Context, schema string) error {
+	return client.Alter(ctx, &api.Operation{Schema: schema})
 }
 
+// InitSchema applies the migrations newer than the version recorded in the
+// SchemaVersion node of the cluster, then records SchemaVersion. A cluster
+// without a SchemaVersion node gets every migration. A cluster at a newer
+// version than SchemaVersion is left untouched and ErrSchemaVersionMismatch is
+// returned.
 func InitSchema(ctx context.Context) error {
-	// TODO(wperron) review schema, I don't like the current Module and
-	//   ModuleVersion types, feels like theres a more 'graph-y' way to express
-	//   these types.
-	return client.Alter(ctx, &api.Operation{
-		Schema: `
-			type Module {
-				name
-				description
-				stars
-				version
-			}
-			type ModuleVersion {
-				module_version
-				README
-				file_specifier
+	uid, current, err := querySchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if current > SchemaVersion {
+		return ErrSchemaVersionMismatch{Expected: SchemaVersion, Actual: current}
+	}
+	if current == SchemaVersion {
+		return nil
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		slog.Info("migrating dgraph schema", "schema_version", m.Version, "description", m.Description)
+		if err := m.Apply(ctx); err != nil {
+			return fmt.Errorf("failed to migrate schema to version %d: %s", m.Version, err)
+		}
+	}
+	return recordSchemaVersion(ctx, uid, SchemaVersion)
+}
+
+// SchemaVersion is the version of the schema created by InitSchema, it is the
+// version of the last migration.
+const SchemaVersion = 3
+
+// ErrSchemaVersionMismatch is returned by CheckSchemaCompatibility when the
+// cluster holds a different schema version than the expected one
+type ErrSchemaVersionMismatch struct {
+	Expected int
+	Actual   int
+}
+
+func (e ErrSchemaVersionMismatch) Error() string {
+	return fmt.Sprintf("dgraph schema version mismatch: expected version %d, the cluster is at version %d", e.Expected, e.Actual)
+}
+
+// CheckSchemaCompatibility compares the version recorded in the SchemaVersion
+// node of the cluster with expectedVersion. If the cluster has no
+// SchemaVersion node yet, expectedVersion is recorded.
+func CheckSchemaCompatibility(ctx context.Context, expectedVersion int) error {
+	uid, actual, err := querySchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	if uid == "" {
+		slog.Info("no schema version found, recording it", "schema_version", expectedVersion)
+		return recordSchemaVersion(ctx, "", expectedVersion)
+	}
+	if actual != expectedVersion {
+		return ErrSchemaVersionMismatch{Expected: expectedVersion, Actual: actual}
+	}
+	return nil
+}
+
+// querySchemaVersion returns the uid and version of the SchemaVersion node of
+// the cluster, or an empty uid and version 0 if there is none
+func querySchemaVersion(ctx context.Context) (string, int, error) {
+	q := `{
+		q(func: type(SchemaVersion)) {
+			uid
+			schema_version
+		}
+	}`
+
+	var resp struct {
+		Q []struct {
+			Uid     string `json:"uid"`
+			Version int    `json:"schema_version"`
+		} `json:"q"`
+	}
+	if err := runQuery(ctx, q, nil, &resp); err != nil {
+		return "", 0, fmt.Errorf("failed to query the schema version: %s", err)
+	}
+	if len(resp.Q) == 0 {
+		return "", 0, nil
+	}
+	return resp.Q[0].Uid, resp.Q[0].Version, nil
+}
+
+// recordSchemaVersion sets the version of the SchemaVersion node with the uid,
+// or creates the node if uid is empty
+func recordSchemaVersion(ctx context.Context, uid string, version int) error {
+	if uid == "" {
+		uid = "_:schema_version"
+	}
+	bytes, err := json.Marshal(map[string]interface{}{
+		"uid":            uid,
+		"schema_version": version,
+		"dgraph.type":    []string{"SchemaVersion"},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal schema version: %s", err)
+	}
+
+	trxCounter.Add(1)
+	mutationsCounter.Add(1)
+	mctx, cancel := withTimeout(ctx, &mutationTimeout)
+	defer cancel()
+	if _, err := newTxn().Mutate(mctx, &api.Mutation{SetJson: bytes, CommitNow: true}); err != nil {
+		return fmt.Errorf("failed to record schema version: %s", err)
+	}
+	return nil
+}
+
+// DropAll removes all the data and the schema from the DGraph cluster. The
+// schema must be reinstated with InitSchema before inserting new data.
+func DropAll(ctx context.Context) error {
+	clearModuleUIDCache()
+	return client.Alter(ctx, &api.Operation{DropOp: api.Operation_ALL})
+}
+
+// TriggerBackup starts a backup of the cluster to destination, either a path
+// on an NFS volume or an `s3://` URL, through the admin endpoint. DGraph runs
+// the backup asynchronously.
+func TriggerBackup(ctx context.Context, destination string) error {
+	if adminURL == "" {
+		return fmt.Errorf("no dgraph admin url configured")
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"query": `mutation backup($destination: String!) {
+			backup(input: {destination: $destination}) {
+				response { code message }
 			}
-			type File {
-				specifier
-				depends_on
-			}
-			name: string @index(term, fulltext, trigram) .
-			description: string @index(term, fulltext, trigram) .
-			stars: int .
-			version: [uid] @reverse .
-			module_version: string @index(term, fulltext, trigram) .
-			README: string @index(term, fulltext, trigram) .
-			file_specifier: [uid] .
-			specifier: string @index(term, fulltext, trigram) .
-			depends_on: [uid] @reverse .
-		`,
+		}`,
+		"variables": map[string]string{"destination": destination},
 	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal backup request: %s", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, adminURL, strings.NewReader(string(body)))
+	if err != nil {
+		return fmt.Errorf("failed to create backup request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to trigger backup: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to trigger backup: unexpected status %d", resp.StatusCode)
+	}
+
+	var res struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("failed to decode backup response: %s", err)
+	}
+	if len(res.Errors) > 0 {
+		return fmt.Errorf("failed to trigger backup: %s", res.Errors[0].Message)
+	}
+	return nil
+}
+
+// indexablePredicates maps the scalar predicates of the schema to their type
+var indexablePredicates = map[string]string{
+	"name":           "string",
+	"description":    "string",
+	"stars":          "int",
+	"owner":          "string",
+	"tags":           "[string]",
+	"license":        "string",
+	"module_version": "string",
+	"README":         "string",
+	"specifier":      "string",
+}
+
+// upsertPredicates are the indexable predicates with the @upsert directive,
+// which must be kept when their indexes change
+var upsertPredicates = map[string]bool{
+	"specifier": true,
+}
+
+var (
+	funcPattern  = regexp.MustCompile(`\b(eq|le|ge|lt|gt|anyofterms|allofterms|anyoftext|alloftext|regexp|match)\s*\(\s*(\w+)`)
+	orderPattern = regexp.MustCompile(`\b(orderasc|orderdesc)\s*:\s*(\w+)`)
+)
+
+// proposeIndexes analyses the DQL queries and returns the minimal set of index
+// tokenizers needed by each indexable predicate to serve them
+func proposeIndexes(queryPatterns []string) map[string][]string {
+	needed := make(map[string]map[string]bool)
+	add := func(pred, tok string) {
+		if _, ok := indexablePredicates[pred]; !ok {
+			return
+		}
+		if needed[pred] == nil {
+			needed[pred] = make(map[string]bool)
+		}
+		needed[pred][tok] = true
+	}
+
+	for _, q := range queryPatterns {
+		for _, m := range funcPattern.FindAllStringSubmatch(q, -1) {
+			fn, pred := m[1], m[2]
+			isInt := indexablePredicates[pred] == "int"
+			switch fn {
+			case "eq":
+				if isInt {
+					add(pred, "int")
+				} else {
+					add(pred, "hash")
+				}
+			case "le", "ge", "lt", "gt":
+				if isInt {
+					add(pred, "int")
+				} else {
+					add(pred, "exact")
+				}
+			case "anyofterms", "allofterms":
+				add(pred, "term")
+			case "anyoftext", "alloftext":
+				add(pred, "fulltext")
+			case "regexp", "match":
+				add(pred, "trigram")
+			}
+		}
+
+		for _, m := range orderPattern.FindAllStringSubmatch(q, -1) {
+			pred := m[2]
+			if indexablePredicates[pred] == "int" {
+				add(pred, "int")
+			} else {
+				add(pred, "exact")
+			}
+		}
+	}
+
+	out := make(map[string][]string, len(needed))
+	for pred, toks := range needed {
+		// the exact tokenizer also supports equality, hash is redundant
+		if toks["exact"] {
+			delete(toks, "hash")
+		}
+		for tok := range toks {
+			out[pred] = append(out[pred], tok)
+		}
+		sort.Strings(out[pred])
+	}
+	return out
+}
+
+// indexSchema renders the schema statements of the indexable predicates used
+// by the queries. The predicates that aren't used by any query are left out so
+// that their existing indexes are kept.
+func indexSchema(indexes map[string][]string) string {
+	preds := make([]string, 0, len(indexes))
+	for pred := range indexes {
+		if _, ok := indexablePredicates[pred]; ok {
+			preds = append(preds, pred)
+		}
+	}
+	sort.Strings(preds)
+
+	var b strings.Builder
+	for _, pred := range preds {
+		upsert := ""
+		if upsertPredicates[pred] {
+			upsert = " @upsert"
+		}
+		fmt.Fprintf(&b, "%s: %s @index(%s)%s .\n", pred, indexablePredicates[pred], strings.Join(indexes[pred], ", "), upsert)
+	}
+	return b.String()
+}
+
+// OptimiseSchema analyses the DQL queries run against the graph and alters the
+// schema so that the indexable predicates they use only have the indexes
+// needed by those queries. The other predicates keep their indexes. When
+// dryRun is true, the proposed schema is logged and not applied.
+func OptimiseSchema(ctx context.Context, queryPatterns []string, dryRun bool) error {
+	schema := indexSchema(proposeIndexes(queryPatterns))
+	if dryRun {
+		slog.Info("proposed schema changes (dry run)", "schema", schema)
+		return nil
+	}
+
+	slog.Info("applying optimised schema", "schema", schema)
+	return client.Alter(ctx, &api.Operation{Schema: schema})
 }
 
 // InsertModules is a passthrough function that makes sure the Module and
 // ModuleVersion exist in the graph before inserting the Version's files.
-func InsertModules(ctx context.Context, mods chan deno.Module) chan deno.Module {
+func InsertModules(ctx context.Context, mods chan deno.Module) (chan deno.Module, chan error) {
 	out := make(chan deno.Module)
+	errs := make(chan error)
 	go func() {
-		all := make(map[string]string)
+		defer close(errs)
 		for mod := range mods {
 			select {
 			case <-ctx.Done():
-				log.Println("received cancel signal, closing InsertModules")
+				ItemsAbandoned.WithLabelValues("insert_modules").Inc()
+				slog.Info("received cancel signal, closing InsertModules")
 				return
 			default:
 			}
 
-			trxCounter.Add(1)
-
-			txn := client.NewTxn()
-			uid := fmt.Sprintf("_:%s", mod.Name)
-			if u, ok := all[mod.Name]; ok {
-				uid = u
-			}
-
-			m := Module{
-				Uid:   uid,
-				Name:  mod.Name,
-				Stars: 0,
-				DType: []string{"Module"},
-			}
-			bytes, err := json.Marshal(m)
+			// the module is looked up and inserted under the lock so that
+			// duplicate messages don't create two Module nodes
+			unlock := lockModule(mod.Name)
+			existing, hit, err := cachedModule(ctx, mod.Name)
 			if err != nil {
-				log.Println(fmt.Errorf("failed to marshal module entry: %s", err))
-				discard(ctx, txn)
+				unlock()
+				slog.Error("failed to look up module", "module_name", mod.Name, "error", err)
+				continue
+			}
+			m := moduleMutation(mod, existing)
+			if hit && unchanged(existing, m) {
+				// nothing new since the module was inserted by this process
+				unlock()
+				out <- mod
 				continue
 			}
 
-			mut := api.Mutation{}
-			mut.SetJson = bytes
-			mutationsCounter.Add(1)
-			resp, err := txn.Mutate(ctx, &mut)
+			bytes, err := json.Marshal(m)
 			if err != nil {
-				log.Println(fmt.Errorf("failed to run mutation for file %s: %s", mod.Name, err))
-				discard(ctx, txn)
+				unlock()
+				slog.Error("failed to marshal module entry", "module_name", mod.Name, "error", err)
 				continue
 			}
 
-			start := time.Now()
-			err = txn.Commit(ctx)
-			commitLatency.Observe(time.Since(start).Seconds())
+			err = runTxn(ctx, func(txn Txn) error {
+				mut := api.Mutation{}
+				mut.SetJson = bytes
+				mutationsCounter.Add(1)
+				mctx, cancel := withTimeout(ctx, &mutationTimeout)
+				defer cancel()
+				resp, err := txn.Mutate(mctx, &mut)
+				if err != nil {
+					return fmt.Errorf("failed to run mutation for module %s: %w", mod.Name, err)
+				}
+				cacheModule(m, resp.Uids, existing)
+				return nil
+			})
+			unlock()
 			if err != nil {
-				log.Fatalf("failed to commit transaction: %s\n", err)
-				discard(ctx, txn)
+				moduleUIDCache.Delete(mod.Name)
+				errs <- fmt.Errorf("failed to insert module %s: %s", mod.Name, err)
 				continue
 			}
 
-			all = merge(all, resp.Uids)
 			out <- mod
 		}
 		close(out)
 	}()
 
-	return out
+	return out, errs
 }
 
-// InsertFiles iterates over a channel of DenoInfo and inserts every specifier
-// in it in the DGraph cluster
-func InsertFiles(ctx context.Context, mods chan deno.DenoInfo) chan bool {
-	done := make(chan bool)
-	go func() {
-		for mod := range mods {
-			trxCounter.Add(1)
-
-			txn := client.NewTxn()
+// moduleUIDCache maps a module name to the *Module holding the uid, stars and
+// description of the module and the uids of its versions in the graph. It lives for the whole process so
+// that modules crawled again by the same process aren't mutated if neither
+// their metadata nor their versions changed.
+var moduleUIDCache sync.Map
 
-		inner:
-			for k, f := range mod.Files {
-				select {
-				case <-ctx.Done():
-					log.Println("received cancel signal, closing InsertFiles")
-					break inner
-				default:
-				}
-
-				uids, err := mutateFile(ctx, txn, k, f)
-				if err != nil {
-					log.Fatalf("failed to run mutation for %s: %s\n", k, err)
-					discard(ctx, txn)
-					continue
-				}
+// cachedModule returns the module from the cache, or from QueryModuleByName on
+// a cache miss. It reports whether the module was found in the cache.
+func cachedModule(ctx context.Context, name string) (*Module, bool, error) {
+	if v, ok := moduleUIDCache.Load(name); ok {
+		moduleUIDCacheHits.Inc()
+		return v.(*Module), true, nil
+	}
+	m, err := QueryModuleByName(ctx, name)
+	if err != nil {
+		return nil, false, err
+	}
+	if m != nil {
+		moduleUIDCache.Store(name, m)
+	}
+	return m, false, nil
+}
 
-				for specifier, uid := range uids {
-					// TODO(wperron): there's probably a better to filter for only
-					//   the UIDs that were created as part of this mutation
-					if strings.HasPrefix(specifier, "https://") {
-						if err := PutEntry(Item{
-							Specifier: specifier,
-							Uid:       uid,
-						}); err != nil {
-							log.Fatal(fmt.Errorf("\tfailed to put entry for %s: %s", specifier, err))
-						}
-					}
-				}
-			}
+// cacheModule stores the uids of the mutated module, resolving the blank
+// nodes with the uids assigned by the mutation, along with the versions of the
+// existing module that weren't mutated. The module is evicted instead if a
+// blank node can't be resolved.
+func cacheModule(m Module, uids map[string]string, existing *Module) {
+	resolve := func(uid string) (string, bool) {
+		if !strings.HasPrefix(uid, "_:") {
+			return uid, true
+		}
+		assigned, ok := uids[strings.TrimPrefix(uid, "_:")]
+		return assigned, ok
+	}
 
-			start := time.Now()
-			err := txn.Commit(ctx)
-			commitLatency.Observe(time.Since(start).Seconds())
-			if err != nil {
-				log.Printf("failed to commit transaction: %s\n", err)
-				discard(ctx, txn)
-				continue
+	cached := &Module{Name: m.Name, Stars: m.Stars, Description: m.Description}
+	var ok bool
+	if cached.Uid, ok = resolve(m.Uid); !ok {
+		moduleUIDCache.Delete(m.Name)
+		return
+	}
+	mutated := make(map[string]bool, len(m.Version))
+	for _, v := range m.Version {
+		uid, ok := resolve(v.Uid)
+		if !ok {
+			moduleUIDCache.Delete(m.Name)
+			return
+		}
+		mutated[v.ModuleVersion] = true
+		cached.Version = append(cached.Version, ModuleVersion{Uid: uid, ModuleVersion: v.ModuleVersion})
+	}
+	// the versions left out of the mutation, e.g. by an incremental crawl,
+	// keep their uids
+	if existing != nil {
+		for _, v := range existing.Version {
+			if !mutated[v.ModuleVersion] {
+				cached.Version = append(cached.Version, ModuleVersion{Uid: v.Uid, ModuleVersion: v.ModuleVersion})
 			}
-			log.Printf("transaction completed for %s\n", mod.Module)
 		}
-
-		log.Println("finished inserting all files")
-		done <- true
-		close(done)
-	}()
-
-	return done
+	}
+	moduleUIDCache.Store(m.Name, cached)
 }
 
-func mutateFile(ctx context.Context, txn *dgo.Txn, specifier string, entry deno.FileEntry) (map[string]string, error) {
-	deps := make([]File, len(entry.Deps))
-	// map specifier->blank uid
-	// used later to insert into DynamoDB UIDs that were created in
-	// this mutation
-	blanks := make(map[string]string)
-	if len(entry.Deps) > 0 {
-		for _, d := range entry.Deps {
-			uid := fmt.Sprintf("_:%s", d)
-
-			item, err := GetEntry(d)
-			if err != nil {
-				log.Fatalf("failed to get specificer %s from DynamoDB: %s\n", d, err)
-			}
+// clearModuleUIDCache evicts every module from the cache
+func clearModuleUIDCache() {
+	moduleUIDCache.Range(func(k, _ interface{}) bool {
+		moduleUIDCache.Delete(k)
+		return true
+	})
+}
 
-			// Uid is a projected attribute of the item in DDB. functionnaly, there
-			// is no difference between checking for `Uid == ""` than checking for
-			// `Specificer == ""`. In this case, checking for Uid is simply the
-			// closest to the semantics of "check if item is in graph."
-			if item.Uid != "" {
-				uid = item.Uid
-			} else {
-				// keep track of blank UIDs used in the mutation
-				blanks[d] = uid
-			}
-			deps = append(deps, File{Uid: uid})
+// unchanged reports whether the mutation of the module would leave the
+// existing module as it is: its stars and description are the same and all of
+// its versions are already in the graph
+func unchanged(existing *Module, m Module) bool {
+	if existing == nil || existing.Stars != m.Stars || existing.Description != m.Description {
+		return false
+	}
+	for _, v := range m.Version {
+		if strings.HasPrefix(v.Uid, "_:") {
+			return false
 		}
 	}
+	return true
+}
 
-	uid := fmt.Sprintf("_:%s", specifier)
-	item, err := GetEntry(specifier)
+// moduleLock serialises the inserts of a module. refs counts the goroutines
+// holding or waiting for it.
+type moduleLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// moduleLocks maps a module name to its lock. An entry is removed once no
+// goroutine holds or waits for it, so the map only grows with the number of
+// modules inserted concurrently.
+var (
+	moduleLocksMu sync.Mutex
+	moduleLocks   = make(map[string]*moduleLock)
+)
+
+// lockModule acquires the lock of the module and returns the function
+// releasing it
+func lockModule(name string) (unlock func()) {
+	moduleLocksMu.Lock()
+	l, ok := moduleLocks[name]
+	if !ok {
+		l = &moduleLock{}
+		moduleLocks[name] = l
+	}
+	l.refs++
+	moduleLocksMu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		moduleLocksMu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(moduleLocks, name)
+		}
+		moduleLocksMu.Unlock()
+	}
+}
+
+// moduleMutation returns the Module node to mutate for the crawled module. If
+// the module is already in the graph, its uid and the uids of its known
+// versions are reused so that the mutation updates the existing nodes.
+func moduleMutation(mod deno.Module, existing *Module) Module {
+	m := Module{
+		Uid:     fmt.Sprintf("_:%s", mod.Name),
+		Name:    mod.Name,
+		Stars:   0,
+		License: mod.LicenseFile,
+		DType:   []string{"Module"},
+	}
+	if md := mod.Metadata; md != nil {
+		m.Description = md.Description
+		m.Stars = md.StarCount
+		m.Owner = md.Owner
+		m.Repository = md.RepoURL
+		m.Tags = md.Tags
+		m.Unlisted = md.IsUnlisted
+	}
+
+	versionUids := make(map[string]string)
+	if existing != nil {
+		m.Uid = existing.Uid
+		for _, v := range existing.Version {
+			versionUids[v.ModuleVersion] = v.Uid
+		}
+	}
+
+	now := time.Now().UTC()
+	for v := range mod.Versions {
+		uid, ok := versionUids[v]
+		if !ok {
+			uid = fmt.Sprintf("_:%s@%s", mod.Name, v)
+		}
+		version := ModuleVersion{
+			Uid:           uid,
+			ModuleVersion: v,
+			LastIndexedAt: now,
+			README:        mod.Readmes[v],
+			DType:         []string{"ModuleVersion"},
+		}
+		if at := mod.UploadedAt[v]; !at.IsZero() {
+			version.UploadedAt = &at
+		}
+		m.Version = append(m.Version, version)
+	}
+	return m
+}
+
+// QueryModuleByName returns the module with its versions, or nil if the module
+// isn't in the graph
+func QueryModuleByName(ctx context.Context, name string) (*Module, error) {
+	q := `query q($name: string) {
+		q(func: eq(name, $name)) @filter(type(Module)) {
+			uid
+			name
+			stars
+			description
+			version {
+				uid
+				module_version
+				module_version_uploaded_at
+			}
+		}
+	}`
+
+	var resp struct {
+		Q []Module `json:"q"`
+	}
+	if err := runQuery(ctx, q, map[string]string{"$name": name}, &resp); err != nil {
+		return nil, fmt.Errorf("failed to query module %s: %s", name, err)
+	}
+	if len(resp.Q) == 0 {
+		return nil, nil
+	}
+	return &resp.Q[0], nil
+}
+
+// QueryModuleVersionUid returns the uid of the ModuleVersion node of the
+// module, or an empty string if the version isn't in the graph
+func QueryModuleVersionUid(ctx context.Context, module, version string) (string, error) {
+	q := `query q($name: string, $version: string) {
+		q(func: eq(name, $name)) @filter(type(Module)) {
+			version @filter(eq(module_version, $version)) {
+				uid
+				module_version
+			}
+		}
+	}`
+
+	var resp struct {
+		Q []Module `json:"q"`
+	}
+	vars := map[string]string{"$name": module, "$version": version}
+	if err := runQuery(ctx, q, vars, &resp); err != nil {
+		return "", fmt.Errorf("failed to query version %s of %s: %s", version, module, err)
+	}
+
+	// eq on a term index can also match versions with the same terms
+	for _, m := range resp.Q {
+		for _, v := range m.Version {
+			if v.ModuleVersion == version {
+				return v.Uid, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// TopModulesByStars returns at most limit modules sorted by star count in
+// descending order, skipping the first offset modules
+func TopModulesByStars(ctx context.Context, limit, offset int) ([]Module, error) {
+	q := `query q($first: int, $offset: int) {
+		q(func: type(Module), orderdesc: stars, first: $first, offset: $offset) {
+			uid
+			name
+			stars
+			description
+		}
+	}`
+
+	var resp struct {
+		Q []Module `json:"q"`
+	}
+	if err := runQuery(ctx, q, pageVars(limit, offset), &resp); err != nil {
+		return nil, fmt.Errorf("failed to query top modules by stars: %s", err)
+	}
+	return resp.Q, nil
+}
+
+// ListModules returns at most limit modules in uid order, starting after the
+// module with the uid after. An empty after starts from the first module.
+func ListModules(ctx context.Context, limit int, after string) ([]Module, error) {
+	if after == "" {
+		after = "0x0"
+	}
+	if !uidPattern.MatchString(after) {
+		return nil, fmt.Errorf("invalid uid %q", after)
+	}
+
+	q := `query q($first: int, $after: string) {
+		q(func: type(Module), first: $first, after: $after) {
+			uid
+			name
+			stars
+			description
+		}
+	}`
+
+	var resp struct {
+		Q []Module `json:"q"`
+	}
+	vars := map[string]string{"$first": strconv.Itoa(limit), "$after": after}
+	if err := runQuery(ctx, q, vars, &resp); err != nil {
+		return nil, fmt.Errorf("failed to list modules after %s: %s", after, err)
+	}
+	return resp.Q, nil
+}
+
+// QueryLeafFiles returns at most limit File nodes that don't depend on any
+// other file
+func QueryLeafFiles(ctx context.Context, limit int) ([]File, error) {
+	q := `query q($first: int) {
+		q(func: type(File), first: $first) @filter(not has(depends_on)) {
+			uid
+			specifier
+		}
+	}`
+
+	var resp struct {
+		Q []File `json:"q"`
+	}
+	if err := runQuery(ctx, q, map[string]string{"$first": strconv.Itoa(limit)}, &resp); err != nil {
+		return nil, fmt.Errorf("failed to query leaf files: %s", err)
+	}
+	return resp.Q, nil
+}
+
+// CountLeafFiles returns the number of File nodes that don't depend on any
+// other file
+func CountLeafFiles(ctx context.Context) (int, error) {
+	q := `{ q(func: type(File)) @filter(not has(depends_on)) { count(uid) } }`
+	var resp struct {
+		Q []struct {
+			Count int `json:"count"`
+		} `json:"q"`
+	}
+	if err := runQuery(ctx, q, nil, &resp); err != nil {
+		return 0, fmt.Errorf("failed to count leaf files: %s", err)
+	}
+	if len(resp.Q) == 0 {
+		return 0, nil
+	}
+	return resp.Q[0].Count, nil
+}
+
+// staleFilter matches the ModuleVersion nodes uploaded and last indexed before
+// $before. Versions indexed before last_indexed_at was introduced are stale.
+const staleFilter = `@filter(type(ModuleVersion) AND lt(module_version_uploaded_at, $before) AND (lt(last_indexed_at, $before) OR NOT has(last_indexed_at)))`
+
+// ModuleVersionAge returns the modules with the versions that were both
+// uploaded and last indexed more than olderThan ago
+func ModuleVersionAge(ctx context.Context, olderThan time.Duration) ([]Module, error) {
+	q := `query q($before: string) {
+		q(func: has(module_version_uploaded_at)) ` + staleFilter + ` {
+			uid
+			module_version
+			module_version_uploaded_at
+			last_indexed_at
+			module: ~version {
+				name
+			}
+		}
+	}`
+
+	var resp struct {
+		Q []struct {
+			ModuleVersion
+			Module []Module `json:"module"`
+		} `json:"q"`
+	}
+	if err := runQuery(ctx, q, staleVars(olderThan), &resp); err != nil {
+		return nil, fmt.Errorf("failed to query stale module versions: %s", err)
+	}
+
+	var mods []Module
+	index := make(map[string]int)
+	for _, v := range resp.Q {
+		if len(v.Module) == 0 {
+			continue
+		}
+		name := v.Module[0].Name
+		i, ok := index[name]
+		if !ok {
+			i = len(mods)
+			index[name] = i
+			mods = append(mods, Module{Name: name})
+		}
+		mods[i].Version = append(mods[i].Version, v.ModuleVersion)
+	}
+	return mods, nil
+}
+
+// CountStaleModuleVersions returns the number of versions that were both
+// uploaded and last indexed more than olderThan ago
+func CountStaleModuleVersions(ctx context.Context, olderThan time.Duration) (int, error) {
+	q := `query q($before: string) {
+		q(func: has(module_version_uploaded_at)) ` + staleFilter + ` {
+			count(uid)
+		}
+	}`
+	var resp struct {
+		Q []struct {
+			Count int `json:"count"`
+		} `json:"q"`
+	}
+	if err := runQuery(ctx, q, staleVars(olderThan), &resp); err != nil {
+		return 0, fmt.Errorf("failed to count stale module versions: %s", err)
+	}
+	if len(resp.Q) == 0 {
+		return 0, nil
+	}
+	return resp.Q[0].Count, nil
+}
+
+func staleVars(olderThan time.Duration) map[string]string {
+	return map[string]string{"$before": time.Now().Add(-olderThan).UTC().Format(time.RFC3339)}
+}
+
+// TopModulesByDependentCount returns at most limit modules sorted by the number
+// of files depending on any of their files, skipping the first offset modules
+func TopModulesByDependentCount(ctx context.Context, limit, offset int) ([]Module, error) {
+	// the dependents of every file are summed up at the version level, then
+	// at the module level
+	q := `query q($first: int, $offset: int) {
+		var(func: type(Module)) {
+			version {
+				file_specifier {
+					fd as count(~depends_on)
+				}
+				vd as sum(val(fd))
+			}
+			md as sum(val(vd))
+		}
+
+		q(func: uid(md), orderdesc: val(md), first: $first, offset: $offset) {
+			uid
+			name
+			stars
+			description
+			dependent_count: val(md)
+		}
+	}`
+
+	var resp struct {
+		Q []Module `json:"q"`
+	}
+	if err := runQuery(ctx, q, pageVars(limit, offset), &resp); err != nil {
+		return nil, fmt.Errorf("failed to query top modules by dependent count: %s", err)
+	}
+	return resp.Q, nil
+}
+
+// pageVars returns the query variables of a paginated query
+func pageVars(limit, offset int) map[string]string {
+	return map[string]string{
+		"$first":  strconv.Itoa(limit),
+		"$offset": strconv.Itoa(offset),
+	}
+}
+
+// DiffVersionFiles compares the files of two versions of the module
+func DiffVersionFiles(ctx context.Context, module, versionA, versionB string) (FileDiff, error) {
+	q := `query q($name: string, $a: string, $b: string) {
+		q(func: eq(name, $name)) @filter(type(Module)) {
+			version @filter(eq(module_version, $a) OR eq(module_version, $b)) {
+				module_version
+				file_specifier {
+					specifier
+					depends_on {
+						specifier
+					}
+				}
+			}
+		}
+	}`
+
+	var resp struct {
+		Q []Module `json:"q"`
+	}
+	vars := map[string]string{"$name": module, "$a": versionA, "$b": versionB}
+	if err := runQuery(ctx, q, vars, &resp); err != nil {
+		return FileDiff{}, fmt.Errorf("failed to query versions of %s: %s", module, err)
+	}
+
+	files := make(map[string]map[string][]string)
+	for _, m := range resp.Q {
+		for _, v := range m.Version {
+			files[v.ModuleVersion] = versionFiles(module, v)
+		}
+	}
+
+	a, ok := files[versionA]
+	if !ok {
+		return FileDiff{}, fmt.Errorf("version %s of %s not found", versionA, module)
+	}
+	b, ok := files[versionB]
+	if !ok {
+		return FileDiff{}, fmt.Errorf("version %s of %s not found", versionB, module)
+	}
+
+	diff := FileDiff{AddedFiles: []string{}, RemovedFiles: []string{}, ModifiedFiles: []string{}}
+	for path, deps := range b {
+		prev, ok := a[path]
+		if !ok {
+			diff.AddedFiles = append(diff.AddedFiles, path)
+			continue
+		}
+		if strings.Join(prev, "\n") != strings.Join(deps, "\n") {
+			diff.ModifiedFiles = append(diff.ModifiedFiles, path)
+		}
+	}
+	for path := range a {
+		if _, ok := b[path]; !ok {
+			diff.RemovedFiles = append(diff.RemovedFiles, path)
+		}
+	}
+
+	sort.Strings(diff.AddedFiles)
+	sort.Strings(diff.RemovedFiles)
+	sort.Strings(diff.ModifiedFiles)
+	return diff, nil
+}
+
+// versionFiles maps the files of the module version to their sorted
+// dependencies. Specifiers within the module version are made relative to its
+// root so that they compare equal across versions.
+func versionFiles(module string, v ModuleVersion) map[string][]string {
+	root := deno.SpecifierURL(module, v.ModuleVersion, "")
+	prefix := root.String()
+
+	files := make(map[string][]string, len(v.Files))
+	for _, f := range v.Files {
+		deps := make([]string, 0, len(f.DependsOn))
+		for _, d := range f.DependsOn {
+			deps = append(deps, strings.TrimPrefix(d.Specifier, prefix))
+		}
+		sort.Strings(deps)
+		files[strings.TrimPrefix(f.Specifier, prefix)] = deps
+	}
+	return files
+}
+
+// insertHook is called with the outcome of the insert of every DenoInfo
+var insertHook = func(ctx context.Context, info deno.DenoInfo, err error) {}
+
+// SetInsertHook sets the function called with every DenoInfo once its files
+// are committed, or with the error that prevented it. It must be set before
+// the files are inserted.
+func SetInsertHook(fn func(ctx context.Context, info deno.DenoInfo, err error)) {
+	insertHook = fn
+}
+
+// InsertFiles iterates over a channel of DenoInfo and inserts every specifier
+// in it in the DGraph cluster
+func InsertFiles(ctx context.Context, mods chan deno.DenoInfo) (chan bool, chan error) {
+	return InsertFilesWorkerPool(ctx, mods, 1)
+}
+
+// InsertFilesWorkerPool is like InsertFiles but inserts the files of up to
+// workers DenoInfo values in parallel, each in its own transaction
+func InsertFilesWorkerPool(ctx context.Context, mods chan deno.DenoInfo, workers int) (chan bool, chan error) {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	done := make(chan bool)
+	errs := make(chan error)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for mod := range mods {
+				err := insertInfo(ctx, mod)
+				insertHook(ctx, mod, err)
+				if err != nil {
+					errs <- fmt.Errorf("failed to insert files of %s: %s", mod.Module, err)
+					continue
+				}
+				slog.Info("transaction completed", "module_name", mod.ModuleName, "version", mod.ModuleVersion, "specifier", mod.Module)
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		slog.Info("finished inserting all files")
+		close(errs)
+		done <- true
+		close(done)
+	}()
+
+	return done, errs
+}
+
+// InsertFilesBatched is like InsertFiles but inserts the files of up to
+// batchSize DenoInfo values in a single transaction, which saves a commit per
+// DenoInfo when they are small. A partial batch is committed once no new
+// DenoInfo has been received for batchFlushInterval.
+func InsertFilesBatched(ctx context.Context, mods chan deno.DenoInfo, batchSize int) (chan bool, chan error) {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+
+	done := make(chan bool)
+	errs := make(chan error)
+	go func() {
+		batch := make([]deno.DenoInfo, 0, batchSize)
+		flush := func() {
+			if len(batch) == 0 {
+				return
+			}
+			if err := insertInfos(ctx, batch); err != nil {
+				errs <- err
+			} else {
+				slog.Info("transaction completed", "modules", len(batch))
+			}
+			batch = batch[:0]
+		}
+
+		// the timer runs from the first module of a batch until it is
+		// flushed, a steady trickle of modules doesn't hold a batch back
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		stopTimer := func() {
+			if timer != nil {
+				timer.Stop()
+				timer, timeout = nil, nil
+			}
+		}
+		defer stopTimer()
+	loop:
+		for {
+			select {
+			case mod, ok := <-mods:
+				if !ok {
+					break loop
+				}
+				batch = append(batch, mod)
+				if timer == nil {
+					timer = time.NewTimer(batchFlushInterval)
+					timeout = timer.C
+				}
+				if len(batch) >= batchSize {
+					stopTimer()
+					flush()
+				}
+			case <-timeout:
+				stopTimer()
+				flush()
+			}
+		}
+		flush()
+
+		slog.Info("finished inserting all files")
+		close(errs)
+		done <- true
+		close(done)
+	}()
+
+	return done, errs
+}
+
+// batchFlushInterval is how long InsertFilesBatched waits for a batch to fill
+// up before committing it, tests shorten it
+var batchFlushInterval = 5 * time.Second
+
+// insertInfo inserts all the files of the DenoInfo in a single transaction and
+// writes the uids of the new nodes to DynamoDB once it is committed. The files
+// of the module version the info was collected for are linked to its
+// ModuleVersion node.
+func insertInfo(ctx context.Context, mod deno.DenoInfo) error {
+	link, err := infoLink(ctx, mod)
+	if err != nil {
+		return err
+	}
+
+	var m infoMutation
+	err = runTxn(ctx, func(txn Txn) error {
+		// a retried transaction starts over, the entries of the aborted one
+		// were never committed
+		var err error
+		m, err = mutateInfo(ctx, txn, mod, link, make(map[string]string))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	reportCycles(mod, m.cycles)
+	return putEntries(ctx, m.entries)
+}
+
+// reportCycles counts the dependency cycles completed by a committed
+// transaction in cycles_detected_total
+func reportCycles(mod deno.DenoInfo, cycles [][]string) {
+	if len(cycles) > 0 {
+		cyclesDetected.Add(float64(len(cycles)))
+		slog.Warn("found dependency cycles", "module_name", mod.ModuleName, "version", mod.ModuleVersion, "cycles", len(cycles))
+	}
+}
+
+// putEntries writes the entries of the nodes created by a committed
+// transaction
+func putEntries(ctx context.Context, entries []Item) error {
+	if err := BulkPutEntries(ctx, entries); err != nil {
+		return fmt.Errorf("failed to put %d entries: %s", len(entries), err)
+	}
+	return nil
+}
+
+// insertInfos inserts the files of all the DenoInfo values in a single
+// transaction. The values whose module version can't be queried are reported
+// and left out of the transaction.
+func insertInfos(ctx context.Context, mods []deno.DenoInfo) error {
+	var failed []string
+	infos := make([]deno.DenoInfo, 0, len(mods))
+	links := make([]versionLink, 0, len(mods))
+	for _, mod := range mods {
+		link, err := infoLink(ctx, mod)
+		if err != nil {
+			insertHook(ctx, mod, err)
+			failed = append(failed, fmt.Sprintf("%s: %s", mod.Module, err))
+			continue
+		}
+		infos = append(infos, mod)
+		links = append(links, link)
+	}
+
+	var muts []infoMutation
+	err := runTxn(ctx, func(txn Txn) error {
+		// the files shared by the infos are only created once in the batch
+		created := make(map[string]string)
+		muts = make([]infoMutation, 0, len(infos))
+		for i, mod := range infos {
+			m, err := mutateInfo(ctx, txn, mod, links[i], created)
+			if err != nil {
+				return err
+			}
+			muts = append(muts, m)
+		}
+		return nil
+	})
+	if err == nil {
+		var entries []Item
+		for i, m := range muts {
+			reportCycles(infos[i], m.cycles)
+			entries = append(entries, m.entries...)
+		}
+		err = putEntries(ctx, entries)
+	}
+	for _, mod := range infos {
+		insertHook(ctx, mod, err)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", mod.Module, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to insert files of %d modules: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// infoLink returns the link from the files of the DenoInfo to the
+// ModuleVersion node it was collected for, if any
+func infoLink(ctx context.Context, mod deno.DenoInfo) (versionLink, error) {
+	if mod.ModuleName == "" || mod.ModuleVersion == "" {
+		return versionLink{}, nil
+	}
+
+	uid, err := QueryModuleVersionUid(ctx, mod.ModuleName, mod.ModuleVersion)
+	if err != nil {
+		return versionLink{}, err
+	}
+	if uid == "" {
+		slog.Warn("version not found, its files won't be linked to it", "module_name", mod.ModuleName, "version", mod.ModuleVersion)
+	}
+	root := deno.SpecifierURL(mod.ModuleName, mod.ModuleVersion, "")
+	return versionLink{uid: uid, prefix: root.String()}, nil
+}
+
+// infoMutation is what mutateInfo leaves to do once the transaction is
+// committed
+type infoMutation struct {
+	// entries of the new nodes, to be written to DynamoDB
+	entries []Item
+	// cycles completed by the edges of the mutated files
+	cycles [][]string
+}
+
+// mutateInfo applies the mutations of all the files of the DenoInfo to txn and
+// returns the entries of the new nodes and the dependency cycles completed by
+// the mutations. created holds the uids of the nodes already created in txn, it
+// is updated with the new ones.
+func mutateInfo(ctx context.Context, txn Txn, mod deno.DenoInfo, link versionLink, created map[string]string) (infoMutation, error) {
+	// the entries are only written once txn is committed, the uids created by
+	// the previous files are looked up in created in the meantime
+	var items []Item
+	mutated := make(map[string]bool)
+	for k, f := range mod.Files {
+		select {
+		case <-ctx.Done():
+			ItemsAbandoned.WithLabelValues("insert_files").Inc()
+			slog.Info("received cancel signal, closing InsertFiles")
+			return infoMutation{entries: items, cycles: newCycles(mod, mutated)}, nil
+		default:
+		}
+
+		uids, edges, err := mutateFile(ctx, txn, k, f, link, created)
+		if err != nil {
+			return infoMutation{}, fmt.Errorf("failed to mutate %s: %w", k, err)
+		}
+		if edges {
+			mutated[canonicalSpecifier(k)] = true
+		}
+
+		for specifier, uid := range uids {
+			// TODO(wperron): there's probably a better to filter for only
+			//   the UIDs that were created as part of this mutation
+			if _, ok := created[specifier]; ok || !strings.HasPrefix(specifier, "https://") {
+				continue
+			}
+			created[specifier] = uid
+			items = append(items, Item{Specifier: specifier, Uid: uid})
+		}
+	}
+	return infoMutation{entries: items, cycles: newCycles(mod, mutated)}, nil
+}
+
+// maxTxnRetries is the number of times a transaction aborted because of a
+// conflict with a concurrent transaction is retried
+const maxTxnRetries = 3
+
+// runTxn applies the mutations of fn in a new transaction and commits it. If
+// a mutation or the commit is aborted because of a conflict, the mutations are
+// re-applied in a new transaction, up to maxTxnRetries times.
+func runTxn(ctx context.Context, fn func(txn Txn) error) error {
+	for attempt := 0; ; attempt++ {
+		trxCounter.Add(1)
+		txn := newTxn()
+		err := fn(txn)
+		if err == nil {
+			if err = commit(ctx, txn); err == nil {
+				return nil
+			}
+		}
+		discard(ctx, txn)
+
+		if !isAborted(err) {
+			return err
+		}
+		txnConflictCounter.Inc()
+		if attempt >= maxTxnRetries {
+			return fmt.Errorf("transaction aborted after %d retries: %s", maxTxnRetries, err)
+		}
+		slog.Warn("transaction aborted, retrying", "attempt", attempt+1, "max_retries", maxTxnRetries)
+	}
+}
+
+// commit commits the transaction and records the latency of the commit
+func commit(ctx context.Context, txn Txn) error {
+	start := time.Now()
+	cctx, cancel := withTimeout(ctx, &mutationTimeout)
+	defer cancel()
+	err := txn.Commit(cctx)
+	commitLatency.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// isAborted reports whether the error, or an error it wraps, is a transaction
+// conflict
+func isAborted(err error) bool {
+	if errors.Is(err, dgo.ErrAborted) {
+		return true
+	}
+	var s interface{ GRPCStatus() *status.Status }
+	return errors.As(err, &s) && s.GRPCStatus().Code() == codes.Aborted
+}
+
+// queryTxn is the subset of a dgo transaction used to run read-only queries
+type queryTxn interface {
+	QueryWithVars(ctx context.Context, q string, vars map[string]string) (*api.Response, error)
+}
+
+// newQueryTxn returns the transaction used by read-only queries. Tests replace
+// it to return fixtures instead of querying a live cluster.
+var newQueryTxn = func() queryTxn {
+	return client.NewReadOnlyTxn()
+}
+
+// Txn is the subset of a dgo transaction used to query and mutate the graph
+type Txn interface {
+	QueryWithVars(ctx context.Context, q string, vars map[string]string) (*api.Response, error)
+	Mutate(ctx context.Context, mu *api.Mutation) (*api.Response, error)
+	Commit(ctx context.Context) error
+	Discard(ctx context.Context) error
+}
+
+// newTxn returns the transaction used by mutations
+var newTxn = func() Txn {
+	return client.NewTxn()
+}
+
+// UseTxn replaces the transactions used for both queries and mutations with the
+// ones returned by f, e.g. an in-memory graph in tests. The returned function
+// restores the previous transactions. The module uid cache is cleared both
+// times since it refers to the uids of the replaced graph.
+func UseTxn(f func() Txn) (restore func()) {
+	origQuery, origTxn := newQueryTxn, newTxn
+	newQueryTxn = func() queryTxn { return f() }
+	newTxn = f
+	clearModuleUIDCache()
+	return func() {
+		newQueryTxn, newTxn = origQuery, origTxn
+		clearModuleUIDCache()
+	}
+}
+
+// runQuery runs the query in a read-only transaction and unmarshals the JSON
+// response into out
+func runQuery(ctx context.Context, q string, vars map[string]string, out interface{}) error {
+	qctx, cancel := withTimeout(ctx, &queryTimeout)
+	defer cancel()
+
+	resp, err := newQueryTxn().QueryWithVars(qctx, q, vars)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(resp.Json, out)
+}
+
+// QueryNeighbourhood returns all the files within depth hops of the specifier
+// following the depends_on edges, including the file itself. Each file's
+// DependsOn only holds the uid and specifier of its direct dependencies.
+func QueryNeighbourhood(ctx context.Context, specifier string, depth int) ([]File, error) {
+	if depth < 0 {
+		return nil, fmt.Errorf("invalid depth %d", depth)
+	}
+
+	// the recurse depth counts the root as the first level
+	q := fmt.Sprintf(`query q($specifier: string) {
+		q(func: eq(specifier, $specifier)) @recurse(depth: %d, loop: false) {
+			uid
+			specifier
+			depends_on
+		}
+	}`, depth+1)
+
+	var resp struct {
+		Q []File `json:"q"`
+	}
+	if err := runQuery(ctx, q, map[string]string{"$specifier": specifier}, &resp); err != nil {
+		return nil, fmt.Errorf("failed to query neighbourhood of %s: %s", specifier, err)
+	}
+
+	return flattenNeighbourhood(resp.Q), nil
+}
+
+// queryModuleNeighbourhood is like QueryNeighbourhood but starts from the files
+// of the versions of the Module node with the uid
+func queryModuleNeighbourhood(ctx context.Context, moduleUID string, depth int) ([]File, error) {
+	if depth < 0 {
+		return nil, fmt.Errorf("invalid depth %d", depth)
+	}
+	if !uidPattern.MatchString(moduleUID) {
+		return nil, fmt.Errorf("invalid uid %q", moduleUID)
+	}
+
+	q := fmt.Sprintf(`{
+		var(func: uid(%s)) {
+			version {
+				f as file_specifier
+			}
+		}
+		q(func: uid(f)) @recurse(depth: %d, loop: false) {
+			uid
+			specifier
+			depends_on
+		}
+	}`, moduleUID, depth+1)
+
+	var resp struct {
+		Q []File `json:"q"`
+	}
+	if err := runQuery(ctx, q, nil, &resp); err != nil {
+		return nil, fmt.Errorf("failed to query neighbourhood of module %s: %s", moduleUID, err)
+	}
+	return flattenNeighbourhood(resp.Q), nil
+}
+
+// flattenNeighbourhood returns every file of the nested result of a recurse
+// query once, in depth-first order
+func flattenNeighbourhood(files []File) []File {
+	// the same node can be reached through different paths
+	seen := make(map[string]bool)
+	var out []File
+	var walk func(files []File)
+	walk = func(files []File) {
+		for _, f := range files {
+			if seen[f.Uid] {
+				continue
+			}
+			seen[f.Uid] = true
+
+			node := File{Uid: f.Uid, Specifier: f.Specifier, DType: f.DType}
+			for _, d := range f.DependsOn {
+				node.DependsOn = append(node.DependsOn, File{Uid: d.Uid, Specifier: d.Specifier})
+			}
+			out = append(out, node)
+			walk(f.DependsOn)
+		}
+	}
+	walk(files)
+	return out
+}
+
+// QueryTransitiveConsumers returns the sorted names of the modules with a file
+// importing the specifier, directly or through up to depth intermediate files
+func QueryTransitiveConsumers(ctx context.Context, specifier string, depth int) ([]string, error) {
+	if depth < 1 {
+		return nil, fmt.Errorf("invalid depth %d", depth)
+	}
+
+	// the recurse depth counts the specifier as the first level
+	q := fmt.Sprintf(`query q($specifier: string) {
+		var(func: eq(specifier, $specifier)) @recurse(depth: %d, loop: false) {
+			consumers as ~depends_on
+		}
+
+		q(func: uid(consumers)) {
+			~file_specifier {
+				~version {
+					name
+				}
+			}
+		}
+	}`, depth+1)
+
+	var resp struct {
+		Q []struct {
+			Versions []struct {
+				Modules []Module `json:"~version"`
+			} `json:"~file_specifier"`
+		} `json:"q"`
+	}
+	if err := runQuery(ctx, q, map[string]string{"$specifier": specifier}, &resp); err != nil {
+		return nil, fmt.Errorf("failed to query consumers of %s: %s", specifier, err)
+	}
+
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, f := range resp.Q {
+		for _, v := range f.Versions {
+			for _, m := range v.Modules {
+				if m.Name == "" || seen[m.Name] {
+					continue
+				}
+				seen[m.Name] = true
+				names = append(names, m.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// QueryDependents returns the files that directly import the specifier,
+// following the reverse of the depends_on edges
+func QueryDependents(ctx context.Context, specifier string) ([]File, error) {
+	q := `query q($specifier: string) {
+		q(func: eq(specifier, $specifier)) {
+			~depends_on(orderasc: specifier) {
+				uid
+				specifier
+			}
+		}
+	}`
+
+	var resp struct {
+		Q []struct {
+			Dependents []File `json:"~depends_on"`
+		} `json:"q"`
+	}
+	if err := runQuery(ctx, q, map[string]string{"$specifier": specifier}, &resp); err != nil {
+		return nil, fmt.Errorf("failed to query dependents of %s: %s", specifier, err)
+	}
+
+	seen := make(map[string]bool)
+	files := []File{}
+	for _, f := range resp.Q {
+		for _, d := range f.Dependents {
+			if seen[d.Uid] {
+				continue
+			}
+			seen[d.Uid] = true
+			files = append(files, d)
+		}
+	}
+	return files, nil
+}
+
+// QueryTransitiveDependents returns the files that import the specifier,
+// directly or through up to depth-1 intermediate files, sorted by specifier
+func QueryTransitiveDependents(ctx context.Context, specifier string, depth int) ([]File, error) {
+	if depth < 1 {
+		return nil, fmt.Errorf("invalid depth %d", depth)
+	}
+
+	// the recurse depth counts the specifier as the first level
+	q := fmt.Sprintf(`query q($specifier: string) {
+		var(func: eq(specifier, $specifier)) @recurse(depth: %d, loop: false) {
+			dependents as ~depends_on
+		}
+
+		q(func: uid(dependents), orderasc: specifier) {
+			uid
+			specifier
+		}
+	}`, depth+1)
+
+	var resp struct {
+		Q []File `json:"q"`
+	}
+	if err := runQuery(ctx, q, map[string]string{"$specifier": specifier}, &resp); err != nil {
+		return nil, fmt.Errorf("failed to query dependents of %s: %s", specifier, err)
+	}
+
+	// a cycle can lead back to the specifier itself
+	files := []File{}
+	for _, f := range resp.Q {
+		if f.Specifier != specifier {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// ErrSpecifierNotFound is returned by FindShortestPath when a specifier has no
+// File node
+type ErrSpecifierNotFound struct {
+	Specifier string
+}
+
+func (e ErrSpecifierNotFound) Error() string {
+	return fmt.Sprintf("specifier %s not found", e.Specifier)
+}
+
+// ErrNoPath is returned by FindShortestPath when the first specifier doesn't
+// depend on the second one, even transitively
+var ErrNoPath = errors.New("no dependency path between the specifiers")
+
+// uidPattern matches the hexadecimal uids of DGraph nodes
+var uidPattern = regexp.MustCompile(`^0x[0-9a-fA-F]+$`)
+
+// pathNode is a node of the `_path_` result of a shortest path query. Its
+// depends_on edge is either a single node or a list of one node depending on
+// the DGraph release.
+type pathNode struct {
+	Uid       string          `json:"uid"`
+	DependsOn json.RawMessage `json:"depends_on"`
+}
+
+// FindShortestPath returns the files of the shortest chain of depends_on edges
+// from the file of the first specifier to the file of the second one, both
+// included. The uids of the specifiers are read from DynamoDB.
+func FindShortestPath(ctx context.Context, from, to string) ([]File, error) {
+	uids := make([]string, 2)
+	for i, specifier := range []string{from, to} {
+		uid, err := lookupUID(ctx, canonicalSpecifier(specifier))
+		if err != nil {
+			return nil, err
+		}
+		if uid == "" {
+			return nil, ErrSpecifierNotFound{Specifier: specifier}
+		}
+		if !uidPattern.MatchString(uid) {
+			return nil, fmt.Errorf("invalid uid %q for %s", uid, specifier)
+		}
+		uids[i] = uid
+	}
+	if uids[0] == uids[1] {
+		return []File{{Uid: uids[0], Specifier: canonicalSpecifier(from)}}, nil
+	}
+
+	q := fmt.Sprintf(`{
+		path as shortest(from: %s, to: %s) {
+			depends_on
+		}
+
+		nodes(func: uid(path)) {
+			uid
+			specifier
+		}
+	}`, uids[0], uids[1])
+
+	var resp struct {
+		Path  []pathNode `json:"_path_"`
+		Nodes []File     `json:"nodes"`
+	}
+	if err := runQuery(ctx, q, nil, &resp); err != nil {
+		return nil, fmt.Errorf("failed to query path from %s to %s: %s", from, to, err)
+	}
+	if len(resp.Path) == 0 {
+		return nil, ErrNoPath
+	}
+
+	specifiers := make(map[string]string, len(resp.Nodes))
+	for _, n := range resp.Nodes {
+		specifiers[n.Uid] = n.Specifier
+	}
+
+	var path []File
+	node := resp.Path[0]
+	for {
+		path = append(path, File{Uid: node.Uid, Specifier: specifiers[node.Uid]})
+		if len(node.DependsOn) == 0 || string(node.DependsOn) == "null" {
+			break
+		}
+
+		var next []pathNode
+		if node.DependsOn[0] == '[' {
+			if err := json.Unmarshal(node.DependsOn, &next); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal path: %s", err)
+			}
+		} else {
+			var n pathNode
+			if err := json.Unmarshal(node.DependsOn, &n); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal path: %s", err)
+			}
+			next = append(next, n)
+		}
+		if len(next) == 0 {
+			break
+		}
+		node = next[0]
+	}
+	return path, nil
+}
+
+// countCacheTTL is how long the results of CountModules and CountVersions are
+// cached for
+const countCacheTTL = 60 * time.Second
+
+// countCache maps a DGraph type to its cachedCount
+var countCache sync.Map
+
+type cachedCount struct {
+	count int
+	at    time.Time
+}
+
+// PingDGraph runs a trivial query to check that DGraph is reachable
+func PingDGraph(ctx context.Context) error {
+	var resp struct {
+		Q []Module `json:"q"`
+	}
+	if err := runQuery(ctx, `{ q(func: has(name), first: 1) { uid } }`, nil, &resp); err != nil {
+		return fmt.Errorf("failed to ping dgraph: %s", err)
+	}
+	return nil
+}
+
+// CountModules returns the number of Module nodes in the graph
+func CountModules(ctx context.Context) (int, error) {
+	return countType(ctx, "Module")
+}
+
+// CountVersions returns the number of ModuleVersion nodes in the graph
+func CountVersions(ctx context.Context) (int, error) {
+	return countType(ctx, "ModuleVersion")
+}
+
+// CountFiles returns the number of File nodes in the graph
+func CountFiles(ctx context.Context) (int, error) {
+	return countType(ctx, "File")
+}
+
+// countType returns the number of nodes of the type, the result is cached for
+// 60 seconds
+func countType(ctx context.Context, dtype string) (int, error) {
+	if v, ok := countCache.Load(dtype); ok {
+		c := v.(cachedCount)
+		if time.Since(c.at) < countCacheTTL {
+			return c.count, nil
+		}
+	}
+
+	q := fmt.Sprintf(`{ q(func: type(%s)) { count(uid) } }`, dtype)
+	var resp struct {
+		Q []struct {
+			Count int `json:"count"`
+		} `json:"q"`
+	}
+	if err := runQuery(ctx, q, nil, &resp); err != nil {
+		return 0, fmt.Errorf("failed to count %s nodes: %s", dtype, err)
+	}
+
+	count := 0
+	if len(resp.Q) > 0 {
+		count = resp.Q[0].Count
+	}
+	countCache.Store(dtype, cachedCount{count: count, at: time.Now()})
+	return count, nil
+}
+
+// PruneDeletedVersions deletes the ModuleVersion nodes of the module that are
+// no longer in currentVersions, along with their file_specifier edges. It
+// returns the number of deleted nodes.
+func PruneDeletedVersions(ctx context.Context, module string, currentVersions []string) (int, error) {
+	q := `query q($name: string) {
+		q(func: eq(name, $name)) @filter(type(Module)) {
+			uid
+			version {
+				uid
+				module_version
+			}
+		}
+	}`
+
+	var resp struct {
+		Q []Module `json:"q"`
+	}
+	if err := runQuery(ctx, q, map[string]string{"$name": module}, &resp); err != nil {
+		return 0, fmt.Errorf("failed to query versions of %s: %s", module, err)
+	}
+
+	current := make(map[string]bool, len(currentVersions))
+	for _, v := range currentVersions {
+		current[v] = true
+	}
+
+	// deleting a node by uid removes all the predicates of its type, including
+	// the file_specifier edges. The version edge is removed from the module.
+	var dels []interface{}
+	for _, m := range resp.Q {
+		for _, v := range m.Version {
+			if current[v.ModuleVersion] {
+				continue
+			}
+			dels = append(dels,
+				map[string]interface{}{"uid": m.Uid, "version": []map[string]string{{"uid": v.Uid}}},
+				map[string]string{"uid": v.Uid},
+			)
+		}
+	}
+
+	if len(dels) == 0 {
+		return 0, nil
+	}
+	moduleUIDCache.Delete(module)
+
+	bytes, err := json.Marshal(dels)
 	if err != nil {
-		log.Fatal(err)
+		return 0, fmt.Errorf("failed to marshal delete mutation: %s", err)
 	}
 
-	if item.Uid != "" {
+	trxCounter.Add(1)
+	mutationsCounter.Add(1)
+	mctx, cancel := withTimeout(ctx, &mutationTimeout)
+	defer cancel()
+	if _, err := newTxn().Mutate(mctx, &api.Mutation{DeleteJson: bytes, CommitNow: true}); err != nil {
+		return 0, fmt.Errorf("failed to delete versions of %s: %s", module, err)
+	}
+
+	deleted := len(dels) / 2
+	slog.Info("pruned deleted versions", "module_name", module, "deleted", deleted)
+	return deleted, nil
+}
+
+// maximum number of NQuads sent in a single mutation by BulkInsertFiles
+const bulkBatchSize = 1000
+
+// BulkInsertFiles inserts the files of all the DenoInfo as NQuads, sending them
+// in batches of about 1000 quads per mutation. This is much faster than
+// InsertFiles for the initial load of an empty cluster. The quads of a single
+// file are always sent in the same batch.
+func BulkInsertFiles(ctx context.Context, infos []deno.DenoInfo) error {
+	b := &bulkLoader{
+		known:    make(map[string]string),
+		labels:   make(map[string]string),
+		declared: make(map[string]bool),
+	}
+
+	for _, info := range infos {
+		for specifier, entry := range info.Files {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+
+			quads, declared, err := b.fileQuads(ctx, specifier, entry)
+			if err != nil {
+				return err
+			}
+
+			if len(b.quads) > 0 && len(b.quads)+len(quads) > bulkBatchSize {
+				if err := b.flush(ctx); err != nil {
+					return err
+				}
+				// blank nodes from the previous batch now have a UID
+				if quads, declared, err = b.fileQuads(ctx, specifier, entry); err != nil {
+					return err
+				}
+			}
+
+			b.quads = append(b.quads, quads...)
+			for _, spec := range declared {
+				b.declared[spec] = true
+			}
+		}
+	}
+	return b.flush(ctx)
+}
+
+type bulkLoader struct {
+	quads    []string
+	known    map[string]string // specifier->uid of nodes that exist in the graph
+	labels   map[string]string // specifier->blank node label
+	declared map[string]bool   // specifiers declared in the current batch
+}
+
+// ref returns the NQuad reference of the specifier's node and whether it is a
+// new node that needs to be declared
+func (b *bulkLoader) ref(ctx context.Context, specifier string) (string, bool, error) {
+	if uid, ok := b.known[specifier]; ok && uid != "" {
+		return fmt.Sprintf("<%s>", uid), false, nil
+	}
+
+	if _, ok := b.known[specifier]; !ok {
+		uid, err := lookupUID(ctx, specifier)
+		if err != nil {
+			return "", false, err
+		}
+		// an empty uid is cached to avoid looking up the same new node again
+		b.known[specifier] = uid
+		if uid != "" {
+			return fmt.Sprintf("<%s>", uid), false, nil
+		}
+	}
+
+	label, ok := b.labels[specifier]
+	if !ok {
+		label = fmt.Sprintf("f%d", len(b.labels))
+		b.labels[specifier] = label
+	}
+	return fmt.Sprintf("_:%s", label), !b.declared[specifier], nil
+}
+
+// fileQuads returns the NQuads of the file and its depends_on edges, along with
+// the specifiers of the new nodes declared by those quads. The specifiers are
+// canonicalised like in mutateFile.
+func (b *bulkLoader) fileQuads(ctx context.Context, specifier string, entry deno.FileEntry) ([]string, []string, error) {
+	specifier = canonicalSpecifier(specifier)
+	var quads, declared []string
+	seen := make(map[string]bool)
+	node := func(spec string) (string, error) {
+		ref, isNew, err := b.ref(ctx, spec)
+		if err != nil {
+			return "", err
+		}
+		if isNew && !seen[spec] {
+			seen[spec] = true
+			declared = append(declared, spec)
+			quads = append(quads,
+				fmt.Sprintf("%s <specifier> %s .", ref, strconv.Quote(spec)),
+				fmt.Sprintf("%s <dgraph.type> \"File\" .", ref),
+			)
+		}
+		return ref, nil
+	}
+
+	subject, err := node(specifier)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, d := range canonicalSpecifiers(entry.Deps) {
+		dep, err := node(d)
+		if err != nil {
+			return nil, nil, err
+		}
+		quads = append(quads, fmt.Sprintf("%s <depends_on> %s .", subject, dep))
+	}
+	return quads, declared, nil
+}
+
+// flush sends the current batch in a single mutation and records the UIDs of
+// the new nodes in DynamoDB
+func (b *bulkLoader) flush(ctx context.Context) error {
+	defer func() {
+		b.quads = b.quads[:0]
+		b.declared = make(map[string]bool)
+	}()
+	if len(b.quads) == 0 {
+		return nil
+	}
+
+	trxCounter.Add(1)
+	mutationsCounter.Add(1)
+	mctx, cancel := withTimeout(ctx, &mutationTimeout)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := newTxn().Mutate(mctx, &api.Mutation{
+		SetNquads: []byte(strings.Join(b.quads, "\n")),
+		CommitNow: true,
+	})
+	commitLatency.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return fmt.Errorf("failed to run bulk mutation: %s", err)
+	}
+
+	items := make([]Item, 0, len(b.declared))
+	for spec := range b.declared {
+		uid, ok := resp.Uids[b.labels[spec]]
+		if !ok {
+			continue
+		}
+		b.known[spec] = uid
+		items = append(items, Item{Specifier: spec, Uid: uid})
+	}
+
+	if err := BulkPutEntries(ctx, items); err != nil {
+		return fmt.Errorf("failed to put entries: %s", err)
+	}
+	slog.Info("bulk inserted files", "quads", len(b.quads), "new_files", len(items))
+	return nil
+}
+
+// mutateFile adds the mutation of the file to txn and returns the uids of the
+// nodes it created, and whether the edges to its dependencies were added. The
+// uids in created take precedence over the DynamoDB entries.
+func mutateFile(ctx context.Context, txn Txn, specifier string, entry deno.FileEntry, link versionLink, created map[string]string) (map[string]string, bool, error) {
+	specifier = canonicalSpecifier(specifier)
+	depSpecifiers := canonicalSpecifiers(entry.Deps)
+
+	// map specifier->blank uid
+	// used later to insert into DynamoDB UIDs that were created in
+	// this mutation
+	blanks := make(map[string]string)
+
+	// the file and its dependencies are read from DynamoDB in a single batch
+	var lookups []string
+	for _, s := range append([]string{specifier}, depSpecifiers...) {
+		if created[s] == "" {
+			lookups = append(lookups, s)
+		}
+	}
+	items, err := BatchGetEntry(ctx, lookups)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get entries from DynamoDB: %s", err)
+	}
+	lookup := func(s string) Item {
+		if known := created[s]; known != "" {
+			return Item{Specifier: s, Uid: known}
+		}
+		return items[s]
+	}
+
+	// The specifiers missing from DynamoDB may still be in DGraph while the
+	// cache is cold, they are all looked up in a single query so that no
+	// duplicate node is created for them. The uids found are returned to be
+	// cached. The file itself is always looked up to know if it is complete.
+	// The lookup is skipped when SetFileUpsert disabled it.
+	missing := []string{specifier}
+	for _, s := range depSpecifiers {
+		if lookup(s).Uid == "" {
+			missing = append(missing, s)
+		}
+	}
+	var nodes map[string]graphFile
+	if atomic.LoadInt32(&fileUpsert) == 1 {
+		nodes, err = lookupFiles(ctx, missing)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to look up nodes: %w", err)
+		}
+	}
+	found := make(map[string]string, len(nodes))
+	for s, n := range nodes {
+		found[s] = n.uid
+	}
+
+	uid := fmt.Sprintf("_:%s", specifier)
+	item := lookup(specifier)
+
+	if n, ok := nodes[specifier]; ok && n.complete {
+		// The dependencies of an existing file don't change so only the link
+		// to its module version is added.
+		nodeExistenceCounter.WithLabelValues("skipped").Inc()
+		uids, err := existingFile(ctx, txn, specifier, n.uid, link)
+		return uids, false, err
+	} else if item.Uid != "" {
 		uid = item.Uid
+	} else if ok {
+		// The node was created as the dependency of another file, its own
+		// dependencies are still missing.
+		nodeExistenceCounter.WithLabelValues("mutated").Inc()
+		uid = n.uid
 	} else {
 		// The item doesn't exist in DynamoDB or in DGraph yet
+		nodeExistenceCounter.WithLabelValues("mutated").Inc()
 		blanks[specifier] = uid
 	}
 
+	deps := make([]File, 0, len(depSpecifiers))
+	for _, d := range depSpecifiers {
+		// Uid is a projected attribute of the item in DDB. functionnaly, there
+		// is no difference between checking for `Uid == ""` than checking for
+		// `Specificer == ""`. In this case, checking for Uid is simply the
+		// closest to the semantics of "check if item is in graph."
+		if item := lookup(d); item.Uid != "" {
+			deps = append(deps, File{Uid: item.Uid})
+		} else if n, ok := nodes[d]; ok {
+			deps = append(deps, File{Uid: n.uid})
+		} else {
+			// keep track of blank UIDs used in the mutation, the new node
+			// gets its specifier so that it can be found before it's mutated
+			blanks[d] = fmt.Sprintf("_:%s", d)
+			deps = append(deps, File{Uid: blanks[d], Specifier: d, DType: []string{"File"}})
+		}
+	}
+
 	file := File{
 		Uid:       uid,
 		Specifier: specifier,
 		DependsOn: deps,
 		DType:     []string{"File"},
 	}
-	bytes, err := json.Marshal(file)
+	var set interface{} = file
+	if link.owns(specifier) {
+		// a ModuleVersion struct would also set the zero upload time
+		set = []interface{}{file, map[string]interface{}{
+			"uid":            link.uid,
+			"file_specifier": []File{{Uid: uid}},
+		}}
+	}
+	bytes, err := json.Marshal(set)
 	if err != nil {
-		log.Println(fmt.Errorf("failed to marshal file entry: %s", err))
+		return nil, false, fmt.Errorf("failed to marshal file entry %s: %s", specifier, err)
 	}
 
 	mut := api.Mutation{}
 	mut.SetJson = bytes
 	mutationsCounter.Add(1)
-	resp, err := txn.Mutate(ctx, &mut)
+	mctx, cancel := withTimeout(ctx, &mutationTimeout)
+	resp, err := txn.Mutate(mctx, &mut)
+	cancel()
 	if err != nil {
-		e := fmt.Errorf("failed to run mutation for file %s: %s", specifier, err)
-		log.Println(e)
-		return map[string]string{}, nil
+		return nil, false, fmt.Errorf("failed to run mutation for file %s: %w", specifier, err)
 	}
 
 	// the returned blanks in the Uids map only contain the right hand part of
 	// the blank that was used in the mutation (_:<specifier>). For all intents
 	// and purposes, the resp.Uids map is a specifier->uids map.
-	return resp.Uids, nil
+	for s, u := range resp.Uids {
+		found[s] = u
+	}
+	return found, true, nil
+}
+
+// existingFile links the existing file node to the module version, if it is one
+// of its files, and returns the uid of the node so that it gets cached
+func existingFile(ctx context.Context, txn Txn, specifier, uid string, link versionLink) (map[string]string, error) {
+	if link.owns(specifier) {
+		bytes, err := json.Marshal(map[string]interface{}{
+			"uid":            link.uid,
+			"file_specifier": []File{{Uid: uid}},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal version link: %s", err)
+		}
+
+		mutationsCounter.Add(1)
+		mctx, cancel := withTimeout(ctx, &mutationTimeout)
+		_, err = txn.Mutate(mctx, &api.Mutation{SetJson: bytes})
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to link file %s to its version: %w", specifier, err)
+		}
+	}
+	return map[string]string{specifier: uid}, nil
+}
+
+// lookupUID returns the uid of the File node of the specifier from its entry,
+// or from DGraph if the entry is missing or expired, in which case the entry is
+// written again. The uid is empty if there is no node for the specifier.
+func lookupUID(ctx context.Context, specifier string) (string, error) {
+	item, err := GetEntry(ctx, specifier)
+	if err != nil {
+		return "", fmt.Errorf("failed to get entry for %s: %s", specifier, err)
+	}
+	if item.Uid != "" {
+		return item.Uid, nil
+	}
+
+	exists, uid, err := NodeExists(ctx, specifier)
+	if err != nil || !exists {
+		return "", err
+	}
+	if err := PutEntry(ctx, Item{Specifier: specifier, Uid: uid}); err != nil {
+		slog.Warn("failed to put entry", "specifier", specifier, "uid", uid, "error", err)
+	}
+	return uid, nil
+}
+
+// graphFile is a File node looked up by its specifier
+type graphFile struct {
+	uid string
+	// complete is set once the dependencies of the file are inserted, a node
+	// created as the dependency of another file is a placeholder until then.
+	// The files without dependencies are never complete and are mutated again.
+	complete bool
+}
+
+// lookupFiles looks up the File nodes of the specifiers in a single query. The
+// specifiers without a node are absent from the returned map.
+func lookupFiles(ctx context.Context, specifiers []string) (map[string]graphFile, error) {
+	if len(specifiers) == 0 {
+		return nil, nil
+	}
+
+	var params, blocks strings.Builder
+	vars := make(map[string]string, len(specifiers))
+	for i, s := range specifiers {
+		if i > 0 {
+			params.WriteString(", ")
+		}
+		fmt.Fprintf(&params, "$s%d: string", i)
+		fmt.Fprintf(&blocks, `
+		s%d(func: eq(specifier, $s%d), first: 1) {
+			uid
+			depends_on(first: 1) {
+				uid
+			}
+		}`, i, i)
+		vars[fmt.Sprintf("$s%d", i)] = s
+	}
+	q := fmt.Sprintf("query q(%s) {%s\n\t}", params.String(), blocks.String())
+
+	var resp map[string][]File
+	if err := runQuery(ctx, q, vars, &resp); err != nil {
+		return nil, fmt.Errorf("failed to look up %d files: %s", len(specifiers), err)
+	}
+
+	nodes := make(map[string]graphFile)
+	for i, s := range specifiers {
+		if q := resp[fmt.Sprintf("s%d", i)]; len(q) > 0 && q[0].Uid != "" {
+			nodes[s] = graphFile{uid: q[0].Uid, complete: len(q[0].DependsOn) > 0}
+		}
+	}
+	return nodes, nil
+}
+
+// NodeExists reports whether there is a File node for the specifier in the
+// graph and returns its uid
+func NodeExists(ctx context.Context, specifier string) (bool, string, error) {
+	q := `query q($specifier: string) {
+		q(func: eq(specifier, $specifier), first: 1) {
+			uid
+		}
+	}`
+
+	var resp struct {
+		Q []File `json:"q"`
+	}
+	if err := runQuery(ctx, q, map[string]string{"$specifier": specifier}, &resp); err != nil {
+		return false, "", fmt.Errorf("failed to check if %s exists: %s", specifier, err)
+	}
+	if len(resp.Q) == 0 || resp.Q[0].Uid == "" {
+		return false, "", nil
+	}
+	return true, resp.Q[0].Uid, nil
+}
+
+// versionLink is the ModuleVersion node the files of a module version are
+// linked to with file_specifier edges
+type versionLink struct {
+	uid    string
+	prefix string
+}
+
+// owns reports whether the specifier is a file of the module version
+func (l versionLink) owns(specifier string) bool {
+	return l.uid != "" && strings.HasPrefix(specifier, l.prefix)
+}
+
+// canonicalSpecifier returns the canonical form of the specifier used as the
+// key of its node, or the specifier itself if it can't be parsed
+func canonicalSpecifier(specifier string) string {
+	canonical, err := deno.CanonicalSpecifier(specifier)
+	if err != nil {
+		slog.Warn("failed to canonicalise specifier", "specifier", specifier, "error", err)
+		return specifier
+	}
+	return canonical
+}
+
+// canonicalSpecifiers canonicalises the specifiers, dropping the duplicates
+// of specifiers that have the same canonical form
+func canonicalSpecifiers(specifiers []string) []string {
+	seen := make(map[string]bool, len(specifiers))
+	out := make([]string, 0, len(specifiers))
+	for _, s := range specifiers {
+		c := canonicalSpecifier(s)
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		out = append(out, c)
+	}
+	return out
 }
 
-func discard(ctx context.Context, txn *dgo.Txn) {
+func discard(ctx context.Context, txn Txn) {
 	select {
 	case <-ctx.Done():
-		log.Println("context is already cancelled, exiting early")
+		slog.Info("context is already cancelled, exiting early")
 		return
 	default:
 	}
 	err := txn.Discard(ctx)
 	if err != nil {
-		log.Println(fmt.Errorf("failed to discard txn: %s", err))
+		slog.Error("failed to discard txn", "error", err)
 	}
 }
 
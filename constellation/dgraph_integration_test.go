@@ -0,0 +1,127 @@
+//go:build integration
+// +build integration
+
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package constellation_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+	"github.com/wperron/depgraph/constellation"
+	"github.com/wperron/depgraph/deno"
+	"github.com/wperron/depgraph/internal/testutil"
+)
+
+// dgraphImage runs a zero and an alpha in the same container
+const dgraphImage = "dgraph/standalone:v20.11.3"
+
+func TestConstellationIntegration(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
+
+	c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        dgraphImage,
+			ExposedPorts: []string{"9080/tcp"},
+			WaitingFor:   wait.ForListeningPort("9080/tcp").WithStartupTimeout(2 * time.Minute),
+		},
+		Started: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to start dgraph: %s", err)
+	}
+	defer c.Terminate(context.Background())
+
+	host, err := c.Host(ctx)
+	if err != nil {
+		t.Fatalf("failed to get the dgraph host: %s", err)
+	}
+	port, err := c.MappedPort(ctx, "9080")
+	if err != nil {
+		t.Fatalf("failed to get the dgraph port: %s", err)
+	}
+
+	err = constellation.InitDGraph(ctx, constellation.DGraphConfig{
+		Addresses:  []string{fmt.Sprintf("%s:%s", host, port.Port())},
+		MaxRetries: 20,
+	})
+	if err != nil {
+		t.Fatalf("failed to connect to dgraph: %s", err)
+	}
+	if err := constellation.InitSchema(ctx); err != nil {
+		t.Fatalf("failed to initialize schema: %s", err)
+	}
+	defer constellation.UseEntryStore(testutil.NewMemoryDynamoDB())()
+
+	var mod deno.Module
+	raw := `{
+		"Name": "oak",
+		"Versions": {"v6.5.0": [{"path": "/mod.ts", "type": "file"}]},
+		"Metadata": {"name": "oak", "description": "A middleware framework", "star_count": 3000}
+	}`
+	if err := json.Unmarshal([]byte(raw), &mod); err != nil {
+		t.Fatalf("failed to unmarshal module: %s", err)
+	}
+
+	mods := make(chan deno.Module, 1)
+	mods <- mod
+	close(mods)
+	inserted, errs := constellation.InsertModules(ctx, mods)
+	go func() {
+		for err := range errs {
+			t.Errorf("unexpected error inserting modules: %s", err)
+		}
+	}()
+	for range inserted {
+	}
+
+	specifier := "https://deno.land/x/oak@v6.5.0/mod.ts"
+	dep := "https://deno.land/std@0.90.0/http/mod.ts"
+	infos := make(chan deno.DenoInfo, 1)
+	infos <- deno.DenoInfo{
+		Module:   specifier,
+		DepCount: 1,
+		Files: map[string]deno.FileEntry{
+			specifier: {Deps: []string{dep}},
+			dep:       {},
+		},
+		ModuleName:    "oak",
+		ModuleVersion: "v6.5.0",
+	}
+	close(infos)
+	done, errs := constellation.InsertFiles(ctx, infos)
+	for err := range errs {
+		t.Errorf("unexpected error inserting files: %s", err)
+	}
+	<-done
+
+	m, err := constellation.QueryModuleByName(ctx, "oak")
+	if err != nil {
+		t.Fatalf("failed to query module: %s", err)
+	}
+	if m == nil {
+		t.Fatal("expected oak to be in the graph")
+	}
+	if m.Name != "oak" || m.Stars != 3000 || m.Description != "A middleware framework" {
+		t.Errorf("unexpected module %+v", m)
+	}
+	if len(m.Version) != 1 || m.Version[0].ModuleVersion != "v6.5.0" {
+		t.Errorf("expected a single version v6.5.0, got %+v", m.Version)
+	}
+
+	for _, s := range []string{specifier, dep} {
+		exists, _, err := constellation.NodeExists(ctx, s)
+		if err != nil {
+			t.Fatalf("failed to check if %s exists: %s", s, err)
+		}
+		if !exists {
+			t.Errorf("expected %s to be in the graph", s)
+		}
+	}
+}
@@ -0,0 +1,1299 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package constellation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/dgo/v2"
+	"github.com/dgraph-io/dgo/v2/protos/api"
+	"github.com/wperron/depgraph/deno"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestProposeIndexes(t *testing.T) {
+	queries := []string{
+		`{ q(func: eq(specifier, "https://deno.land/std@0.83.0/fs/mod.ts")) { uid } }`,
+		`{ q(func: anyofterms(name, "http server"), orderdesc: stars) { name } }`,
+		`{ q(func: regexp(module_version, /^v1/)) { uid } }`,
+		`{ q(func: ge(stars, 10)) { uid } }`,
+		`{ q(func: has(depends_on)) { uid } }`,
+	}
+
+	expected := map[string][]string{
+		"specifier":      {"hash"},
+		"name":           {"term"},
+		"stars":          {"int"},
+		"module_version": {"trigram"},
+	}
+
+	actual := proposeIndexes(queries)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+func TestProposeIndexesExactSupersedesHash(t *testing.T) {
+	actual := proposeIndexes([]string{
+		`{ q(func: eq(name, "oak")) { uid } }`,
+		`{ q(func: has(name), orderasc: name) { uid } }`,
+	})
+
+	if !reflect.DeepEqual(actual["name"], []string{"exact"}) {
+		t.Errorf("expected name to only need the exact index, got %v", actual["name"])
+	}
+}
+
+func TestIndexSchema(t *testing.T) {
+	schema := indexSchema(map[string][]string{"specifier": {"hash"}})
+
+	if !strings.Contains(schema, "specifier: string @index(hash) @upsert .\n") {
+		t.Errorf("expected schema to index specifier with hash and keep @upsert, got:\n%s", schema)
+	}
+	for _, pred := range []string{"README", "owner", "tags", "license"} {
+		if strings.Contains(schema, pred+":") {
+			t.Errorf("expected %s to be left out to keep its indexes, got:\n%s", pred, schema)
+		}
+	}
+}
+
+// fixtureTxn returns the same JSON response to every query
+type fixtureTxn struct {
+	json  string
+	query string
+	vars  map[string]string
+}
+
+func (f *fixtureTxn) QueryWithVars(ctx context.Context, q string, vars map[string]string) (*api.Response, error) {
+	f.query = q
+	f.vars = vars
+	return &api.Response{Json: []byte(f.json)}, nil
+}
+
+func withFixture(t *testing.T, json string) *fixtureTxn {
+	f := &fixtureTxn{json: json}
+	orig := newQueryTxn
+	newQueryTxn = func() queryTxn { return f }
+	t.Cleanup(func() { newQueryTxn = orig })
+	return f
+}
+
+func TestQueryNeighbourhood(t *testing.T) {
+	f := withFixture(t, `{"q": [{
+		"uid": "0x1",
+		"specifier": "https://deno.land/x/oak/mod.ts",
+		"depends_on": [
+			{
+				"uid": "0x2",
+				"specifier": "https://deno.land/x/oak/deps.ts",
+				"depends_on": [{"uid": "0x4", "specifier": "https://deno.land/std/http/mod.ts"}]
+			},
+			{
+				"uid": "0x3",
+				"specifier": "https://deno.land/x/oak/router.ts",
+				"depends_on": [{"uid": "0x4", "specifier": "https://deno.land/std/http/mod.ts"}]
+			}
+		]
+	}]}`)
+
+	files, err := QueryNeighbourhood(context.Background(), "https://deno.land/x/oak/mod.ts", 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{"0x1", "0x2", "0x4", "0x3"}
+	if len(files) != len(expected) {
+		t.Fatalf("expected %d files, got %d", len(expected), len(files))
+	}
+	for i := range expected {
+		if files[i].Uid != expected[i] {
+			t.Errorf("expected element #%d to be %s, got %s", i, expected[i], files[i].Uid)
+		}
+	}
+
+	if len(files[0].DependsOn) != 2 || files[0].DependsOn[0].DependsOn != nil {
+		t.Errorf("expected the root to have 2 shallow dependencies, got %+v", files[0].DependsOn)
+	}
+	if !strings.Contains(f.query, "@recurse(depth: 3") {
+		t.Errorf("expected recurse depth to include the root, got query:\n%s", f.query)
+	}
+	if f.vars["$specifier"] != "https://deno.land/x/oak/mod.ts" {
+		t.Errorf("unexpected query variables: %v", f.vars)
+	}
+}
+
+func TestQueryTransitiveConsumers(t *testing.T) {
+	f := withFixture(t, `{"q": [
+		{"~file_specifier": [{"~version": [{"name": "oak"}]}]},
+		{"~file_specifier": [{"~version": [{"name": "abc"}]}]},
+		{"~file_specifier": [{"~version": [{"name": "oak"}]}]},
+		{"uid": "0x9"}
+	]}`)
+
+	names, err := QueryTransitiveConsumers(context.Background(), "https://deno.land/std@0.90.0/http/mod.ts", 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{"abc", "oak"}
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+	if !strings.Contains(f.query, "@recurse(depth: 3") {
+		t.Errorf("expected recurse depth to include the specifier, got query:\n%s", f.query)
+	}
+}
+
+func TestQueryDependents(t *testing.T) {
+	f := withFixture(t, `{"q": [{"~depends_on": [
+		{"uid": "0x2", "specifier": "https://deno.land/x/oak@v10.0.0/deps.ts"},
+		{"uid": "0x3", "specifier": "https://deno.land/x/abc@v1.0.0/mod.ts"},
+		{"uid": "0x2", "specifier": "https://deno.land/x/oak@v10.0.0/deps.ts"}
+	]}]}`)
+
+	files, err := QueryDependents(context.Background(), "https://deno.land/std@0.90.0/http/mod.ts")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(files) != 2 || files[0].Uid != "0x2" || files[1].Uid != "0x3" {
+		t.Errorf("unexpected dependents %+v", files)
+	}
+	if f.vars["$specifier"] != "https://deno.land/std@0.90.0/http/mod.ts" {
+		t.Errorf("unexpected vars %v", f.vars)
+	}
+}
+
+func TestQueryTransitiveDependents(t *testing.T) {
+	f := withFixture(t, `{"q": [
+		{"uid": "0x1", "specifier": "https://deno.land/std@0.90.0/http/mod.ts"},
+		{"uid": "0x3", "specifier": "https://deno.land/x/abc@v1.0.0/mod.ts"},
+		{"uid": "0x2", "specifier": "https://deno.land/x/oak@v10.0.0/deps.ts"}
+	]}`)
+
+	files, err := QueryTransitiveDependents(context.Background(), "https://deno.land/std@0.90.0/http/mod.ts", 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(files) != 2 {
+		t.Errorf("expected the specifier itself to be left out, got %+v", files)
+	}
+	if !strings.Contains(f.query, "@recurse(depth: 3") {
+		t.Errorf("expected recurse depth to include the specifier, got query:\n%s", f.query)
+	}
+
+	if _, err := QueryTransitiveDependents(context.Background(), "https://deno.land/std@0.90.0/http/mod.ts", 0); err == nil {
+		t.Error("expected an error for an invalid depth")
+	}
+}
+
+// mapEntryStore is an EntryStore mapping specifiers to uids
+type mapEntryStore map[string]string
+
+func (m mapEntryStore) PutEntry(ctx context.Context, item Item) error {
+	m[item.Specifier] = item.Uid
+	return nil
+}
+
+func (m mapEntryStore) GetEntry(ctx context.Context, specifier string) (Item, error) {
+	uid, ok := m[specifier]
+	if !ok {
+		return Item{}, nil
+	}
+	return Item{Specifier: specifier, Uid: uid}, nil
+}
+
+func TestFindShortestPath(t *testing.T) {
+	from := "https://deno.land/x/oak@v10.0.0/mod.ts"
+	to := "https://deno.land/std@0.90.0/path/mod.ts"
+	defer UseEntryStore(mapEntryStore{from: "0x1", to: "0x5"})()
+
+	f := withFixture(t, `{
+		"_path_": [{"uid": "0x1", "_weight_": 2, "depends_on": {"uid": "0x3", "depends_on": {"uid": "0x5"}}}],
+		"nodes": [
+			{"uid": "0x1", "specifier": "https://deno.land/x/oak@v10.0.0/mod.ts"},
+			{"uid": "0x3", "specifier": "https://deno.land/x/oak@v10.0.0/deps.ts"},
+			{"uid": "0x5", "specifier": "https://deno.land/std@0.90.0/path/mod.ts"}
+		]
+	}`)
+
+	path, err := FindShortestPath(context.Background(), from, to)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []string{from, "https://deno.land/x/oak@v10.0.0/deps.ts", to}
+	if len(path) != len(expected) {
+		t.Fatalf("expected %d files, got %+v", len(expected), path)
+	}
+	for i := range expected {
+		if path[i].Specifier != expected[i] {
+			t.Errorf("expected element #%d to be %s, got %s", i, expected[i], path[i].Specifier)
+		}
+	}
+	if !strings.Contains(f.query, "shortest(from: 0x1, to: 0x5)") {
+		t.Errorf("unexpected query:\n%s", f.query)
+	}
+
+	f.json = `{"nodes": []}`
+	if _, err := FindShortestPath(context.Background(), from, to); err != ErrNoPath {
+		t.Errorf("expected ErrNoPath, got %v", err)
+	}
+
+	_, err = FindShortestPath(context.Background(), from, "https://deno.land/x/nope/mod.ts")
+	if nf, ok := err.(ErrSpecifierNotFound); !ok || nf.Specifier != "https://deno.land/x/nope/mod.ts" {
+		t.Errorf("expected ErrSpecifierNotFound, got %v", err)
+	}
+}
+
+func TestFindShortestPathExpiredEntry(t *testing.T) {
+	from := "https://deno.land/x/oak@v10.0.0/mod.ts"
+	to := "https://deno.land/std@0.90.0/path/mod.ts"
+	// the entry of to has expired while its node is still in the graph
+	store := mapEntryStore{from: "0x1"}
+	defer UseEntryStore(store)()
+
+	withFixture(t, `{
+		"q": [{"uid": "0x5"}],
+		"_path_": [{"uid": "0x1", "_weight_": 1, "depends_on": {"uid": "0x5"}}],
+		"nodes": [
+			{"uid": "0x1", "specifier": "https://deno.land/x/oak@v10.0.0/mod.ts"},
+			{"uid": "0x5", "specifier": "https://deno.land/std@0.90.0/path/mod.ts"}
+		]
+	}`)
+
+	path, err := FindShortestPath(context.Background(), from, to)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(path) != 2 || path[1].Uid != "0x5" {
+		t.Errorf("expected a path to 0x5, got %+v", path)
+	}
+	if store[to] != "0x5" {
+		t.Errorf("expected the entry of %s to be written again, got %q", to, store[to])
+	}
+}
+
+func TestCountModulesCached(t *testing.T) {
+	f := withFixture(t, `{"q": [{"count": 42}]}`)
+	countCache.Delete("Module")
+	t.Cleanup(func() { countCache.Delete("Module") })
+
+	count, err := CountModules(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if count != 42 {
+		t.Errorf("expected 42 modules, got %d", count)
+	}
+
+	f.json = `{"q": [{"count": 43}]}`
+	if count, _ = CountModules(context.Background()); count != 42 {
+		t.Errorf("expected the cached count 42, got %d", count)
+	}
+}
+
+func TestPruneDeletedVersionsNothingToDelete(t *testing.T) {
+	withFixture(t, `{"q": [{
+		"uid": "0x1",
+		"version": [
+			{"uid": "0x2", "module_version": "v1.0.0"},
+			{"uid": "0x3", "module_version": "v1.1.0"}
+		]
+	}]}`)
+
+	deleted, err := PruneDeletedVersions(context.Background(), "oak", []string{"v1.0.0", "v1.1.0", "v2.0.0"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if deleted != 0 {
+		t.Errorf("expected no deleted versions, got %d", deleted)
+	}
+}
+
+func TestPruneDeletedVersions(t *testing.T) {
+	var mutations []*api.Mutation
+	fixture := `{"q": [{
+		"uid": "0x1",
+		"version": [
+			{"uid": "0x2", "module_version": "v1.0.0"},
+			{"uid": "0x3", "module_version": "v1.1.0"}
+		]
+	}]}`
+	defer UseTxn(func() Txn { return mutationTxn{&fixtureTxn{json: fixture}, &mutations} })()
+	moduleUIDCache.Store("oak", &Module{Uid: "0x1"})
+
+	deleted, err := PruneDeletedVersions(context.Background(), "oak", []string{"v1.0.0"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if deleted != 1 {
+		t.Errorf("expected 1 deleted version, got %d", deleted)
+	}
+	if _, ok := moduleUIDCache.Load("oak"); ok {
+		t.Error("expected the module to be evicted from the uid cache")
+	}
+
+	if len(mutations) != 1 {
+		t.Fatalf("expected 1 mutation, got %d", len(mutations))
+	}
+	expected := `[{"uid":"0x1","version":[{"uid":"0x3"}]},{"uid":"0x3"}]`
+	if got := string(mutations[0].DeleteJson); got != expected {
+		t.Errorf("expected delete %s, got %s", expected, got)
+	}
+}
+
+func TestPingDGraph(t *testing.T) {
+	f := withFixture(t, `{"q": []}`)
+
+	if err := PingDGraph(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(f.query, "first: 1") {
+		t.Errorf("expected the ping to read a single node, got %s", f.query)
+	}
+}
+
+func TestCheckSchemaCompatibilityMismatch(t *testing.T) {
+	withFixture(t, `{"q": [{"uid": "0x1", "schema_version": 3}]}`)
+
+	err := CheckSchemaCompatibility(context.Background(), 2)
+	mismatch, ok := err.(ErrSchemaVersionMismatch)
+	if !ok {
+		t.Fatalf("expected an ErrSchemaVersionMismatch, got %v", err)
+	}
+	if mismatch.Expected != 2 || mismatch.Actual != 3 {
+		t.Errorf("unexpected mismatch %+v", mismatch)
+	}
+
+	if err := CheckSchemaCompatibility(context.Background(), 3); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+// mutationTxn answers every query with a fixture and records the mutations
+type mutationTxn struct {
+	*fixtureTxn
+	mutations *[]*api.Mutation
+}
+
+func (m mutationTxn) Mutate(ctx context.Context, mu *api.Mutation) (*api.Response, error) {
+	*m.mutations = append(*m.mutations, mu)
+	return &api.Response{}, nil
+}
+
+func (m mutationTxn) Commit(ctx context.Context) error  { return nil }
+func (m mutationTxn) Discard(ctx context.Context) error { return nil }
+
+func TestInitSchemaMigrations(t *testing.T) {
+	cases := []struct {
+		name      string
+		fixture   string
+		applied   int
+		recordUid string
+		fails     bool
+	}{
+		{"new cluster", `{"q": []}`, len(migrations), "_:schema_version", false},
+		{"previous version", `{"q": [{"uid": "0x1", "schema_version": 1}]}`, SchemaVersion - 1, "0x1", false},
+		{"current version", fmt.Sprintf(`{"q": [{"uid": "0x1", "schema_version": %d}]}`, SchemaVersion), 0, "", false},
+		{"newer version", fmt.Sprintf(`{"q": [{"uid": "0x1", "schema_version": %d}]}`, SchemaVersion+1), 0, "", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var mutations []*api.Mutation
+			defer UseTxn(func() Txn { return mutationTxn{&fixtureTxn{json: c.fixture}, &mutations} })()
+
+			var applied []string
+			orig := alterSchema
+			alterSchema = func(ctx context.Context, schema string) error {
+				applied = append(applied, schema)
+				return nil
+			}
+			defer func() { alterSchema = orig }()
+
+			err := InitSchema(context.Background())
+			if (err != nil) != c.fails {
+				t.Fatalf("expected failure %t, got %v", c.fails, err)
+			}
+			if len(applied) != c.applied {
+				t.Errorf("expected %d migrations, got %d", c.applied, len(applied))
+			}
+
+			if c.recordUid == "" {
+				if len(mutations) != 0 {
+					t.Errorf("expected no mutation, got %d", len(mutations))
+				}
+				return
+			}
+			if len(mutations) != 1 {
+				t.Fatalf("expected 1 mutation, got %d", len(mutations))
+			}
+			var node struct {
+				Uid     string `json:"uid"`
+				Version int    `json:"schema_version"`
+			}
+			if err := json.Unmarshal(mutations[0].SetJson, &node); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if node.Uid != c.recordUid || node.Version != SchemaVersion {
+				t.Errorf("expected version %d recorded on %s, got %+v", SchemaVersion, c.recordUid, node)
+			}
+		})
+	}
+}
+
+func TestQueryModuleByNameNotFound(t *testing.T) {
+	f := withFixture(t, `{"q": []}`)
+
+	m, err := QueryModuleByName(context.Background(), "oak")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if m != nil {
+		t.Errorf("expected no module, got %+v", m)
+	}
+	if f.vars["$name"] != "oak" {
+		t.Errorf("expected $name to be oak, got %s", f.vars["$name"])
+	}
+}
+
+func TestTopModulesByStars(t *testing.T) {
+	f := withFixture(t, `{"q": [
+		{"uid": "0x1", "name": "oak", "stars": 3000},
+		{"uid": "0x2", "name": "abc", "stars": 12}
+	]}`)
+
+	mods, err := TopModulesByStars(context.Background(), 2, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(mods) != 2 || mods[0].Name != "oak" || mods[1].Stars != 12 {
+		t.Errorf("unexpected modules: %+v", mods)
+	}
+	if f.vars["$first"] != "2" || f.vars["$offset"] != "10" {
+		t.Errorf("unexpected query variables: %v", f.vars)
+	}
+	if !strings.Contains(f.query, "orderdesc: stars") {
+		t.Errorf("expected the query to order by stars, got:\n%s", f.query)
+	}
+}
+
+func TestQueryLeafFiles(t *testing.T) {
+	f := withFixture(t, `{"q": [
+		{"uid": "0x1", "specifier": "https://deno.land/std@0.90.0/fmt/colors.ts"}
+	]}`)
+
+	files, err := QueryLeafFiles(context.Background(), 50)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(files) != 1 || files[0].Specifier != "https://deno.land/std@0.90.0/fmt/colors.ts" {
+		t.Errorf("unexpected files: %+v", files)
+	}
+	if f.vars["$first"] != "50" {
+		t.Errorf("unexpected query variables: %v", f.vars)
+	}
+	if !strings.Contains(f.query, "not has(depends_on)") {
+		t.Errorf("expected the query to filter out files with dependencies, got:\n%s", f.query)
+	}
+}
+
+func TestDiffVersionFiles(t *testing.T) {
+	withFixture(t, `{"q": [{"version": [
+		{"module_version": "v1.0.0", "file_specifier": [
+			{"specifier": "https://deno.land/x/oak@v1.0.0/mod.ts", "depends_on": [
+				{"specifier": "https://deno.land/x/oak@v1.0.0/router.ts"}
+			]},
+			{"specifier": "https://deno.land/x/oak@v1.0.0/router.ts"},
+			{"specifier": "https://deno.land/x/oak@v1.0.0/util.ts"}
+		]},
+		{"module_version": "v2.0.0", "file_specifier": [
+			{"specifier": "https://deno.land/x/oak@v2.0.0/mod.ts", "depends_on": [
+				{"specifier": "https://deno.land/x/oak@v2.0.0/router.ts"}
+			]},
+			{"specifier": "https://deno.land/x/oak@v2.0.0/router.ts", "depends_on": [
+				{"specifier": "https://deno.land/std@0.90.0/http/mod.ts"}
+			]},
+			{"specifier": "https://deno.land/x/oak@v2.0.0/body.ts"}
+		]}
+	]}]}`)
+
+	diff, err := DiffVersionFiles(context.Background(), "oak", "v1.0.0", "v2.0.0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := FileDiff{
+		AddedFiles:    []string{"body.ts"},
+		RemovedFiles:  []string{"util.ts"},
+		ModifiedFiles: []string{"router.ts"},
+	}
+	if fmt.Sprint(diff) != fmt.Sprint(expected) {
+		t.Errorf("expected %+v, got %+v", expected, diff)
+	}
+
+	if _, err := DiffVersionFiles(context.Background(), "oak", "v1.0.0", "v3.0.0"); err == nil {
+		t.Error("expected an error for an unknown version")
+	}
+}
+
+func TestModuleMutationUploadedAt(t *testing.T) {
+	uploadedAt := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	var mod deno.Module
+	if err := json.Unmarshal([]byte(`{"Name": "oak", "Versions": {"v6.5.0": [], "v7.0.0": []}, "UploadedAt": {"v7.0.0": "2021-01-01T00:00:00Z"}}`), &mod); err != nil {
+		t.Fatalf("failed to unmarshal module: %s", err)
+	}
+
+	for _, v := range moduleMutation(mod, nil).Version {
+		bs, _ := json.Marshal(v)
+		switch v.ModuleVersion {
+		case "v6.5.0":
+			// the upload time isn't known, it isn't written
+			if v.UploadedAt != nil || strings.Contains(string(bs), "module_version_uploaded_at") {
+				t.Errorf("expected no upload time for v6.5.0, got %s", bs)
+			}
+		case "v7.0.0":
+			if v.UploadedAt == nil || !v.UploadedAt.Equal(uploadedAt) {
+				t.Errorf("expected v7.0.0 to be uploaded at %s, got %s", uploadedAt, bs)
+			}
+		}
+	}
+}
+
+func TestInsertModulesUpsert(t *testing.T) {
+	var mod deno.Module
+	if err := json.Unmarshal([]byte(`{"Name": "oak", "Versions": {"v6.5.0": [], "v7.0.0": []}}`), &mod); err != nil {
+		t.Fatalf("failed to unmarshal module: %s", err)
+	}
+	mod.Metadata = &deno.ModuleMetadata{Description: "A middleware framework", StarCount: 10}
+
+	var mutations []*api.Mutation
+	f := &fixtureTxn{json: `{"q": []}`}
+	defer UseTxn(func() Txn { return mutationTxn{f, &mutations} })()
+	inserted := func() Module {
+		var m Module
+		if err := json.Unmarshal(mutations[len(mutations)-1].SetJson, &m); err != nil {
+			t.Fatalf("failed to unmarshal mutation: %s", err)
+		}
+		return m
+	}
+
+	// first insert, the module isn't in the graph yet
+	insertModule(t, mod)
+	if len(mutations) != 1 {
+		t.Fatalf("expected a mutation for the new module, got %d", len(mutations))
+	}
+	if m := inserted(); m.Uid != "_:oak" || m.Stars != 10 {
+		t.Errorf("expected a new module with 10 stars, got uid %s and %d stars", m.Uid, m.Stars)
+	}
+
+	// second insert with updated stars, the existing nodes are reused
+	f.json = `{"q": [{"uid": "0x1", "name": "oak", "stars": 10, "version": [{"uid": "0x2", "module_version": "v6.5.0"}]}]}`
+	mod.Metadata.StarCount = 25
+	insertModule(t, mod)
+	if len(mutations) != 2 {
+		t.Fatalf("expected a mutation for the updated module, got %d", len(mutations))
+	}
+	m := inserted()
+	if m.Uid != "0x1" {
+		t.Errorf("expected the existing uid 0x1, got %s", m.Uid)
+	}
+	if m.Stars != 25 || m.Description != "A middleware framework" {
+		t.Errorf("expected 25 stars and the description to be updated, got %d and %q", m.Stars, m.Description)
+	}
+
+	uids := make(map[string]string)
+	for _, v := range m.Version {
+		uids[v.ModuleVersion] = v.Uid
+	}
+	expected := map[string]string{"v6.5.0": "0x2", "v7.0.0": "_:oak@v7.0.0"}
+	if !reflect.DeepEqual(uids, expected) {
+		t.Errorf("expected version uids %v, got %v", expected, uids)
+	}
+	for _, v := range m.Version {
+		if v.LastIndexedAt.IsZero() {
+			t.Errorf("expected %s to have a last indexed time", v.ModuleVersion)
+		}
+	}
+}
+
+func TestModuleVersionAge(t *testing.T) {
+	f := withFixture(t, `{"q": [
+		{"uid": "0x2", "module_version": "v1.0.0", "module": [{"name": "oak"}]},
+		{"uid": "0x3", "module_version": "v2.0.0", "module": [{"name": "oak"}]},
+		{"uid": "0x5", "module_version": "v0.1.0", "module": [{"name": "abc"}]}
+	]}`)
+
+	mods, err := ModuleVersionAge(context.Background(), 30*24*time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(mods) != 2 || mods[0].Name != "oak" || len(mods[0].Version) != 2 || mods[1].Name != "abc" {
+		t.Errorf("unexpected modules: %+v", mods)
+	}
+
+	before, err := time.Parse(time.RFC3339, f.vars["$before"])
+	if err != nil {
+		t.Fatalf("expected $before to be an RFC3339 time, got %q", f.vars["$before"])
+	}
+	if d := time.Since(before); d < 30*24*time.Hour || d > 31*24*time.Hour {
+		t.Errorf("expected $before to be 30 days ago, got %s", before)
+	}
+}
+
+// abortingTxn aborts the first `aborts` commits made by any transaction
+type abortingTxn struct {
+	*fixtureTxn
+	aborts  *int
+	commits *int
+}
+
+func (a abortingTxn) Mutate(ctx context.Context, mu *api.Mutation) (*api.Response, error) {
+	return &api.Response{}, nil
+}
+
+func (a abortingTxn) Commit(ctx context.Context) error {
+	*a.commits++
+	if *a.aborts > 0 {
+		*a.aborts--
+		return dgo.ErrAborted
+	}
+	return nil
+}
+
+func (a abortingTxn) Discard(ctx context.Context) error { return nil }
+
+func TestRunTxnRetriesAborted(t *testing.T) {
+	cases := []struct {
+		aborts  int
+		commits int
+		fails   bool
+	}{
+		{aborts: 0, commits: 1},
+		{aborts: 2, commits: 3},
+		{aborts: 4, commits: 4, fails: true},
+	}
+
+	for _, c := range cases {
+		aborts, commits := c.aborts, 0
+		restore := UseTxn(func() Txn { return abortingTxn{fixtureTxn: &fixtureTxn{}, aborts: &aborts, commits: &commits} })
+
+		applied := 0
+		err := runTxn(context.Background(), func(txn Txn) error {
+			applied++
+			_, err := txn.Mutate(context.Background(), &api.Mutation{})
+			return err
+		})
+		restore()
+
+		if (err != nil) != c.fails {
+			t.Errorf("%d aborts: expected failure %t, got %v", c.aborts, c.fails, err)
+		}
+		if commits != c.commits || applied != c.commits {
+			t.Errorf("%d aborts: expected %d commits, got %d commits and %d applied", c.aborts, c.commits, commits, applied)
+		}
+	}
+}
+
+func TestInsertFilesBatchedFlushInterval(t *testing.T) {
+	defer func(d time.Duration) { batchFlushInterval = d }(batchFlushInterval)
+	batchFlushInterval = 50 * time.Millisecond
+
+	aborts, commits := 0, 0
+	f := withFixture(t, `{}`)
+	defer UseTxn(func() Txn { return abortingTxn{fixtureTxn: f, aborts: &aborts, commits: &commits} })()
+	defer UseEntryStore(mapEntryStore{})()
+
+	mods := make(chan deno.DenoInfo)
+	done, errs := InsertFilesBatched(context.Background(), mods, 100)
+	go func() {
+		for err := range errs {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}()
+
+	// a steady trickle of modules never fills the batch
+	deadline := time.Now().Add(4 * batchFlushInterval)
+	for i := 0; time.Now().Before(deadline); i++ {
+		mod := fmt.Sprintf("https://deno.land/x/mod%d@v1.0.0/mod.ts", i)
+		mods <- deno.DenoInfo{Module: mod, Files: map[string]deno.FileEntry{mod: {}}}
+		time.Sleep(batchFlushInterval / 5)
+	}
+	close(mods)
+	<-done
+
+	if commits < 3 {
+		t.Errorf("expected a commit every %s, got %d commits", batchFlushInterval, commits)
+	}
+}
+
+// moduleGraphTxn keeps Module nodes by name and creates a new node for every
+// blank uid
+type moduleGraphTxn struct {
+	mu    *sync.Mutex
+	nodes map[string][]string
+}
+
+func (g moduleGraphTxn) QueryWithVars(ctx context.Context, q string, vars map[string]string) (*api.Response, error) {
+	g.mu.Lock()
+	var found []Module
+	for _, uid := range g.nodes[vars["$name"]] {
+		found = append(found, Module{Uid: uid, Name: vars["$name"]})
+	}
+	g.mu.Unlock()
+
+	// leave room for a concurrent insert to read the same snapshot
+	time.Sleep(10 * time.Millisecond)
+
+	b, _ := json.Marshal(map[string][]Module{"q": found})
+	return &api.Response{Json: b}, nil
+}
+
+func (g moduleGraphTxn) Mutate(ctx context.Context, mu *api.Mutation) (*api.Response, error) {
+	var m Module
+	if err := json.Unmarshal(mu.SetJson, &m); err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if strings.HasPrefix(m.Uid, "_:") {
+		g.nodes[m.Name] = append(g.nodes[m.Name], fmt.Sprintf("0x%x", len(g.nodes[m.Name])+1))
+	}
+	return &api.Response{}, nil
+}
+
+func (g moduleGraphTxn) Commit(ctx context.Context) error  { return nil }
+func (g moduleGraphTxn) Discard(ctx context.Context) error { return nil }
+
+func TestInsertModulesConcurrentSameModule(t *testing.T) {
+	g := moduleGraphTxn{mu: &sync.Mutex{}, nodes: make(map[string][]string)}
+	defer UseTxn(func() Txn { return g })()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mods := make(chan deno.Module, 1)
+			mods <- deno.Module{Name: "oak"}
+			close(mods)
+
+			out, errs := InsertModules(context.Background(), mods)
+			go func() {
+				for err := range errs {
+					t.Errorf("unexpected error: %s", err)
+				}
+			}()
+			for range out {
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(g.nodes["oak"]); n != 1 {
+		t.Errorf("expected a single oak node, got %d", n)
+	}
+}
+
+func TestLockModule(t *testing.T) {
+	unlock := lockModule("oak")
+	locked, released := make(chan struct{}), make(chan struct{})
+	go func() {
+		unlock := lockModule("oak")
+		close(locked)
+		unlock()
+		close(released)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("expected the second lock to wait for the first one")
+	case <-time.After(10 * time.Millisecond):
+	}
+	unlock()
+	<-released
+
+	moduleLocksMu.Lock()
+	n := len(moduleLocks)
+	moduleLocksMu.Unlock()
+	if n != 0 {
+		t.Errorf("expected the released locks to be removed, got %d", n)
+	}
+}
+
+func TestWaitForDGraph(t *testing.T) {
+	orig := connectRetryInterval
+	connectRetryInterval = time.Millisecond
+	defer func() { connectRetryInterval = orig }()
+
+	calls := 0
+	err := waitForDGraph(context.Background(), 5, func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return fmt.Errorf("connection refused")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 attempts, got %d", calls)
+	}
+
+	calls = 0
+	err = waitForDGraph(context.Background(), 2, func(ctx context.Context) error {
+		calls++
+		return fmt.Errorf("connection refused")
+	})
+	if err == nil {
+		t.Error("expected an error once the retries are exhausted")
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 attempts, got %d", calls)
+	}
+}
+
+func TestDialOptionMissingCertificate(t *testing.T) {
+	_, err := dialOption(DGraphConfig{
+		TLSCertFile: "testdata/does-not-exist.crt",
+		TLSKeyFile:  "testdata/does-not-exist.key",
+	})
+	if err == nil {
+		t.Error("expected an error for a missing certificate")
+	}
+}
+
+func TestTLSFromEnv(t *testing.T) {
+	for v, encrypted := range map[string]bool{"": false, "false": false, "yes": false, "true": true, "1": true} {
+		t.Setenv("DGRAPH_TLS", v)
+		cfg, err := tlsConfig(DGraphConfig{})
+		if err != nil {
+			t.Fatalf("DGRAPH_TLS=%q: unexpected error: %s", v, err)
+		}
+		if (cfg != nil) != encrypted {
+			t.Errorf("DGRAPH_TLS=%q: expected encrypted to be %t, got %t", v, encrypted, cfg != nil)
+		}
+	}
+
+	// the CA is still loaded without a client certificate
+	t.Setenv("DGRAPH_TLS", "true")
+	if _, err := tlsConfig(DGraphConfig{CAFile: "testdata/does-not-exist.crt"}); err == nil {
+		t.Error("expected an error for a missing CA certificate")
+	}
+}
+
+func TestAlphaAddress(t *testing.T) {
+	t.Setenv("DGRAPH_ALPHA", "")
+	if addr := AlphaAddress(""); addr != DefaultAlphaAddress {
+		t.Errorf("expected %s, got %s", DefaultAlphaAddress, addr)
+	}
+
+	t.Setenv("DGRAPH_ALPHA", "alpha-1:9080")
+	if addr := AlphaAddress(""); addr != "alpha-1:9080" {
+		t.Errorf("expected alpha-1:9080, got %s", addr)
+	}
+	if addr := AlphaAddress("alpha-2:9080"); addr != "alpha-2:9080" {
+		t.Errorf("expected alpha-2:9080, got %s", addr)
+	}
+}
+
+// uidTxn assigns a uid to every blank node of the mutations and counts them
+type uidTxn struct {
+	mu        *sync.Mutex
+	mutations *[]Module
+}
+
+func (g uidTxn) QueryWithVars(ctx context.Context, q string, vars map[string]string) (*api.Response, error) {
+	return &api.Response{Json: []byte(`{"q": []}`)}, nil
+}
+
+func (g uidTxn) Mutate(ctx context.Context, mu *api.Mutation) (*api.Response, error) {
+	var m Module
+	if err := json.Unmarshal(mu.SetJson, &m); err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	*g.mutations = append(*g.mutations, m)
+	uids := make(map[string]string)
+	if strings.HasPrefix(m.Uid, "_:") {
+		uids[strings.TrimPrefix(m.Uid, "_:")] = "0x1"
+	}
+	for _, v := range m.Version {
+		if strings.HasPrefix(v.Uid, "_:") {
+			uids[strings.TrimPrefix(v.Uid, "_:")] = fmt.Sprintf("0x%x", len(uids)+100)
+		}
+	}
+	return &api.Response{Uids: uids}, nil
+}
+
+func (g uidTxn) Commit(ctx context.Context) error  { return nil }
+func (g uidTxn) Discard(ctx context.Context) error { return nil }
+
+func TestInsertModulesUIDCache(t *testing.T) {
+	var mutations []Module
+	defer UseTxn(func() Txn { return uidTxn{mu: &sync.Mutex{}, mutations: &mutations} })()
+
+	insert := func(versions ...string) {
+		var mod deno.Module
+		raw := `{"Name": "cached", "Versions": {}}`
+		if err := json.Unmarshal([]byte(raw), &mod); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		for _, v := range versions {
+			mod.Versions[v] = nil
+		}
+		mods := make(chan deno.Module, 1)
+		mods <- mod
+		close(mods)
+		out, errs := InsertModules(context.Background(), mods)
+		go func() {
+			for err := range errs {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}()
+		for range out {
+		}
+	}
+
+	insert("v1.0.0")
+	insert("v1.0.0")
+	if len(mutations) != 1 {
+		t.Fatalf("expected the cached module to be skipped, got %d mutations", len(mutations))
+	}
+
+	insert("v1.0.0", "v1.1.0")
+	if len(mutations) != 2 {
+		t.Fatalf("expected a mutation for the new version, got %d mutations", len(mutations))
+	}
+	m := mutations[1]
+	if m.Uid != "0x1" {
+		t.Errorf("expected the cached module uid 0x1, got %s", m.Uid)
+	}
+	for _, v := range m.Version {
+		if v.ModuleVersion == "v1.0.0" && strings.HasPrefix(v.Uid, "_:") {
+			t.Errorf("expected the cached uid of v1.0.0 to be reused, got %s", v.Uid)
+		}
+	}
+
+	// an incremental crawl only sends the new versions
+	insert("v1.2.0")
+	insert("v1.0.0", "v1.1.0", "v1.2.0")
+	if len(mutations) != 3 {
+		t.Fatalf("expected the versions of the previous mutations to stay cached, got %d mutations", len(mutations))
+	}
+}
+
+func TestTriggerBackup(t *testing.T) {
+	var destination string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Variables map[string]string `json:"variables"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		destination = req.Variables["destination"]
+		if destination == "nfs://denied" {
+			w.Write([]byte(`{"errors": [{"message": "permission denied"}]}`))
+			return
+		}
+		w.Write([]byte(`{"data": {"backup": {"response": {"code": "Success"}}}}`))
+	}))
+	defer srv.Close()
+
+	orig := adminURL
+	adminURL = srv.URL
+	defer func() { adminURL = orig }()
+
+	if err := TriggerBackup(context.Background(), "s3://backups/andromeda"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if destination != "s3://backups/andromeda" {
+		t.Errorf("expected the destination to be sent, got %q", destination)
+	}
+
+	if err := TriggerBackup(context.Background(), "nfs://denied"); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("expected the GraphQL error to be returned, got %v", err)
+	}
+}
+
+// nquadsTxn assigns a uid to every blank node of the NQuads mutations and
+// keeps them
+type nquadsTxn struct {
+	mu        *sync.Mutex
+	mutations *[]string
+}
+
+var blankLabel = regexp.MustCompile(`_:(\w+)`)
+
+func (n nquadsTxn) QueryWithVars(ctx context.Context, q string, vars map[string]string) (*api.Response, error) {
+	return &api.Response{Json: []byte(`{"q": []}`)}, nil
+}
+
+func (n nquadsTxn) Mutate(ctx context.Context, mu *api.Mutation) (*api.Response, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	*n.mutations = append(*n.mutations, string(mu.SetNquads))
+	uids := make(map[string]string)
+	for _, m := range blankLabel.FindAllStringSubmatch(string(mu.SetNquads), -1) {
+		if _, ok := uids[m[1]]; !ok {
+			uids[m[1]] = fmt.Sprintf("0x%x", len(*n.mutations)*10000+len(uids))
+		}
+	}
+	return &api.Response{Uids: uids}, nil
+}
+
+func (n nquadsTxn) Commit(ctx context.Context) error  { return nil }
+func (n nquadsTxn) Discard(ctx context.Context) error { return nil }
+
+// batchStore is a mapEntryStore keeping the items of every bulk write
+type batchStore struct {
+	mapEntryStore
+	batches *[][]Item
+}
+
+func (b batchStore) BulkPutEntries(ctx context.Context, items []Item) error {
+	*b.batches = append(*b.batches, items)
+	for _, item := range items {
+		b.mapEntryStore[item.Specifier] = item.Uid
+	}
+	return nil
+}
+
+func TestBulkInsertFiles(t *testing.T) {
+	var mutations []string
+	defer UseTxn(func() Txn { return nquadsTxn{mu: &sync.Mutex{}, mutations: &mutations} })()
+	var batches [][]Item
+	store := batchStore{mapEntryStore: mapEntryStore{}, batches: &batches}
+	defer UseEntryStore(store)()
+
+	// the 500 files without dependencies fill the first batch
+	first := deno.DenoInfo{Files: make(map[string]deno.FileEntry)}
+	for i := 0; i < bulkBatchSize/2; i++ {
+		first.Files[fmt.Sprintf("https://deno.land/x/mod@v1.0.0/f%d.ts", i)] = deno.FileEntry{}
+	}
+	dep := "https://deno.land/x/mod@v1.0.0/f0.ts"
+	second := deno.DenoInfo{Files: map[string]deno.FileEntry{
+		"https://cdn.deno.land/mod/versions/v1.0.0/raw/main.ts": {Deps: []string{
+			dep,
+			"https://cdn.deno.land/mod/versions/v1.0.0/raw/f0.ts",
+		}},
+	}}
+
+	if err := BulkInsertFiles(context.Background(), []deno.DenoInfo{first, second}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(mutations) != 2 {
+		t.Fatalf("expected 2 batches, got %d", len(mutations))
+	}
+	if n := len(strings.Split(mutations[0], "\n")); n != bulkBatchSize {
+		t.Errorf("expected %d quads in the first batch, got %d", bulkBatchSize, n)
+	}
+	if len(batches) != 2 || len(batches[0]) != bulkBatchSize/2 || len(batches[1]) != 1 {
+		t.Fatalf("expected the entries to be put after each batch, got %d batches", len(batches))
+	}
+
+	root := "https://deno.land/x/mod@v1.0.0/main.ts"
+	if batches[1][0].Specifier != root {
+		t.Errorf("expected the canonical specifier %s, got %s", root, batches[1][0].Specifier)
+	}
+	// the dependency was created by the first batch and is referenced by
+	// its uid, both of its forms are the same edge
+	edge := fmt.Sprintf("<depends_on> <%s> .", store.mapEntryStore[dep])
+	if strings.Count(mutations[1], "<depends_on>") != 1 || !strings.Contains(mutations[1], edge) {
+		t.Errorf("expected a single edge to the existing uid of %s, got:\n%s", dep, mutations[1])
+	}
+	if strings.Contains(mutations[1], "cdn.deno.land") {
+		t.Errorf("expected no cdn.deno.land specifier, got:\n%s", mutations[1])
+	}
+}
+
+// failingTxn fails every mutation
+type failingTxn struct {
+	*fixtureTxn
+	err error
+}
+
+func (f failingTxn) Mutate(ctx context.Context, mu *api.Mutation) (*api.Response, error) {
+	return nil, f.err
+}
+
+func (f failingTxn) Commit(ctx context.Context) error  { return nil }
+func (f failingTxn) Discard(ctx context.Context) error { return nil }
+
+func TestInsertFilesMutationFailure(t *testing.T) {
+	f := withFixture(t, `{}`)
+	defer UseTxn(func() Txn { return failingTxn{fixtureTxn: f, err: fmt.Errorf("connection reset")} })()
+	defer UseEntryStore(mapEntryStore{})()
+
+	var hookErr error
+	orig := insertHook
+	SetInsertHook(func(ctx context.Context, info deno.DenoInfo, err error) { hookErr = err })
+	defer SetInsertHook(orig)
+
+	mod := "https://deno.land/x/oak@v6.5.0/mod.ts"
+	mods := make(chan deno.DenoInfo, 1)
+	mods <- deno.DenoInfo{Module: mod, Files: map[string]deno.FileEntry{mod: {}}}
+	close(mods)
+
+	done, errs := InsertFiles(context.Background(), mods)
+	var failures int
+	for range errs {
+		failures++
+	}
+	<-done
+
+	if failures != 1 {
+		t.Errorf("expected the failed mutation to be reported, got %d errors", failures)
+	}
+	if hookErr == nil || !strings.Contains(hookErr.Error(), "connection reset") {
+		t.Errorf("expected the hook to get the mutation error, got %v", hookErr)
+	}
+}
+
+// queryFailingTxn fails every query
+type queryFailingTxn struct {
+	err error
+}
+
+func (q queryFailingTxn) QueryWithVars(ctx context.Context, _ string, _ map[string]string) (*api.Response, error) {
+	return nil, q.err
+}
+
+func TestMutateFileLookupFailure(t *testing.T) {
+	orig := newQueryTxn
+	newQueryTxn = func() queryTxn { return queryFailingTxn{err: fmt.Errorf("connection reset")} }
+	defer func() { newQueryTxn = orig }()
+	defer UseEntryStore(mapEntryStore{})()
+
+	var mutations []*api.Mutation
+	txn := mutationTxn{fixtureTxn: &fixtureTxn{}, mutations: &mutations}
+	mod := "https://deno.land/x/oak@v6.5.0/mod.ts"
+	entry := deno.FileEntry{Deps: []string{"https://deno.land/std/http/mod.ts"}}
+	if _, _, err := mutateFile(context.Background(), txn, mod, entry, versionLink{}, nil); err == nil || !strings.Contains(err.Error(), "connection reset") {
+		t.Errorf("expected the lookup error, got %v", err)
+	}
+	if len(mutations) != 0 {
+		t.Errorf("expected no mutation after a failed lookup, got %d", len(mutations))
+	}
+}
+
+func TestMutateFileWithoutUpsert(t *testing.T) {
+	orig := newQueryTxn
+	newQueryTxn = func() queryTxn { return queryFailingTxn{err: fmt.Errorf("connection reset")} }
+	defer func() { newQueryTxn = orig }()
+	defer UseEntryStore(mapEntryStore{})()
+	SetFileUpsert(false)
+	defer SetFileUpsert(true)
+
+	var mutations []*api.Mutation
+	txn := mutationTxn{fixtureTxn: &fixtureTxn{}, mutations: &mutations}
+	mod := "https://deno.land/x/oak@v6.5.0/mod.ts"
+	if _, _, err := mutateFile(context.Background(), txn, mod, deno.FileEntry{}, versionLink{}, nil); err != nil {
+		t.Fatalf("expected the file to be mutated without a lookup, got %s", err)
+	}
+	if len(mutations) != 1 {
+		t.Errorf("expected 1 mutation, got %d", len(mutations))
+	}
+}
+
+// conflictingTxn aborts the first `aborts` mutations made by any transaction
+type conflictingTxn struct {
+	*fixtureTxn
+	aborts    *int
+	mutations *int
+}
+
+func (c conflictingTxn) Mutate(ctx context.Context, mu *api.Mutation) (*api.Response, error) {
+	*c.mutations++
+	if *c.aborts > 0 {
+		*c.aborts--
+		return nil, status.Error(codes.Aborted, "transaction has been aborted")
+	}
+	return &api.Response{}, nil
+}
+
+func (c conflictingTxn) Commit(ctx context.Context) error  { return nil }
+func (c conflictingTxn) Discard(ctx context.Context) error { return nil }
+
+func TestInsertFilesRetriesAbortedMutation(t *testing.T) {
+	f := withFixture(t, `{}`)
+	aborts, mutations := 1, 0
+	defer UseTxn(func() Txn { return conflictingTxn{fixtureTxn: f, aborts: &aborts, mutations: &mutations} })()
+	defer UseEntryStore(mapEntryStore{})()
+
+	mod := "https://deno.land/x/oak@v6.5.0/mod.ts"
+	if err := insertInfo(context.Background(), deno.DenoInfo{Module: mod, Files: map[string]deno.FileEntry{mod: {}}}); err != nil {
+		t.Fatalf("expected the aborted mutation to be retried, got %s", err)
+	}
+	if mutations != 2 {
+		t.Errorf("expected the mutation to be applied again, got %d mutations", mutations)
+	}
+
+	if !isAborted(fmt.Errorf("failed to mutate %s: %w", mod, dgo.ErrAborted)) {
+		t.Error("expected a wrapped ErrAborted to be a conflict")
+	}
+}
+
+// insertModule runs InsertModules with the single module
+func insertModule(t *testing.T, mod deno.Module) {
+	mods := make(chan deno.Module, 1)
+	mods <- mod
+	close(mods)
+	out, errs := InsertModules(context.Background(), mods)
+	go func() {
+		for err := range errs {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}()
+	for range out {
+	}
+}
+
+func TestInsertModulesUpdatedStars(t *testing.T) {
+	var mutations []Module
+	defer UseTxn(func() Txn { return uidTxn{mu: &sync.Mutex{}, mutations: &mutations} })()
+
+	var mod deno.Module
+	if err := json.Unmarshal([]byte(`{"Name": "starred", "Versions": {"v1.0.0": []}}`), &mod); err != nil {
+		t.Fatalf("failed to unmarshal module: %s", err)
+	}
+	mod.Metadata = &deno.ModuleMetadata{Description: "A starred module", StarCount: 10}
+
+	insertModule(t, mod)
+	insertModule(t, mod)
+	if len(mutations) != 1 {
+		t.Fatalf("expected the unchanged module to be skipped, got %d mutations", len(mutations))
+	}
+
+	mod.Metadata.StarCount = 25
+	insertModule(t, mod)
+	if len(mutations) != 2 {
+		t.Fatalf("expected the updated stars to be mutated, got %d mutations", len(mutations))
+	}
+	m := mutations[1]
+	if m.Uid != "0x1" || m.Stars != 25 {
+		t.Errorf("expected 25 stars on the cached module uid 0x1, got %d stars on %s", m.Stars, m.Uid)
+	}
+	if len(m.Version) != 1 || m.Version[0].LastIndexedAt.IsZero() {
+		t.Errorf("expected the last indexed time of the version to be refreshed, got %+v", m.Version)
+	}
+
+	mod.Metadata.Description = "A module with a new description"
+	insertModule(t, mod)
+	if len(mutations) != 3 || mutations[2].Description != mod.Metadata.Description {
+		t.Errorf("expected the updated description to be mutated, got %d mutations", len(mutations))
+	}
+}
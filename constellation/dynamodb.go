@@ -3,40 +3,109 @@ package constellation
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/wperron/depgraph/internal/awsutil"
 )
 
 var svc *dynamodb.Client
 
+// DefaultTable is the specifier->uid table used when none is configured
+const DefaultTable = "andromeda-test-4"
+
+// table is the name of the specifier->uid table, set by InitDynamoDB
+var table = DefaultTable
+
 const (
-	table = "andromeda-test-4"
+	// maximum number of write requests allowed in a single BatchWriteItem call
+	batchWriteSize = 25
+
+	// maximum number of actions allowed in a single TransactWriteItems call
+	transactWriteSize = 25
+
+	// maximum number of keys allowed in a single BatchGetItem call
+	batchGetSize = 100
+
+	// backoff between the retries of the unprocessed items of a batch read or
+	// write
+	batchMinBackoff = 50 * time.Millisecond
+	batchMaxBackoff = 5 * time.Second
+	batchAttempts   = 8
+
+	// number of concurrent GetItem calls made by BatchGetEntry for the stores
+	// without batch reads
+	depsLookupConcurrency = 10
 )
 
 type Item struct {
 	Specifier string `json:"specifier"`
 	Uid       string `json:"uid,omitempty"`
+	// TTL is the unix time at which DynamoDB deletes the item, 0 never expires
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+// DefaultEntryTTL is how long the entries are kept unless SetEntryTTL is called
+const DefaultEntryTTL = 30 * 24 * time.Hour
+
+// entryTTL is the time.Duration after which the new entries expire
+var entryTTL = int64(DefaultEntryTTL)
+
+// SetEntryTTL sets how long the new entries are kept in the table before
+// DynamoDB deletes them, 0 keeps them forever. The expiry drops the stale
+// uids left in the table after DGraph is reset.
+func SetEntryTTL(d time.Duration) {
+	atomic.StoreInt64(&entryTTL, int64(d))
+}
+
+// withTTL sets the expiry of the item unless it already has one
+func withTTL(item Item) Item {
+	if ttl := time.Duration(atomic.LoadInt64(&entryTTL)); item.TTL == 0 && ttl > 0 {
+		item.TTL = time.Now().Add(ttl).Unix()
+	}
+	return item
+}
+
+// expired reports whether the item is past its TTL. DynamoDB deletes expired
+// items in the background and keeps returning them until then.
+func (i Item) expired() bool {
+	return i.TTL != 0 && i.TTL <= time.Now().Unix()
+}
+
+// attributes returns the DynamoDB attributes of the item
+func (i Item) attributes() map[string]types.AttributeValue {
+	av := map[string]types.AttributeValue{
+		"specifier": &types.AttributeValueMemberS{
+			Value: i.Specifier,
+		},
+		"uid": &types.AttributeValueMemberS{
+			Value: i.Uid,
+		},
+	}
+	if i.TTL != 0 {
+		av["ttl"] = &types.AttributeValueMemberN{
+			Value: strconv.FormatInt(i.TTL, 10),
+		}
+	}
+	return av
 }
 
 var putItemCounter prometheus.Counter
-var putConditionFailedCounter prometheus.Counter
+var putAlreadyExistsCounter prometheus.Counter
 var getItemCounter prometheus.Counter
 var ddbLatency prometheus.Histogram
 
 func init() {
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("us-east-1"))
-	if err != nil {
-		log.Fatal(err)
-	}
-	svc = dynamodb.NewFromConfig(cfg)
-
 	putItemCounter = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "dynamodb_put_item_total",
@@ -44,10 +113,10 @@ func init() {
 		},
 	)
 
-	putConditionFailedCounter = prometheus.NewCounter(
+	putAlreadyExistsCounter = prometheus.NewCounter(
 		prometheus.CounterOpts{
-			Name: "dynamodb_put_item_condition_failed_total",
-			Help: "A counter for transactions in DGraph",
+			Name: "dynamodb_put_item_already_exists_total",
+			Help: "Number of DynamoDB PutItem requests skipped because the specifier already exists",
 		},
 	)
 
@@ -65,44 +134,424 @@ func init() {
 		},
 	)
 
-	prometheus.MustRegister(putItemCounter, putConditionFailedCounter, getItemCounter, ddbLatency)
+	prometheus.MustRegister(putItemCounter, putAlreadyExistsCounter, getItemCounter, ddbLatency)
 }
 
-func PutEntry(item Item) error {
+// InitDynamoDB creates the DynamoDB client from the AWS config, targeting the
+// region if it isn't empty, and reads and writes the entries to tableName, or
+// DefaultTable if it is empty. The credentials are wrapped in a cache that
+// refreshes them before they expire, which is needed for long running crawls
+// using temporary IAM role credentials.
+func InitDynamoDB(cfg aws.Config, region, tableName string) {
+	table = DefaultTable
+	if tableName != "" {
+		table = tableName
+	}
+	if region != "" {
+		cfg = cfg.Copy()
+		cfg.Region = region
+	}
+	svc = dynamodb.NewFromConfig(awsutil.WithCredentialsCache(cfg))
+	slog.Info("using dynamodb table", "table", table, "region", cfg.Region)
+}
+
+// PingDynamoDB describes the table to check that DynamoDB is reachable
+func PingDynamoDB(ctx context.Context) error {
+	if svc == nil {
+		return fmt.Errorf("dynamodb client is not initialized")
+	}
+	if _, err := svc.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(table)}); err != nil {
+		return fmt.Errorf("failed to describe table %s: %s", table, err)
+	}
+	return nil
+}
+
+// EntryStore reads and writes the specifier->uid items
+type EntryStore interface {
+	// PutEntry writes the item unless the specifier already exists
+	PutEntry(ctx context.Context, item Item) error
+	// GetEntry returns the item of the specifier, or an empty Item if the
+	// specifier doesn't exist
+	GetEntry(ctx context.Context, specifier string) (Item, error)
+}
+
+// entries is the store used by PutEntry, GetEntry, BatchGetEntry and
+// GetEntriesConcurrent
+var entries EntryStore = dynamoStore{}
+
+// UseEntryStore replaces the DynamoDB table with the store, e.g. an in-memory
+// store in tests. The returned function restores the previous store.
+func UseEntryStore(store EntryStore) (restore func()) {
+	orig := entries
+	entries = store
+	return func() { entries = orig }
+}
+
+// bulkEntryStore is implemented by the stores that can write many items at
+// once
+type bulkEntryStore interface {
+	BulkPutEntries(ctx context.Context, items []Item) error
+}
+
+// batchGetEntryStore is implemented by the stores that can read many items at
+// once
+type batchGetEntryStore interface {
+	BatchGetEntry(ctx context.Context, specifiers []string) (map[string]Item, error)
+}
+
+// PutEntry writes the item to the table unless the specifier already exists.
+// The item expires after the duration set with SetEntryTTL.
+func PutEntry(ctx context.Context, item Item) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	start := time.Now()
 	putItemCounter.Add(1)
-	_, err := svc.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		Item: map[string]types.AttributeValue{
-			"specifier": &types.AttributeValueMemberS{
-				Value: item.Specifier,
-			},
-			"uid": &types.AttributeValueMemberS{
-				Value: item.Uid,
-			},
+	err := entries.PutEntry(ctx, withTTL(item))
+	ddbLatency.Observe(time.Since(start).Seconds())
+	return err
+}
+
+// dynamoStore is the EntryStore backed by the DynamoDB table
+type dynamoStore struct{}
+
+// putCondition only lets a put through if the specifier isn't in the table yet.
+// Expired items count as missing until DynamoDB deletes them.
+const putCondition = "attribute_not_exists(specifier) OR (attribute_exists(#ttl) AND #ttl <= :now)"
+
+// putConditionValues returns the expression attribute values of putCondition
+func putConditionValues() map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		":now": &types.AttributeValueMemberN{
+			Value: strconv.FormatInt(time.Now().Unix(), 10),
 		},
+	}
+}
+
+func (dynamoStore) PutEntry(ctx context.Context, item Item) error {
+	_, err := svc.PutItem(ctx, &dynamodb.PutItemInput{
+		Item:                   item.attributes(),
 		ReturnConsumedCapacity: "TOTAL",
-		ConditionExpression:    aws.String("attribute_not_exists(specifier)"),
-		TableName:              aws.String(table),
+		ConditionExpression:    aws.String(putCondition),
+		ExpressionAttributeNames: map[string]string{
+			"#ttl": "ttl",
+		},
+		ExpressionAttributeValues: putConditionValues(),
+		TableName:                 aws.String(table),
 	})
 
 	if err != nil {
 		if _, ok := err.(*types.ConditionalCheckFailedException); ok {
-			putConditionFailedCounter.Inc()
-			log.Printf("%s already exists, nothing to do.", item.Specifier)
-			ddbLatency.Observe(time.Since(start).Seconds())
+			putAlreadyExistsCounter.Inc()
+			slog.Info("already exists, nothing to do", "specifier", item.Specifier, "uid", item.Uid)
 			return nil
 		}
-		ddbLatency.Observe(time.Since(start).Seconds())
 		return err
 	}
+	return nil
+}
+
+// BulkPutEntries writes all the items to the table using transactions of at
+// most 25 conditional puts, which expire like the ones written by PutEntry. As
+// with PutEntry, the specifiers already in the table are left untouched. Stores
+// without bulk writes get one PutEntry per item.
+func BulkPutEntries(ctx context.Context, items []Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	bulk, ok := entries.(bulkEntryStore)
+	if !ok {
+		for _, item := range items {
+			if err := PutEntry(ctx, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	expiring := make([]Item, 0, len(items))
+	for _, item := range items {
+		expiring = append(expiring, withTTL(item))
+	}
+
+	start := time.Now()
+	putItemCounter.Add(float64(len(items)))
+	err := bulk.BulkPutEntries(ctx, expiring)
 	ddbLatency.Observe(time.Since(start).Seconds())
+	return err
+}
+
+func (dynamoStore) BulkPutEntries(ctx context.Context, items []Item) error {
+	// a transaction can't hold two puts of the same specifier
+	items = uniqueItems(items)
+	for i := 0; i < len(items); i += transactWriteSize {
+		end := i + transactWriteSize
+		if end > len(items) {
+			end = len(items)
+		}
+
+		if err := transactPut(ctx, items[i:end]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func GetEntry(specifier string) (Item, error) {
+// transactPut writes the items with conditional puts in a single transaction.
+// When the transaction is canceled because some of the specifiers are already
+// in the table, these items are dropped and the others are sent again.
+func transactPut(ctx context.Context, items []Item) error {
+	backoff := batchMinBackoff
+	for attempt := 1; len(items) > 0; attempt++ {
+		values := putConditionValues()
+		reqs := make([]types.TransactWriteItem, 0, len(items))
+		for _, item := range items {
+			reqs = append(reqs, types.TransactWriteItem{
+				Put: &types.Put{
+					Item:                item.attributes(),
+					ConditionExpression: aws.String(putCondition),
+					ExpressionAttributeNames: map[string]string{
+						"#ttl": "ttl",
+					},
+					ExpressionAttributeValues: values,
+					TableName:                 aws.String(table),
+				},
+			})
+		}
+
+		_, err := svc.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: reqs,
+		})
+		if err == nil {
+			return nil
+		}
+		var canceled *types.TransactionCanceledException
+		if !errors.As(err, &canceled) {
+			return fmt.Errorf("failed to write items: %s", err)
+		}
+		if attempt == batchAttempts {
+			return fmt.Errorf("%d items still unwritten after %d attempts: %s", len(items), attempt, err)
+		}
+
+		var existing int
+		items, existing = withoutExisting(items, canceled.CancellationReasons)
+		if existing > 0 {
+			putAlreadyExistsCounter.Add(float64(existing))
+			continue
+		}
+
+		// canceled by a conflicting transaction or throttled
+		slog.Debug("retrying canceled transaction", "count", len(items), "error", err, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = nextBackoff(backoff)
+	}
+	return nil
+}
+
+// withoutExisting drops the items whose put was canceled because the specifier
+// is already in the table and returns how many were dropped. The reasons are in
+// the same order as the items of the transaction.
+func withoutExisting(items []Item, reasons []types.CancellationReason) ([]Item, int) {
+	if len(reasons) != len(items) {
+		return items, 0
+	}
+
+	kept := make([]Item, 0, len(items))
+	for i, item := range items {
+		if aws.ToString(reasons[i].Code) == "ConditionalCheckFailed" {
+			continue
+		}
+		kept = append(kept, item)
+	}
+	return kept, len(items) - len(kept)
+}
+
+// uniqueItems returns the items without the repeated specifiers, keeping the
+// first item of each
+func uniqueItems(items []Item) []Item {
+	seen := make(map[string]bool, len(items))
+	unique := make([]Item, 0, len(items))
+	for _, item := range items {
+		if seen[item.Specifier] {
+			continue
+		}
+		seen[item.Specifier] = true
+		unique = append(unique, item)
+	}
+	return unique
+}
+
+// GetEntry reads the item of the specifier from the table. The returned Item is
+// empty if the specifier isn't in the table.
+func GetEntry(ctx context.Context, specifier string) (Item, error) {
 	start := time.Now()
+	item, err := getItem(ctx, specifier)
+	ddbLatency.Observe(time.Since(start).Seconds())
+	return item, err
+}
+
+func getItem(ctx context.Context, specifier string) (Item, error) {
+	if err := ctx.Err(); err != nil {
+		return Item{}, err
+	}
+
 	getItemCounter.Add(1)
-	out, err := svc.GetItem(context.TODO(), &dynamodb.GetItemInput{
+	return entries.GetEntry(ctx, specifier)
+}
+
+// GetEntriesConcurrent reads the items of the specifiers with at most
+// concurrency GetItem calls in flight. The specifiers that aren't in the table
+// map to an empty Item.
+func GetEntriesConcurrent(ctx context.Context, specifiers []string, concurrency int) (map[string]Item, error) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	start := time.Now()
+	defer func() { ddbLatency.Observe(time.Since(start).Seconds()) }()
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	items := make(map[string]Item, len(specifiers))
+	sem := make(chan struct{}, concurrency)
+	for _, spec := range specifiers {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(spec string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			item, err := getItem(ctx, spec)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("failed to get specifier %s: %s", spec, err)
+				}
+				return
+			}
+			items[spec] = item
+		}(spec)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return items, nil
+}
+
+// BatchGetEntry reads the items of the specifiers using batched get requests
+// of at most 100 keys. The specifiers that aren't in the table map to an empty
+// Item. Stores without batch reads fall back to GetEntriesConcurrent.
+func BatchGetEntry(ctx context.Context, specifiers []string) (map[string]Item, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(specifiers) == 0 {
+		return map[string]Item{}, nil
+	}
+
+	batch, ok := entries.(batchGetEntryStore)
+	if !ok {
+		return GetEntriesConcurrent(ctx, specifiers, depsLookupConcurrency)
+	}
+
+	start := time.Now()
+	getItemCounter.Add(float64(len(specifiers)))
+	items, err := batch.BatchGetEntry(ctx, specifiers)
+	ddbLatency.Observe(time.Since(start).Seconds())
+	return items, err
+}
+
+func (dynamoStore) BatchGetEntry(ctx context.Context, specifiers []string) (map[string]Item, error) {
+	items := make(map[string]Item, len(specifiers))
+	keys := make([]map[string]types.AttributeValue, 0, len(specifiers))
+	for _, spec := range specifiers {
+		// BatchGetItem rejects duplicate keys
+		if _, ok := items[spec]; ok {
+			continue
+		}
+		items[spec] = Item{}
+		keys = append(keys, map[string]types.AttributeValue{
+			"specifier": &types.AttributeValueMemberS{
+				Value: spec,
+			},
+		})
+	}
+
+	for i := 0; i < len(keys); i += batchGetSize {
+		end := i + batchGetSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err := batchGet(ctx, keys[i:end], items); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// batchGet reads the keys from the table into items, resending any unprocessed
+// keys with an exponential backoff until DynamoDB has returned all of them.
+func batchGet(ctx context.Context, keys []map[string]types.AttributeValue, items map[string]Item) error {
+	pending := map[string]types.KeysAndAttributes{table: {
+		Keys:           keys,
+		ConsistentRead: aws.Bool(true),
+	}}
+	backoff := batchMinBackoff
+	for attempt := 1; ; attempt++ {
+		out, err := svc.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+			RequestItems: pending,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to batch get items: %s", err)
+		}
+		for _, av := range out.Responses[table] {
+			var item Item
+			if err := attributevalue.UnmarshalMap(av, &item); err != nil {
+				return err
+			}
+			if !item.expired() {
+				items[item.Specifier] = item
+			}
+		}
+
+		pending = out.UnprocessedKeys
+		if len(pending[table].Keys) == 0 {
+			return nil
+		}
+		if attempt == batchAttempts {
+			return fmt.Errorf("%d keys still unprocessed after %d attempts", len(pending[table].Keys), attempt)
+		}
+
+		slog.Debug("retrying unprocessed keys", "count", len(pending[table].Keys), "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+func (dynamoStore) GetEntry(ctx context.Context, specifier string) (Item, error) {
+	out, err := svc.GetItem(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(table),
 		Key: map[string]types.AttributeValue{
 			"specifier": &types.AttributeValueMemberS{
@@ -111,18 +560,160 @@ func GetEntry(specifier string) (Item, error) {
 		},
 		ConsistentRead: aws.Bool(true),
 	})
-
 	if err != nil {
-		ddbLatency.Observe(time.Since(start).Seconds())
 		return Item{}, err
 	}
 
 	var item Item
 	if err := attributevalue.UnmarshalMap(out.Item, &item); err != nil {
-		ddbLatency.Observe(time.Since(start).Seconds())
 		return Item{}, err
 	}
-
-	ddbLatency.Observe(time.Since(start).Seconds())
+	if item.expired() {
+		return Item{}, nil
+	}
 	return item, nil
 }
+
+// DefaultIndexedVersionsTable is the table of the indexed versions used when
+// none is configured
+const DefaultIndexedVersionsTable = "indexed_versions"
+
+// DynamoDBVersionChecker is a deno.VersionChecker backed by a table of the
+// indexed versions
+type DynamoDBVersionChecker struct {
+	// Table is the name of the table, DefaultIndexedVersionsTable if empty
+	Table string
+}
+
+func (c DynamoDBVersionChecker) table() string {
+	if c.Table == "" {
+		return DefaultIndexedVersionsTable
+	}
+	return c.Table
+}
+
+func versionKey(module, version string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"module_version": &types.AttributeValueMemberS{
+			Value: fmt.Sprintf("%s@%s", module, version),
+		},
+	}
+}
+
+// IsIndexed reports whether the version is in the table
+func (c DynamoDBVersionChecker) IsIndexed(module, version string) (bool, error) {
+	getItemCounter.Add(1)
+	out, err := svc.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(c.table()),
+		Key:       versionKey(module, version),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to check if %s@%s is indexed: %s", module, version, err)
+	}
+	return len(out.Item) > 0, nil
+}
+
+// MarkIndexed adds the version to the table
+func (c DynamoDBVersionChecker) MarkIndexed(ctx context.Context, module, version string) error {
+	putItemCounter.Add(1)
+	if _, err := svc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(c.table()),
+		Item:      versionKey(module, version),
+	}); err != nil {
+		return fmt.Errorf("failed to mark %s@%s as indexed: %s", module, version, err)
+	}
+	return nil
+}
+
+// Clear deletes every version from the table, they are all crawled again by
+// the next crawl
+func (c DynamoDBVersionChecker) Clear(ctx context.Context) error {
+	return clearTable(ctx, c.table(), "module_version")
+}
+
+// ClearEntries scans the whole table and deletes every item it contains using
+// batched delete requests.
+func ClearEntries(ctx context.Context) error {
+	return clearTable(ctx, table, "specifier")
+}
+
+// clearTable deletes every item of the table whose hash key is key
+func clearTable(ctx context.Context, name, key string) error {
+	var startKey map[string]types.AttributeValue
+	for {
+		out, err := svc.Scan(ctx, &dynamodb.ScanInput{
+			TableName:            aws.String(name),
+			ProjectionExpression: aws.String(key),
+			ExclusiveStartKey:    startKey,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to scan table %s: %s", name, err)
+		}
+
+		for i := 0; i < len(out.Items); i += batchWriteSize {
+			end := i + batchWriteSize
+			if end > len(out.Items) {
+				end = len(out.Items)
+			}
+
+			reqs := make([]types.WriteRequest, 0, end-i)
+			for _, item := range out.Items[i:end] {
+				reqs = append(reqs, types.WriteRequest{
+					DeleteRequest: &types.DeleteRequest{
+						Key: map[string]types.AttributeValue{
+							key: item[key],
+						},
+					},
+				})
+			}
+
+			if err := batchWrite(ctx, name, reqs); err != nil {
+				return err
+			}
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		startKey = out.LastEvaluatedKey
+	}
+}
+
+// batchWrite sends the write requests to the table, resending any unprocessed
+// items with an exponential backoff until DynamoDB has accepted all of them.
+func batchWrite(ctx context.Context, name string, reqs []types.WriteRequest) error {
+	pending := map[string][]types.WriteRequest{name: reqs}
+	backoff := batchMinBackoff
+	for attempt := 1; ; attempt++ {
+		out, err := svc.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: pending,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to batch write items: %s", err)
+		}
+		pending = out.UnprocessedItems
+		if len(pending[name]) == 0 {
+			return nil
+		}
+		if attempt == batchAttempts {
+			return fmt.Errorf("%d items still unprocessed after %d attempts", len(pending[name]), attempt)
+		}
+
+		slog.Debug("retrying unprocessed items", "count", len(pending[name]), "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// nextBackoff doubles the backoff, capped at batchMaxBackoff
+func nextBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d > batchMaxBackoff {
+		return batchMaxBackoff
+	}
+	return d
+}
@@ -0,0 +1,285 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package constellation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestEntriesCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := PutEntry(ctx, Item{Specifier: "https://deno.land/std/fs/mod.ts", Uid: "0x1"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected PutEntry to return context.Canceled, got %v", err)
+	}
+
+	if err := BulkPutEntries(ctx, []Item{{Specifier: "https://deno.land/std/fs/mod.ts", Uid: "0x1"}}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected BulkPutEntries to return context.Canceled, got %v", err)
+	}
+
+	if _, err := GetEntry(ctx, "https://deno.land/std/fs/mod.ts"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected GetEntry to return context.Canceled, got %v", err)
+	}
+
+	if _, err := BatchGetEntry(ctx, []string{"https://deno.land/std/fs/mod.ts"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected BatchGetEntry to return context.Canceled, got %v", err)
+	}
+
+	if _, err := GetEntriesConcurrent(ctx, []string{"https://deno.land/std/fs/mod.ts", "https://deno.land/std/path/mod.ts"}, 2); err == nil {
+		t.Errorf("expected GetEntriesConcurrent to fail with a cancelled context")
+	}
+}
+
+// bulkMapStore is a mapEntryStore counting its bulk reads and writes
+type bulkMapStore struct {
+	mapEntryStore
+	calls *int
+}
+
+func (b bulkMapStore) BulkPutEntries(ctx context.Context, items []Item) error {
+	*b.calls++
+	for _, item := range items {
+		b.mapEntryStore[item.Specifier] = item.Uid
+	}
+	return nil
+}
+
+func (b bulkMapStore) BatchGetEntry(ctx context.Context, specifiers []string) (map[string]Item, error) {
+	*b.calls++
+	items := make(map[string]Item, len(specifiers))
+	for _, spec := range specifiers {
+		items[spec], _ = b.GetEntry(ctx, spec)
+	}
+	return items, nil
+}
+
+func TestBulkPutEntries(t *testing.T) {
+	items := []Item{
+		{Specifier: "https://deno.land/std/fs/mod.ts", Uid: "0x1"},
+		{Specifier: "https://deno.land/std/path/mod.ts", Uid: "0x2"},
+	}
+
+	calls := 0
+	bulk := bulkMapStore{mapEntryStore: mapEntryStore{}, calls: &calls}
+	restore := UseEntryStore(bulk)
+	if err := BulkPutEntries(context.Background(), items); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	restore()
+	if calls != 1 || len(bulk.mapEntryStore) != 2 {
+		t.Errorf("expected a single bulk write of 2 items, got %d calls and %d items", calls, len(bulk.mapEntryStore))
+	}
+
+	store := mapEntryStore{}
+	defer UseEntryStore(store)()
+	if err := BulkPutEntries(context.Background(), items); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(store) != 2 {
+		t.Errorf("expected the items to be put one by one, got %d items", len(store))
+	}
+}
+
+// recordingStore is an EntryStore keeping the last item put
+type recordingStore struct {
+	last *Item
+}
+
+func (r recordingStore) PutEntry(ctx context.Context, item Item) error {
+	*r.last = item
+	return nil
+}
+
+func (r recordingStore) GetEntry(ctx context.Context, specifier string) (Item, error) {
+	return Item{}, nil
+}
+
+func TestEntryTTL(t *testing.T) {
+	var last Item
+	defer UseEntryStore(recordingStore{last: &last})()
+	defer SetEntryTTL(DefaultEntryTTL)
+
+	before := time.Now().Add(DefaultEntryTTL).Unix()
+	if err := PutEntry(context.Background(), Item{Specifier: "https://deno.land/std/fs/mod.ts", Uid: "0x1"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if last.TTL < before || last.TTL > time.Now().Add(DefaultEntryTTL).Unix() {
+		t.Errorf("expected the entry to expire in %s, got ttl %d", DefaultEntryTTL, last.TTL)
+	}
+	if last.expired() {
+		t.Errorf("expected the new entry not to be expired")
+	}
+
+	SetEntryTTL(0)
+	if err := PutEntry(context.Background(), Item{Specifier: "https://deno.land/std/fs/mod.ts", Uid: "0x1"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if last.TTL != 0 {
+		t.Errorf("expected no ttl when the expiry is disabled, got %d", last.TTL)
+	}
+
+	if !(Item{TTL: time.Now().Add(-time.Hour).Unix()}).expired() {
+		t.Errorf("expected an item past its ttl to be expired")
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	if d := nextBackoff(batchMinBackoff); d != 2*batchMinBackoff {
+		t.Errorf("expected the backoff to double, got %s", d)
+	}
+	if d := nextBackoff(4 * time.Second); d != batchMaxBackoff {
+		t.Errorf("expected the backoff to be capped at %s, got %s", batchMaxBackoff, d)
+	}
+}
+
+func TestWithoutExisting(t *testing.T) {
+	items := []Item{
+		{Specifier: "https://deno.land/std/fs/mod.ts", Uid: "0x1"},
+		{Specifier: "https://deno.land/std/path/mod.ts", Uid: "0x2"},
+		{Specifier: "https://deno.land/std/io/mod.ts", Uid: "0x3"},
+	}
+	reasons := []types.CancellationReason{
+		{Code: aws.String("None")},
+		{Code: aws.String("ConditionalCheckFailed")},
+		{Code: aws.String("TransactionConflict")},
+	}
+
+	kept, existing := withoutExisting(items, reasons)
+	if existing != 1 {
+		t.Errorf("expected 1 existing item, got %d", existing)
+	}
+	if len(kept) != 2 || kept[0].Uid != "0x1" || kept[1].Uid != "0x3" {
+		t.Errorf("expected the items 0x1 and 0x3 to be kept, got %v", kept)
+	}
+
+	// reasons that don't line up with the items can't be trusted
+	if kept, existing := withoutExisting(items, reasons[:1]); existing != 0 || len(kept) != 3 {
+		t.Errorf("expected all the items to be kept, got %v", kept)
+	}
+}
+
+func TestUniqueItems(t *testing.T) {
+	items := uniqueItems([]Item{
+		{Specifier: "https://deno.land/std/fs/mod.ts", Uid: "0x1"},
+		{Specifier: "https://deno.land/std/fs/mod.ts", Uid: "0x2"},
+		{Specifier: "https://deno.land/std/path/mod.ts", Uid: "0x3"},
+	})
+	if len(items) != 2 || items[0].Uid != "0x1" || items[1].Uid != "0x3" {
+		t.Errorf("expected the first item of each specifier, got %v", items)
+	}
+}
+
+func TestBatchGetEntry(t *testing.T) {
+	specifiers := []string{"https://deno.land/std/fs/mod.ts", "https://deno.land/std/path/mod.ts"}
+
+	calls := 0
+	restore := UseEntryStore(bulkMapStore{mapEntryStore: mapEntryStore{specifiers[0]: "0x1"}, calls: &calls})
+	items, err := BatchGetEntry(context.Background(), specifiers)
+	restore()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if calls != 1 || items[specifiers[0]].Uid != "0x1" || items[specifiers[1]].Uid != "" {
+		t.Errorf("expected a single batch read, got %d calls and %+v", calls, items)
+	}
+
+	defer UseEntryStore(mapEntryStore{specifiers[1]: "0x2"})()
+	items, err = BatchGetEntry(context.Background(), specifiers)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(items) != 2 || items[specifiers[1]].Uid != "0x2" {
+		t.Errorf("expected the fallback to read every specifier, got %+v", items)
+	}
+}
+
+// fakeDynamoDB serves the GetItem and PutItem calls of the DynamoDB API from
+// the items keyed by their module_version attribute
+func fakeDynamoDB(t *testing.T, items map[string]bool) (tables *[]string) {
+	tables = &[]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			TableName string
+			Key       map[string]map[string]string
+			Item      map[string]map[string]string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("invalid request: %s", err)
+		}
+		*tables = append(*tables, req.TableName)
+
+		body := `{}`
+		switch r.Header.Get("X-Amz-Target") {
+		case "DynamoDB_20120810.GetItem":
+			if key := req.Key["module_version"]["S"]; items[key] {
+				body = fmt.Sprintf(`{"Item": {"module_version": {"S": %q}}}`, key)
+			}
+		case "DynamoDB_20120810.PutItem":
+			items[req.Item["module_version"]["S"]] = true
+		}
+		// the client checks the responses against their checksum
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		w.Header().Set("X-Amz-Crc32", strconv.FormatUint(uint64(crc32.ChecksumIEEE([]byte(body))), 10))
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(srv.Close)
+
+	orig := svc
+	svc = dynamodb.NewFromConfig(aws.Config{
+		Region: "us-east-1",
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		}),
+		EndpointResolver: aws.EndpointResolverFunc(func(service, region string) (aws.Endpoint, error) {
+			return aws.Endpoint{URL: srv.URL}, nil
+		}),
+	})
+	t.Cleanup(func() { svc = orig })
+	return tables
+}
+
+func TestDynamoDBVersionChecker(t *testing.T) {
+	tables := fakeDynamoDB(t, map[string]bool{"oak@v1.0.0": true})
+
+	checker := DynamoDBVersionChecker{}
+	if indexed, err := checker.IsIndexed("oak", "v1.0.0"); err != nil || !indexed {
+		t.Errorf("expected oak@v1.0.0 to be indexed, got %t, %v", indexed, err)
+	}
+	if indexed, err := checker.IsIndexed("oak", "v2.0.0"); err != nil || indexed {
+		t.Errorf("expected oak@v2.0.0 not to be indexed, got %t, %v", indexed, err)
+	}
+
+	if err := checker.MarkIndexed(context.Background(), "oak", "v2.0.0"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if indexed, err := checker.IsIndexed("oak", "v2.0.0"); err != nil || !indexed {
+		t.Errorf("expected oak@v2.0.0 to be indexed once marked, got %t, %v", indexed, err)
+	}
+	for _, table := range *tables {
+		if table != DefaultIndexedVersionsTable {
+			t.Errorf("expected the default table %s, got %s", DefaultIndexedVersionsTable, table)
+		}
+	}
+
+	*tables = nil
+	checker = DynamoDBVersionChecker{Table: "indexed-prod"}
+	if _, err := checker.IsIndexed("oak", "v1.0.0"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(*tables) != 1 || (*tables)[0] != "indexed-prod" {
+		t.Errorf("expected the configured table, got %v", *tables)
+	}
+}
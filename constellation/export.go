@@ -0,0 +1,280 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package constellation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/wperron/depgraph/deno"
+)
+
+// entrypoint is the file used as the root of a module's graph
+const entrypoint = "mod.ts"
+
+type cytoscapeGraph struct {
+	Elements cytoscapeElements `json:"elements"`
+}
+
+type cytoscapeElements struct {
+	Nodes []cytoscapeElement `json:"nodes"`
+	Edges []cytoscapeElement `json:"edges"`
+}
+
+type cytoscapeElement struct {
+	Data cytoscapeData `json:"data"`
+}
+
+type cytoscapeData struct {
+	ID     string `json:"id"`
+	Source string `json:"source,omitempty"`
+	Target string `json:"target,omitempty"`
+}
+
+// ExportCytoscape writes the files within depth hops of the root specifier to w
+// in the Cytoscape.js elements JSON format. Nodes are identified by their
+// specifier and every depends_on edge goes from the dependent to the
+// dependency.
+func ExportCytoscape(ctx context.Context, root string, depth int, w io.Writer) error {
+	files, err := QueryNeighbourhood(ctx, root, depth)
+	if err != nil {
+		return err
+	}
+
+	return writeCytoscape(files, w)
+}
+
+// writeCytoscape writes the files and the depends_on edges between them to w in
+// the Cytoscape.js elements JSON format
+func writeCytoscape(files []File, w io.Writer) error {
+	g := cytoscapeGraph{
+		Elements: cytoscapeElements{
+			Nodes: make([]cytoscapeElement, 0, len(files)),
+			Edges: []cytoscapeElement{},
+		},
+	}
+
+	// files at the edge of the neighbourhood still list their dependencies,
+	// only the edges between exported nodes are kept
+	nodes := make(map[string]bool, len(files))
+	for _, f := range files {
+		nodes[f.Specifier] = true
+		g.Elements.Nodes = append(g.Elements.Nodes, cytoscapeElement{Data: cytoscapeData{ID: f.Specifier}})
+	}
+	for _, f := range files {
+		for _, d := range f.DependsOn {
+			if !nodes[d.Specifier] {
+				continue
+			}
+			g.Elements.Edges = append(g.Elements.Edges, cytoscapeElement{Data: cytoscapeData{
+				ID:     fmt.Sprintf("%s->%s", f.Specifier, d.Specifier),
+				Source: f.Specifier,
+				Target: d.Specifier,
+			}})
+		}
+	}
+
+	if err := json.NewEncoder(w).Encode(g); err != nil {
+		return fmt.Errorf("failed to encode cytoscape graph: %s", err)
+	}
+	return nil
+}
+
+// dotColors are the fill colors of the nodes of the DOT export by host path
+// prefix, other files are left white
+var dotColors = []struct {
+	prefix string
+	color  string
+}{
+	{"deno.land/std", "lightblue"},
+	{"deno.land/x/", "lightgoldenrod"},
+}
+
+// ExportDOT writes the files within depth hops of the files of the versions of
+// the Module node with the uid to w as a Graphviz DOT digraph, e.g. to be
+// rendered with `dot -Tsvg`. Files from deno.land/std and deno.land/x are
+// colored differently.
+func ExportDOT(ctx context.Context, moduleUID string, depth int, w io.Writer) error {
+	files, err := queryModuleNeighbourhood(ctx, moduleUID, depth)
+	if err != nil {
+		return err
+	}
+
+	return writeDOT(files, w)
+}
+
+// writeDOT writes the files and the depends_on edges between them to w as a
+// DOT digraph
+func writeDOT(files []File, w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph dependencies {\n")
+	b.WriteString("\tnode [shape=box, style=filled, fillcolor=white];\n")
+
+	nodes := make(map[string]bool, len(files))
+	for _, f := range files {
+		nodes[f.Specifier] = true
+		fmt.Fprintf(&b, "\t%s [label=%s", dotID(f.Specifier), dotID(f.Specifier))
+		if c := dotColor(f.Specifier); c != "" {
+			fmt.Fprintf(&b, ", fillcolor=%s", c)
+		}
+		b.WriteString("];\n")
+	}
+	for _, f := range files {
+		for _, d := range f.DependsOn {
+			if !nodes[d.Specifier] {
+				continue
+			}
+			fmt.Fprintf(&b, "\t%s -> %s;\n", dotID(f.Specifier), dotID(d.Specifier))
+		}
+	}
+	b.WriteString("}\n")
+
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return fmt.Errorf("failed to write dot graph: %s", err)
+	}
+	return nil
+}
+
+// dotID quotes the specifier to be used as a DOT identifier
+func dotID(specifier string) string {
+	return `"` + strings.ReplaceAll(specifier, `"`, `\"`) + `"`
+}
+
+// dotColor returns the fill color of the specifier's node
+func dotColor(specifier string) string {
+	trimmed := strings.TrimPrefix(strings.TrimPrefix(specifier, "https://"), "http://")
+	for _, c := range dotColors {
+		if strings.HasPrefix(trimmed, c.prefix) {
+			return c.color
+		}
+	}
+	return ""
+}
+
+// ExportFiles pages through all the File nodes in uid order and calls fn with
+// every page of at most pageSize files. Each file's DependsOn only holds the
+// uid and specifier of its direct dependencies.
+func ExportFiles(ctx context.Context, pageSize int, fn func(page []File) error) error {
+	if pageSize <= 0 {
+		return fmt.Errorf("invalid page size %d", pageSize)
+	}
+
+	q := `query q($first: int, $after: string) {
+		q(func: type(File), first: $first, after: $after) {
+			uid
+			specifier
+			depends_on {
+				uid
+				specifier
+			}
+		}
+	}`
+
+	after := "0x0"
+	for {
+		var resp struct {
+			Q []File `json:"q"`
+		}
+		vars := map[string]string{"$first": strconv.Itoa(pageSize), "$after": after}
+		if err := runQuery(ctx, q, vars, &resp); err != nil {
+			return fmt.Errorf("failed to query files after %s: %s", after, err)
+		}
+		if len(resp.Q) == 0 {
+			return nil
+		}
+
+		if err := fn(resp.Q); err != nil {
+			return err
+		}
+		if len(resp.Q) < pageSize {
+			return nil
+		}
+		after = resp.Q[len(resp.Q)-1].Uid
+	}
+}
+
+// ExportAllCytoscape writes every File node of the graph to w in the
+// Cytoscape.js elements JSON format. The whole graph is held in memory.
+func ExportAllCytoscape(ctx context.Context, pageSize int, w io.Writer) error {
+	var files []File
+	err := ExportFiles(ctx, pageSize, func(page []File) error {
+		files = append(files, page...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return writeCytoscape(files, w)
+}
+
+// QueryDependencyTree returns the file of the specifier with its dependencies
+// nested up to depth levels deep. A dependency that is already one of its
+// ancestors isn't expanded again to break cycles.
+func QueryDependencyTree(ctx context.Context, specifier string, depth int) (*File, error) {
+	files, err := QueryNeighbourhood(ctx, specifier, depth)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	byUid := make(map[string]File, len(files))
+	for _, f := range files {
+		byUid[f.Uid] = f
+	}
+	root := nest(byUid, files[0].Uid, depth, make(map[string]bool))
+	return &root, nil
+}
+
+// nest returns the file of the uid with its dependencies nested up to depth
+// levels deep, ancestors holds the uids of the files on the path to it
+func nest(byUid map[string]File, uid string, depth int, ancestors map[string]bool) File {
+	f := byUid[uid]
+	node := File{Uid: f.Uid, Specifier: f.Specifier}
+	if depth == 0 {
+		return node
+	}
+
+	ancestors[uid] = true
+	defer delete(ancestors, uid)
+	for _, d := range f.DependsOn {
+		if _, ok := byUid[d.Uid]; !ok || ancestors[d.Uid] {
+			node.DependsOn = append(node.DependsOn, File{Uid: d.Uid, Specifier: d.Specifier})
+			continue
+		}
+		node.DependsOn = append(node.DependsOn, nest(byUid, d.Uid, depth-1, ancestors))
+	}
+	return node
+}
+
+// ModuleEntrypoint returns the specifier of the mod.ts file of the most
+// recently uploaded version of the module
+func ModuleEntrypoint(ctx context.Context, name string) (string, error) {
+	m, err := QueryModuleByName(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if m == nil || len(m.Version) == 0 {
+		return "", fmt.Errorf("module %s has no versions", name)
+	}
+
+	latest := m.Version[0]
+	for _, v := range m.Version[1:] {
+		if !v.uploadedAt().Before(latest.uploadedAt()) {
+			latest = v
+		}
+	}
+
+	return VersionEntrypoint(name, latest.ModuleVersion), nil
+}
+
+// VersionEntrypoint returns the specifier of the mod.ts file of the module
+// version
+func VersionEntrypoint(name, version string) string {
+	u := deno.SpecifierURL(name, version, entrypoint)
+	return u.String()
+}
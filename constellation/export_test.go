@@ -0,0 +1,167 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package constellation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// validateCytoscape checks the document against the Cytoscape.js elements
+// JSON format: every element has a data.id, edges have a data.source and a
+// data.target that reference existing nodes.
+func validateCytoscape(t *testing.T, doc []byte) (nodes, edges int) {
+	t.Helper()
+
+	var g struct {
+		Elements *struct {
+			Nodes []struct {
+				Data map[string]interface{} `json:"data"`
+			} `json:"nodes"`
+			Edges []struct {
+				Data map[string]interface{} `json:"data"`
+			} `json:"edges"`
+		} `json:"elements"`
+	}
+	if err := json.Unmarshal(doc, &g); err != nil {
+		t.Fatalf("invalid JSON document: %s", err)
+	}
+	if g.Elements == nil || g.Elements.Nodes == nil || g.Elements.Edges == nil {
+		t.Fatalf("expected elements.nodes and elements.edges arrays, got %s", doc)
+	}
+
+	ids := make(map[string]bool)
+	for _, n := range g.Elements.Nodes {
+		id, ok := n.Data["id"].(string)
+		if !ok || id == "" {
+			t.Fatalf("node without a data.id: %v", n.Data)
+		}
+		if ids[id] {
+			t.Fatalf("duplicate node id %s", id)
+		}
+		ids[id] = true
+	}
+	for _, e := range g.Elements.Edges {
+		for _, k := range []string{"id", "source", "target"} {
+			if v, ok := e.Data[k].(string); !ok || v == "" {
+				t.Fatalf("edge without a data.%s: %v", k, e.Data)
+			}
+		}
+		if !ids[e.Data["source"].(string)] || !ids[e.Data["target"].(string)] {
+			t.Fatalf("edge references an unknown node: %v", e.Data)
+		}
+	}
+	return len(g.Elements.Nodes), len(g.Elements.Edges)
+}
+
+func TestExportCytoscape(t *testing.T) {
+	withFixture(t, `{"q": [{
+		"uid": "0x1",
+		"specifier": "https://deno.land/x/oak/mod.ts",
+		"depends_on": [
+			{
+				"uid": "0x2",
+				"specifier": "https://deno.land/x/oak/deps.ts",
+				"depends_on": [{"uid": "0x4", "specifier": "https://deno.land/std/http/mod.ts"}]
+			},
+			{"uid": "0x3", "specifier": "https://deno.land/x/oak/router.ts"}
+		]
+	}]}`)
+
+	var buf bytes.Buffer
+	if err := ExportCytoscape(context.Background(), "https://deno.land/x/oak/mod.ts", 1, &buf); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	nodes, edges := validateCytoscape(t, buf.Bytes())
+	if nodes != 4 || edges != 3 {
+		t.Errorf("expected 4 nodes and 3 edges, got %d and %d", nodes, edges)
+	}
+}
+
+func TestExportCytoscapeEmpty(t *testing.T) {
+	withFixture(t, `{"q": []}`)
+
+	var buf bytes.Buffer
+	if err := ExportCytoscape(context.Background(), "https://deno.land/x/oak/mod.ts", 1, &buf); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if nodes, edges := validateCytoscape(t, buf.Bytes()); nodes != 0 || edges != 0 {
+		t.Errorf("expected an empty graph, got %d nodes and %d edges", nodes, edges)
+	}
+}
+
+func TestExportDOT(t *testing.T) {
+	f := withFixture(t, `{"q": [{
+		"uid": "0x1",
+		"specifier": "https://deno.land/x/oak/mod.ts",
+		"depends_on": [
+			{
+				"uid": "0x2",
+				"specifier": "https://deno.land/x/oak/deps.ts",
+				"depends_on": [{"uid": "0x4", "specifier": "https://deno.land/std/http/mod.ts"}]
+			},
+			{"uid": "0x3", "specifier": "https://esm.sh/react"}
+		]
+	}]}`)
+
+	var buf bytes.Buffer
+	// 0x10 is the Module node, the graph starts from the files of its versions
+	if err := ExportDOT(context.Background(), "0x10", 1, &buf); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(f.query, "var(func: uid(0x10))") || !strings.Contains(f.query, "f as file_specifier") || !strings.Contains(f.query, "q(func: uid(f))") {
+		t.Errorf("expected the query to start from the files of the module, got:\n%s", f.query)
+	}
+
+	out := buf.String()
+	for _, line := range []string{
+		`"https://deno.land/x/oak/mod.ts" [label="https://deno.land/x/oak/mod.ts", fillcolor=lightgoldenrod];`,
+		`"https://deno.land/std/http/mod.ts" [label="https://deno.land/std/http/mod.ts", fillcolor=lightblue];`,
+		`"https://esm.sh/react" [label="https://esm.sh/react"];`,
+		`"https://deno.land/x/oak/mod.ts" -> "https://deno.land/x/oak/deps.ts";`,
+		`"https://deno.land/x/oak/deps.ts" -> "https://deno.land/std/http/mod.ts";`,
+	} {
+		if !strings.Contains(out, "\t"+line+"\n") {
+			t.Errorf("expected line %s in:\n%s", line, out)
+		}
+	}
+	if !strings.HasPrefix(out, "digraph dependencies {\n") || !strings.HasSuffix(out, "}\n") {
+		t.Errorf("expected a digraph, got:\n%s", out)
+	}
+
+	if err := ExportDOT(context.Background(), "mod.ts", 1, &buf); err == nil {
+		t.Error("expected an error for an invalid uid")
+	}
+}
+
+func TestQueryDependencyTree(t *testing.T) {
+	withFixture(t, `{"q": [{
+		"uid": "0x1",
+		"specifier": "https://deno.land/x/oak/mod.ts",
+		"depends_on": [{
+			"uid": "0x2",
+			"specifier": "https://deno.land/x/oak/deps.ts",
+			"depends_on": [{"uid": "0x1", "specifier": "https://deno.land/x/oak/mod.ts"}]
+		}]
+	}]}`)
+
+	root, err := QueryDependencyTree(context.Background(), "https://deno.land/x/oak/mod.ts", 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if root == nil || root.Uid != "0x1" || len(root.DependsOn) != 1 {
+		t.Fatalf("unexpected root: %+v", root)
+	}
+
+	deps := root.DependsOn[0]
+	if deps.Uid != "0x2" || len(deps.DependsOn) != 1 {
+		t.Fatalf("unexpected dependency: %+v", deps)
+	}
+	if cycle := deps.DependsOn[0]; cycle.Uid != "0x1" || cycle.DependsOn != nil {
+		t.Errorf("expected the cycle back to the root not to be expanded, got %+v", cycle)
+	}
+}
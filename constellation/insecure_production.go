@@ -0,0 +1,18 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+
+//go:build production
+// +build production
+
+package constellation
+
+import (
+	"fmt"
+
+	"google.golang.org/grpc"
+)
+
+// insecureDialOption always fails, production builds must connect to the
+// alpha servers over TLS
+func insecureDialOption() (grpc.DialOption, error) {
+	return nil, fmt.Errorf("dgraph TLS certificate required in production builds")
+}
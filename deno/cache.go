@@ -0,0 +1,108 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package deno
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var infoCacheHits prometheus.Counter
+
+func init() {
+	infoCacheHits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "deno_info_cache_hits_total",
+			Help: "A counter of `deno info` results served from the cache",
+		},
+	)
+
+	prometheus.MustRegister(infoCacheHits)
+}
+
+// Cache stores the output of `deno info` keyed by specifier
+type Cache interface {
+	Get(specifier string) (DenoInfo, bool)
+	Put(specifier string, info DenoInfo, ttl time.Duration)
+}
+
+type cacheEntry struct {
+	info    DenoInfo
+	expires time.Time
+}
+
+// MemoryCache is a Cache that keeps the entries in memory. Expired entries are
+// never returned and are evicted periodically.
+type MemoryCache struct {
+	entries sync.Map
+}
+
+// NewMemoryCache returns an empty MemoryCache that evicts the expired entries
+// every interval until ctx is cancelled
+func NewMemoryCache(ctx context.Context, interval time.Duration) *MemoryCache {
+	c := &MemoryCache{}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				c.evict(now)
+			}
+		}
+	}()
+	return c
+}
+
+// Get returns the info stored for the specifier if it hasn't expired
+func (c *MemoryCache) Get(specifier string) (DenoInfo, bool) {
+	v, ok := c.entries.Load(specifier)
+	if !ok {
+		return DenoInfo{}, false
+	}
+	e := v.(cacheEntry)
+	if time.Now().After(e.expires) {
+		return DenoInfo{}, false
+	}
+	return e.info, true
+}
+
+// Put stores the info of the specifier for ttl
+func (c *MemoryCache) Put(specifier string, info DenoInfo, ttl time.Duration) {
+	c.entries.Store(specifier, cacheEntry{info: info, expires: time.Now().Add(ttl)})
+}
+
+// evict removes the entries that expired before now
+func (c *MemoryCache) evict(now time.Time) {
+	c.entries.Range(func(k, v interface{}) bool {
+		if now.After(v.(cacheEntry).expires) {
+			c.entries.Delete(k)
+		}
+		return true
+	})
+}
+
+// CachedExecInfo returns a function that runs exec, e.g. ExecInfo, on the
+// specifiers that aren't in c and stores the successful results for ttl. The
+// empty result returned when the context is cancelled isn't stored.
+func CachedExecInfo(c Cache, ttl time.Duration, exec func(context.Context, url.URL) (DenoInfo, error)) func(context.Context, url.URL) (DenoInfo, error) {
+	return func(ctx context.Context, target url.URL) (DenoInfo, error) {
+		specifier := target.String()
+		if info, ok := c.Get(specifier); ok {
+			infoCacheHits.Inc()
+			return info, nil
+		}
+
+		info, err := exec(ctx, target)
+		if err != nil || info.Module == "" {
+			return info, err
+		}
+		c.Put(specifier, info, ttl)
+		return info, nil
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package deno
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCachedExec(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := 0
+	fail := false
+	exec := func(ctx context.Context, target url.URL) (DenoInfo, error) {
+		calls++
+		if fail {
+			return DenoInfo{}, errors.New("deno info failed")
+		}
+		return DenoInfo{Module: target.String()}, nil
+	}
+
+	cache := NewMemoryCache(ctx, time.Minute)
+	cached := CachedExecInfo(cache, time.Minute, exec)
+	u := SpecifierURL("oak", "v10.0.0", "mod.ts")
+
+	for i := 0; i < 2; i++ {
+		info, err := cached(ctx, u)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if info.Module != u.String() {
+			t.Errorf("expected %s, got %s", u.String(), info.Module)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 call, got %d", calls)
+	}
+
+	// failures aren't cached
+	fail = true
+	other := SpecifierURL("oak", "v10.0.0", "deps.ts")
+	for i := 0; i < 2; i++ {
+		if _, err := cached(ctx, other); err == nil {
+			t.Error("expected an error")
+		}
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 calls, got %d", calls)
+	}
+}
+
+func TestCachedExecCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := 0
+	exec := func(ctx context.Context, target url.URL) (DenoInfo, error) {
+		calls++
+		// runInfo returns an empty result when the context is cancelled
+		if ctx.Err() != nil {
+			return DenoInfo{}, nil
+		}
+		return DenoInfo{Module: target.String()}, nil
+	}
+
+	cached := CachedExecInfo(NewMemoryCache(ctx, time.Minute), time.Minute, exec)
+	u := SpecifierURL("oak", "v10.0.0", "mod.ts")
+
+	cancelled, cancelExec := context.WithCancel(ctx)
+	cancelExec()
+	if info, err := cached(cancelled, u); err != nil || info.Module != "" {
+		t.Fatalf("expected an empty result, got %+v, %v", info, err)
+	}
+
+	info, err := cached(ctx, u)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if info.Module != u.String() {
+		t.Errorf("expected the cancelled result not to be cached, got %+v", info)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 calls, got %d", calls)
+	}
+}
+
+func TestMemoryCacheExpiry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache := NewMemoryCache(ctx, time.Hour)
+	cache.Put("https://deno.land/x/oak@v10.0.0/mod.ts", DenoInfo{}, -time.Second)
+	if _, ok := cache.Get("https://deno.land/x/oak@v10.0.0/mod.ts"); ok {
+		t.Error("expected the expired entry to be missing")
+	}
+
+	cache.evict(time.Now())
+	if _, ok := cache.entries.Load("https://deno.land/x/oak@v10.0.0/mod.ts"); ok {
+		t.Error("expected the expired entry to be evicted")
+	}
+}
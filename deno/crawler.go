@@ -2,13 +2,16 @@
 package deno
 
 import (
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/time/rate"
 )
 
 // Client interface defines the basic functions of an HTTP crawler
@@ -16,34 +19,95 @@ type Client interface {
 	DoRequest(*http.Request) (*http.Response, error)
 }
 
+// defaultMaxRetries is the number of times a request is retried when the
+// server responds with 429 Too Many Requests or 503 Service Unavailable
+const defaultMaxRetries = 3
+
+// defaultRequestsPerSecond and defaultBurst configure the token bucket used
+// when no rate limit is given
+const (
+	defaultRequestsPerSecond = 1
+	defaultBurst             = 1
+)
+
 type throttledClient struct {
-	client       *http.Client
-	ThrottleRate int // minimal interval wait between requests
-	mut          sync.Mutex
-	last         time.Time
+	client     *http.Client
+	mu         sync.Mutex    // guards limiter
+	limiter    *rate.Limiter // nil means requests are not rate limited
+	MaxRetries int           // maximum number of retries on 429 and 503 responses
+	etags      ETagCache     // nil disables conditional requests
+}
+
+// ClientOption configures optional behavior of the Client
+type ClientOption func(*throttledClient)
+
+// WithMaxRetries sets the maximum number of times a request is retried when the
+// server responds with 429 or 503
+func WithMaxRetries(n int) ClientOption {
+	return func(c *throttledClient) {
+		c.MaxRetries = n
+	}
+}
+
+// WithRateLimit replaces the default token bucket with one that allows rps
+// requests per second with bursts of up to burst requests
+func WithRateLimit(rps float64, burst int) ClientOption {
+	return func(c *throttledClient) {
+		c.limiter = rate.NewLimiter(rate.Limit(rps), burst)
+	}
+}
+
+// WithETagCache makes the client send conditional requests with the ETag
+// stored in cache
+func WithETagCache(cache ETagCache) ClientOption {
+	return func(c *throttledClient) {
+		c.etags = cache
+	}
+}
+
+func newLimiter() *rate.Limiter {
+	return rate.NewLimiter(defaultRequestsPerSecond, defaultBurst)
 }
 
 // DefaultClient returns an instance of a crawler that uses the default http
 // client
-func DefaultClient() Client {
-	return &throttledClient{
-		client:       http.DefaultClient,
-		ThrottleRate: 1,
+func DefaultClient(opts ...ClientOption) Client {
+	c := &throttledClient{
+		client:     http.DefaultClient,
+		limiter:    newLimiter(),
+		MaxRetries: defaultMaxRetries,
 	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
-// NewInstrumentedClient returns an instance of a crawler that uses an http
-// client intstrumented with Prometheus
-func NewInstrumentedClient() Client {
-	client := http.DefaultClient
-	client.Timeout = 1 * time.Second
+// NewCrawlerWithLimiter returns an instance of a crawler that uses the default
+// http client and allows rps requests per second with bursts of up to burst
+// requests
+func NewCrawlerWithLimiter(rps float64, burst int, opts ...ClientOption) Client {
+	return DefaultClient(append([]ClientOption{WithRateLimit(rps, burst)}, opts...)...)
+}
+
+// metrics of the client returned by NewInstrumentedClient, registered once so
+// that it can be created more than once
+var (
+	inFlightGauge   prometheus.Gauge
+	requestsCounter *prometheus.CounterVec
+	dnsLatencyVec   *prometheus.HistogramVec
+	tlsLatencyVec   *prometheus.HistogramVec
+	histVec         *prometheus.HistogramVec
+)
 
-	inFlightGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+func init() {
+	inFlightGauge = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "client_in_flight_requests",
 		Help: "A gauge of in-flight requests for the wrapped client.",
 	})
 
-	counter := prometheus.NewCounterVec(
+	requestsCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "client_api_requests_total",
 			Help: "A counter for requests from the wrapped client.",
@@ -55,7 +119,7 @@ func NewInstrumentedClient() Client {
 	// It has an instance label "event", which is set in the
 	// DNSStart and DNSDonehook functions defined in the
 	// InstrumentTrace struct below.
-	dnsLatencyVec := prometheus.NewHistogramVec(
+	dnsLatencyVec = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "dns_duration_seconds",
 			Help:    "Trace dns latency histogram.",
@@ -68,7 +132,7 @@ func NewInstrumentedClient() Client {
 	// It has an instance label "event", which is set in the
 	// TLSHandshakeStart and TLSHandshakeDone hook functions defined in the
 	// InstrumentTrace struct below.
-	tlsLatencyVec := prometheus.NewHistogramVec(
+	tlsLatencyVec = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "tls_duration_seconds",
 			Help:    "Trace tls latency histogram.",
@@ -78,7 +142,7 @@ func NewInstrumentedClient() Client {
 	)
 
 	// histVec has no labels, making it a zero-dimensional ObserverVec.
-	histVec := prometheus.NewHistogramVec(
+	histVec = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "request_duration_seconds",
 			Help:    "A histogram of request latencies.",
@@ -88,7 +152,13 @@ func NewInstrumentedClient() Client {
 	)
 
 	// Register all of the metrics in the standard registry.
-	prometheus.MustRegister(counter, tlsLatencyVec, dnsLatencyVec, histVec, inFlightGauge)
+	prometheus.MustRegister(requestsCounter, tlsLatencyVec, dnsLatencyVec, histVec, inFlightGauge)
+}
+
+// NewInstrumentedClient returns an instance of a crawler that uses an http
+// client intstrumented with Prometheus
+func NewInstrumentedClient(opts ...ClientOption) Client {
+	client := &http.Client{Timeout: 1 * time.Second}
 
 	// Define functions for the available httptrace.ClientTrace hook
 	// functions that we want to instrument.
@@ -109,7 +179,7 @@ func NewInstrumentedClient() Client {
 
 	// Wrap the default RoundTripper with middleware.
 	roundTripper := promhttp.InstrumentRoundTripperInFlight(inFlightGauge,
-		promhttp.InstrumentRoundTripperCounter(counter,
+		promhttp.InstrumentRoundTripperCounter(requestsCounter,
 			promhttp.InstrumentRoundTripperTrace(trace,
 				promhttp.InstrumentRoundTripperDuration(histVec, http.DefaultTransport),
 			),
@@ -119,19 +189,115 @@ func NewInstrumentedClient() Client {
 	// Set the RoundTripper on our client.
 	client.Transport = roundTripper
 
-	return &throttledClient{
-		client:       client,
-		ThrottleRate: 1,
+	c := &throttledClient{
+		client:     client,
+		limiter:    newLimiter(),
+		MaxRetries: defaultMaxRetries,
+	}
+
+	for _, opt := range opts {
+		opt(c)
 	}
+	return c
 }
 
+// DoRequest sends the request once the rate limiter allows it. Requests that
+// get a 429 or 503 response are retried up to MaxRetries times, waiting for the
+// duration of the Retry-After header or an exponential backoff. Cancelling the
+// request's context aborts both waits.
+//
+// Requests made with a conditional context send the ETag cached for their URL
+// in an If-None-Match header, and ErrNotModified is returned if the server
+// responds with 304 Not Modified. The ETag of a new response is kept in the
+// context until storeETags is called.
 func (c *throttledClient) DoRequest(req *http.Request) (*http.Response, error) {
-	c.mut.Lock()
-	defer c.mut.Unlock()
-
-	time.Sleep(time.Until(c.last.Add(time.Duration(c.ThrottleRate) * time.Second)))
-	c.last = time.Now()
-	log.Printf("request %s\n", req.URL.String())
 	req.Header.Set("User-Agent", "Andromedaland-v0.1")
-	return c.client.Do(req)
+	ctx := req.Context()
+	useETag := c.etags != nil && isConditional(ctx)
+	if useETag {
+		if etag, ok := c.etags.Get(req.URL.String()); ok {
+			req.Header.Set("If-None-Match", etag)
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		if limiter := c.rateLimiter(); limiter != nil {
+			if err := limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+		slog.Debug("request", "url", req.URL.String())
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusNotModified {
+			resp.Body.Close()
+			return nil, ErrNotModified
+		}
+		if useETag && resp.StatusCode == http.StatusOK {
+			if etag := resp.Header.Get("ETag"); etag != "" {
+				addETag(ctx, req.URL.String(), etag)
+			}
+		}
+
+		if !isRetryable(resp.StatusCode) || attempt > c.MaxRetries {
+			return resp, nil
+		}
+
+		wait := retryAfter(resp.Header.Get("Retry-After"), attempt)
+		resp.Body.Close()
+		slog.Warn("retrying request", "url", req.URL.String(), "status", resp.StatusCode, "wait", wait)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// SetRequestsPerSecond changes the rate of the client's limiter, falling back
+// to the default rate when rps is not positive. It is safe to call while
+// requests are in flight.
+func (c *throttledClient) SetRequestsPerSecond(rps int) {
+	if rps <= 0 {
+		rps = defaultRequestsPerSecond
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.limiter == nil {
+		c.limiter = rate.NewLimiter(rate.Limit(rps), defaultBurst)
+		return
+	}
+	c.limiter.SetLimit(rate.Limit(rps))
+}
+
+// rateLimiter returns the current limiter of the client, nil if requests are
+// not rate limited
+func (c *throttledClient) rateLimiter() *rate.Limiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limiter
+}
+
+func isRetryable(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// retryAfter parses the value of a Retry-After header, which is either a number
+// of seconds or an HTTP date. It falls back to 2^attempt seconds if the header
+// is absent or invalid.
+func retryAfter(header string, attempt int) time.Duration {
+	if secs, err := strconv.Atoi(header); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(header); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+		return 0
+	}
+
+	return time.Duration(math.Pow(2, float64(attempt))) * time.Second
 }
@@ -0,0 +1,142 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package deno
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	cases := []struct {
+		header   string
+		attempt  int
+		expected time.Duration
+	}{
+		{"5", 1, 5 * time.Second},
+		{"0", 3, 0},
+		{"", 1, 2 * time.Second},
+		{"", 3, 8 * time.Second},
+		{"garbage", 2, 4 * time.Second},
+		{"Mon, 02 Jan 2006 15:04:05 GMT", 1, 0},
+	}
+
+	for _, c := range cases {
+		if actual := retryAfter(c.header, c.attempt); actual != c.expected {
+			t.Errorf("expected retryAfter(%q, %d) to be %s, got %s", c.header, c.attempt, c.expected, actual)
+		}
+	}
+}
+
+func TestDoRequestRetries(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := &throttledClient{client: srv.Client(), MaxRetries: 3}
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	resp, err := c.DoRequest(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 calls, got %d", calls)
+	}
+}
+
+func TestDoRequestMaxRetries(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	c := &throttledClient{client: srv.Client(), MaxRetries: 2}
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	resp, err := c.DoRequest(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 calls, got %d", calls)
+	}
+}
+
+func TestDoRequestLimiterCancelled(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := NewCrawlerWithLimiter(0.001, 1).(*throttledClient)
+	c.client = srv.Client()
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	resp, err := c.DoRequest(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+
+	// the bucket is now empty, the next request would wait ~1000s
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ = http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+	if _, err := c.DoRequest(req); err == nil {
+		t.Fatal("expected an error when the context is cancelled while waiting")
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 call, got %d", calls)
+	}
+}
+
+func TestSetRequestsPerSecondConcurrent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	// the limiter is created by the first call while requests are in flight
+	c := &throttledClient{client: srv.Client()}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			req, _ := http.NewRequest("GET", srv.URL, nil)
+			if resp, err := c.DoRequest(req); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+	c.SetRequestsPerSecond(1000)
+	c.SetRequestsPerSecond(2000)
+	<-done
+
+	if l := c.rateLimiter(); l == nil || l.Limit() != 2000 {
+		t.Errorf("expected a limit of 2000, got %v", l)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package deno
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrNotModified is returned by DoRequest when the server responds with 304
+// Not Modified to a conditional request, meaning the content at the URL hasn't
+// changed since the last crawl
+var ErrNotModified = errors.New("not modified")
+
+// ETagCache stores the last ETag seen for a URL
+type ETagCache interface {
+	Get(url string) (string, bool)
+	Set(url string, etag string)
+	// Clear removes every ETag, the next requests aren't conditional
+	Clear()
+}
+
+// MemoryETagCache is an ETagCache that keeps the ETags in memory for the
+// lifetime of the process
+type MemoryETagCache struct {
+	mu    sync.RWMutex
+	etags map[string]string
+}
+
+// NewMemoryETagCache returns an empty MemoryETagCache
+func NewMemoryETagCache() *MemoryETagCache {
+	return &MemoryETagCache{etags: make(map[string]string)}
+}
+
+// Get returns the ETag stored for the url
+func (c *MemoryETagCache) Get(url string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	etag, ok := c.etags[url]
+	return etag, ok
+}
+
+// Set stores the ETag of the url
+func (c *MemoryETagCache) Set(url string, etag string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.etags[url] = etag
+}
+
+// Clear removes every ETag
+func (c *MemoryETagCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.etags = make(map[string]string)
+}
+
+// redisKV is the subset of the redis.Client used by RedisETagCache
+type redisKV interface {
+	Get(ctx context.Context, key string) *redis.StringCmd
+	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd
+	Del(ctx context.Context, keys ...string) *redis.IntCmd
+}
+
+// RedisETagCache is an ETagCache backed by Redis, so the ETags survive restarts
+// and are shared between crawler instances
+type RedisETagCache struct {
+	client redisKV
+	prefix string
+	ttl    time.Duration
+}
+
+// NewRedisETagCache returns a RedisETagCache storing the ETags under keys
+// starting with prefix. The keys expire after ttl, or never if ttl is 0.
+func NewRedisETagCache(c *redis.Client, prefix string, ttl time.Duration) *RedisETagCache {
+	return &RedisETagCache{client: c, prefix: prefix, ttl: ttl}
+}
+
+// Get returns the ETag stored for the url. Redis errors are logged and treated
+// as a cache miss.
+func (c *RedisETagCache) Get(url string) (string, bool) {
+	etag, err := c.client.Get(context.Background(), c.prefix+url).Result()
+	if err != nil {
+		if err != redis.Nil {
+			slog.Warn("failed to get etag", "url", url, "error", err)
+		}
+		return "", false
+	}
+	return etag, true
+}
+
+// Set stores the ETag of the url. Redis errors are logged.
+func (c *RedisETagCache) Set(url string, etag string) {
+	if err := c.client.Set(context.Background(), c.prefix+url, etag, c.ttl).Err(); err != nil {
+		slog.Warn("failed to set etag", "url", url, "error", err)
+	}
+}
+
+// Clear deletes every key starting with the prefix of the cache. Redis errors
+// are logged.
+func (c *RedisETagCache) Clear() {
+	ctx := context.Background()
+	var cursor uint64
+	for {
+		keys, next, err := c.client.Scan(ctx, cursor, c.prefix+"*", 1000).Result()
+		if err != nil {
+			slog.Warn("failed to scan etags", "prefix", c.prefix, "error", err)
+			return
+		}
+		if len(keys) > 0 {
+			if err := c.client.Del(ctx, keys...).Err(); err != nil {
+				slog.Warn("failed to delete etags", "prefix", c.prefix, "error", err)
+				return
+			}
+		}
+		if next == 0 {
+			return
+		}
+		cursor = next
+	}
+}
+
+type conditionalKey struct{}
+
+// pendingETags holds the ETags of the responses received with a conditional
+// context until the caller is done processing them
+type pendingETags struct {
+	mu    sync.Mutex
+	etags map[string]string
+}
+
+// conditional returns a context that makes DoRequest send a conditional
+// request if the client has an ETag for the URL. Only the callers that can skip
+// an unchanged response should use it. The ETags of the responses are only
+// stored by storeETags, once the caller has processed them.
+func conditional(ctx context.Context) context.Context {
+	return context.WithValue(ctx, conditionalKey{}, &pendingETags{etags: make(map[string]string)})
+}
+
+func isConditional(ctx context.Context) bool {
+	_, ok := ctx.Value(conditionalKey{}).(*pendingETags)
+	return ok
+}
+
+// addETag records the ETag of a response received with the conditional
+// context
+func addETag(ctx context.Context, url, etag string) {
+	if p, ok := ctx.Value(conditionalKey{}).(*pendingETags); ok {
+		p.mu.Lock()
+		p.etags[url] = etag
+		p.mu.Unlock()
+	}
+}
+
+// storeETags stores the ETags of the responses received with the conditional
+// context in cache
+func storeETags(ctx context.Context, cache ETagCache) {
+	p, ok := ctx.Value(conditionalKey{}).(*pendingETags)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for url, etag := range p.etags {
+		cache.Set(url, etag)
+	}
+	p.etags = make(map[string]string)
+}
@@ -0,0 +1,197 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package deno
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestDoRequestConditional(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := &throttledClient{client: srv.Client(), etags: NewMemoryETagCache()}
+	ctx := conditional(context.Background())
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+	resp, err := c.DoRequest(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+
+	// the etag is only stored once the response is processed
+	if _, ok := c.etags.Get(srv.URL); ok {
+		t.Error("expected the etag not to be stored before the response is processed")
+	}
+	storeETags(ctx, c.etags)
+
+	req, _ = http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+	if _, err := c.DoRequest(req); err != ErrNotModified {
+		t.Errorf("expected ErrNotModified, got %v", err)
+	}
+
+	// requests without a conditional context always get the full response
+	req, _ = http.NewRequest("GET", srv.URL, nil)
+	resp, err = c.DoRequest(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	if calls != 3 {
+		t.Errorf("expected 3 calls, got %d", calls)
+	}
+}
+
+// memoryKV is a redisKV backed by a map
+type memoryKV map[string]string
+
+func (kv memoryKV) Get(ctx context.Context, key string) *redis.StringCmd {
+	v, ok := kv[key]
+	if !ok {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult(v, nil)
+}
+
+func (kv memoryKV) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	kv[key] = value.(string)
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (kv memoryKV) Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd {
+	var keys []string
+	for k := range kv {
+		if strings.HasPrefix(k, strings.TrimSuffix(match, "*")) {
+			keys = append(keys, k)
+		}
+	}
+	return redis.NewScanCmdResult(keys, 0, nil)
+}
+
+func (kv memoryKV) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	for _, k := range keys {
+		delete(kv, k)
+	}
+	return redis.NewIntResult(int64(len(keys)), nil)
+}
+
+func TestRedisETagCache(t *testing.T) {
+	kv := memoryKV{}
+	c := &RedisETagCache{client: kv, prefix: "etag:"}
+
+	if _, ok := c.Get("https://cdn.deno.land/oak/meta/versions.json"); ok {
+		t.Error("expected a cache miss")
+	}
+
+	c.Set("https://cdn.deno.land/oak/meta/versions.json", `"abc"`)
+	if etag, ok := c.Get("https://cdn.deno.land/oak/meta/versions.json"); !ok || etag != `"abc"` {
+		t.Errorf("expected \"abc\", got %q (%t)", etag, ok)
+	}
+	if _, ok := kv["etag:https://cdn.deno.land/oak/meta/versions.json"]; !ok {
+		t.Error("expected the key to be prefixed")
+	}
+
+	kv["other:key"] = "kept"
+	c.Clear()
+	if _, ok := c.Get("https://cdn.deno.land/oak/meta/versions.json"); ok {
+		t.Error("expected the etag to be cleared")
+	}
+	if _, ok := kv["other:key"]; !ok {
+		t.Error("expected the keys without the prefix to be kept")
+	}
+}
+
+// roundTripFunc adapts a function to the http.RoundTripper interface
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// failingQueue is a ChanQueue whose Put always fails
+type failingQueue struct {
+	*ChanQueue
+}
+
+func (q failingQueue) Put(m Module) error {
+	return errors.New("queue unavailable")
+}
+
+func TestCrawlModuleNotModified(t *testing.T) {
+	routes := map[string]string{
+		"/oak/meta/versions.json":             `{"versions": ["v1.0.0"]}`,
+		"/oak/versions/v1.0.0/meta/meta.json": `{"uploaded_at": "2021-01-01T00:00:00Z", "directory_listing": [{"path": "/mod.ts", "type": "file", "size": 10}]}`,
+	}
+	transport := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		body, ok := routes[req.URL.Path]
+		if !ok {
+			return &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(strings.NewReader("{}"))}, nil
+		}
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			return &http.Response{StatusCode: http.StatusNotModified, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}
+		header := http.Header{}
+		header.Set("ETag", `"v1"`)
+		return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+	})
+	etags := NewMemoryETagCache()
+	client := &throttledClient{client: &http.Client{Transport: transport}, etags: etags}
+	versionsURL := "https://cdn.deno.land/oak/meta/versions.json"
+
+	// a module that failed to be queued is fetched in full on the next crawl
+	q := NewChanQueue(1)
+	x, err := NewXQueuedCrawler(failingQueue{&q})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	x.Client = client
+	if err := x.CrawlModule(context.Background(), "oak", false); err == nil {
+		t.Fatal("expected the crawl to fail when the module can't be queued")
+	}
+	if _, ok := etags.Get(versionsURL); ok {
+		t.Error("expected the etag not to be stored when the module failed")
+	}
+
+	x.Queue = &q
+	if err := x.CrawlModule(context.Background(), "oak", false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok := etags.Get(versionsURL); !ok {
+		t.Error("expected the etag to be stored once the module is queued")
+	}
+	if m, err := q.Get(context.Background()); err != nil || len(m.Versions) != 1 {
+		t.Fatalf("expected the module to be queued, got %v, %v", m.Versions, err)
+	}
+
+	// unchanged modules aren't queued again
+	if err := x.CrawlModule(context.Background(), "oak", false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	select {
+	case m := <-q.mods:
+		t.Errorf("expected the unchanged module not to be queued, got %s", m.Name)
+	default:
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package deno
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// FilterFunc reports whether the module should be crawled
+type FilterFunc func(moduleName string) bool
+
+// NewPrefixFilter returns a filter accepting the module names that start with
+// any of the prefixes
+func NewPrefixFilter(prefixes []string) FilterFunc {
+	return func(name string) bool {
+		for _, p := range prefixes {
+			if strings.HasPrefix(name, p) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// NewRegexFilter returns a filter accepting the module names that match the
+// regular expression
+func NewRegexFilter(pattern string) (FilterFunc, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter pattern %q: %s", pattern, err)
+	}
+	return re.MatchString, nil
+}
+
+// Not returns a filter accepting the module names rejected by f, which turns
+// an allowlist into a blocklist
+func Not(f FilterFunc) FilterFunc {
+	return func(name string) bool {
+		return !f(name)
+	}
+}
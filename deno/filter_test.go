@@ -0,0 +1,63 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package deno
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFilters(t *testing.T) {
+	prefix := NewPrefixFilter([]string{"oak", "std"})
+	re, err := NewRegexFilter(`^(oak|opine)$`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cases := []struct {
+		name   string
+		filter FilterFunc
+		accept []string
+		reject []string
+	}{
+		{"prefix", prefix, []string{"oak", "oak_middleware", "std"}, []string{"opine", "x_std"}},
+		{"regex", re, []string{"oak", "opine"}, []string{"oak_middleware", "std"}},
+		{"not", Not(prefix), []string{"opine"}, []string{"oak", "std"}},
+	}
+	for _, c := range cases {
+		for _, name := range c.accept {
+			if !c.filter(name) {
+				t.Errorf("%s: expected %s to be accepted", c.name, name)
+			}
+		}
+		for _, name := range c.reject {
+			if c.filter(name) {
+				t.Errorf("%s: expected %s to be rejected", c.name, name)
+			}
+		}
+	}
+
+	if _, err := NewRegexFilter(`(`); err == nil {
+		t.Error("expected an invalid pattern to be rejected")
+	}
+}
+
+func TestCrawlWithFilter(t *testing.T) {
+	crawl := func(modules int, opts ...XQueuedCrawlerOption) int32 {
+		client := &slowClient{modules: modules}
+		q := NewChanQueue(0)
+		x, err := NewXQueuedCrawler(&q, opts...)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		x.Client = client
+		for range x.Crawl(context.Background()) {
+		}
+		return atomic.LoadInt32(&client.requests)
+	}
+
+	single := crawl(1)
+	if got := crawl(10, WithFilter(NewPrefixFilter([]string{"mod1"}))); got != single {
+		t.Errorf("expected only mod1 to be crawled with %d requests, got %d", single, got)
+	}
+}
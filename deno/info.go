@@ -2,12 +2,24 @@
 package deno
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
-	"log"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
 	"net/url"
+	"os"
 	"os/exec"
+	"regexp"
+	"strings"
 	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 // DenoInfo is the in-memory representation of the output of `deno info --json`
@@ -19,6 +31,11 @@ type DenoInfo struct {
 	DepCount  int                  `json:"depCount"`
 	FileType  string               `json:"fileType"`
 	Files     map[string]FileEntry `json:"files"`
+
+	// ModuleName and ModuleVersion identify the module version the info was
+	// collected for, they aren't part of the `deno info` output
+	ModuleName    string `json:"-"`
+	ModuleVersion string `json:"-"`
 }
 
 // FileEntry in the Files map of DenoInfo
@@ -27,52 +44,223 @@ type FileEntry struct {
 	Size int      `json:"size"`
 }
 
-// Exists checks whether the `deno` executable is in path
-func Exists() bool {
+// infoInFlight tracks the running `deno info` subprocesses, if set
+var infoInFlight prometheus.Gauge
+
+// SetInfoInFlightGauge sets the gauge incremented while a `deno info`
+// subprocess is running. It must be called before any call to ExecInfo.
+func SetInfoInFlightGauge(g prometheus.Gauge) {
+	infoInFlight = g
+}
+
+var (
+	// ErrMissingModule is returned by ValidateDenoInfo when the info has no
+	// root module
+	ErrMissingModule = errors.New("deno info output has no module")
+	// ErrEmptyFiles is returned by ValidateDenoInfo when the info has a root
+	// module but no files, not even the module itself
+	ErrEmptyFiles = errors.New("deno info output has no files")
+	// ErrMismatchedDepCount is returned by ValidateDenoInfo when the depCount
+	// doesn't match the number of files
+	ErrMismatchedDepCount = errors.New("deno info depCount doesn't match the files")
+)
+
+// ValidateDenoInfo rejects obviously malformed `deno info` output. The
+// depCount must be the number of files besides the root module, as counted by
+// deno.
+func ValidateDenoInfo(info DenoInfo) error {
+	if info.Module == "" {
+		return ErrMissingModule
+	}
+	if len(info.Files) == 0 {
+		return ErrEmptyFiles
+	}
+
+	if expected := len(info.Files) - 1; info.DepCount != expected {
+		return errors.Wrapf(ErrMismatchedDepCount, "expected %d, got %d", expected, info.DepCount)
+	}
+	return nil
+}
+
+// MinDenoVersion is the oldest release of deno whose `deno info --json` output
+// can be decoded
+const MinDenoVersion = "1.5.0"
+
+// Exists checks whether the `deno` executable is in path and is at least
+// MinDenoVersion
+func Exists() error {
 	path, err := exec.LookPath("deno")
 	if err != nil {
-		log.Println(err)
-		return false
+		return fmt.Errorf("executable `deno` not found in PATH: %s", err)
 	}
 
-	if path == "" {
-		return false
+	out, err := exec.Command(path, "--version").Output()
+	if err != nil {
+		return fmt.Errorf("failed to get the version of deno: %s", err)
 	}
+	return checkDenoVersion(string(out))
+}
 
-	return true
+// checkDenoVersion parses the output of `deno --version`, e.g.
+// `deno 1.11.0 (release, x86_64-unknown-linux-gnu)`, and returns an error if
+// the version is older than MinDenoVersion
+func checkDenoVersion(output string) error {
+	fields := strings.Fields(output)
+	if len(fields) < 2 || fields[0] != "deno" {
+		return fmt.Errorf("unexpected output of `deno --version`: %q", output)
+	}
+	v, ok := parseSemver(fields[1])
+	if !ok {
+		return fmt.Errorf("invalid deno version %q", fields[1])
+	}
+	min, _ := parseSemver(MinDenoVersion)
+	if v.compare(min) < 0 {
+		return fmt.Errorf("deno %s is too old, %s or later is required", fields[1], MinDenoVersion)
+	}
+	return nil
 }
 
 // ExecInfo executes `deno info` as a subcommand and returns the DenoInfo struct
 // that it outputs
 func ExecInfo(ctx context.Context, target url.URL) (DenoInfo, error) {
-	cmd := exec.Command("deno", "info", "--unstable", "--json", target.String())
+	return runInfo(ctx, infoCommand(target))
+}
+
+// ExecInfoWithTrace executes `deno info` like ExecInfo and passes the W3C trace
+// context of ctx to the subprocess through the TRACEPARENT environment
+// variable. The subprocess is terminated after timeout, in which case an error
+// wrapping context.DeadlineExceeded is returned.
+func ExecInfoWithTrace(ctx context.Context, target url.URL, timeout time.Duration) (DenoInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return runInfo(ctx, tracedInfoCommand(ctx, target))
+}
+
+func infoCommand(target url.URL) *exec.Cmd {
+	return exec.Command("deno", "info", "--unstable", "--json", target.String())
+}
+
+func tracedInfoCommand(ctx context.Context, target url.URL) *exec.Cmd {
+	cmd := infoCommand(target)
+	cmd.Env = append(os.Environ(), traceEnv(ctx)...)
+	return cmd
+}
+
+// traceEnv returns the environment variables holding the trace context of ctx,
+// if any
+func traceEnv(ctx context.Context) []string {
+	carrier := propagation.HeaderCarrier(http.Header{})
+	propagation.TraceContext{}.Inject(ctx, carrier)
+
+	var env []string
+	if tp := carrier.Get("traceparent"); tp != "" {
+		env = append(env, "TRACEPARENT="+tp)
+	}
+	if ts := carrier.Get("tracestate"); ts != "" {
+		env = append(env, "TRACESTATE="+ts)
+	}
+	return env
+}
+
+// maxStderrSize is the maximum number of bytes of `deno info`'s stderr kept in
+// its errors
+const maxStderrSize = 4 * 1024
+
+// boundedBuffer keeps the first max bytes written to it and discards the rest
+type boundedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// waitResult is the outcome of a `deno info` subprocess along with its decoded
+// output
+type waitResult struct {
+	info      DenoInfo
+	decodeErr error
+	err       error
+}
+
+func runInfo(ctx context.Context, cmd *exec.Cmd) (DenoInfo, error) {
+	target := cmd.Args[len(cmd.Args)-1]
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return DenoInfo{}, err
 	}
-	if err := cmd.Start(); err != nil {
-		return DenoInfo{}, err
+	stderr := &boundedBuffer{max: maxStderrSize}
+	cmd.Stderr = stderr
+
+	if infoInFlight != nil {
+		infoInFlight.Inc()
+		defer infoInFlight.Dec()
 	}
-	var info DenoInfo
-	if err := json.NewDecoder(stdout).Decode(&info); err != nil {
+	if err := cmd.Start(); err != nil {
 		return DenoInfo{}, err
 	}
 
-	errs := make(chan error)
+	done := make(chan waitResult, 1)
 	go func() {
-		errs <- cmd.Wait()
+		// stdout must be read to the end before calling Wait, which closes it
+		info, decodeErr := decodeDenoInfo(stdout)
+		io.Copy(ioutil.Discard, stdout)
+		done <- waitResult{info: info, decodeErr: decodeErr, err: cmd.Wait()}
 	}()
 
 	select {
 	case <-ctx.Done():
-		log.Println("received cancel signal, closing ExecInfo")
 		cmd.Process.Signal(syscall.SIGTERM)
+		if ctx.Err() == context.DeadlineExceeded {
+			return DenoInfo{}, fmt.Errorf("deno info timed out for %s: %w", target, ctx.Err())
+		}
+		slog.Info("received cancel signal, closing ExecInfo")
 		return DenoInfo{}, nil
-	case err := <-errs:
-		if err != nil {
-			return DenoInfo{}, err
+	case res := <-done:
+		if res.err != nil {
+			// Wait has returned, nothing writes to stderr anymore
+			return DenoInfo{}, fmt.Errorf("deno info failed for %s: stderr=%q: %w", target, strings.TrimSpace(stderr.String()), res.err)
 		}
+		if res.decodeErr != nil {
+			return DenoInfo{}, res.decodeErr
+		}
+		return res.info, nil
+	}
+}
+
+// cdnRawPath matches the raw file paths of cdn.deno.land, e.g.
+// /oak/versions/v10.0.0/raw/mod.ts
+var cdnRawPath = regexp.MustCompile(`^/([^/]+)/versions/([^/]+)/raw/(.*)$`)
+
+// CanonicalSpecifier rewrites the cdn.deno.land URLs of a file to the
+// deno.land URL of the same file so that both forms refer to the same node.
+// Other specifiers are returned unchanged.
+func CanonicalSpecifier(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid specifier %s: %s", raw, err)
+	}
+	if u.Host != CDN_HOST {
+		return raw, nil
 	}
 
-	return info, nil
+	if m := cdnRawPath.FindStringSubmatch(u.Path); m != nil {
+		canonical := SpecifierURL(m[1], m[2], m[3])
+		return canonical.String(), nil
+	}
+
+	u.Host = "deno.land"
+	if !strings.HasPrefix(u.Path, "/x/") && !strings.HasPrefix(u.Path, "/std@") && !strings.HasPrefix(u.Path, "/std/") {
+		u.Path = "/x" + u.Path
+	}
+	return u.String(), nil
 }
@@ -0,0 +1,136 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package deno
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ErrUnknownInfoSchema is returned when the output of `deno info --json`
+// matches none of the known schemas
+var ErrUnknownInfoSchema = errors.New("unknown deno info output schema")
+
+// rawDenoInfo is the union of the schemas emitted by `deno info --json`. Deno
+// releases before 1.11 emit a `files` map keyed by specifier, newer releases
+// emit the module graph as a list of `modules`.
+type rawDenoInfo struct {
+	// legacy schema
+	TotalSize int                  `json:"totalSize"`
+	Module    string               `json:"module"`
+	Map       *string              `json:"map"`
+	Compiled  *string              `json:"compiled"`
+	DepCount  int                  `json:"depCount"`
+	FileType  string               `json:"fileType"`
+	Files     map[string]FileEntry `json:"files"`
+
+	// module graph schema
+	Roots     []string          `json:"roots"`
+	Modules   []graphModule     `json:"modules"`
+	Redirects map[string]string `json:"redirects"`
+}
+
+type graphModule struct {
+	Specifier    string            `json:"specifier"`
+	Size         int               `json:"size"`
+	Dependencies []graphDependency `json:"dependencies"`
+}
+
+type graphDependency struct {
+	Specifier string          `json:"specifier"`
+	Code      json.RawMessage `json:"code"`
+	Type      json.RawMessage `json:"type"`
+}
+
+// resolved returns the resolved specifier of the dependency. Depending on the
+// deno release, `code` is either the specifier itself or an object holding it.
+func (d graphDependency) resolved() string {
+	for _, raw := range []json.RawMessage{d.Code, d.Type} {
+		if len(raw) == 0 {
+			continue
+		}
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil && s != "" {
+			return s
+		}
+		var obj struct {
+			Specifier string `json:"specifier"`
+		}
+		if err := json.Unmarshal(raw, &obj); err == nil && obj.Specifier != "" {
+			return obj.Specifier
+		}
+	}
+	return ""
+}
+
+// decodeDenoInfo decodes the output of `deno info --json` in any of the known
+// schemas and normalises it to a DenoInfo
+func decodeDenoInfo(r io.Reader) (DenoInfo, error) {
+	var raw rawDenoInfo
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return DenoInfo{}, err
+	}
+
+	switch {
+	case raw.Files != nil || raw.Module != "":
+		return DenoInfo{
+			TotalSize: raw.TotalSize,
+			Module:    raw.Module,
+			Map:       raw.Map,
+			Compiled:  raw.Compiled,
+			DepCount:  raw.DepCount,
+			FileType:  raw.FileType,
+			Files:     raw.Files,
+		}, nil
+	case raw.Roots != nil || raw.Modules != nil:
+		return normaliseGraph(raw), nil
+	default:
+		return DenoInfo{}, ErrUnknownInfoSchema
+	}
+}
+
+// normaliseGraph converts the module graph schema to a DenoInfo. Redirected
+// specifiers are replaced by their target.
+func normaliseGraph(raw rawDenoInfo) DenoInfo {
+	redirect := func(s string) string {
+		// bound the lookups in case of a redirect loop
+		for i := 0; i < 10; i++ {
+			to, ok := raw.Redirects[s]
+			if !ok {
+				break
+			}
+			s = to
+		}
+		return s
+	}
+
+	info := DenoInfo{Files: make(map[string]FileEntry, len(raw.Modules))}
+	if len(raw.Roots) > 0 {
+		info.Module = redirect(raw.Roots[0])
+	}
+
+	for _, m := range raw.Modules {
+		entry := FileEntry{Size: m.Size, Deps: []string{}}
+		seen := make(map[string]bool)
+		for _, d := range m.Dependencies {
+			dep := d.resolved()
+			if dep == "" {
+				continue
+			}
+			dep = redirect(dep)
+			if seen[dep] {
+				continue
+			}
+			seen[dep] = true
+			entry.Deps = append(entry.Deps, dep)
+		}
+		info.Files[m.Specifier] = entry
+		info.TotalSize += m.Size
+	}
+	// like deno, the root module isn't counted
+	if len(info.Files) > 0 {
+		info.DepCount = len(info.Files) - 1
+	}
+	return info
+}
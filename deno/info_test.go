@@ -0,0 +1,239 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package deno
+
+import (
+	"context"
+	"net/url"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracedInfoCommand(t *testing.T) {
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+		SpanID:     trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), sc)
+	target := url.URL{Scheme: "https", Host: "deno.land", Path: "std@0.90.0/fs/mod.ts"}
+
+	cmd := tracedInfoCommand(ctx, target)
+	expected := "TRACEPARENT=00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	found := false
+	for _, e := range cmd.Env {
+		if e == expected {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected %s in the command environment", expected)
+	}
+
+	cmd = tracedInfoCommand(context.Background(), target)
+	for _, e := range cmd.Env {
+		if strings.HasPrefix(e, "TRACEPARENT=") {
+			t.Errorf("expected no traceparent without an active span, got %s", e)
+		}
+	}
+}
+
+func TestCanonicalSpecifier(t *testing.T) {
+	cases := map[string]string{
+		"https://cdn.deno.land/x/oak@v10.0.0/mod.ts":              "https://deno.land/x/oak@v10.0.0/mod.ts",
+		"https://cdn.deno.land/oak/versions/v10.0.0/raw/mod.ts":   "https://deno.land/x/oak@v10.0.0/mod.ts",
+		"https://cdn.deno.land/oak@v10.0.0/mod.ts":                "https://deno.land/x/oak@v10.0.0/mod.ts",
+		"https://deno.land/x/oak@v10.0.0/mod.ts":                  "https://deno.land/x/oak@v10.0.0/mod.ts",
+		"https://cdn.deno.land/std/versions/0.90.0/raw/fs/mod.ts": "https://deno.land/std@0.90.0/fs/mod.ts",
+		"https://esm.sh/preact":                                   "https://esm.sh/preact",
+	}
+
+	for in, expected := range cases {
+		got, err := CanonicalSpecifier(in)
+		if err != nil {
+			t.Errorf("unexpected error for %s: %s", in, err)
+			continue
+		}
+		if got != expected {
+			t.Errorf("expected %s to be canonicalised to %s, got %s", in, expected, got)
+		}
+	}
+
+	if _, err := CanonicalSpecifier("https://cdn.deno.land/%zz"); err == nil {
+		t.Error("expected an error for an invalid URL")
+	}
+}
+
+func TestValidateDenoInfo(t *testing.T) {
+	mod := "https://deno.land/x/oak@v6.5.0/mod.ts"
+	deps := "https://deno.land/x/oak@v6.5.0/deps.ts"
+	std := "https://deno.land/std@0.90.0/http/mod.ts"
+
+	cases := []struct {
+		name     string
+		info     DenoInfo
+		expected error
+	}{
+		{"valid", DenoInfo{Module: mod, DepCount: 2, Files: map[string]FileEntry{
+			mod:  {Deps: []string{deps, std}},
+			deps: {Deps: []string{std}},
+			std:  {},
+		}}, nil},
+		{"cyclic import of the module", DenoInfo{Module: mod, DepCount: 1, Files: map[string]FileEntry{
+			mod:  {Deps: []string{deps}},
+			deps: {Deps: []string{mod}},
+		}}, nil},
+		{"no module", DenoInfo{Files: map[string]FileEntry{mod: {}}}, ErrMissingModule},
+		{"no files", DenoInfo{Module: mod}, ErrEmptyFiles},
+		{"wrong dep count", DenoInfo{Module: mod, DepCount: 3, Files: map[string]FileEntry{
+			mod: {Deps: []string{deps}},
+		}}, ErrMismatchedDepCount},
+	}
+
+	for _, c := range cases {
+		if err := ValidateDenoInfo(c.info); !errors.Is(err, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, err)
+		}
+	}
+}
+
+func TestRunInfoStderr(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "echo 'error: Module not found' >&2; exit 1", "https://deno.land/x/nope/mod.ts")
+	_, err := runInfo(context.Background(), cmd)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), `stderr="error: Module not found"`) {
+		t.Errorf("expected the error to contain stderr, got %s", err)
+	}
+	if !strings.Contains(err.Error(), "https://deno.land/x/nope/mod.ts") {
+		t.Errorf("expected the error to contain the specifier, got %s", err)
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Errorf("expected the error to wrap an *exec.ExitError, got %T", err)
+	}
+}
+
+func TestRunInfoLargeOutput(t *testing.T) {
+	// more stderr than is kept, while stdout is written after it
+	script := `head -c 131072 /dev/zero | tr '\0' x >&2; echo '{"module": "https://deno.land/x/big/mod.ts", "files": {}}'`
+	cmd := exec.Command("sh", "-c", script, "https://deno.land/x/big/mod.ts")
+	info, err := runInfo(context.Background(), cmd)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if info.Module != "https://deno.land/x/big/mod.ts" {
+		t.Errorf("expected the info of the module, got %+v", info)
+	}
+}
+
+func TestRunInfoTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	cmd := exec.Command("sh", "-c", "exec sleep 5", "https://deno.land/x/slow/mod.ts")
+	start := time.Now()
+	_, err := runInfo(ctx, cmd)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the timeout to be returned, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected deno info to be stopped after the timeout, took %s", d)
+	}
+
+	// a cancelled crawl isn't a failure of the file
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	cmd = exec.Command("sh", "-c", "exec sleep 5", "https://deno.land/x/slow/mod.ts")
+	if _, err := runInfo(ctx, cmd); err != nil {
+		t.Errorf("unexpected error on cancel: %s", err)
+	}
+}
+
+func TestBoundedBuffer(t *testing.T) {
+	b := &boundedBuffer{max: 4}
+	if n, err := b.Write([]byte("abc")); n != 3 || err != nil {
+		t.Errorf("expected 3 bytes written, got %d, %v", n, err)
+	}
+	if n, err := b.Write([]byte("def")); n != 3 || err != nil {
+		t.Errorf("expected the write to be reported complete, got %d, %v", n, err)
+	}
+	if b.String() != "abcd" {
+		t.Errorf("expected the first 4 bytes to be kept, got %q", b.String())
+	}
+}
+
+func TestDecodeDenoInfo(t *testing.T) {
+	legacy := `{
+		"module": "https://deno.land/x/oak@v10.0.0/mod.ts",
+		"depCount": 1,
+		"totalSize": 30,
+		"files": {
+			"https://deno.land/x/oak@v10.0.0/mod.ts": {"deps": ["https://deno.land/x/oak@v10.0.0/deps.ts"], "size": 20},
+			"https://deno.land/x/oak@v10.0.0/deps.ts": {"deps": [], "size": 10}
+		}
+	}`
+	graph := `{
+		"roots": ["https://deno.land/x/oak/mod.ts"],
+		"modules": [
+			{
+				"specifier": "https://deno.land/x/oak@v10.0.0/mod.ts",
+				"size": 20,
+				"dependencies": [
+					{"specifier": "./deps.ts", "code": {"specifier": "https://deno.land/x/oak@v10.0.0/deps.ts"}},
+					{"specifier": "./deps.ts", "code": "https://deno.land/x/oak@v10.0.0/deps.ts"}
+				]
+			},
+			{"specifier": "https://deno.land/x/oak@v10.0.0/deps.ts", "size": 10}
+		],
+		"redirects": {"https://deno.land/x/oak/mod.ts": "https://deno.land/x/oak@v10.0.0/mod.ts"}
+	}`
+
+	for name, raw := range map[string]string{"legacy": legacy, "graph": graph} {
+		t.Run(name, func(t *testing.T) {
+			info, err := decodeDenoInfo(strings.NewReader(raw))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if err := ValidateDenoInfo(info); err != nil {
+				t.Errorf("expected a valid info, got %s", err)
+			}
+			if info.Module != "https://deno.land/x/oak@v10.0.0/mod.ts" {
+				t.Errorf("unexpected module %s", info.Module)
+			}
+			if info.TotalSize != 30 {
+				t.Errorf("expected total size 30, got %d", info.TotalSize)
+			}
+			deps := info.Files["https://deno.land/x/oak@v10.0.0/mod.ts"].Deps
+			if len(deps) != 1 || deps[0] != "https://deno.land/x/oak@v10.0.0/deps.ts" {
+				t.Errorf("unexpected deps %v", deps)
+			}
+		})
+	}
+
+	if _, err := decodeDenoInfo(strings.NewReader(`{"foo": "bar"}`)); err != ErrUnknownInfoSchema {
+		t.Errorf("expected ErrUnknownInfoSchema, got %v", err)
+	}
+}
+
+func TestCheckDenoVersion(t *testing.T) {
+	cases := []struct {
+		output string
+		ok     bool
+	}{
+		{"deno 1.11.0 (release, x86_64-unknown-linux-gnu)\nv8 9.1.269.27\ntypescript 4.3.2\n", true},
+		{"deno " + MinDenoVersion + " (release, x86_64-apple-darwin)", true},
+		{"deno 1.0.0 (release, x86_64-unknown-linux-gnu)", false},
+		{"command not found", false},
+	}
+	for _, c := range cases {
+		if err := checkDenoVersion(c.output); (err == nil) != c.ok {
+			t.Errorf("checkDenoVersion(%q): expected ok=%t, got %v", c.output, c.ok, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package deno
+
+import (
+	"context"
+	"net/url"
+	"sync"
+)
+
+// DefaultInfoWorkers is the number of `deno info` subprocesses run in parallel
+// when no pool size is configured
+const DefaultInfoWorkers = 4
+
+// WorkItem is a specifier of a module version to run `deno info` on
+type WorkItem struct {
+	Module  string
+	Version string
+	URL     url.URL
+}
+
+// WorkResult is the outcome of running exec on a WorkItem
+type WorkResult struct {
+	Item WorkItem
+	Info DenoInfo
+	Err  error
+}
+
+// WorkerPool runs exec on the items received from in with n goroutines and
+// sends the results, in no particular order, to the returned channel. The
+// channel is closed once in is closed and every item is processed, or once ctx
+// is cancelled and the running workers have returned.
+func WorkerPool(ctx context.Context, n int, in <-chan WorkItem, exec func(WorkItem) (DenoInfo, error)) <-chan WorkResult {
+	if n <= 0 {
+		n = DefaultInfoWorkers
+	}
+
+	out := make(chan WorkResult)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var item WorkItem
+				var ok bool
+				select {
+				case <-ctx.Done():
+					return
+				case item, ok = <-in:
+					if !ok {
+						return
+					}
+				}
+
+				info, err := exec(item)
+				select {
+				case <-ctx.Done():
+					return
+				case out <- WorkResult{Item: item, Info: info, Err: err}:
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out
+}
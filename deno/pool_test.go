@@ -0,0 +1,72 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package deno
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool(t *testing.T) {
+	in := make(chan WorkItem)
+	go func() {
+		defer close(in)
+		for i := 0; i < 8; i++ {
+			in <- WorkItem{Module: "oak", Version: fmt.Sprintf("v%d.0.0", i)}
+		}
+	}()
+
+	var running, peak int32
+	exec := func(item WorkItem) (DenoInfo, error) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return DenoInfo{Module: item.Version}, nil
+	}
+
+	seen := make(map[string]bool)
+	for res := range WorkerPool(context.Background(), 4, in, exec) {
+		if res.Err != nil {
+			t.Fatalf("unexpected error: %s", res.Err)
+		}
+		if res.Info.Module != res.Item.Version {
+			t.Errorf("expected result of %s, got %s", res.Item.Version, res.Info.Module)
+		}
+		seen[res.Item.Version] = true
+	}
+
+	if len(seen) != 8 {
+		t.Errorf("expected 8 results, got %d", len(seen))
+	}
+	if peak > 4 {
+		t.Errorf("expected at most 4 concurrent workers, got %d", peak)
+	}
+}
+
+func TestWorkerPoolCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan WorkItem)
+	exec := func(item WorkItem) (DenoInfo, error) {
+		return DenoInfo{}, nil
+	}
+
+	out := WorkerPool(ctx, 2, in, exec)
+	cancel()
+
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Error("expected no results after cancellation")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the results channel to be closed after cancellation")
+	}
+}
@@ -3,16 +3,25 @@ package deno
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"reflect"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"github.com/cornelk/hashmap"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/wperron/depgraph/internal/awsutil"
 )
 
 // Queue interface for putting and getting messages. The interface doesn make
@@ -20,7 +29,10 @@ import (
 // interface implementation.
 type Queue interface {
 	Put(Module) error
-	Get() (Module, error)
+	Get(ctx context.Context) (Module, error)
+	// Nack sends a module that failed processing to the dead-letter queue
+	// along with the reason of the failure
+	Nack(Module, error) error
 	isOpened() bool
 }
 
@@ -30,7 +42,7 @@ type Queue interface {
 // of a Queue that uses a persistent back end like SQS or Kafka can be used.
 // This is necessary to be able to start and stop the crawler arbitrarily and
 // pick up where it left off
-func Enqueue(mods chan Module, q Queue) (chan Module, chan error) {
+func Enqueue(ctx context.Context, mods chan Module, q Queue) (chan Module, chan error) {
 	out := make(chan Module)
 	e := make(chan error)
 	go func() {
@@ -44,7 +56,10 @@ func Enqueue(mods chan Module, q Queue) (chan Module, chan error) {
 
 	go func() {
 		for q.isOpened() {
-			m, err := q.Get()
+			m, err := q.Get(ctx)
+			if ctx.Err() != nil {
+				return
+			}
 			if err != nil {
 				e <- err
 			}
@@ -58,13 +73,19 @@ func Enqueue(mods chan Module, q Queue) (chan Module, chan error) {
 // channel is unbuffered, Put and Get are blocking operations
 type ChanQueue struct {
 	mods   chan Module
+	dead   chan Module
 	closed bool
 }
 
+// deadLetterBuffer is the number of failed modules a ChanQueue holds before
+// Nack returns an error
+const deadLetterBuffer = 100
+
 // NewChanQueue returns a new ChanQueue instance
 func NewChanQueue(buf int) ChanQueue {
 	return ChanQueue{
 		mods: make(chan Module, buf),
+		dead: make(chan Module, deadLetterBuffer),
 	}
 }
 
@@ -74,50 +95,210 @@ func (q *ChanQueue) Put(m Module) error {
 	return nil
 }
 
-// Get gets the next message from the underlying channel
-func (q *ChanQueue) Get() (Module, error) {
-	m, ok := <-q.mods
-	if !ok {
-		q.closed = true
+// Get gets the next message from the underlying channel, or returns the
+// context's error if it is cancelled first
+func (q *ChanQueue) Get(ctx context.Context) (Module, error) {
+	select {
+	case <-ctx.Done():
+		return Module{}, ctx.Err()
+	case m, ok := <-q.mods:
+		if !ok {
+			q.closed = true
+		}
+		return m, nil
 	}
-	return m, nil
+}
+
+// Nack sends the module to the dead-letter channel. The reason is only logged.
+func (q *ChanQueue) Nack(m Module, reason error) error {
+	select {
+	case q.dead <- m:
+		slog.Warn("sent to the dead-letter channel", "module_name", m.Name, "reason", reason)
+		return nil
+	default:
+		return fmt.Errorf("dead-letter channel is full, dropping %s", m.Name)
+	}
+}
+
+// DeadLetters returns the channel of the modules that failed processing
+func (q *ChanQueue) DeadLetters() <-chan Module {
+	return q.dead
 }
 
 func (q *ChanQueue) isOpened() bool {
 	return !q.closed
 }
 
+// sqsClient is the subset of the sqs.Client used by SQSQueue
+type sqsClient interface {
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+	DeleteMessageBatch(ctx context.Context, params *sqs.DeleteMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error)
+	ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error)
+	GetQueueAttributes(ctx context.Context, params *sqs.GetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error)
+}
+
 // SQSQueue is a simple abstraction over the standard sqs.Client struct that
 // implements the Queue interface
 type SQSQueue struct {
-	queue    *sqs.Client
+	queue    sqsClient
 	queueURL *string
-	buf      chan Module
+	buf      chan sqsMessage
 	receipts *hashmap.HashMap
 	closed   bool
+	dlqURL   *string
+
+	// maxMsgs is the number of messages requested per ReceiveMessage call,
+	// between 1 and 10
+	maxMsgs int
+	// flushInterval is the longest time a deleted message waits for the
+	// pending deletes to fill a DeleteMessageBatch call
+	flushInterval time.Duration
+	// waitSeconds is how long ReceiveMessage waits for a message to arrive
+	// when the queue is empty, between 0 and 20
+	waitSeconds int32
+
+	mu      sync.Mutex
+	pending []string
+}
+
+// sqsMessage is a module received from SQS along with the receipt handle
+// needed to delete it
+type sqsMessage struct {
+	module  Module
+	receipt *string
+	// putID identifies the copies of a message written to several queues
+	putID string
 }
 
-// NewSQSQueue instantiates a new SQS Client with the given config
-func NewSQSQueue(c aws.Config, url string, buf int) *SQSQueue {
-	client := sqs.NewFromConfig(c)
+const (
+	// defaultMaxMessages is the maximum number of messages SQS returns per
+	// ReceiveMessage call
+	defaultMaxMessages = 10
+
+	// defaultLongPollSeconds is how long ReceiveMessage waits for a message
+	// to arrive when the queue is empty, the SQS maximum
+	defaultLongPollSeconds = 20
+
+	// deleteBatchSize is the maximum number of entries of a
+	// DeleteMessageBatch call
+	deleteBatchSize = 10
+
+	defaultDeleteFlushInterval = 5 * time.Second
+
+	// visibilityTimeout is how long, in seconds, a received message stays
+	// hidden from the other consumers, 3 hours (60 * 60 * 3)
+	visibilityTimeout = 10800
+
+	// keepAliveInterval is how often KeepAlive extends the visibility
+	// timeout, well before it expires
+	keepAliveInterval = visibilityTimeout / 2 * time.Second
+
+	// putIDAttribute is the message attribute holding the id shared by the
+	// copies of a message written by a MultiRegionSQSQueue
+	putIDAttribute = "put_id"
+
+	// maxSeenPutIDs is the number of put ids a MultiRegionSQSQueue remembers
+	// to drop the second copy of a message
+	maxSeenPutIDs = 10000
+
+	// maxNackReasonSize is the maximum number of bytes of the reason sent
+	// along with a failed module, the attributes count towards the 256KB
+	// limit of a message
+	maxNackReasonSize = 1024
+)
+
+// SQSQueueOption configures an SQSQueue before it starts polling the queue
+type SQSQueueOption func(*SQSQueue)
+
+// WithMaxMessages sets the number of messages requested per ReceiveMessage
+// call, clamped between 1 and 10
+func WithMaxMessages(n int) SQSQueueOption {
+	return func(s *SQSQueue) {
+		s.maxMsgs = n
+	}
+}
+
+// WithDeleteFlushInterval sets the longest time a deleted message waits for
+// the pending deletes to fill a DeleteMessageBatch call
+func WithDeleteFlushInterval(d time.Duration) SQSQueueOption {
+	return func(s *SQSQueue) {
+		if d > 0 {
+			s.flushInterval = d
+		}
+	}
+}
+
+// WithLongPollSeconds sets how long ReceiveMessage waits for a message to
+// arrive when the queue is empty, clamped between 0 and 20. 0 disables long
+// polling.
+func WithLongPollSeconds(n int) SQSQueueOption {
+	return func(s *SQSQueue) {
+		switch {
+		case n < 0:
+			n = 0
+		case n > defaultLongPollSeconds:
+			n = defaultLongPollSeconds
+		}
+		s.waitSeconds = int32(n)
+	}
+}
+
+// NewSQSQueueInRegion is like NewSQSQueue but the SQS client targets the region
+// instead of the region of the config. An empty region keeps the config's.
+func NewSQSQueueInRegion(ctx context.Context, c aws.Config, region, url string, buf int, opts ...SQSQueueOption) *SQSQueue {
+	return NewSQSQueue(ctx, withRegion(c, region), url, buf, opts...)
+}
+
+// withRegion returns a copy of the config targeting the region, or the config
+// itself if region is empty
+func withRegion(c aws.Config, region string) aws.Config {
+	if region == "" {
+		return c
+	}
+	c = c.Copy()
+	c.Region = region
+	return c
+}
+
+// NewSQSQueue instantiates a new SQS Client with the given config. The queue is
+// polled until the context is cancelled, at which point the pending deletes
+// are flushed.
+func NewSQSQueue(ctx context.Context, c aws.Config, url string, buf int, opts ...SQSQueueOption) *SQSQueue {
+	client := sqs.NewFromConfig(awsutil.WithCredentialsCache(c))
 	receipts := &hashmap.HashMap{}
 	q := &SQSQueue{
 		queue:    client,
 		queueURL: aws.String(url),
-		buf:      make(chan Module),
+		buf:      make(chan sqsMessage),
 		receipts: receipts,
+
+		maxMsgs:       defaultMaxMessages,
+		flushInterval: defaultDeleteFlushInterval,
+		waitSeconds:   defaultLongPollSeconds,
+	}
+	for _, opt := range opts {
+		opt(q)
 	}
+	go q.flushDeletes(ctx)
 
 	// start polling the queue asynchronously
 	go func() {
 		for {
-			out, err := client.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{
-				QueueUrl:          q.queueURL,
-				VisibilityTimeout: 10800, // 3 hours (60 * 60 * 3)
+			out, err := client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+				QueueUrl:              q.queueURL,
+				MaxNumberOfMessages:   q.maxMessages(),
+				WaitTimeSeconds:       q.waitSeconds,
+				VisibilityTimeout:     visibilityTimeout,
+				MessageAttributeNames: []string{putIDAttribute},
 			})
+			if ctx.Err() != nil {
+				slog.Info("received cancel signal, stopping SQS polling", "queue_url", url)
+				return
+			}
 
 			if err != nil {
-				log.Printf("error consuming SQS: %s\n", err)
+				slog.Error("error consuming SQS", "queue_url", url, "error", err)
 				continue
 			}
 
@@ -125,10 +306,17 @@ func NewSQSQueue(c aws.Config, url string, buf int) *SQSQueue {
 				var mod Module
 				err := json.Unmarshal([]byte(*m.Body), &mod)
 				if err != nil {
-					log.Printf("error unmarshalling message from SQS: %s\n", err)
+					slog.Error("error unmarshalling message from SQS", "queue_url", url, "error", err)
+				}
+				msg := sqsMessage{module: mod, receipt: m.ReceiptHandle}
+				if id, ok := m.MessageAttributes[putIDAttribute]; ok {
+					msg.putID = aws.ToString(id.StringValue)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case q.buf <- msg:
 				}
-				q.buf <- mod
-				receipts.Set(mod.Name, m.ReceiptHandle)
 			}
 		}
 	}()
@@ -136,49 +324,279 @@ func NewSQSQueue(c aws.Config, url string, buf int) *SQSQueue {
 	return q
 }
 
+// maxMessages returns maxMsgs clamped to the range accepted by SQS
+func (s *SQSQueue) maxMessages() int32 {
+	switch {
+	case s.maxMsgs < 1:
+		return 1
+	case s.maxMsgs > defaultMaxMessages:
+		return defaultMaxMessages
+	default:
+		return int32(s.maxMsgs)
+	}
+}
+
 // Put sends a message to SQS and returns any error encountered by the aws client
 func (s *SQSQueue) Put(m Module) error {
+	return s.put(m, "")
+}
+
+// put sends a message to SQS with the put id attribute, if any
+func (s *SQSQueue) put(m Module, putID string) error {
 	bs, err := json.Marshal(m)
 	if err != nil {
 		return err
 	}
 
-	_, err = s.queue.SendMessage(context.TODO(), &sqs.SendMessageInput{
+	in := &sqs.SendMessageInput{
 		QueueUrl:    s.queueURL,
 		MessageBody: aws.String(string(bs)),
-	})
+	}
+	if putID != "" {
+		in.MessageAttributes = map[string]types.MessageAttributeValue{
+			putIDAttribute: {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(putID),
+			},
+		}
+	}
+	_, err = s.queue.SendMessage(context.TODO(), in)
 	return err
 }
 
 // Get returns a single message either from the internal buffer queue or from
-// the SQS queue
-func (s *SQSQueue) Get() (Module, error) {
-	return <-s.buf, nil
+// the SQS queue, or the context's error if it is cancelled first
+func (s *SQSQueue) Get(ctx context.Context) (Module, error) {
+	select {
+	case <-ctx.Done():
+		return Module{}, ctx.Err()
+	case m := <-s.buf:
+		return s.received(m), nil
+	}
+}
+
+// received records the receipt handle of the message so that the module can
+// be deleted, and returns the module
+func (s *SQSQueue) received(m sqsMessage) Module {
+	s.receipts.Set(m.module.Name, m.receipt)
+	return m.module
+}
+
+// SetDeadLetterURL sets the SQS queue the failed modules are sent to by Nack
+func (s *SQSQueue) SetDeadLetterURL(url string) {
+	s.dlqURL = aws.String(url)
+}
+
+// Nack sends the module to the dead-letter queue with the reason of the
+// failure in the `error` message attribute, truncated to maxNackReasonSize
+func (s *SQSQueue) Nack(m Module, reason error) error {
+	if s.dlqURL == nil {
+		return fmt.Errorf("no dead-letter queue configured, dropping %s", m.Name)
+	}
+
+	bs, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.queue.SendMessage(context.TODO(), &sqs.SendMessageInput{
+		QueueUrl:    s.dlqURL,
+		MessageBody: aws.String(string(bs)),
+		MessageAttributes: map[string]types.MessageAttributeValue{
+			"error": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(truncateReason(reason.Error(), maxNackReasonSize)),
+			},
+		},
+	})
+	return err
+}
+
+// truncateReason returns the first max bytes of reason, without splitting a
+// UTF-8 character
+func truncateReason(reason string, max int) string {
+	if len(reason) <= max {
+		return reason
+	}
+	for max > 0 && !utf8.RuneStart(reason[max]) {
+		max--
+	}
+	return reason[:max]
 }
 
-// Delete uses the message's receipt handle to delete the message from the queue
+// Delete adds the message's receipt handle to the pending deletes. They are
+// deleted from the queue once there are enough to fill a DeleteMessageBatch
+// call, or after the flush interval. A failed flush is only logged, the
+// handles stay pending until the next one.
 func (s *SQSQueue) Delete(m Module) error {
-	val, ok := s.receipts.Get(m.Name)
+	handle, err := s.receipt(m.Name)
+	if err != nil {
+		return err
+	}
+	s.receipts.Del(m.Name)
+	s.deleteHandle(handle)
+	return nil
+}
+
+// deleteHandle adds the receipt handle to the pending deletes and flushes them
+// once they fill a DeleteMessageBatch call
+func (s *SQSQueue) deleteHandle(handle string) {
+	s.mu.Lock()
+	s.pending = append(s.pending, handle)
+	full := len(s.pending) >= deleteBatchSize
+	s.mu.Unlock()
+
+	if full {
+		if err := s.Flush(context.TODO()); err != nil {
+			slog.Error("failed to flush pending deletes", "queue_url", *s.queueURL, "error", err)
+		}
+	}
+}
+
+// receipt returns the receipt handle of the module's message
+func (s *SQSQueue) receipt(name string) (string, error) {
+	val, ok := s.receipts.Get(name)
 	if !ok {
-		return fmt.Errorf("no receipt for module %s", m.Name)
+		return "", fmt.Errorf("no receipt for module %s", name)
 	}
 
-	var handle string
-	if handle, ok = val.(string); ok {
+	if handle, ok := val.(string); ok {
+		return handle, nil
 	} else if ref, ok := val.(*string); ok {
-		handle = *ref
-	} else {
-		return fmt.Errorf("wrong type for key, got %s", reflect.TypeOf(val))
+		return *ref, nil
 	}
+	return "", fmt.Errorf("wrong type for key, got %s", reflect.TypeOf(val))
+}
 
-	if _, err := s.queue.DeleteMessage(context.TODO(), &sqs.DeleteMessageInput{
-		QueueUrl:      s.queueURL,
-		ReceiptHandle: &handle,
-	}); err != nil {
-		return err
+// KeepAlive extends the visibility timeout of the module's message until the
+// returned channel is closed or ctx is cancelled, so that the module isn't
+// received by another consumer while it is being processed
+func (s *SQSQueue) KeepAlive(ctx context.Context, mod Module) chan struct{} {
+	stop := make(chan struct{})
+	handle, err := s.receipt(mod.Name)
+	if err != nil {
+		slog.Warn("can't extend the visibility timeout", "queue_url", *s.queueURL, "module_name", mod.Name, "error", err)
+		return stop
 	}
 
-	return nil
+	go func() {
+		ticker := time.NewTicker(keepAliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			if _, err := s.queue.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+				QueueUrl:          s.queueURL,
+				ReceiptHandle:     aws.String(handle),
+				VisibilityTimeout: visibilityTimeout,
+			}); err != nil {
+				slog.Error("failed to extend the visibility timeout", "queue_url", *s.queueURL, "module_name", mod.Name, "error", err)
+			}
+		}
+	}()
+	return stop
+}
+
+// Flush deletes the pending messages from the queue. The messages that couldn't
+// be deleted are pending again, to be retried by the next flush.
+func (s *SQSQueue) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	handles := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	var retry []string
+	var err error
+	for len(handles) > 0 {
+		n := len(handles)
+		if n > deleteBatchSize {
+			n = deleteBatchSize
+		}
+		var failed []string
+		failed, err = s.deleteBatch(ctx, handles[:n])
+		retry = append(retry, failed...)
+		if err != nil {
+			// the remaining batches are likely to fail the same way
+			retry = append(retry, handles[n:]...)
+			break
+		}
+		handles = handles[n:]
+	}
+
+	if len(retry) > 0 {
+		s.mu.Lock()
+		s.pending = append(s.pending, retry...)
+		s.mu.Unlock()
+		if err == nil {
+			err = fmt.Errorf("failed to delete %d messages, retrying on the next flush", len(retry))
+		}
+	}
+	return err
+}
+
+// deleteBatch deletes the messages of the handles and returns the handles of
+// the messages that weren't deleted and can be retried. Failures caused by the
+// request, like an expired receipt handle, can't be retried and are dropped.
+func (s *SQSQueue) deleteBatch(ctx context.Context, handles []string) ([]string, error) {
+	entries := make([]types.DeleteMessageBatchRequestEntry, len(handles))
+	for i := range handles {
+		entries[i] = types.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(i)),
+			ReceiptHandle: aws.String(handles[i]),
+		}
+	}
+
+	out, err := s.queue.DeleteMessageBatch(ctx, &sqs.DeleteMessageBatchInput{
+		QueueUrl: s.queueURL,
+		Entries:  entries,
+	})
+	if err != nil {
+		return handles, fmt.Errorf("failed to delete %d messages: %s", len(handles), err)
+	}
+
+	var failed []string
+	for _, f := range out.Failed {
+		i, err := strconv.Atoi(aws.ToString(f.Id))
+		if err != nil || i < 0 || i >= len(handles) {
+			continue
+		}
+		if f.SenderFault {
+			slog.Warn("dropping message that can't be deleted", "queue_url", *s.queueURL, "code", aws.ToString(f.Code), "error", aws.ToString(f.Message))
+			continue
+		}
+		failed = append(failed, handles[i])
+	}
+	return failed, nil
+}
+
+// flushDeletes flushes the pending deletes every flush interval, and one last
+// time once ctx is cancelled
+func (s *SQSQueue) flushDeletes(ctx context.Context) {
+	interval := s.flushInterval
+	if interval <= 0 {
+		interval = defaultDeleteFlushInterval
+	}
+	for {
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if err := s.Flush(context.Background()); err != nil {
+				slog.Error("failed to flush pending deletes", "queue_url", *s.queueURL, "error", err)
+			}
+			return
+		case <-timer.C:
+			if err := s.Flush(ctx); err != nil {
+				slog.Error("failed to flush pending deletes", "queue_url", *s.queueURL, "error", err)
+			}
+		}
+	}
 }
 
 // Approx returns the approximate total number of messages in the queue, visible,
@@ -201,7 +619,7 @@ func (s *SQSQueue) Approx() (int, error) {
 	for _, v := range out.Attributes {
 		i, err := strconv.Atoi(v)
 		if err != nil {
-			log.Printf("couldn't convert value '%s' to an int\n", v)
+			slog.Warn("couldn't convert queue attribute to an int", "queue_url", *s.queueURL, "value", v)
 		}
 
 		total += i
@@ -209,6 +627,284 @@ func (s *SQSQueue) Approx() (int, error) {
 	return total, nil
 }
 
+// URL returns the URL of the queue
+func (s *SQSQueue) URL() string {
+	return *s.queueURL
+}
+
+// Ping gets an attribute of the queue to check that SQS is reachable
+func (s *SQSQueue) Ping(ctx context.Context) error {
+	if _, err := s.queue.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       s.queueURL,
+		AttributeNames: []types.QueueAttributeName{"QueueArn"},
+	}); err != nil {
+		return fmt.Errorf("failed to get queue attributes: %s", err)
+	}
+	return nil
+}
+
 func (s *SQSQueue) isOpened() bool {
 	return !s.closed
 }
+
+// MultiRegionSQSQueue writes every message to a primary and a replica SQS queue
+// in different regions and reads from whichever has messages available,
+// preferring the primary. Both copies of a message share a put id, the second
+// one received is deleted instead of being returned by Get.
+type MultiRegionSQSQueue struct {
+	primary *SQSQueue
+	replica *SQSQueue
+
+	mu   sync.Mutex
+	seen map[string]bool
+	// order holds the seen put ids from the oldest to the newest
+	order []string
+}
+
+// NewMultiRegionSQSQueue instantiates the primary and replica SQSQueue
+func NewMultiRegionSQSQueue(ctx context.Context, primaryCfg aws.Config, primaryURL string, replicaCfg aws.Config, replicaURL string) *MultiRegionSQSQueue {
+	return &MultiRegionSQSQueue{
+		primary: NewSQSQueue(ctx, primaryCfg, primaryURL, 0),
+		replica: NewSQSQueue(ctx, replicaCfg, replicaURL, 0),
+		seen:    make(map[string]bool),
+	}
+}
+
+// newPutID returns a random id shared by the copies of a message
+func newPutID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// firstCopy reports whether the message with the put id wasn't received
+// before. The second copy of a message is forgotten once received.
+func (m *MultiRegionSQSQueue) firstCopy(putID string) bool {
+	if putID == "" {
+		return true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.seen[putID] {
+		delete(m.seen, putID)
+		return false
+	}
+
+	m.seen[putID] = true
+	m.order = append(m.order, putID)
+	// the order can hold ids already forgotten, it is trimmed along with the
+	// oldest ids
+	if len(m.order) > 2*maxSeenPutIDs {
+		for _, id := range m.order[:len(m.order)-maxSeenPutIDs] {
+			delete(m.seen, id)
+		}
+		m.order = append([]string(nil), m.order[len(m.order)-maxSeenPutIDs:]...)
+	}
+	return true
+}
+
+// Put sends the message to both queues in parallel. An error is only returned
+// if neither queue accepted the message.
+func (m *MultiRegionSQSQueue) Put(mod Module) error {
+	putID := newPutID()
+	errs := make(chan error, 2)
+	for _, q := range []*SQSQueue{m.primary, m.replica} {
+		go func(q *SQSQueue) {
+			errs <- q.put(mod, putID)
+		}(q)
+	}
+
+	var first error
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err == nil {
+			return nil
+		} else if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Get returns the next message of the primary queue if one is available, or
+// the first message of either queue otherwise. The second copy of a message
+// is deleted from its queue and skipped.
+func (m *MultiRegionSQSQueue) Get(ctx context.Context) (Module, error) {
+	for {
+		q, msg, err := m.next(ctx)
+		if err != nil {
+			return Module{}, err
+		}
+		if m.firstCopy(msg.putID) {
+			return q.received(msg), nil
+		}
+		q.deleteHandle(aws.ToString(msg.receipt))
+	}
+}
+
+// next returns the next message of either queue, preferring the primary
+func (m *MultiRegionSQSQueue) next(ctx context.Context) (*SQSQueue, sqsMessage, error) {
+	select {
+	case msg := <-m.primary.buf:
+		return m.primary, msg, nil
+	default:
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, sqsMessage{}, ctx.Err()
+	case msg := <-m.primary.buf:
+		return m.primary, msg, nil
+	case msg := <-m.replica.buf:
+		return m.replica, msg, nil
+	}
+}
+
+// Delete removes the message from every queue it was received from
+func (m *MultiRegionSQSQueue) Delete(mod Module) error {
+	deleted := false
+	var first error
+	for _, q := range []*SQSQueue{m.primary, m.replica} {
+		if _, ok := q.receipts.Get(mod.Name); !ok {
+			continue
+		}
+		if err := q.Delete(mod); err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		deleted = true
+	}
+
+	if !deleted && first == nil {
+		return fmt.Errorf("no receipt for module %s", mod.Name)
+	}
+	return first
+}
+
+// Flush deletes the pending messages from both queues
+func (m *MultiRegionSQSQueue) Flush(ctx context.Context) error {
+	if err := m.primary.Flush(ctx); err != nil {
+		return err
+	}
+	return m.replica.Flush(ctx)
+}
+
+// Approx returns the sum of the approximate number of messages in both queues
+func (m *MultiRegionSQSQueue) Approx() (int, error) {
+	p, err := m.primary.Approx()
+	if err != nil {
+		return -1, err
+	}
+	r, err := m.replica.Approx()
+	if err != nil {
+		return -1, err
+	}
+	return p + r, nil
+}
+
+// Nack sends the module to the dead-letter queue of the primary queue
+func (m *MultiRegionSQSQueue) Nack(mod Module, reason error) error {
+	return m.primary.Nack(mod, reason)
+}
+
+func (m *MultiRegionSQSQueue) isOpened() bool {
+	return m.primary.isOpened() || m.replica.isOpened()
+}
+
+// ErrQueueClosed is returned by Get once the queue is closed
+var ErrQueueClosed = errors.New("queue is closed")
+
+// redisList is the subset of the redis.Client used by RedisQueue
+type redisList interface {
+	LPush(ctx context.Context, key string, values ...interface{}) *redis.IntCmd
+	BRPop(ctx context.Context, timeout time.Duration, keys ...string) *redis.StringSliceCmd
+}
+
+// RedisQueue implements the Queue interface with a Redis list. Messages are
+// pushed to the head of the list and popped from its tail, so they are
+// consumed in order. It only needs a local Redis server, e.g.
+// `docker run -p 6379:6379 redis`.
+type RedisQueue struct {
+	client  redisList
+	key     string
+	timeout time.Duration
+	closed  int32
+}
+
+// NewRedisQueue returns a RedisQueue using the list at key. Get blocks for at
+// most timeout on each pop so that Close is noticed.
+func NewRedisQueue(c *redis.Client, key string, timeout time.Duration) *RedisQueue {
+	return &RedisQueue{
+		client:  c,
+		key:     key,
+		timeout: timeout,
+	}
+}
+
+// Put pushes the JSON encoded module to the head of the list
+func (r *RedisQueue) Put(m Module) error {
+	bs, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := r.client.LPush(context.TODO(), r.key, string(bs)).Err(); err != nil {
+		return fmt.Errorf("failed to push %s to redis: %s", m.Name, err)
+	}
+	return nil
+}
+
+// Get pops the module at the tail of the list, waiting for one to be pushed
+// until the queue is closed or the context is cancelled
+func (r *RedisQueue) Get(ctx context.Context) (Module, error) {
+	for r.isOpened() {
+		res, err := r.client.BRPop(ctx, r.timeout, r.key).Result()
+		if ctx.Err() != nil {
+			return Module{}, ctx.Err()
+		}
+		if err == redis.Nil {
+			// the pop timed out, check whether the queue was closed meanwhile
+			continue
+		}
+		if err != nil {
+			return Module{}, fmt.Errorf("failed to pop from redis: %s", err)
+		}
+
+		// the result is the name of the list followed by the value
+		var mod Module
+		if err := json.Unmarshal([]byte(res[1]), &mod); err != nil {
+			return Module{}, fmt.Errorf("error unmarshalling message from redis: %s", err)
+		}
+		return mod, nil
+	}
+	return Module{}, ErrQueueClosed
+}
+
+// Delete is a no-op, the message is removed from the list when it is popped
+func (r *RedisQueue) Delete(m Module) error {
+	return nil
+}
+
+// Nack pushes the module to the `<key>:dead` list. The reason is only logged.
+func (r *RedisQueue) Nack(m Module, reason error) error {
+	bs, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := r.client.LPush(context.TODO(), r.key+":dead", string(bs)).Err(); err != nil {
+		return fmt.Errorf("failed to push %s to the dead-letter list: %s", m.Name, err)
+	}
+	slog.Warn("sent to the dead-letter list", "module_name", m.Name, "reason", reason)
+	return nil
+}
+
+// Close stops Get from waiting for new messages. The client isn't closed.
+func (r *RedisQueue) Close() {
+	atomic.StoreInt32(&r.closed, 1)
+}
+
+func (r *RedisQueue) isOpened() bool {
+	return atomic.LoadInt32(&r.closed) == 0
+}
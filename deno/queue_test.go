@@ -0,0 +1,428 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package deno
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/cornelk/hashmap"
+	"github.com/redis/go-redis/v9"
+	"pgregory.net/rapid"
+)
+
+func genListing() *rapid.Generator {
+	return rapid.Custom(func(t *rapid.T) directoryListing {
+		return directoryListing{
+			Path: rapid.StringMatching(`(/[a-z0-9_.-]{1,10}){1,4}`).Draw(t, "path").(string),
+			Size: rapid.IntRange(0, 1<<20).Draw(t, "size").(int),
+			Type: rapid.StringMatching(`file|dir`).Draw(t, "type").(string),
+		}
+	})
+}
+
+func genModule() *rapid.Generator {
+	version := rapid.StringMatching(`v[0-9]{1,2}\.[0-9]{1,2}\.[0-9]{1,2}`)
+	uploadedAt := rapid.Custom(func(t *rapid.T) time.Time {
+		return time.Unix(rapid.Int64Range(0, 1<<33).Draw(t, "sec").(int64), rapid.Int64Range(0, 999999999).Draw(t, "nsec").(int64)).UTC()
+	})
+	meta := rapid.Custom(func(t *rapid.T) ModuleMetadata {
+		return ModuleMetadata{
+			Name:        rapid.String().Draw(t, "name").(string),
+			Description: rapid.String().Draw(t, "description").(string),
+			StarCount:   rapid.IntRange(0, 100000).Draw(t, "stars").(int),
+			IsUnlisted:  rapid.Bool().Draw(t, "unlisted").(bool),
+			Tags:        rapid.SliceOf(rapid.String()).Draw(t, "tags").([]string),
+			Owner:       rapid.String().Draw(t, "owner").(string),
+			RepoURL:     rapid.String().Draw(t, "repo").(string),
+		}
+	})
+
+	return rapid.Custom(func(t *rapid.T) Module {
+		return Module{
+			Name:        rapid.String().Draw(t, "name").(string),
+			Versions:    rapid.MapOf(version, rapid.SliceOf(genListing())).Draw(t, "versions").(map[string][]directoryListing),
+			Readmes:     rapid.MapOf(version, rapid.String()).Draw(t, "readmes").(map[string]string),
+			UploadedAt:  rapid.MapOf(version, uploadedAt).Draw(t, "uploaded_at").(map[string]time.Time),
+			LicenseFile: rapid.String().Draw(t, "license").(string),
+			Metadata:    rapid.Ptr(meta, true).Draw(t, "metadata").(*ModuleMetadata),
+		}
+	})
+}
+
+// equalModules compares the modules the way a queue consumer sees them: nil
+// and empty maps and slices are equal, times are compared with time.Equal
+func equalModules(a, b Module) bool {
+	if a.Name != b.Name || a.LicenseFile != b.LicenseFile {
+		return false
+	}
+	if len(a.Versions) != len(b.Versions) || len(a.Readmes) != len(b.Readmes) || len(a.UploadedAt) != len(b.UploadedAt) {
+		return false
+	}
+	for v, la := range a.Versions {
+		lb, ok := b.Versions[v]
+		if !ok || len(la) != len(lb) || (len(la) > 0 && !reflect.DeepEqual(la, lb)) {
+			return false
+		}
+	}
+	for v, r := range a.Readmes {
+		if b.Readmes[v] != r {
+			return false
+		}
+	}
+	for v, at := range a.UploadedAt {
+		if !at.Equal(b.UploadedAt[v]) {
+			return false
+		}
+	}
+
+	if (a.Metadata == nil) != (b.Metadata == nil) {
+		return false
+	}
+	if a.Metadata != nil {
+		ma, mb := *a.Metadata, *b.Metadata
+		if len(ma.Tags) == 0 && len(mb.Tags) == 0 {
+			ma.Tags, mb.Tags = nil, nil
+		}
+		return reflect.DeepEqual(ma, mb)
+	}
+	return true
+}
+
+func TestModuleJSONRoundTrip(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		mod := genModule().Draw(t, "module").(Module)
+
+		b, err := json.Marshal(mod)
+		if err != nil {
+			t.Fatalf("failed to marshal module: %s", err)
+		}
+		var actual Module
+		if err := json.Unmarshal(b, &actual); err != nil {
+			t.Fatalf("failed to unmarshal module: %s", err)
+		}
+
+		if !equalModules(mod, actual) {
+			t.Fatalf("module didn't round-trip:\nexpected %+v\ngot      %+v", mod, actual)
+		}
+	})
+}
+
+func TestWithRegion(t *testing.T) {
+	cfg := aws.Config{Region: "us-east-1"}
+
+	if got := withRegion(cfg, "eu-west-1"); got.Region != "eu-west-1" {
+		t.Errorf("expected region eu-west-1, got %s", got.Region)
+	}
+	if cfg.Region != "us-east-1" {
+		t.Errorf("expected the original config to be unchanged, got %s", cfg.Region)
+	}
+	if got := withRegion(cfg, ""); got.Region != "us-east-1" {
+		t.Errorf("expected the config region to be kept, got %s", got.Region)
+	}
+}
+
+// memoryList is a redisList backed by a slice
+type memoryList struct {
+	mu     sync.Mutex
+	values []string
+}
+
+func (l *memoryList) LPush(ctx context.Context, key string, values ...interface{}) *redis.IntCmd {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, v := range values {
+		l.values = append([]string{v.(string)}, l.values...)
+	}
+	return redis.NewIntResult(int64(len(l.values)), nil)
+}
+
+func (l *memoryList) BRPop(ctx context.Context, timeout time.Duration, keys ...string) *redis.StringSliceCmd {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.values) == 0 {
+		time.Sleep(timeout)
+		return redis.NewStringSliceResult(nil, redis.Nil)
+	}
+	v := l.values[len(l.values)-1]
+	l.values = l.values[:len(l.values)-1]
+	return redis.NewStringSliceResult([]string{keys[0], v}, nil)
+}
+
+func TestRedisQueue(t *testing.T) {
+	q := &RedisQueue{client: &memoryList{}, key: "modules", timeout: time.Millisecond}
+
+	for _, name := range []string{"oak", "abc"} {
+		if err := q.Put(Module{Name: name}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	for _, expected := range []string{"oak", "abc"} {
+		m, err := q.Get(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if m.Name != expected {
+			t.Errorf("expected %s, got %s", expected, m.Name)
+		}
+	}
+
+	// Get keeps waiting on an empty list until the queue is closed
+	got := make(chan error)
+	go func() {
+		_, err := q.Get(context.Background())
+		got <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if !q.isOpened() {
+		t.Fatal("expected the queue to be opened before Close")
+	}
+	q.Close()
+	if err := <-got; err != ErrQueueClosed {
+		t.Errorf("expected ErrQueueClosed, got %v", err)
+	}
+	if q.isOpened() {
+		t.Error("expected the queue to be closed")
+	}
+}
+
+func TestChanQueueGetCancelled(t *testing.T) {
+	q := NewChanQueue(0)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	got := make(chan error)
+	go func() {
+		_, err := q.Get(ctx)
+		got <- err
+	}()
+	cancel()
+
+	select {
+	case err := <-got:
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Get to return once the context is cancelled")
+	}
+}
+
+func TestChanQueueNack(t *testing.T) {
+	q := NewChanQueue(0)
+	if err := q.Nack(Module{Name: "oak"}, fmt.Errorf("deno info timed out")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	select {
+	case m := <-q.DeadLetters():
+		if m.Name != "oak" {
+			t.Errorf("expected oak in the dead letters, got %s", m.Name)
+		}
+	default:
+		t.Fatal("expected a module in the dead letters")
+	}
+}
+
+func TestSQSQueueMaxMessages(t *testing.T) {
+	cases := map[int]int32{0: 1, 1: 1, 5: 5, 10: 10, 25: 10}
+	for n, expected := range cases {
+		q := &SQSQueue{}
+		WithMaxMessages(n)(q)
+		if got := q.maxMessages(); got != expected {
+			t.Errorf("WithMaxMessages(%d): expected %d, got %d", n, expected, got)
+		}
+	}
+}
+
+func TestSQSQueueLongPollSeconds(t *testing.T) {
+	cases := map[int]int32{-1: 0, 0: 0, 5: 5, 20: 20, 30: 20}
+	for n, expected := range cases {
+		q := &SQSQueue{}
+		WithLongPollSeconds(n)(q)
+		if q.waitSeconds != expected {
+			t.Errorf("WithLongPollSeconds(%d): expected %d, got %d", n, expected, q.waitSeconds)
+		}
+	}
+}
+
+// fakeSQS is an sqsClient answering DeleteMessageBatch with the results of
+// its deletes function, in order, and recording the messages sent
+type fakeSQS struct {
+	sqsClient
+	mu      sync.Mutex
+	deletes []func(in *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error)
+	batches [][]string
+	sent    []*sqs.SendMessageInput
+}
+
+func (f *fakeSQS) SendMessage(ctx context.Context, in *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, in)
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func (f *fakeSQS) DeleteMessageBatch(ctx context.Context, in *sqs.DeleteMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var handles []string
+	for _, e := range in.Entries {
+		handles = append(handles, *e.ReceiptHandle)
+	}
+	f.batches = append(f.batches, handles)
+	if len(f.deletes) == 0 {
+		return &sqs.DeleteMessageBatchOutput{}, nil
+	}
+	next := f.deletes[0]
+	f.deletes = f.deletes[1:]
+	return next(in)
+}
+
+func TestSQSQueueFlushRetriesFailedDeletes(t *testing.T) {
+	fake := &fakeSQS{deletes: []func(*sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error){
+		func(in *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error) {
+			return &sqs.DeleteMessageBatchOutput{Failed: []types.BatchResultErrorEntry{
+				{Id: in.Entries[1].Id, Code: aws.String("InternalError")},
+				{Id: in.Entries[2].Id, Code: aws.String("ReceiptHandleIsInvalid"), SenderFault: true},
+			}}, nil
+		},
+		func(in *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error) {
+			return nil, fmt.Errorf("connection reset")
+		},
+	}}
+	q := &SQSQueue{queue: fake, queueURL: aws.String("https://sqs.example.com/queue")}
+	for i := 0; i < 12; i++ {
+		q.pending = append(q.pending, fmt.Sprintf("h%d", i))
+	}
+
+	if err := q.Flush(context.Background()); err == nil {
+		t.Fatal("expected the failed deletes to be reported")
+	}
+	// the retryable failure of the first batch and the unsent second batch
+	expected := []string{"h1", "h10", "h11"}
+	if !reflect.DeepEqual(q.pending, expected) {
+		t.Errorf("expected %v to be pending, got %v", expected, q.pending)
+	}
+
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(q.pending) != 0 {
+		t.Errorf("expected no pending deletes, got %v", q.pending)
+	}
+	if last := fake.batches[len(fake.batches)-1]; !reflect.DeepEqual(last, expected) {
+		t.Errorf("expected the pending deletes to be retried, got %v", last)
+	}
+}
+
+func TestSQSQueueDeleteIgnoresFlushErrors(t *testing.T) {
+	fake := &fakeSQS{deletes: []func(*sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error){
+		func(in *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error) {
+			return nil, fmt.Errorf("connection reset")
+		},
+	}}
+	q := &SQSQueue{queue: fake, queueURL: aws.String("https://sqs.example.com/queue"), receipts: &hashmap.HashMap{}}
+	for i := 0; i < deleteBatchSize; i++ {
+		m := q.received(sqsMessage{module: Module{Name: fmt.Sprintf("mod%d", i)}, receipt: aws.String(fmt.Sprintf("h%d", i))})
+		if err := q.Delete(m); err != nil {
+			t.Errorf("expected the failed flush not to be returned to %s, got %s", m.Name, err)
+		}
+	}
+	if len(fake.batches) != 1 || len(q.pending) != deleteBatchSize {
+		t.Errorf("expected a single flush leaving %d pending deletes, got %d flushes and %d pending", deleteBatchSize, len(fake.batches), len(q.pending))
+	}
+}
+
+func TestSQSQueueNack(t *testing.T) {
+	fake := &fakeSQS{}
+	q := &SQSQueue{queue: fake, queueURL: aws.String("https://sqs.example.com/queue")}
+	if err := q.Nack(Module{Name: "oak"}, fmt.Errorf("deno info failed")); err == nil {
+		t.Error("expected an error without a dead-letter queue")
+	}
+
+	q.SetDeadLetterURL("https://sqs.example.com/dlq")
+	reason := fmt.Errorf("deno info failed: %s", strings.Repeat("é", maxNackReasonSize))
+	if err := q.Nack(Module{Name: "oak"}, reason); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(fake.sent) != 1 || *fake.sent[0].QueueUrl != "https://sqs.example.com/dlq" {
+		t.Fatalf("expected the module to be sent to the dead-letter queue, got %v", fake.sent)
+	}
+	got := *fake.sent[0].MessageAttributes["error"].StringValue
+	if len(got) > maxNackReasonSize || !utf8.ValidString(got) || !strings.HasPrefix(got, "deno info failed: ") {
+		t.Errorf("expected the reason to be truncated to %d bytes of valid UTF-8, got %d bytes", maxNackReasonSize, len(got))
+	}
+}
+
+func TestMultiRegionSQSQueueDedupe(t *testing.T) {
+	newQueue := func(url string) (*SQSQueue, *fakeSQS) {
+		fake := &fakeSQS{}
+		return &SQSQueue{queue: fake, queueURL: aws.String(url), buf: make(chan sqsMessage, 2), receipts: &hashmap.HashMap{}}, fake
+	}
+	primary, primarySQS := newQueue("https://sqs.us-east-1.example.com/queue")
+	replica, replicaSQS := newQueue("https://sqs.eu-west-1.example.com/queue")
+	m := &MultiRegionSQSQueue{primary: primary, replica: replica, seen: make(map[string]bool)}
+
+	if err := m.Put(Module{Name: "oak"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// Put returns as soon as one of the queues accepted the module
+	putIDs := func(f *fakeSQS) []string {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		var ids []string
+		for _, in := range f.sent {
+			ids = append(ids, *in.MessageAttributes[putIDAttribute].StringValue)
+		}
+		return ids
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(putIDs(primarySQS))+len(putIDs(replicaSQS)) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	primaryIDs, replicaIDs := putIDs(primarySQS), putIDs(replicaSQS)
+	if len(primaryIDs) != 1 || len(replicaIDs) != 1 {
+		t.Fatalf("expected the module to be sent to both queues, got %v and %v", primaryIDs, replicaIDs)
+	}
+	putID := primaryIDs[0]
+	if putID == "" || replicaIDs[0] != putID {
+		t.Fatalf("expected both copies to share a put id, got %v and %v", primaryIDs, replicaIDs)
+	}
+
+	// both copies are received, the replica's after the primary's
+	replica.buf <- sqsMessage{module: Module{Name: "oak"}, receipt: aws.String("replica-oak"), putID: putID}
+	primary.buf <- sqsMessage{module: Module{Name: "oak"}, receipt: aws.String("primary-oak"), putID: putID}
+	replica.buf <- sqsMessage{module: Module{Name: "abc"}, receipt: aws.String("replica-abc")}
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		mod, err := m.Get(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got = append(got, mod.Name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if mod, err := m.Get(ctx); err == nil {
+		t.Errorf("expected the second copy of oak to be skipped, got %s", mod.Name)
+	}
+	if fmt.Sprint(got) != "[oak abc]" {
+		t.Errorf("expected oak then abc, got %v", got)
+	}
+	if !reflect.DeepEqual(replica.pending, []string{"replica-oak"}) {
+		t.Errorf("expected the second copy to be deleted, got %v", replica.pending)
+	}
+	if len(m.seen) != 0 {
+		t.Errorf("expected the put id to be forgotten once both copies are received, got %v", m.seen)
+	}
+}
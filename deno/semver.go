@@ -0,0 +1,150 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package deno
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// semver is a parsed semantic version. Build metadata is ignored since it has
+// no bearing on precedence.
+type semver struct {
+	major, minor, patch int
+	pre                 string
+}
+
+// parseSemver parses version strings of the form `1.2.3`, `v1.2.3` or
+// `v1.2.3-rc.1`. The minor and patch components are optional, which is common
+// for tags on deno.land/x (e.g. `v1` or `v1.2`).
+func parseSemver(s string) (semver, bool) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+
+	var v semver
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		v.pre = s[i+1:]
+		s = s[:i]
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) == 0 || len(parts) > 3 {
+		return semver{}, false
+	}
+
+	nums := [3]int{}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return semver{}, false
+		}
+		nums[i] = n
+	}
+	v.major, v.minor, v.patch = nums[0], nums[1], nums[2]
+	return v, true
+}
+
+// compare returns -1, 0 or 1 if v is respectively lower than, equal to or
+// greater than o. A pre-release version has a lower precedence than the
+// associated normal version.
+func (v semver) compare(o semver) int {
+	for _, d := range []int{v.major - o.major, v.minor - o.minor, v.patch - o.patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+
+	switch {
+	case v.pre == o.pre:
+		return 0
+	case v.pre == "":
+		return 1
+	case o.pre == "":
+		return -1
+	case v.pre < o.pre:
+		return -1
+	default:
+		return 1
+	}
+}
+
+type comparator struct {
+	op      string
+	version semver
+}
+
+func (c comparator) check(v semver) bool {
+	cmp := v.compare(c.version)
+	switch c.op {
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case "!=":
+		return cmp != 0
+	default:
+		return cmp == 0
+	}
+}
+
+// versionConstraint is a set of comparators that must all be satisfied by a
+// version, e.g. `>=0.50.0 <1.0.0`
+type versionConstraint []comparator
+
+// parseConstraint parses a space or comma separated list of comparators.
+// Supported operators are `=`, `!=`, `>`, `>=`, `<` and `<=`; a version
+// without an operator is an exact match.
+func parseConstraint(s string) (versionConstraint, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty version constraint")
+	}
+
+	c := make(versionConstraint, 0, len(fields))
+	for _, f := range fields {
+		op := strings.TrimRight(f, "v0123456789.-+abcdefghijklmnopqrstuwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+		if op == "" {
+			op = "="
+		}
+
+		switch op {
+		case "=", "!=", ">", ">=", "<", "<=":
+		default:
+			return nil, fmt.Errorf("invalid operator '%s' in constraint '%s'", op, s)
+		}
+
+		v, ok := parseSemver(strings.TrimPrefix(f, op))
+		if !ok {
+			return nil, fmt.Errorf("invalid version in constraint '%s'", s)
+		}
+		c = append(c, comparator{op: op, version: v})
+	}
+	return c, nil
+}
+
+// check reports whether the version satisfies every comparator of the
+// constraint. Versions that aren't valid semver never satisfy a constraint.
+func (c versionConstraint) check(version string) bool {
+	v, ok := parseSemver(version)
+	if !ok {
+		return false
+	}
+
+	for _, comp := range c {
+		if !comp.check(v) {
+			return false
+		}
+	}
+	return true
+}
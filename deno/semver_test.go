@@ -0,0 +1,41 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package deno
+
+import "testing"
+
+func TestParseConstraint(t *testing.T) {
+	cases := []struct {
+		constraint string
+		version    string
+		expected   bool
+	}{
+		{">=0.100.0", "v0.100.0", true},
+		{">=0.100.0", "v0.1.0", false},
+		{">=1.0.0 <2.0.0", "v1.5.2", true},
+		{">=1.0.0, <2.0.0", "v2.0.0", false},
+		{"1.2.3", "v1.2.3", true},
+		{"!=1.2.3", "v1.2.3", false},
+		{">1.0.0", "v1.0.1-rc.1", true},
+		{">=1.0.0", "v1.0.0-rc.1", false},
+		{">=1.0.0", "main", false},
+	}
+
+	for _, c := range cases {
+		vc, err := parseConstraint(c.constraint)
+		if err != nil {
+			t.Errorf("failed to parse constraint '%s': %s", c.constraint, err)
+			continue
+		}
+		if actual := vc.check(c.version); actual != c.expected {
+			t.Errorf("expected '%s' check on %s to be %t, got %t", c.constraint, c.version, c.expected, actual)
+		}
+	}
+}
+
+func TestParseConstraintInvalid(t *testing.T) {
+	for _, c := range []string{"", "~>1.0.0", ">=foo"} {
+		if _, err := parseConstraint(c); err == nil {
+			t.Errorf("expected an error parsing constraint '%s'", c)
+		}
+	}
+}
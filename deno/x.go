@@ -5,64 +5,550 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 const CDN_HOST = "cdn.deno.land"
 const API_HOST = "api.deno.land"
 const PREFIX_LENGTH = len("https://deno.land/x/")
 
+// STD_MODULE is the name of the standard library. Unlike third party modules
+// it is served from https://deno.land/std rather than https://deno.land/x/
+const STD_MODULE = "std"
+
+var (
+	modulesSkippedTooLarge prometheus.Counter
+	modulesFilteredByOwner prometheus.Counter
+	modulesNotModified     prometheus.Counter
+	modulesFiltered        prometheus.Counter
+)
+
+func init() {
+	modulesSkippedTooLarge = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "modules_skipped_too_large_total",
+			Help: "A counter of modules skipped because they exceed the validation limits",
+		},
+	)
+
+	modulesFilteredByOwner = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "modules_filtered_by_owner_total",
+			Help: "A counter of modules skipped because they aren't published by the owner set with WithOwnerFilter",
+		},
+	)
+
+	modulesNotModified = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "modules_not_modified_total",
+			Help: "A counter of modules skipped because their versions haven't changed since the last crawl",
+		},
+	)
+
+	modulesFiltered = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "modules_filtered_total",
+			Help: "A counter of modules skipped because they are rejected by the filter set with WithFilter",
+		},
+	)
+
+	prometheus.MustRegister(modulesSkippedTooLarge, modulesFilteredByOwner, modulesNotModified, modulesFiltered)
+}
+
+// maxReadmeSize is the maximum number of bytes read from a module's README
+const maxReadmeSize = 100 * 1024
+
 // XQueuedCrawler is a composite type composed of both a Queue and a Crawler
 type XQueuedCrawler struct {
 	Client
-	done chan bool
 	Queue
+
+	// mu guards the done and stop channels of the latest crawl and the
+	// concurrency, crawling is held while a crawl runs
+	mu       sync.Mutex
+	done     chan bool
+	stop     chan struct{}
+	crawling sync.Mutex
+
+	versionConstraint    versionConstraint
+	stdVersionConstraint versionConstraint
+	uploadedAfter        time.Time
+	pruneVersions        VersionPruner
+	maxModules           int
+	maxConcurrency       int
+	validation           ValidationConfig
+	owner                string
+	blocklist            []string
+	versionChecker       VersionChecker
+	filter               FilterFunc
+}
+
+// defaultMaxConcurrency is the number of modules crawled concurrently during a
+// crawl
+const defaultMaxConcurrency = 20
+
+// VersionChecker reports whether a module version was already indexed by a
+// previous crawl
+type VersionChecker interface {
+	IsIndexed(module, version string) (bool, error)
+}
+
+// VersionPruner removes the versions of a module that are no longer listed on
+// the CDN from the index and returns the number of versions removed
+type VersionPruner func(ctx context.Context, module string, currentVersions []string) (int, error)
+
+// ErrStopTimeout is returned by Stop when the crawl doesn't finish within the
+// timeout
+var ErrStopTimeout = errors.New("timed out waiting for the crawler to stop")
+
+// XQueuedCrawlerOption configures optional behavior of an XQueuedCrawler
+type XQueuedCrawlerOption func(*XQueuedCrawler) error
+
+// WithVersionConstraint only crawls the module versions that satisfy the
+// semver constraint (e.g. `>=1.0.0 <2.0.0`)
+func WithVersionConstraint(constraint string) XQueuedCrawlerOption {
+	return func(x *XQueuedCrawler) error {
+		c, err := parseConstraint(constraint)
+		if err != nil {
+			return err
+		}
+		x.versionConstraint = c
+		return nil
+	}
+}
+
+// WithUploadedAfter only crawls the module versions that were uploaded after t,
+// which allows time-windowed incremental crawls
+func WithUploadedAfter(t time.Time) XQueuedCrawlerOption {
+	return func(x *XQueuedCrawler) error {
+		x.uploadedAfter = t
+		return nil
+	}
+}
+
+// WithVersionPruner calls the pruner with the list of versions of each module
+// listed on the CDN, so that yanked versions can be removed from the index
+func WithVersionPruner(p VersionPruner) XQueuedCrawlerOption {
+	return func(x *XQueuedCrawler) error {
+		x.pruneVersions = p
+		return nil
+	}
+}
+
+// WithStdVersionConstraint only crawls the versions of deno.land/std that
+// satisfy the semver constraint. It takes precedence over the constraint set
+// with WithVersionConstraint for the std module.
+func WithStdVersionConstraint(constraint string) XQueuedCrawlerOption {
+	return func(x *XQueuedCrawler) error {
+		c, err := parseConstraint(constraint)
+		if err != nil {
+			return err
+		}
+		x.stdVersionConstraint = c
+		return nil
+	}
+}
+
+// WithMaxModules limits the number of modules crawled. A value of 0 means
+// there is no limit.
+func WithMaxModules(n int) XQueuedCrawlerOption {
+	return func(x *XQueuedCrawler) error {
+		if n < 0 {
+			return fmt.Errorf("max modules must be positive, got %d", n)
+		}
+		x.maxModules = n
+		return nil
+	}
+}
+
+// WithMaxConcurrency limits the number of modules crawled concurrently by
+// Crawl. The versions of a module are fetched while it holds its slot, so the
+// limit also bounds the version fetches.
+func WithMaxConcurrency(n int) XQueuedCrawlerOption {
+	return func(x *XQueuedCrawler) error {
+		if n <= 0 {
+			return fmt.Errorf("max concurrency must be greater than 0, got %d", n)
+		}
+		x.maxConcurrency = n
+		return nil
+	}
+}
+
+// WithMaxConcurrentVersionFetches limits the number of modules for which the
+// versions are fetched concurrently.
+//
+// Deprecated: use WithMaxConcurrency.
+func WithMaxConcurrentVersionFetches(n int) XQueuedCrawlerOption {
+	return WithMaxConcurrency(n)
+}
+
+// WithVersionChecker skips the versions already indexed according to c, their
+// directory listing isn't fetched. Forced crawls still fetch every version.
+func WithVersionChecker(c VersionChecker) XQueuedCrawlerOption {
+	return func(x *XQueuedCrawler) error {
+		x.versionChecker = c
+		return nil
+	}
+}
+
+// WithConditionalRequests sends conditional requests for the versions of the
+// crawled modules using the ETags stored in cache. Modules and versions that
+// haven't changed since the last crawl are skipped unless the crawl is forced.
+func WithConditionalRequests(cache ETagCache) XQueuedCrawlerOption {
+	return func(x *XQueuedCrawler) error {
+		c, ok := x.Client.(*throttledClient)
+		if !ok {
+			return errors.New("conditional requests are not supported by the crawler's client")
+		}
+		c.etags = cache
+		return nil
+	}
+}
+
+// WithOwnerFilter only crawls the modules whose GitHub repository belongs to
+// owner. The comparison is case-insensitive.
+func WithOwnerFilter(owner string) XQueuedCrawlerOption {
+	return func(x *XQueuedCrawler) error {
+		if owner == "" {
+			return fmt.Errorf("owner filter must not be empty")
+		}
+		x.owner = owner
+		return nil
+	}
+}
+
+// WithFilter only crawls the modules for which f returns true. The filter is
+// applied to the names of the listed modules, before their versions are
+// fetched. Forced crawls of a single module aren't filtered.
+func WithFilter(f FilterFunc) XQueuedCrawlerOption {
+	return func(x *XQueuedCrawler) error {
+		x.filter = f
+		return nil
+	}
+}
+
+// WithSpecifierBlocklist skips the specifiers matching any of the glob
+// patterns. Patterns are matched with path.Match against the full URL, so `*`
+// doesn't cross a `/`.
+func WithSpecifierBlocklist(patterns []string) XQueuedCrawlerOption {
+	return func(x *XQueuedCrawler) error {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid blocklist pattern %q: %s", p, err)
+			}
+		}
+		x.blocklist = append(x.blocklist, patterns...)
+		return nil
+	}
+}
+
+// WithSpecifierBlocklistFile reads the blocklist patterns from a file, one
+// glob per line. Empty lines and lines starting with `#` are ignored.
+func WithSpecifierBlocklistFile(file string) XQueuedCrawlerOption {
+	return func(x *XQueuedCrawler) error {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read blocklist file: %s", err)
+		}
+		var patterns []string
+		for _, line := range strings.Split(string(b), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			patterns = append(patterns, line)
+		}
+		return WithSpecifierBlocklist(patterns)(x)
+	}
+}
+
+// WithValidation skips the modules that exceed the limits of the config
+func WithValidation(cfg ValidationConfig) XQueuedCrawlerOption {
+	return func(x *XQueuedCrawler) error {
+		if cfg.MaxVersions < 0 || cfg.MaxFilesPerVersion < 0 {
+			return fmt.Errorf("validation limits must not be negative, got %+v", cfg)
+		}
+		x.validation = cfg
+		return nil
+	}
+}
+
+// ValidationConfig limits the size of the modules that get indexed. A zero
+// value means there is no limit.
+type ValidationConfig struct {
+	MaxVersions        int
+	MaxFilesPerVersion int
+}
+
+// ValidateModule returns an error if the module exceeds the limits of the
+// config
+func ValidateModule(m Module, cfg ValidationConfig) error {
+	if err := cfg.checkVersions(len(m.Versions)); err != nil {
+		return err
+	}
+	for v, files := range m.Versions {
+		if err := cfg.checkFiles(v, len(files)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkVersions returns an error if n versions exceed the limit
+func (cfg ValidationConfig) checkVersions(n int) error {
+	if cfg.MaxVersions > 0 && n > cfg.MaxVersions {
+		return fmt.Errorf("%d versions exceeds the limit of %d", n, cfg.MaxVersions)
+	}
+	return nil
+}
+
+// checkFiles returns an error if n files in the version exceed the limit
+func (cfg ValidationConfig) checkFiles(version string, n int) error {
+	if cfg.MaxFilesPerVersion > 0 && n > cfg.MaxFilesPerVersion {
+		return fmt.Errorf("%d files in version %s exceeds the limit of %d", n, version, cfg.MaxFilesPerVersion)
+	}
+	return nil
+}
+
+// skipModule records a module skipped for exceeding the validation limits
+func skipModule(mod string, err error) {
+	// large modules are skipped on purpose, it isn't a crawl error
+	modulesSkippedTooLarge.Inc()
+	slog.Warn("skipping module", "module_name", mod, "error", err)
 }
 
 type apiResponse struct {
-	Success bool        `json:"success"`
-	Data    interface{} `json:"data"`
+	Success bool            `json:"success"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// ModuleMetadata is the metadata of a module returned by the deno.land API
+type ModuleMetadata struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	StarCount   int      `json:"star_count"`
+	IsUnlisted  bool     `json:"is_unlisted"`
+	Tags        []string `json:"tags"`
+	Owner       string   `json:"owner"`
+	RepoURL     string   `json:"repo_url"`
+}
+
+// moduleMetadataResponse is the shape of the `data` field of the API response
+// for a single module
+type moduleMetadataResponse struct {
+	Name          string   `json:"name"`
+	Description   string   `json:"description"`
+	StarCount     int      `json:"star_count"`
+	IsUnlisted    bool     `json:"is_unlisted"`
+	Tags          []string `json:"tags"`
+	UploadOptions struct {
+		Type       string `json:"type"`
+		Repository string `json:"repository"`
+	} `json:"upload_options"`
 }
 
 // Module contains the name of the volume and a map of all its versions to all
 // the files contained in the module
+//
+// Modules are sent through the queue as JSON. Empty Readmes and UploadedAt maps
+// are decoded as nil maps and the UploadedAt times lose their monotonic clock
+// reading and location, they must be compared with time.Equal.
 type Module struct {
-	Name     string
-	Versions map[string][]directoryListing
+	Name        string
+	Versions    map[string][]directoryListing
+	Readmes     map[string]string    `json:",omitempty"`
+	UploadedAt  map[string]time.Time `json:",omitempty"`
+	LicenseFile string               `json:",omitempty"`
+	Metadata    *ModuleMetadata      `json:",omitempty"`
 }
 
 type simpleModuleList []string
 
+// searchPageSize is the number of results requested per page of the search
+// endpoint
+const searchPageSize = 100
+
+// searchResponse is the shape of the `data` field of the API response for a
+// module search
+type searchResponse struct {
+	TotalCount int `json:"total_count"`
+	Results    []struct {
+		Name string `json:"name"`
+	} `json:"results"`
+}
+
 type versions struct {
-	Latest   string   `json:"latest"`
 	Versions []string `json:"versions"`
 }
 
+// Sorted returns a copy of the versions sorted in descending semver order.
+// Versions that aren't valid semver are appended after in lexicographic order.
+func (v *versions) Sorted() []string {
+	sorted := make([]string, len(v.Versions))
+	copy(sorted, v.Versions)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, aok := parseSemver(sorted[i])
+		b, bok := parseSemver(sorted[j])
+		switch {
+		case aok && bok:
+			return a.compare(b) > 0
+		case aok != bok:
+			return aok
+		default:
+			return sorted[i] < sorted[j]
+		}
+	})
+	return sorted
+}
+
+// Latest returns the highest semver version of the module. The `latest` field
+// returned by the CDN isn't used since it can be stale.
+func (v *versions) Latest() string {
+	sorted := v.Sorted()
+	if len(sorted) == 0 {
+		return ""
+	}
+	return sorted[0]
+}
+
 type meta struct {
-	UploadedAt       string             `json:"uploaded_at"`
+	UploadedAt       time.Time          `json:"uploaded_at"`
 	DirectoryListing []directoryListing `json:"directory_listing"`
 }
 
+// UnmarshalJSON parses the `uploaded_at` field as an RFC3339 timestamp. An
+// empty or missing timestamp results in the zero time.
+func (m *meta) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		UploadedAt       string             `json:"uploaded_at"`
+		DirectoryListing []directoryListing `json:"directory_listing"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	m.DirectoryListing = raw.DirectoryListing
+	m.UploadedAt = time.Time{}
+	if raw.UploadedAt == "" {
+		return nil
+	}
+
+	t, err := time.Parse(time.RFC3339, raw.UploadedAt)
+	if err != nil {
+		return fmt.Errorf("invalid uploaded_at timestamp: %s", err)
+	}
+	m.UploadedAt = t
+	return nil
+}
+
 type directoryListing struct {
 	Path string `json:"path"`
 	Size int    `json:"size"`
 	Type string `json:"type"`
 }
 
+// DirNode is a node of the virtual directory tree of a module version. Leaf
+// nodes are files and internal nodes are directories.
+type DirNode struct {
+	Name     string
+	Path     string
+	Type     string
+	Size     int
+	Children []*DirNode
+}
+
+// BuildDirectoryTree reconstructs the directory tree from the flat directory
+// listing of a module version. Directories that are missing from the listing
+// are created implicitly.
+func BuildDirectoryTree(listings []directoryListing) *DirNode {
+	root := &DirNode{Type: "dir"}
+	for _, l := range listings {
+		prefix := ""
+		if strings.HasPrefix(l.Path, "/") {
+			prefix = "/"
+		}
+		parts := strings.Split(strings.Trim(l.Path, "/"), "/")
+
+		node := root
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+
+			child := node.child(part)
+			if child == nil {
+				child = &DirNode{
+					Name: part,
+					Path: prefix + strings.Join(parts[:i+1], "/"),
+					Type: "dir",
+				}
+				node.Children = append(node.Children, child)
+			}
+			node = child
+		}
+
+		if node != root {
+			node.Path = l.Path
+			node.Type = l.Type
+			node.Size = l.Size
+		}
+	}
+	return root
+}
+
+func (n *DirNode) child(name string) *DirNode {
+	for _, c := range n.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Flatten returns the flat directory listing of the tree in depth-first order,
+// excluding the root node
+func (n *DirNode) Flatten() []directoryListing {
+	var out []directoryListing
+	for _, c := range n.Children {
+		out = append(out, directoryListing{
+			Path: c.Path,
+			Size: c.Size,
+			Type: c.Type,
+		})
+		out = append(out, c.Flatten()...)
+	}
+	return out
+}
+
 // NewXQueuedCrawler returns an instance of a crawler for https://deno.land with
 // a Queue
-func NewXQueuedCrawler(q Queue) *XQueuedCrawler {
-	return &XQueuedCrawler{
-		Client: NewInstrumentedClient(),
-		Queue:  q,
+func NewXQueuedCrawler(q Queue, opts ...XQueuedCrawlerOption) (*XQueuedCrawler, error) {
+	x := &XQueuedCrawler{
+		Client:         NewInstrumentedClient(),
+		Queue:          q,
+		maxConcurrency: defaultMaxConcurrency,
 	}
+
+	for _, opt := range opts {
+		if err := opt(x); err != nil {
+			return nil, err
+		}
+	}
+	return x, nil
 }
 
 // IterateModules asynchronously consumes the queue and sends each Module to a
@@ -72,19 +558,21 @@ func (x *XQueuedCrawler) IterateModules(ctx context.Context) (chan Module, chan
 	errs := make(chan error)
 
 	go func() {
-		// TODO(wperron) add a ctx param to the function and a select statement
-		//  to exit the infinite loop
 		for {
 			select {
 			case <-ctx.Done():
-				log.Println("received cancel signal, closing IterateModules goroutine")
+				slog.Info("received cancel signal, closing IterateModules goroutine")
 				close(out)
 				close(errs)
 				return
 			default:
 			}
 
-			mod, err := x.Queue.Get()
+			mod, err := x.Queue.Get(ctx)
+			if ctx.Err() != nil {
+				// the select above closes the channels on the next iteration
+				continue
+			}
 			if err != nil {
 				errs <- err
 			} else {
@@ -96,14 +584,20 @@ func (x *XQueuedCrawler) IterateModules(ctx context.Context) (chan Module, chan
 	return out, errs
 }
 
-var closedchan = make(chan bool)
-
-func init() {
-	close(closedchan)
+// IsBlocked reports whether the specifier matches the blocklist
+func (x *XQueuedCrawler) IsBlocked(specifier string) bool {
+	for _, p := range x.blocklist {
+		if ok, _ := path.Match(p, specifier); ok {
+			return true
+		}
+	}
+	return false
 }
 
-// Done returns the done channel of the crawler
+// Done returns the channel closed once the latest crawl is finished
 func (x *XQueuedCrawler) Done() <-chan bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
 	if x.done == nil {
 		x.done = make(chan bool)
 	}
@@ -111,77 +605,407 @@ func (x *XQueuedCrawler) Done() <-chan bool {
 }
 
 // Crawl asynchronously crawls https://deno.land and puts each Module in the
-// queue to be processed later
+// queue to be processed later. The returned channel is closed once the crawl
+// is finished. If a crawl is already running, Crawl waits for it to finish
+// first.
 func (x *XQueuedCrawler) Crawl(ctx context.Context) chan error {
+	return x.crawl(ctx, false, nil)
+}
+
+// Recrawl is like Crawl but runs reset once the running crawl, if any, is
+// finished and crawls every version of every module again, like CrawlModule
+// does when forced. No other crawl starts between reset and the end of the
+// recrawl. If reset fails, nothing is crawled and its error is sent on the
+// returned channel.
+func (x *XQueuedCrawler) Recrawl(ctx context.Context, reset func(ctx context.Context) error) chan error {
+	return x.crawl(ctx, true, reset)
+}
+
+func (x *XQueuedCrawler) crawl(ctx context.Context, force bool, reset func(ctx context.Context) error) chan error {
 	errs := make(chan error)
+	var once sync.Once
+	closeErrs := func() { once.Do(func() { close(errs) }) }
+
+	x.crawling.Lock()
+	done := make(chan bool)
+	stop := make(chan struct{}, 1)
+	x.mu.Lock()
+	x.done, x.stop = done, stop
+	x.mu.Unlock()
 
 	go func() {
-		if x.done == closedchan || x.done == nil {
-			x.done = make(chan bool)
+		defer x.crawling.Unlock()
+		if reset != nil {
+			if err := reset(ctx); err != nil {
+				errs <- err
+				closeErrs()
+				close(done)
+				return
+			}
 		}
 
 		list, err := x.listAllModules()
 		if err != nil {
 			errs <- err
-			close(errs)
+			closeErrs()
+			close(done)
 			return
 		}
 
 		wg := sync.WaitGroup{}
-		for mod := range list {
+		x.mu.Lock()
+		limit := x.maxConcurrency
+		x.mu.Unlock()
+		if limit <= 0 {
+			limit = defaultMaxConcurrency
+		}
+		sem := make(chan struct{}, limit)
+	loop:
+		for {
+			var mod string
+			var ok bool
+			select {
+			case <-ctx.Done():
+				break loop
+			case <-stop:
+				break loop
+			case mod, ok = <-list:
+				if !ok {
+					break loop
+				}
+			}
+
+			if x.filter != nil && !x.filter(mod) {
+				modulesFiltered.Inc()
+				continue
+			}
+
 			wg.Add(1)
+			sem <- struct{}{}
 			go func(mod string, wg *sync.WaitGroup) {
-				select {
-				case <-ctx.Done():
+				defer func() {
+					<-sem
 					wg.Done()
-					return
-				default:
-				}
+				}()
 
-				v, err := x.listModuleVersions(mod)
-				if err != nil {
+				if err := x.crawlModule(ctx, mod, force, errs); err != nil {
 					errs <- err
-					return
 				}
+			}(mod, &wg)
+		}
+		// unblock the listing goroutine if the loop exited early
+		go func() {
+			for range list {
+			}
+		}()
+		wg.Wait()
+		closeErrs()
+		close(done)
+	}()
 
-				versionMap := make(map[string][]directoryListing)
+	return errs
+}
 
-				for _, ver := range v.Versions {
-					select {
-					case <-ctx.Done():
-						wg.Done()
-						return
-					default:
-					}
+// Stop signals the running crawl to stop listing new modules and waits up to
+// timeout for the modules already being crawled to finish. Unlike cancelling
+// the context passed to Crawl, it doesn't interrupt the downstream stages.
+func (x *XQueuedCrawler) Stop(timeout time.Duration) error {
+	x.mu.Lock()
+	done, stop := x.done, x.stop
+	x.mu.Unlock()
+	if done == nil || stop == nil {
+		return nil
+	}
+	select {
+	case stop <- struct{}{}:
+	default:
+	}
 
-					dir, err := x.getModuleVersionDirectoryListing(mod, ver)
-					if err != nil {
-						errs <- err
-						return
-					}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		return ErrStopTimeout
+	}
+}
 
-					dir = stripUselessEntries(dir)
-					versionMap[ver] = dir
-				}
+// CrawlSearch asynchronously pages through at most maxPages pages of the
+// modules matching query on deno.land and puts each of them in the queue. The
+// returned channel is closed once the search is exhausted.
+func (x *XQueuedCrawler) CrawlSearch(ctx context.Context, query string, maxPages int) chan error {
+	errs := make(chan error)
 
-				err = x.Queue.Put(Module{
-					Name:     mod,
-					Versions: versionMap,
-				})
+	go func() {
+		defer close(errs)
+		seen := 0
+		for page := 1; page <= maxPages; page++ {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			names, total, err := x.searchModules(ctx, query, page)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for _, mod := range names {
+				m, processed, err := x.fetchModule(ctx, mod, false, errs)
 				if err != nil {
 					errs <- err
+					continue
 				}
-				wg.Done()
-			}(mod, &wg)
+				if m == nil {
+					continue
+				}
+				if err := x.Queue.Put(*m); err != nil {
+					errs <- err
+					continue
+				}
+				processed()
+			}
+
+			seen += len(names)
+			if len(names) == 0 || seen >= total {
+				return
+			}
 		}
-		wg.Wait()
-		x.done <- true
-		close(x.done)
 	}()
 
 	return errs
 }
 
+// SetMaxConcurrency changes the number of modules crawled concurrently, the
+// default if n is 0. It applies from the next crawl.
+func (x *XQueuedCrawler) SetMaxConcurrency(n int) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if n <= 0 {
+		n = defaultMaxConcurrency
+	}
+	x.maxConcurrency = n
+}
+
+// MaxConcurrency returns the number of modules crawled concurrently
+func (x *XQueuedCrawler) MaxConcurrency() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.maxConcurrency
+}
+
+// SetRequestsPerSecond changes the throttle rate of the crawler's client if it
+// supports it. It reports whether the rate was applied.
+func (x *XQueuedCrawler) SetRequestsPerSecond(rps int) bool {
+	t, ok := x.Client.(interface{ SetRequestsPerSecond(int) })
+	if !ok {
+		return false
+	}
+	t.SetRequestsPerSecond(rps)
+	return true
+}
+
+// allowVersion reports whether the version of the module satisfies the
+// version constraints of the crawler
+func (x *XQueuedCrawler) allowVersion(mod, version string) bool {
+	c := x.versionConstraint
+	if mod == STD_MODULE && x.stdVersionConstraint != nil {
+		c = x.stdVersionConstraint
+	}
+
+	if c == nil {
+		return true
+	}
+	return c.check(version)
+}
+
+// CrawlModule crawls a single module and puts it in the queue. When force is
+// true, the versions uploaded before the crawl window set with
+// WithUploadedAfter are crawled as well.
+func (x *XQueuedCrawler) CrawlModule(ctx context.Context, mod string, force bool) error {
+	warnings := make(chan error)
+	done := make(chan error, 1)
+	go func() {
+		done <- x.crawlModule(ctx, mod, force, warnings)
+		close(warnings)
+	}()
+
+	for w := range warnings {
+		slog.Warn("warning while crawling", "module_name", mod, "error", w)
+	}
+	return <-done
+}
+
+// crawlModule fetches the versions of a module and puts it in the queue.
+// Errors that don't prevent the module from being indexed are sent to
+// warnings.
+func (x *XQueuedCrawler) crawlModule(ctx context.Context, mod string, force bool, warnings chan<- error) error {
+	m, processed, err := x.fetchModule(ctx, mod, force, warnings)
+	if err != nil || m == nil {
+		return err
+	}
+	if err := x.Queue.Put(*m); err != nil {
+		return err
+	}
+	processed()
+	return nil
+}
+
+// fetchModule fetches the versions of a module. It returns a nil module if
+// there is nothing to index, otherwise processed must be called once the
+// module is queued.
+func (x *XQueuedCrawler) fetchModule(ctx context.Context, mod string, force bool, warnings chan<- error) (*Module, func(), error) {
+	select {
+	case <-ctx.Done():
+		return nil, nil, nil
+	default:
+	}
+
+	metadata, err := x.GetModuleMetadata(ctx, mod)
+	if err != nil {
+		// metadata is optional, the module can still be indexed
+		warnings <- err
+	}
+
+	if x.owner != "" && (metadata == nil || !strings.EqualFold(metadata.Owner, x.owner)) {
+		modulesFilteredByOwner.Inc()
+		return nil, nil, nil
+	}
+
+	// unchanged versions are only skipped when the crawl isn't forced
+	cctx := ctx
+	if !force {
+		cctx = conditional(ctx)
+	}
+
+	v, err := x.listVersions(cctx, mod)
+	if err == ErrNotModified {
+		modulesNotModified.Inc()
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	// a module that failed is fetched in full on the next crawl
+	processed := func() { x.storeETags(cctx) }
+
+	// the limits are checked before fetching the metadata of every version
+	if err := x.validation.checkVersions(len(v.Versions)); err != nil {
+		skipModule(mod, err)
+		processed()
+		return nil, nil, nil
+	}
+
+	if x.pruneVersions != nil {
+		if _, err := x.pruneVersions(ctx, mod, v.Versions); err != nil {
+			warnings <- err
+		}
+	}
+
+	versionMap := make(map[string][]directoryListing)
+	readmes := make(map[string]string)
+	uploadedAt := make(map[string]time.Time)
+	licenses := make(map[string]string)
+
+	for _, ver := range v.Versions {
+		select {
+		case <-ctx.Done():
+			return nil, nil, nil
+		default:
+		}
+
+		if !x.allowVersion(mod, ver) {
+			continue
+		}
+
+		if x.versionChecker != nil && !force {
+			indexed, err := x.versionChecker.IsIndexed(mod, ver)
+			if err != nil {
+				// crawl the version anyway, indexing is idempotent
+				warnings <- err
+			} else if indexed {
+				continue
+			}
+		}
+
+		m, err := x.getModuleVersionMeta(cctx, mod, ver)
+		if err == ErrNotModified {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if !force && !x.uploadedAfter.IsZero() && !m.UploadedAt.After(x.uploadedAfter) {
+			continue
+		}
+
+		if f, ok := DetectLicense(m.DirectoryListing); ok {
+			licenses[ver] = f
+		}
+
+		dir := stripUselessEntries(m.DirectoryListing)
+		if err := x.validation.checkFiles(ver, len(dir)); err != nil {
+			skipModule(mod, err)
+			processed()
+			return nil, nil, nil
+		}
+		versionMap[ver] = dir
+		uploadedAt[ver] = m.UploadedAt
+
+		if hasReadme(dir) {
+			readme, err := x.FetchReadme(ctx, mod, ver)
+			if err != nil {
+				warnings <- err
+			} else if readme != "" {
+				readmes[ver] = readme
+			}
+		}
+	}
+
+	if len(versionMap) == 0 {
+		// every version was filtered out, nothing to index
+		processed()
+		return nil, nil, nil
+	}
+
+	// the license of the module is the one of its latest version
+	var licenseFile string
+	for _, ver := range v.Sorted() {
+		if f, ok := licenses[ver]; ok {
+			licenseFile = f
+			break
+		}
+	}
+
+	m := Module{
+		Name:        mod,
+		Versions:    versionMap,
+		Readmes:     readmes,
+		UploadedAt:  uploadedAt,
+		LicenseFile: licenseFile,
+		Metadata:    metadata,
+	}
+	return &m, processed, nil
+}
+
+// storeETags stores the ETags of the responses received with the conditional
+// context in the cache of the client, if any
+func (x *XQueuedCrawler) storeETags(ctx context.Context) {
+	if c, ok := x.Client.(*throttledClient); ok && c.etags != nil {
+		storeETags(ctx, c.etags)
+	}
+}
+
+// ClearETags removes the ETags stored by the crawls with conditional requests,
+// the next crawl fetches every module in full
+func (x *XQueuedCrawler) ClearETags() {
+	if c, ok := x.Client.(*throttledClient); ok && c.etags != nil {
+		c.etags.Clear()
+	}
+}
+
 func (x *XQueuedCrawler) listAllModules() (chan string, error) {
 	out := make(chan string, 100)
 
@@ -210,24 +1034,122 @@ func (x *XQueuedCrawler) listAllModules() (chan string, error) {
 		return nil, errors.Errorf("failed to unmarshal response body: %s", err)
 	}
 
+	if x.maxModules > 0 && len(moduleList) > x.maxModules {
+		moduleList = moduleList[:x.maxModules]
+	}
+
 	go func() {
 		for _, mod := range moduleList {
 			out <- mod
 		}
+		close(out)
 	}()
 
 	return out, nil
 }
 
-func (x *XQueuedCrawler) listModuleVersions(mod string) (versions, error) {
+// searchModules returns the names of the modules on the given page of the
+// search results and the total number of results
+func (x *XQueuedCrawler) searchModules(ctx context.Context, query string, page int) ([]string, int, error) {
+	u := url.URL{
+		Scheme:   "https",
+		Host:     API_HOST,
+		Path:     "modules",
+		RawQuery: url.Values{"query": {query}, "limit": {fmt.Sprint(searchPageSize)}, "page": {fmt.Sprint(page)}}.Encode(),
+	}
+	req, _ := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+
+	resp, err := x.DoRequest(req)
+	if err != nil {
+		return nil, 0, errors.Errorf("failed to search modules for %q: %s", query, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	var r apiResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, 0, errors.Errorf("failed to unmarshal response body: %s", err)
+	}
+	if !r.Success {
+		return nil, 0, errors.Errorf("unsuccessful API response: %s", string(r.Data))
+	}
+
+	var data searchResponse
+	if err := json.Unmarshal(r.Data, &data); err != nil {
+		return nil, 0, errors.Errorf("failed to unmarshal search results: %s", err)
+	}
+	names := make([]string, 0, len(data.Results))
+	for _, res := range data.Results {
+		names = append(names, res.Name)
+	}
+	return names, data.TotalCount, nil
+}
+
+// GetModuleMetadata returns the metadata of the module from the deno.land API
+func (x *XQueuedCrawler) GetModuleMetadata(ctx context.Context, name string) (*ModuleMetadata, error) {
+	u := url.URL{
+		Scheme: "https",
+		Host:   API_HOST,
+		Path:   fmt.Sprintf("modules/%s", name),
+	}
+	req, _ := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+
+	resp, err := x.DoRequest(req)
+	if err != nil {
+		return nil, errors.Errorf("failed to get metadata for module %s: %s", name, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseModuleMetadata(body)
+}
+
+func parseModuleMetadata(body []byte) (*ModuleMetadata, error) {
+	var r apiResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, errors.Errorf("failed to unmarshal response body: %s", err)
+	}
+	if !r.Success {
+		return nil, errors.Errorf("unsuccessful API response: %s", string(r.Data))
+	}
+
+	var data moduleMetadataResponse
+	if err := json.Unmarshal(r.Data, &data); err != nil {
+		return nil, errors.Errorf("failed to unmarshal module metadata: %s", err)
+	}
+
+	m := &ModuleMetadata{
+		Name:        data.Name,
+		Description: data.Description,
+		StarCount:   data.StarCount,
+		IsUnlisted:  data.IsUnlisted,
+		Tags:        data.Tags,
+	}
+	if data.UploadOptions.Type == "github" && data.UploadOptions.Repository != "" {
+		m.Owner = strings.SplitN(data.UploadOptions.Repository, "/", 2)[0]
+		m.RepoURL = fmt.Sprintf("https://github.com/%s", data.UploadOptions.Repository)
+	}
+	return m, nil
+}
+
+func (x *XQueuedCrawler) listModuleVersions(ctx context.Context, mod string) (versions, error) {
 	u := url.URL{
 		Scheme: "https",
 		Host:   CDN_HOST,
 		Path:   fmt.Sprintf("%s/meta/versions.json", mod),
 	}
-	req, _ := http.NewRequest("GET", u.String(), nil)
+	req, _ := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
 
 	resp, err := x.DoRequest(req)
+	if err == ErrNotModified {
+		return versions{}, err
+	}
 	if err != nil {
 		return versions{}, errors.Errorf("failed to get versions for module %s: %s\n", mod, err)
 	}
@@ -246,30 +1168,212 @@ func (x *XQueuedCrawler) listModuleVersions(mod string) (versions, error) {
 	return ver, nil
 }
 
-func (x *XQueuedCrawler) getModuleVersionDirectoryListing(mod, version string) ([]directoryListing, error) {
+// GetLatestVersion returns the latest version of the module published on the
+// CDN
+func (x *XQueuedCrawler) GetLatestVersion(ctx context.Context, mod string) (string, error) {
+	v, err := x.listModuleVersions(ctx, mod)
+	if err != nil {
+		return "", err
+	}
+
+	latest := v.Latest()
+	if latest == "" {
+		return "", errors.Errorf("no versions found for module %s", mod)
+	}
+	return latest, nil
+}
+
+// IterateStdVersions asynchronously fetches the versions of deno.land/std and
+// sends each of them to a channel, from the latest to the oldest
+func (x *XQueuedCrawler) IterateStdVersions(ctx context.Context) (chan string, chan error) {
+	out := make(chan string)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(out)
+		defer close(errs)
+
+		v, err := x.listModuleVersions(ctx, STD_MODULE)
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		for _, ver := range v.Sorted() {
+			select {
+			case <-ctx.Done():
+				return
+			case out <- ver:
+			}
+		}
+	}()
+
+	return out, errs
+}
+
+// GetStdDirectoryListing returns the directory listing of a version of
+// deno.land/std
+func (x *XQueuedCrawler) GetStdDirectoryListing(ctx context.Context, version string) ([]directoryListing, error) {
+	m, err := x.getModuleVersionMeta(ctx, STD_MODULE, version)
+	if err != nil {
+		return []directoryListing{}, err
+	}
+	return m.DirectoryListing, nil
+}
+
+// listVersions returns the versions of the module, the versions of std are
+// listed with IterateStdVersions
+func (x *XQueuedCrawler) listVersions(ctx context.Context, mod string) (versions, error) {
+	if mod != STD_MODULE {
+		return x.listModuleVersions(ctx, mod)
+	}
+
+	out, errs := x.IterateStdVersions(ctx)
+	var v versions
+	for ver := range out {
+		v.Versions = append(v.Versions, ver)
+	}
+	// errs is closed before out
+	return v, <-errs
+}
+
+// SpecifierURL returns the URL of a file of a module version on deno.land
+func SpecifierURL(mod, version, path string) url.URL {
+	p := fmt.Sprintf("x/%s@%s/%s", mod, version, path)
+	if mod == STD_MODULE {
+		p = fmt.Sprintf("%s@%s/%s", mod, version, path)
+	}
+
+	return url.URL{
+		Scheme: "https",
+		Host:   "deno.land",
+		Path:   p,
+	}
+}
+
+// getModuleVersionMeta returns the upload time and the normalised directory
+// listing of a module version
+func (x *XQueuedCrawler) getModuleVersionMeta(ctx context.Context, mod, version string) (meta, error) {
 	u := url.URL{
 		Scheme: "https",
 		Host:   CDN_HOST,
 		Path:   fmt.Sprintf("%s/versions/%s/meta/meta.json", mod, version),
 	}
-	req, _ := http.NewRequest("GET", u.String(), nil)
+	req, _ := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
 
 	resp, err := x.DoRequest(req)
+	if err == ErrNotModified {
+		return meta{}, err
+	}
 	if err != nil {
-		return []directoryListing{}, errors.Errorf("failed to get directory listing for %s@%s: %s", mod, version, err)
+		return meta{}, errors.Errorf("failed to get directory listing for %s@%s: %s", mod, version, err)
 	}
 	defer resp.Body.Close()
 
 	var m meta
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return []directoryListing{}, err
+		return meta{}, err
 	}
 	err = json.Unmarshal(body, &m)
 	if err != nil {
-		return []directoryListing{}, errors.Errorf("failed to unmarshal response body: %s", err)
+		return meta{}, errors.Errorf("failed to unmarshal response body: %s", err)
 	}
-	return m.DirectoryListing, nil
+
+	m.DirectoryListing = deduplicateListings(normalisePaths(m.DirectoryListing))
+	return m, nil
+}
+
+// FetchReadme returns the content of the README.md file at the root of the
+// module version. At most 100KB of the file are read. An empty string is
+// returned if the module version doesn't have a README.
+func (x *XQueuedCrawler) FetchReadme(ctx context.Context, mod, version string) (string, error) {
+	u := url.URL{
+		Scheme: "https",
+		Host:   CDN_HOST,
+		Path:   fmt.Sprintf("%s/versions/%s/raw/README.md", mod, version),
+	}
+	req, _ := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+
+	resp, err := x.DoRequest(req)
+	if err != nil {
+		return "", errors.Errorf("failed to get README for %s@%s: %s", mod, version, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("failed to get README for %s@%s: unexpected status %d", mod, version, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxReadmeSize))
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// hasReadme reports whether the directory listing contains a README.md file at
+// the root of the module
+func hasReadme(dir []directoryListing) bool {
+	for _, d := range dir {
+		if strings.TrimPrefix(d.Path, "/") == "README.md" {
+			return true
+		}
+	}
+	return false
+}
+
+// licenseFiles are the names of the files commonly holding a module's license
+var licenseFiles = map[string]bool{
+	"license":     true,
+	"license.md":  true,
+	"license.txt": true,
+	"copying":     true,
+}
+
+// DetectLicense looks for a license file at the root of the module version and
+// returns its path. The file names are matched case-insensitively.
+func DetectLicense(listings []directoryListing) (licenseFile string, found bool) {
+	for _, d := range listings {
+		if d.Type == "dir" {
+			continue
+		}
+		p := strings.TrimPrefix(d.Path, "/")
+		if licenseFiles[strings.ToLower(p)] {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// Some meta.json files use paths with a leading slash while others don't.
+// normalisePaths strips the leading slash so that the same file always maps to
+// the same specifier.
+func normalisePaths(dir []directoryListing) []directoryListing {
+	out := make([]directoryListing, len(dir))
+	for i, d := range dir {
+		d.Path = strings.TrimPrefix(d.Path, "/")
+		out[i] = d
+	}
+	return out
+}
+
+// The CDN occasionally returns the same path more than once in meta.json.
+// deduplicateListings removes the duplicates, keeping the first occurrence.
+func deduplicateListings(dir []directoryListing) []directoryListing {
+	seen := make(map[string]bool, len(dir))
+	out := make([]directoryListing, 0, len(dir))
+	for _, d := range dir {
+		if seen[d.Path] {
+			continue
+		}
+		seen[d.Path] = true
+		out = append(out, d)
+	}
+	return out
 }
 
 // Since we only care about source code files, filter out
@@ -0,0 +1,17 @@
+//go:build integration && network
+// +build integration,network
+
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package deno
+
+import (
+	"testing"
+
+	"gopkg.in/dnaeon/go-vcr.v3/recorder"
+)
+
+// TestDenoAPIIntegration queries the real deno.land API and records the
+// responses to the cassette replayed by TestDenoAPIReplay
+func TestDenoAPIIntegration(t *testing.T) {
+	testDenoAPI(t, newRecordedCrawler(t, recorder.ModeRecordOnly))
+}
@@ -0,0 +1,18 @@
+//go:build !integration
+// +build !integration
+
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package deno
+
+import (
+	"testing"
+
+	"gopkg.in/dnaeon/go-vcr.v3/recorder"
+)
+
+// TestDenoAPIReplay replays the deno.land responses recorded by
+// TestDenoAPIIntegration, it doesn't need network access. The cassette is
+// trimmed down to the modules and files the test looks at.
+func TestDenoAPIReplay(t *testing.T) {
+	testDenoAPI(t, newRecordedCrawler(t, recorder.ModeReplayOnly))
+}
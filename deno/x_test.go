@@ -1,7 +1,22 @@
 // Copyright 2020-2021 William Perron. All rights reserved. MIT License.
 package deno
 
-import "testing"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/dnaeon/go-vcr.v3/recorder"
+)
 
 func TestStripEntries(t *testing.T) {
 	input := []directoryListing{
@@ -149,3 +164,898 @@ func TestStripEntriesToEmpty(t *testing.T) {
 		t.Errorf("expected output to be empty, got list of length %d", len(actual))
 	}
 }
+
+func TestStdVersionConstraint(t *testing.T) {
+	x := &XQueuedCrawler{}
+	if err := WithStdVersionConstraint(">=0.100.0")(x); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cases := []struct {
+		mod      string
+		version  string
+		expected bool
+	}{
+		{"std", "v0.1.0", false},
+		{"std", "0.99.0", false},
+		{"std", "0.100.0", true},
+		{"std", "0.101.0", true},
+		{"oak", "v0.1.0", true},
+	}
+
+	for _, c := range cases {
+		if actual := x.allowVersion(c.mod, c.version); actual != c.expected {
+			t.Errorf("expected %s@%s to be allowed=%t, got %t", c.mod, c.version, c.expected, actual)
+		}
+	}
+}
+
+func TestVersionConstraintStdOverride(t *testing.T) {
+	x := &XQueuedCrawler{}
+	if err := WithVersionConstraint(">=1.0.0")(x); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := WithStdVersionConstraint(">=0.100.0")(x); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !x.allowVersion("std", "0.100.0") {
+		t.Errorf("expected std@0.100.0 to be allowed by the std constraint")
+	}
+	if x.allowVersion("oak", "v0.100.0") {
+		t.Errorf("expected oak@v0.100.0 to be excluded by the global constraint")
+	}
+}
+
+func TestParseModuleMetadata(t *testing.T) {
+	body := []byte(`{
+		"success": true,
+		"data": {
+			"name": "oak",
+			"description": "A middleware framework for Deno's http server",
+			"star_count": 3000,
+			"is_unlisted": false,
+			"tags": ["http", "middleware"],
+			"upload_options": {
+				"type": "github",
+				"repository": "oakserver/oak",
+				"ref_prefix": ""
+			}
+		}
+	}`)
+
+	m, err := parseModuleMetadata(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if m.Name != "oak" || m.StarCount != 3000 || len(m.Tags) != 2 {
+		t.Errorf("unexpected metadata: %+v", m)
+	}
+	if m.Owner != "oakserver" {
+		t.Errorf("expected owner to be oakserver, got %s", m.Owner)
+	}
+	if m.RepoURL != "https://github.com/oakserver/oak" {
+		t.Errorf("expected repo url to be https://github.com/oakserver/oak, got %s", m.RepoURL)
+	}
+}
+
+func TestVersionsSorted(t *testing.T) {
+	v := versions{
+		Versions: []string{"v1.0.0", "main", "v10.1.0", "v2.0.0-rc.1", "v2.0.0", "dev", "v1.10.0"},
+	}
+	expected := []string{"v10.1.0", "v2.0.0", "v2.0.0-rc.1", "v1.10.0", "v1.0.0", "dev", "main"}
+
+	actual := v.Sorted()
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %d versions, got %d", len(expected), len(actual))
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("expected element #%d to be %s, got %s", i, expected[i], actual[i])
+		}
+	}
+
+	if v.Versions[0] != "v1.0.0" {
+		t.Errorf("expected Sorted not to modify the original slice")
+	}
+	if latest := v.Latest(); latest != "v10.1.0" {
+		t.Errorf("expected latest to be v10.1.0, got %s", latest)
+	}
+}
+
+func TestMetaUnmarshalUploadedAt(t *testing.T) {
+	var m meta
+	body := []byte(`{"uploaded_at":"2021-01-12T18:43:21.443Z","directory_listing":[{"path":"/mod.ts","size":100,"type":"file"}]}`)
+	if err := json.Unmarshal(body, &m); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := time.Date(2021, 1, 12, 18, 43, 21, 443000000, time.UTC)
+	if !m.UploadedAt.Equal(expected) {
+		t.Errorf("expected uploaded_at to be %s, got %s", expected, m.UploadedAt)
+	}
+	if len(m.DirectoryListing) != 1 {
+		t.Errorf("expected 1 directory listing entry, got %d", len(m.DirectoryListing))
+	}
+
+	if err := json.Unmarshal([]byte(`{"uploaded_at":"yesterday"}`), &m); err == nil {
+		t.Errorf("expected an error for an invalid timestamp")
+	}
+}
+
+func TestDirectoryTreeRoundTrip(t *testing.T) {
+	input := []directoryListing{
+		{Path: "/foo", Size: 300, Type: "dir"},
+		{Path: "/foo/bar.ts", Size: 100, Type: "file"},
+		{Path: "/foo/baz", Size: 200, Type: "dir"},
+		{Path: "/foo/baz/mod.ts", Size: 200, Type: "file"},
+		{Path: "/mod.ts", Size: 50, Type: "file"},
+	}
+
+	tree := BuildDirectoryTree(input)
+	if len(tree.Children) != 2 {
+		t.Fatalf("expected 2 children at the root, got %d", len(tree.Children))
+	}
+
+	foo := tree.Children[0]
+	if foo.Name != "foo" || foo.Type != "dir" || len(foo.Children) != 2 {
+		t.Errorf("unexpected node for foo: %+v", foo)
+	}
+
+	actual := tree.Flatten()
+	if len(actual) != len(input) {
+		t.Fatalf("expected %d entries, got %d", len(input), len(actual))
+	}
+	for i := range input {
+		if actual[i] != input[i] {
+			t.Errorf("expected element #%d to be %+v, got %+v", i, input[i], actual[i])
+		}
+	}
+}
+
+func TestDirectoryTreeImplicitDirs(t *testing.T) {
+	tree := BuildDirectoryTree([]directoryListing{
+		{Path: "foo/bar/baz.ts", Size: 10, Type: "file"},
+	})
+
+	actual := tree.Flatten()
+	expected := []string{"foo", "foo/bar", "foo/bar/baz.ts"}
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %d entries, got %d", len(expected), len(actual))
+	}
+	for i := range expected {
+		if actual[i].Path != expected[i] {
+			t.Errorf("expected element #%d to be %s, got %s", i, expected[i], actual[i].Path)
+		}
+	}
+	if actual[2].Type != "file" || actual[1].Type != "dir" {
+		t.Errorf("unexpected node types: %+v", actual)
+	}
+}
+
+func TestDeduplicateListings(t *testing.T) {
+	input := []directoryListing{
+		{Path: "/mod.ts", Size: 100, Type: "file"},
+		{Path: "/deps.ts", Size: 50, Type: "file"},
+		{Path: "/mod.ts", Size: 200, Type: "file"},
+	}
+
+	actual := deduplicateListings(input)
+	if len(actual) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(actual))
+	}
+	if actual[0].Path != "/mod.ts" || actual[0].Size != 100 {
+		t.Errorf("expected the first occurrence of /mod.ts to be kept, got %+v", actual[0])
+	}
+	if actual[1].Path != "/deps.ts" {
+		t.Errorf("expected element #1 to be /deps.ts, got %s", actual[1].Path)
+	}
+}
+
+func TestNormalisePaths(t *testing.T) {
+	input := []directoryListing{
+		{Path: "/mod.ts", Type: "file"},
+		{Path: "mod.ts", Type: "file"},
+		{Path: "/foo/bar.ts", Type: "file"},
+	}
+	expected := []string{"mod.ts", "mod.ts", "foo/bar.ts"}
+
+	actual := normalisePaths(input)
+	for i := range expected {
+		if actual[i].Path != expected[i] {
+			t.Errorf("expected element #%d to be %s, got %s", i, expected[i], actual[i].Path)
+		}
+	}
+
+	if deduped := deduplicateListings(actual); len(deduped) != 2 {
+		t.Errorf("expected normalised paths to deduplicate to 2 entries, got %d", len(deduped))
+	}
+}
+
+func TestSpecifierURL(t *testing.T) {
+	cases := []struct {
+		mod, version, path string
+		want               string
+	}{
+		{"std", "0.90.0", "fs/mod.ts", "https://deno.land/std@0.90.0/fs/mod.ts"},
+		{"oak", "v6.5.0", "mod.ts", "https://deno.land/x/oak@v6.5.0/mod.ts"},
+	}
+
+	for _, c := range cases {
+		u := SpecifierURL(c.mod, c.version, c.path)
+		if got := u.String(); got != c.want {
+			t.Errorf("expected %s, got %s", c.want, got)
+		}
+	}
+}
+
+func TestDetectLicense(t *testing.T) {
+	cases := []struct {
+		listing []directoryListing
+		want    string
+		found   bool
+	}{
+		{[]directoryListing{{Path: "mod.ts", Type: "file"}, {Path: "/LICENSE", Type: "file"}}, "LICENSE", true},
+		{[]directoryListing{{Path: "License.md", Type: "file"}}, "License.md", true},
+		{[]directoryListing{{Path: "COPYING", Type: "file"}}, "COPYING", true},
+		{[]directoryListing{{Path: "vendor/LICENSE", Type: "file"}}, "", false},
+		{[]directoryListing{{Path: "license", Type: "dir"}}, "", false},
+	}
+
+	for _, c := range cases {
+		got, found := DetectLicense(c.listing)
+		if got != c.want || found != c.found {
+			t.Errorf("expected (%s, %t), got (%s, %t)", c.want, c.found, got, found)
+		}
+	}
+}
+
+func TestValidateModule(t *testing.T) {
+	m := Module{
+		Name: "sdk",
+		Versions: map[string][]directoryListing{
+			"v1.0.0": {{Path: "/mod.ts"}},
+			"v1.1.0": {{Path: "/mod.ts"}, {Path: "/client.ts"}, {Path: "/types.ts"}},
+		},
+	}
+
+	cases := []struct {
+		cfg   ValidationConfig
+		valid bool
+	}{
+		{ValidationConfig{}, true},
+		{ValidationConfig{MaxVersions: 2, MaxFilesPerVersion: 3}, true},
+		{ValidationConfig{MaxVersions: 1}, false},
+		{ValidationConfig{MaxFilesPerVersion: 2}, false},
+	}
+
+	for _, c := range cases {
+		err := ValidateModule(m, c.cfg)
+		if c.valid && err != nil {
+			t.Errorf("expected %+v to accept the module, got %s", c.cfg, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("expected %+v to reject the module", c.cfg)
+		}
+	}
+}
+
+func TestCrawlModuleValidation(t *testing.T) {
+	client := &routeClient{routes: map[string]string{
+		"/oak/meta/versions.json":             `{"versions": ["v1.0.0", "v2.0.0"]}`,
+		"/oak/versions/v1.0.0/meta/meta.json": `{"uploaded_at": "2021-01-01T00:00:00Z", "directory_listing": [{"path": "/mod.ts", "type": "file", "size": 10}, {"path": "/deps.ts", "type": "file", "size": 10}]}`,
+		"/oak/versions/v2.0.0/meta/meta.json": `{"uploaded_at": "2021-01-01T00:00:00Z", "directory_listing": [{"path": "/mod.ts", "type": "file", "size": 10}]}`,
+	}}
+
+	for _, c := range []struct {
+		cfg     ValidationConfig
+		fetched int
+	}{
+		// too many versions is known before fetching any of them
+		{ValidationConfig{MaxVersions: 1}, 0},
+		// the module is skipped at the first version with too many files
+		{ValidationConfig{MaxFilesPerVersion: 1}, 1},
+	} {
+		q := NewChanQueue(1)
+		x, err := NewXQueuedCrawler(&q, WithValidation(c.cfg))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		client.requests = nil
+		x.Client = client
+
+		if err := x.CrawlModule(context.Background(), "oak", false); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		fetched := 0
+		for _, path := range client.requests {
+			if strings.HasSuffix(path, "/meta/meta.json") {
+				fetched++
+			}
+		}
+		if fetched != c.fetched {
+			t.Errorf("%+v: expected %d version fetched, got %d", c.cfg, c.fetched, fetched)
+		}
+		select {
+		case m := <-q.mods:
+			t.Errorf("%+v: expected the module to be skipped, got %v", c.cfg, m.Versions)
+		default:
+		}
+	}
+}
+
+// denoAPICassette holds the deno.land responses recorded by
+// TestDenoAPIIntegration and replayed by TestDenoAPIReplay
+const denoAPICassette = "testdata/denoapi"
+
+// recordedClient is a Client sending its requests through a go-vcr recorder
+type recordedClient struct {
+	*http.Client
+}
+
+func (c recordedClient) DoRequest(req *http.Request) (*http.Response, error) {
+	return c.Do(req)
+}
+
+// newRecordedCrawler returns a crawler whose requests go through a recorder
+// using the denoAPICassette in the given mode
+func newRecordedCrawler(t *testing.T, mode recorder.Mode) *XQueuedCrawler {
+	t.Helper()
+	r, err := recorder.NewWithOptions(&recorder.Options{
+		CassetteName: denoAPICassette,
+		Mode:         mode,
+	})
+	if err != nil {
+		t.Fatalf("failed to create recorder: %s", err)
+	}
+	t.Cleanup(func() {
+		if err := r.Stop(); err != nil {
+			t.Errorf("failed to save cassette: %s", err)
+		}
+	})
+
+	q := NewChanQueue(0)
+	x, err := NewXQueuedCrawler(&q)
+	if err != nil {
+		t.Fatalf("failed to create crawler: %s", err)
+	}
+	x.Client = recordedClient{r.GetDefaultClient()}
+	return x
+}
+
+// testDenoAPI exercises the deno.land endpoints used during a crawl
+func testDenoAPI(t *testing.T, x *XQueuedCrawler) {
+	mods, err := x.listAllModules()
+	if err != nil {
+		t.Fatalf("failed to list modules: %s", err)
+	}
+	count := 0
+	for range mods {
+		count++
+	}
+	if count == 0 {
+		t.Error("expected a non-empty list of modules")
+	}
+
+	v, err := x.listModuleVersions(context.Background(), "oak")
+	if err != nil {
+		t.Fatalf("failed to list versions of oak: %s", err)
+	}
+	if len(v.Versions) == 0 {
+		t.Error("expected oak to have at least one version")
+	}
+
+	m, err := x.getModuleVersionMeta(context.Background(), "oak", "v10.0.0")
+	if err != nil {
+		t.Fatalf("failed to get directory listing of oak@v10.0.0: %s", err)
+	}
+	found := false
+	for _, d := range m.DirectoryListing {
+		if d.Type == "file" && strings.HasSuffix(d.Path, ".ts") {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Errorf("expected oak@v10.0.0 to have at least one .ts file, got %+v", m.DirectoryListing)
+	}
+}
+
+// slowClient serves a list of modules without any versions, waiting before
+// answering every other request
+type slowClient struct {
+	modules  int
+	delay    time.Duration
+	requests int32
+}
+
+func (c *slowClient) DoRequest(req *http.Request) (*http.Response, error) {
+	body := `{"versions":[]}`
+	if req.URL.Path == "/modules" {
+		names := make([]string, c.modules)
+		for i := range names {
+			names[i] = fmt.Sprintf("mod%d", i)
+		}
+		b, _ := json.Marshal(names)
+		body = string(b)
+	} else {
+		atomic.AddInt32(&c.requests, 1)
+		time.Sleep(c.delay)
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}, nil
+}
+
+func TestStop(t *testing.T) {
+	client := &slowClient{modules: 1000, delay: 5 * time.Millisecond}
+	q := NewChanQueue(0)
+	x, _ := NewXQueuedCrawler(&q, WithMaxConcurrency(1))
+	x.Client = client
+
+	errs := x.Crawl(context.Background())
+	go func() {
+		for range errs {
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if err := x.Stop(time.Second); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := atomic.LoadInt32(&client.requests); n >= 2*int32(client.modules) {
+		t.Errorf("expected the crawl to stop early, got %d requests", n)
+	}
+}
+
+func TestStopTimeout(t *testing.T) {
+	q := NewChanQueue(0)
+	x, _ := NewXQueuedCrawler(&q)
+	x.Client = &slowClient{modules: 1, delay: time.Second}
+
+	errs := x.Crawl(context.Background())
+	go func() {
+		for range errs {
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if err := x.Stop(10 * time.Millisecond); err != ErrStopTimeout {
+		t.Errorf("expected ErrStopTimeout, got %v", err)
+	}
+}
+
+// routeClient answers every request with the body registered for its path and
+// records the paths requested
+type routeClient struct {
+	mu       sync.Mutex
+	routes   map[string]string
+	requests []string
+}
+
+func (c *routeClient) DoRequest(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, req.URL.Path)
+	body, ok := c.routes[req.URL.Path]
+	if !ok {
+		return &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(strings.NewReader("{}"))}, nil
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+}
+
+func TestWithOwnerFilter(t *testing.T) {
+	metadata := `{"success": true, "data": {"name": "%s", "upload_options": {"type": "github", "repository": "%s"}}}`
+	client := &routeClient{routes: map[string]string{
+		"/modules/oak":                 fmt.Sprintf(metadata, "oak", "oakserver/oak"),
+		"/modules/deno_std":            fmt.Sprintf(metadata, "deno_std", "denoland/deno_std"),
+		"/oak/meta/versions.json":      `{"versions":[]}`,
+		"/deno_std/meta/versions.json": `{"versions":[]}`,
+	}}
+	q := NewChanQueue(0)
+	x, err := NewXQueuedCrawler(&q, WithOwnerFilter("DenoLand"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	x.Client = client
+
+	for _, mod := range []string{"oak", "deno_std"} {
+		if err := x.CrawlModule(context.Background(), mod, false); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	fetched := make(map[string]bool)
+	for _, path := range client.requests {
+		fetched[path] = true
+	}
+	if fetched["/oak/meta/versions.json"] {
+		t.Error("expected oak to be filtered out before fetching its versions")
+	}
+	if !fetched["/deno_std/meta/versions.json"] {
+		t.Error("expected the versions of deno_std to be fetched")
+	}
+	if _, err := NewXQueuedCrawler(&q, WithOwnerFilter("")); err == nil {
+		t.Error("expected an empty owner to be rejected")
+	}
+}
+
+func TestSpecifierBlocklist(t *testing.T) {
+	f, err := ioutil.TempFile("", "blocklist")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# known to hang deno info\nhttps://deno.land/x/hang@*/*\n\n")
+	f.Close()
+
+	q := NewChanQueue(0)
+	x, err := NewXQueuedCrawler(&q,
+		WithSpecifierBlocklist([]string{"https://evil.example.com/*"}),
+		WithSpecifierBlocklistFile(f.Name()),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cases := map[string]bool{
+		"https://evil.example.com/mod.ts":        true,
+		"https://evil.example.com/nested/mod.ts": false,
+		"https://deno.land/x/hang@v1.0.0/mod.ts": true,
+		"https://deno.land/x/oak@v6.5.0/mod.ts":  false,
+	}
+	for spec, expected := range cases {
+		if actual := x.IsBlocked(spec); actual != expected {
+			t.Errorf("expected IsBlocked(%s) to be %t, got %t", spec, expected, actual)
+		}
+	}
+
+	if _, err := NewXQueuedCrawler(&q, WithSpecifierBlocklist([]string{"["})); err == nil {
+		t.Error("expected an invalid pattern to be rejected")
+	}
+}
+
+// clientFunc adapts a function to the Client interface
+type clientFunc func(*http.Request) (*http.Response, error)
+
+func (f clientFunc) DoRequest(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestCrawlSearch(t *testing.T) {
+	pages := map[string]string{
+		"1": `{"success": true, "data": {"total_count": 3, "results": [{"name": "a"}, {"name": "b"}]}}`,
+		"2": `{"success": true, "data": {"total_count": 3, "results": [{"name": "c"}]}}`,
+	}
+
+	cases := []struct {
+		maxPages int
+		expected []string
+	}{
+		{5, []string{"a", "b", "c"}},
+		{1, []string{"a", "b"}},
+	}
+	for _, c := range cases {
+		var mu sync.Mutex
+		var searched []string
+		client := clientFunc(func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			body := `{}`
+			switch {
+			case req.URL.Path == "/modules" && req.URL.Query().Get("query") == "http":
+				page := req.URL.Query().Get("page")
+				searched = append(searched, page)
+				body = pages[page]
+			case strings.HasSuffix(req.URL.Path, "/meta/versions.json"):
+				body = `{"versions": ["v1.0.0"]}`
+			case strings.HasSuffix(req.URL.Path, "/meta/meta.json"):
+				body = `{"uploaded_at": "2021-01-01T00:00:00Z", "directory_listing": [{"path": "/mod.ts", "type": "file", "size": 10}]}`
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+		})
+
+		q := NewChanQueue(len(c.expected))
+		x, err := NewXQueuedCrawler(&q)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		x.Client = client
+		for range x.CrawlSearch(context.Background(), "http", c.maxPages) {
+		}
+
+		if len(searched) > 2 {
+			t.Errorf("expected the search to stop after the last result, got pages %v", searched)
+		}
+		var queued []string
+		for len(q.mods) > 0 {
+			m := <-q.mods
+			queued = append(queued, m.Name)
+		}
+		if strings.Join(queued, ",") != strings.Join(c.expected, ",") {
+			t.Errorf("expected %v to be queued with %d max pages, got %v", c.expected, c.maxPages, queued)
+		}
+	}
+}
+
+// indexedVersions is a VersionChecker backed by a set of `<module>@<version>`
+type indexedVersions map[string]bool
+
+func (v indexedVersions) IsIndexed(module, version string) (bool, error) {
+	return v[module+"@"+version], nil
+}
+
+func TestWithVersionChecker(t *testing.T) {
+	client := &routeClient{routes: map[string]string{
+		"/oak/meta/versions.json":             `{"versions": ["v1.0.0", "v2.0.0"]}`,
+		"/oak/versions/v2.0.0/meta/meta.json": `{"uploaded_at": "2021-01-01T00:00:00Z", "directory_listing": [{"path": "/mod.ts", "type": "file", "size": 10}]}`,
+	}}
+	q := NewChanQueue(1)
+	x, err := NewXQueuedCrawler(&q, WithVersionChecker(indexedVersions{"oak@v1.0.0": true}))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	x.Client = client
+
+	if err := x.CrawlModule(context.Background(), "oak", false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, path := range client.requests {
+		if strings.Contains(path, "v1.0.0") {
+			t.Errorf("expected the indexed version to be skipped, got a request to %s", path)
+		}
+	}
+	m, err := q.Get(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok := m.Versions["v2.0.0"]; !ok || len(m.Versions) != 1 {
+		t.Errorf("expected only v2.0.0 to be queued, got %v", m.Versions)
+	}
+}
+
+// inFlightClient records the highest number of concurrent requests made to
+// anything but the module list
+type inFlightClient struct {
+	slowClient
+	mu       sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (c *inFlightClient) DoRequest(req *http.Request) (*http.Response, error) {
+	if req.URL.Path != "/modules" {
+		c.mu.Lock()
+		c.inFlight++
+		if c.inFlight > c.max {
+			c.max = c.inFlight
+		}
+		c.mu.Unlock()
+		defer func() {
+			c.mu.Lock()
+			c.inFlight--
+			c.mu.Unlock()
+		}()
+	}
+	return c.slowClient.DoRequest(req)
+}
+
+func TestCrawlMaxConcurrency(t *testing.T) {
+	client := &inFlightClient{slowClient: slowClient{modules: 30, delay: 2 * time.Millisecond}}
+	q := NewChanQueue(0)
+	x, err := NewXQueuedCrawler(&q, WithMaxConcurrency(3))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	x.Client = client
+
+	for range x.Crawl(context.Background()) {
+	}
+	<-x.Done()
+
+	if client.max > 3 {
+		t.Errorf("expected at most 3 concurrent requests, got %d", client.max)
+	}
+	if _, err := NewXQueuedCrawler(&q, WithMaxConcurrency(0)); err == nil {
+		t.Error("expected a concurrency of 0 to be rejected")
+	}
+}
+
+func TestCrawlMaxModules(t *testing.T) {
+	client := &routeClient{routes: map[string]string{"/modules": `["a", "b", "c", "d", "e"]`}}
+	q := NewChanQueue(0)
+	x, err := NewXQueuedCrawler(&q, WithMaxModules(2))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	x.Client = client
+
+	for range x.Crawl(context.Background()) {
+	}
+	<-x.Done()
+
+	crawled := make(map[string]bool)
+	for _, p := range client.requests {
+		if strings.HasSuffix(p, "/meta/versions.json") {
+			crawled[strings.TrimSuffix(strings.TrimPrefix(p, "/"), "/meta/versions.json")] = true
+		}
+	}
+	if len(crawled) != 2 || !crawled["a"] || !crawled["b"] {
+		t.Errorf("expected only a and b to be crawled, got %v", crawled)
+	}
+	if _, err := NewXQueuedCrawler(&q, WithMaxModules(-1)); err == nil {
+		t.Error("expected a negative limit to be rejected")
+	}
+}
+
+func TestWithMaxConcurrentVersionFetches(t *testing.T) {
+	q := NewChanQueue(0)
+	x, err := NewXQueuedCrawler(&q, WithMaxConcurrentVersionFetches(4))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := x.MaxConcurrency(); n != 4 {
+		t.Errorf("expected a concurrency of 4, got %d", n)
+	}
+	if _, err := NewXQueuedCrawler(&q, WithMaxConcurrentVersionFetches(0)); err == nil {
+		t.Error("expected a concurrency of 0 to be rejected")
+	}
+}
+
+func TestCrawlListError(t *testing.T) {
+	q := NewChanQueue(0)
+	x, _ := NewXQueuedCrawler(&q)
+	x.Client = clientFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("not json"))}, nil
+	})
+
+	var errs []error
+	for err := range x.Crawl(context.Background()) {
+		errs = append(errs, err)
+	}
+	if len(errs) != 1 {
+		t.Errorf("expected the listing error only, got %v", errs)
+	}
+
+	select {
+	case <-x.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the crawl to be done")
+	}
+	// the crawler is released for the next crawl
+	for range x.Crawl(context.Background()) {
+	}
+}
+
+func TestConcurrentCrawls(t *testing.T) {
+	client := &inFlightClient{slowClient: slowClient{modules: 10, delay: time.Millisecond}}
+	q := NewChanQueue(0)
+	x, err := NewXQueuedCrawler(&q, WithMaxConcurrency(1))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	x.Client = client
+
+	// a crawl started while another one runs waits for it to finish
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range x.Crawl(context.Background()) {
+			}
+		}()
+	}
+	wg.Wait()
+	<-x.Done()
+
+	if client.max > 1 {
+		t.Errorf("expected the crawls not to overlap, got %d concurrent requests", client.max)
+	}
+}
+
+func TestRecrawl(t *testing.T) {
+	client := &routeClient{routes: map[string]string{
+		"/modules":                            `["oak"]`,
+		"/oak/meta/versions.json":             `{"versions": ["v1.0.0", "v2.0.0"]}`,
+		"/oak/versions/v1.0.0/meta/meta.json": `{"uploaded_at": "2021-01-01T00:00:00Z", "directory_listing": [{"path": "/mod.ts", "type": "file", "size": 10}]}`,
+		"/oak/versions/v2.0.0/meta/meta.json": `{"uploaded_at": "2021-02-01T00:00:00Z", "directory_listing": [{"path": "/mod.ts", "type": "file", "size": 10}]}`,
+	}}
+	q := NewChanQueue(1)
+	x, err := NewXQueuedCrawler(&q, WithVersionChecker(indexedVersions{"oak@v1.0.0": true}))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	x.Client = client
+
+	failed := errors.New("failed to drop the graph")
+	var errs []error
+	for err := range x.Recrawl(context.Background(), func(ctx context.Context) error { return failed }) {
+		errs = append(errs, err)
+	}
+	if len(errs) != 1 || errs[0] != failed || len(client.requests) > 0 {
+		t.Fatalf("expected nothing to be crawled after the reset failed, got %v and %d requests", errs, len(client.requests))
+	}
+
+	requested := -1
+	for range x.Recrawl(context.Background(), func(ctx context.Context) error {
+		requested = len(client.requests)
+		return nil
+	}) {
+	}
+	if requested != 0 {
+		t.Errorf("expected the reset to run before the crawl, got %d requests before it", requested)
+	}
+
+	// the indexed version is crawled again
+	m, err := q.Get(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(m.Versions) != 2 {
+		t.Errorf("expected both versions to be queued, got %v", m.Versions)
+	}
+}
+
+func TestIterateStdVersions(t *testing.T) {
+	q := NewChanQueue(1)
+	x, err := NewXQueuedCrawler(&q)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	x.Client = &routeClient{routes: map[string]string{
+		"/std/meta/versions.json":              `{"versions": ["0.89.0", "0.100.0", "0.90.0"]}`,
+		"/std/versions/0.100.0/meta/meta.json": `{"uploaded_at": "2021-07-01T00:00:00Z", "directory_listing": [{"path": "/fs/mod.ts", "type": "file", "size": 10}]}`,
+	}}
+
+	out, errs := x.IterateStdVersions(context.Background())
+	var got []string
+	for v := range out {
+		got = append(got, v)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []string{"0.100.0", "0.90.0", "0.89.0"}
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	dir, err := x.GetStdDirectoryListing(context.Background(), "0.100.0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(dir) != 1 || dir[0].Path != "fs/mod.ts" {
+		t.Errorf("expected the listing of std@0.100.0, got %+v", dir)
+	}
+
+	// std is crawled like the other modules with its own version listing
+	if err := x.CrawlModule(context.Background(), STD_MODULE, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	m, err := q.Get(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok := m.Versions["0.100.0"]; !ok {
+		t.Errorf("expected std@0.100.0 to be queued, got %v", m.Versions)
+	}
+}
+
+func TestIterateStdVersionsError(t *testing.T) {
+	q := NewChanQueue(0)
+	x, _ := NewXQueuedCrawler(&q)
+	x.Client = &routeClient{routes: map[string]string{"/std/meta/versions.json": "not json"}}
+
+	out, errs := x.IterateStdVersions(context.Background())
+	for range out {
+		t.Error("expected no versions")
+	}
+	if err := <-errs; err == nil {
+		t.Error("expected the listing error")
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/wperron/depgraph/constellation"
+	"github.com/wperron/depgraph/deno"
+	"github.com/wperron/depgraph/internal/testutil"
+)
+
+// recordMarked replaces markIndexed with a function recording the marked
+// versions
+func recordMarked(t *testing.T) func() []string {
+	var mu sync.Mutex
+	var marked []string
+	orig := markIndexed
+	markIndexed = func(ctx context.Context, module, version string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		marked = append(marked, module+"@"+version)
+		return nil
+	}
+	t.Cleanup(func() { markIndexed = orig })
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		sort.Strings(marked)
+		return append([]string(nil), marked...)
+	}
+}
+
+func TestIndexedTracker(t *testing.T) {
+	marked := recordMarked(t)
+	ctx := context.Background()
+	tracker := newIndexedTracker()
+	info := func(version string) deno.DenoInfo {
+		return deno.DenoInfo{ModuleName: "oak", ModuleVersion: version}
+	}
+
+	// inserted before all the files of the version are processed
+	tracker.inserted(ctx, info("v1.0.0"), nil)
+	tracker.inserted(ctx, info("v1.0.0"), nil)
+	if len(marked()) != 0 {
+		t.Errorf("expected no version marked before the expected count is known, got %v", marked())
+	}
+	tracker.expect(ctx, "oak", "v1.0.0", 2, false)
+
+	// processed before its files are inserted
+	tracker.expect(ctx, "oak", "v2.0.0", 2, false)
+	tracker.inserted(ctx, info("v2.0.0"), nil)
+	if fmt.Sprint(marked()) != "[oak@v1.0.0]" {
+		t.Errorf("expected only oak@v1.0.0 to be marked, got %v", marked())
+	}
+	tracker.inserted(ctx, info("v2.0.0"), nil)
+
+	// a failed insert or file
+	tracker.expect(ctx, "oak", "v3.0.0", 1, false)
+	tracker.inserted(ctx, info("v3.0.0"), fmt.Errorf("transaction aborted"))
+	tracker.expect(ctx, "oak", "v4.0.0", 0, true)
+
+	expected := []string{"oak@v1.0.0", "oak@v2.0.0"}
+	if fmt.Sprint(marked()) != fmt.Sprint(expected) {
+		t.Errorf("expected %v to be marked, got %v", expected, marked())
+	}
+	if len(tracker.versions) != 0 {
+		t.Errorf("expected every version to be forgotten, got %v", tracker.versions)
+	}
+}
+
+// failingCommit fails the commits of the transactions
+type failingCommit struct {
+	*testutil.MemoryDGraph
+}
+
+func (f failingCommit) Commit(ctx context.Context) error {
+	return fmt.Errorf("connection refused")
+}
+
+func TestIterateModuleInfoMarksInsertedVersions(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		fail   bool
+		marked []string
+	}{
+		{name: "inserted", marked: []string{"oak@v1.0.0"}},
+		{name: "failed insert", fail: true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			marked := recordMarked(t)
+			g := testutil.NewMemoryDGraph()
+			defer constellation.UseTxn(func() constellation.Txn {
+				if c.fail {
+					return failingCommit{g}
+				}
+				return g
+			})()
+			defer constellation.UseEntryStore(testutil.NewMemoryDynamoDB())()
+			constellation.SetInsertHook(indexed.inserted)
+			defer constellation.SetInsertHook(func(context.Context, deno.DenoInfo, error) {})
+
+			origExec := execInfo
+			execInfo = func(ctx context.Context, u url.URL) (deno.DenoInfo, error) {
+				return deno.DenoInfo{Module: u.String(), Files: map[string]deno.FileEntry{u.String(): {}}}, nil
+			}
+			defer func() { execInfo = origExec }()
+
+			var mod deno.Module
+			raw := `{"Name": "oak", "Versions": {"v1.0.0": [{"path": "mod.ts", "type": "file"}, {"path": "deps.ts", "type": "file"}]}}`
+			if err := json.Unmarshal([]byte(raw), &mod); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			mods := make(chan deno.Module, 1)
+			mods <- mod
+			close(mods)
+
+			infos := IterateModuleInfo(context.Background(), mods, testutil.NewMemoryQueue(), nil, 2)
+			done, errs := constellation.InsertFiles(context.Background(), infos)
+			go func() {
+				for range errs {
+				}
+			}()
+			<-done
+
+			if fmt.Sprint(marked()) != fmt.Sprint(c.marked) {
+				t.Errorf("expected %v to be marked, got %v", c.marked, marked())
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+
+// Package awsutil holds the helpers shared by the AWS clients of the deno and
+// constellation packages.
+package awsutil
+
+import "github.com/aws/aws-sdk-go-v2/aws"
+
+// WithCredentialsCache wraps the credentials provider of the config in a
+// CredentialsCache unless it is already cached, so that temporary credentials
+// are refreshed before they expire
+func WithCredentialsCache(cfg aws.Config) aws.Config {
+	if cfg.Credentials == nil {
+		return cfg
+	}
+	if _, ok := cfg.Credentials.(*aws.CredentialsCache); !ok {
+		cfg.Credentials = aws.NewCredentialsCache(cfg.Credentials)
+	}
+	return cfg
+}
@@ -0,0 +1,62 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package awsutil
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// expiringProvider returns new credentials on every call that expire after ttl
+type expiringProvider struct {
+	calls int
+	ttl   time.Duration
+}
+
+func (p *expiringProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	p.calls++
+	return aws.Credentials{
+		AccessKeyID:     fmt.Sprintf("AKID%d", p.calls),
+		SecretAccessKey: "secret",
+		CanExpire:       true,
+		Expires:         time.Now().Add(p.ttl),
+	}, nil
+}
+
+func TestCredentialsCacheRefresh(t *testing.T) {
+	p := &expiringProvider{ttl: 50 * time.Millisecond}
+	cfg := WithCredentialsCache(aws.Config{Credentials: p})
+
+	if _, ok := cfg.Credentials.(*aws.CredentialsCache); !ok {
+		t.Fatalf("expected credentials to be wrapped in a cache, got %T", cfg.Credentials)
+	}
+
+	first, err := cfg.Credentials.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	second, err := cfg.Credentials.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if first.AccessKeyID == second.AccessKeyID {
+		t.Errorf("expected refreshed credentials after expiry, got %s twice", first.AccessKeyID)
+	}
+	if second.AccessKeyID != "AKID2" {
+		t.Errorf("expected the second set of credentials, got %s", second.AccessKeyID)
+	}
+}
+
+func TestCredentialsCacheNotWrappedTwice(t *testing.T) {
+	cache := aws.NewCredentialsCache(&expiringProvider{})
+	cfg := WithCredentialsCache(aws.Config{Credentials: cache})
+	if cfg.Credentials != cache {
+		t.Errorf("expected the existing cache to be kept")
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+
+// Package httputil holds the helpers shared by the admin API of the crawler
+// and the public API server.
+package httputil
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// WriteJSON writes v as the JSON body of the response with the given status
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("failed to encode response", "error", err)
+	}
+}
+
+// IntParam parses the query parameter, returning def if it is empty
+func IntParam(v string, def int) (int, error) {
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
@@ -0,0 +1,44 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteJSON(t *testing.T) {
+	rec := httptest.NewRecorder()
+	WriteJSON(rec, http.StatusCreated, map[string]string{"status": "ok"})
+
+	if rec.Code != http.StatusCreated {
+		t.Errorf("expected status 201, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected a JSON content type, got %s", ct)
+	}
+	if body := rec.Body.String(); body != "{\"status\":\"ok\"}\n" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
+
+func TestIntParam(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected int
+		fails    bool
+	}{
+		{"", 10, false},
+		{"3", 3, false},
+		{"three", 0, true},
+	}
+	for _, c := range cases {
+		n, err := IntParam(c.value, 10)
+		if (err != nil) != c.fails {
+			t.Errorf("%q: expected failure %t, got %v", c.value, c.fails, err)
+		}
+		if !c.fails && n != c.expected {
+			t.Errorf("%q: expected %d, got %d", c.value, c.expected, n)
+		}
+	}
+}
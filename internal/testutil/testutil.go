@@ -0,0 +1,237 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+
+// Package testutil provides in-memory implementations of the queue, DGraph
+// and DynamoDB dependencies so that the pipeline can be tested without any
+// network calls.
+package testutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/dgraph-io/dgo/v2/protos/api"
+	"github.com/wperron/depgraph/constellation"
+	"github.com/wperron/depgraph/deno"
+)
+
+var (
+	_ deno.Queue               = (*MemoryQueue)(nil)
+	_ constellation.Txn        = (*MemoryDGraph)(nil)
+	_ constellation.EntryStore = (*MemoryDynamoDB)(nil)
+)
+
+// memoryQueueSize is the number of modules a MemoryQueue holds before Put
+// blocks
+const memoryQueueSize = 100
+
+// MemoryQueue is a deno.Queue backed by a ChanQueue that also records the
+// modules deleted from it
+type MemoryQueue struct {
+	*deno.ChanQueue
+
+	mu      sync.Mutex
+	deleted []string
+}
+
+// NewMemoryQueue returns a new MemoryQueue instance
+func NewMemoryQueue() *MemoryQueue {
+	q := deno.NewChanQueue(memoryQueueSize)
+	return &MemoryQueue{ChanQueue: &q}
+}
+
+// Delete records the module as deleted
+func (q *MemoryQueue) Delete(m deno.Module) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.deleted = append(q.deleted, m.Name)
+	return nil
+}
+
+// Deleted returns the names of the modules deleted from the queue
+func (q *MemoryQueue) Deleted() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]string(nil), q.deleted...)
+}
+
+// MemoryDGraph is a constellation.Txn that keeps the File nodes in memory. It
+// can be used in place of the DGraph client with constellation.UseTxn.
+type MemoryDGraph struct {
+	mu        sync.Mutex
+	Files     map[string]constellation.File
+	Mutations []*api.Mutation
+	next      int
+
+	// Versions maps `<module>@<version>` to the uid of its ModuleVersion node
+	Versions map[string]string
+}
+
+// NewMemoryDGraph returns a new MemoryDGraph instance
+func NewMemoryDGraph() *MemoryDGraph {
+	return &MemoryDGraph{
+		Files:    make(map[string]constellation.File),
+		Versions: make(map[string]string),
+	}
+}
+
+// QueryWithVars returns the file matching the `$specifier` variable, the files
+// matching the `$s0`..`$sN` variables in the `s0`..`sN` blocks, or the module
+// version matching the `$name` and `$version` variables, if any. Other queries
+// return an empty result.
+func (g *MemoryDGraph) QueryWithVars(ctx context.Context, q string, vars map[string]string) (*api.Response, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := vars["$s0"]; ok {
+		res := make(map[string][]constellation.File)
+		for i := 0; ; i++ {
+			s, ok := vars[fmt.Sprintf("$s%d", i)]
+			if !ok {
+				break
+			}
+			res[fmt.Sprintf("s%d", i)] = []constellation.File{}
+			if f, ok := g.Files[s]; ok {
+				res[fmt.Sprintf("s%d", i)] = append(res[fmt.Sprintf("s%d", i)], f)
+			}
+		}
+		b, err := json.Marshal(res)
+		if err != nil {
+			return nil, err
+		}
+		return &api.Response{Json: b}, nil
+	}
+
+	if version, ok := vars["$version"]; ok {
+		res := struct {
+			Q []constellation.Module `json:"q"`
+		}{Q: []constellation.Module{}}
+		if uid, ok := g.Versions[vars["$name"]+"@"+version]; ok {
+			res.Q = append(res.Q, constellation.Module{
+				Name:    vars["$name"],
+				Version: []constellation.ModuleVersion{{Uid: uid, ModuleVersion: version}},
+			})
+		}
+		b, err := json.Marshal(res)
+		if err != nil {
+			return nil, err
+		}
+		return &api.Response{Json: b}, nil
+	}
+
+	res := struct {
+		Q []constellation.File `json:"q"`
+	}{Q: []constellation.File{}}
+	if f, ok := g.Files[vars["$specifier"]]; ok {
+		res.Q = append(res.Q, f)
+	}
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	return &api.Response{Json: b}, nil
+}
+
+// Mutate records the mutation, assigns a uid to every blank node and stores
+// the File nodes it contains, including the new dependencies with a specifier
+func (g *MemoryDGraph) Mutate(ctx context.Context, mu *api.Mutation) (*api.Response, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.Mutations = append(g.Mutations, mu)
+
+	if len(mu.SetJson) == 0 {
+		return &api.Response{Uids: map[string]string{}}, nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(mu.SetJson, &v); err != nil {
+		return nil, fmt.Errorf("invalid mutation: %s", err)
+	}
+
+	uids := make(map[string]string)
+	g.assignUids(v, uids)
+
+	// the mutation is either a single node or a list of nodes
+	nodes := []json.RawMessage{mu.SetJson}
+	if _, ok := v.([]interface{}); ok {
+		nodes = nil
+		if err := json.Unmarshal(mu.SetJson, &nodes); err != nil {
+			return nil, fmt.Errorf("invalid mutation: %s", err)
+		}
+	}
+	for _, n := range nodes {
+		var f constellation.File
+		if err := json.Unmarshal(n, &f); err == nil && f.Specifier != "" {
+			if uid, ok := uids[strings.TrimPrefix(f.Uid, "_:")]; ok {
+				f.Uid = uid
+			}
+			for i, d := range f.DependsOn {
+				if uid, ok := uids[strings.TrimPrefix(d.Uid, "_:")]; ok {
+					f.DependsOn[i].Uid = uid
+				}
+				if _, ok := g.Files[d.Specifier]; !ok && d.Specifier != "" {
+					g.Files[d.Specifier] = f.DependsOn[i]
+				}
+			}
+			g.Files[f.Specifier] = f
+		}
+	}
+	return &api.Response{Uids: uids}, nil
+}
+
+func (g *MemoryDGraph) assignUids(v interface{}, uids map[string]string) {
+	switch n := v.(type) {
+	case map[string]interface{}:
+		if uid, ok := n["uid"].(string); ok && strings.HasPrefix(uid, "_:") {
+			blank := strings.TrimPrefix(uid, "_:")
+			if _, ok := uids[blank]; !ok {
+				g.next++
+				uids[blank] = fmt.Sprintf("0x%x", g.next)
+			}
+		}
+		for _, c := range n {
+			g.assignUids(c, uids)
+		}
+	case []interface{}:
+		for _, c := range n {
+			g.assignUids(c, uids)
+		}
+	}
+}
+
+// Commit is a no-op, mutations are applied immediately
+func (g *MemoryDGraph) Commit(ctx context.Context) error { return nil }
+
+// Discard is a no-op, mutations are applied immediately
+func (g *MemoryDGraph) Discard(ctx context.Context) error { return nil }
+
+// MemoryDynamoDB is a constellation.EntryStore that keeps the items in memory.
+// It can be used in place of the DynamoDB table with
+// constellation.UseEntryStore.
+type MemoryDynamoDB struct {
+	items sync.Map
+}
+
+// NewMemoryDynamoDB returns a new MemoryDynamoDB instance
+func NewMemoryDynamoDB() *MemoryDynamoDB {
+	return &MemoryDynamoDB{}
+}
+
+// PutEntry stores the item unless the specifier already exists
+func (d *MemoryDynamoDB) PutEntry(ctx context.Context, item constellation.Item) error {
+	d.items.LoadOrStore(item.Specifier, item)
+	return nil
+}
+
+// GetEntry returns the item of the specifier, or an empty Item if the
+// specifier doesn't exist
+func (d *MemoryDynamoDB) GetEntry(ctx context.Context, specifier string) (constellation.Item, error) {
+	v, ok := d.items.Load(specifier)
+	if !ok {
+		return constellation.Item{}, nil
+	}
+	return v.(constellation.Item), nil
+}
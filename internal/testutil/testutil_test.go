@@ -0,0 +1,343 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package testutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/dgo/v2"
+	"github.com/wperron/depgraph/constellation"
+	"github.com/wperron/depgraph/deno"
+)
+
+func TestInsertFilesInMemory(t *testing.T) {
+	g := NewMemoryDGraph()
+	defer constellation.UseTxn(func() constellation.Txn { return g })()
+	d := NewMemoryDynamoDB()
+	defer constellation.UseEntryStore(d)()
+
+	mod := "https://deno.land/x/oak@v6.5.0/mod.ts"
+	dep := "https://deno.land/x/oak@v6.5.0/deps.ts"
+	infos := make(chan deno.DenoInfo, 1)
+	infos <- deno.DenoInfo{
+		Module: mod,
+		Files: map[string]deno.FileEntry{
+			mod: {Deps: []string{dep}},
+		},
+	}
+	close(infos)
+
+	done, errs := constellation.InsertFiles(context.Background(), infos)
+	for err := range errs {
+		t.Errorf("unexpected error: %s", err)
+	}
+	<-done
+
+	f, ok := g.Files[mod]
+	if !ok {
+		t.Fatalf("expected %s to be stored in the graph", mod)
+	}
+	for _, spec := range []string{mod, dep} {
+		item, err := d.GetEntry(context.Background(), spec)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if item.Uid == "" {
+			t.Errorf("expected %s to have a uid", spec)
+		}
+		if spec == mod && item.Uid != f.Uid {
+			t.Errorf("expected uid %s, got %s", f.Uid, item.Uid)
+		}
+	}
+}
+
+func TestInsertFilesWorkerPoolInMemory(t *testing.T) {
+	g := NewMemoryDGraph()
+	defer constellation.UseTxn(func() constellation.Txn { return g })()
+	defer constellation.UseEntryStore(NewMemoryDynamoDB())()
+
+	infos := make(chan deno.DenoInfo, 10)
+	for i := 0; i < 10; i++ {
+		mod := fmt.Sprintf("https://deno.land/x/mod%d@v1.0.0/mod.ts", i)
+		infos <- deno.DenoInfo{
+			Module: mod,
+			Files:  map[string]deno.FileEntry{mod: {}},
+		}
+	}
+	close(infos)
+
+	done, errs := constellation.InsertFilesWorkerPool(context.Background(), infos, 4)
+	for err := range errs {
+		t.Errorf("unexpected error: %s", err)
+	}
+	<-done
+
+	if len(g.Files) != 10 {
+		t.Errorf("expected 10 files in the graph, got %d", len(g.Files))
+	}
+}
+
+func TestInsertFilesLinksModuleVersion(t *testing.T) {
+	g := NewMemoryDGraph()
+	g.Versions["oak@v6.5.0"] = "0x99"
+	defer constellation.UseTxn(func() constellation.Txn { return g })()
+	defer constellation.UseEntryStore(NewMemoryDynamoDB())()
+
+	mod := "https://deno.land/x/oak@v6.5.0/mod.ts"
+	dep := "https://deno.land/std@0.90.0/http/mod.ts"
+	infos := make(chan deno.DenoInfo, 1)
+	infos <- deno.DenoInfo{
+		Module: mod,
+		Files: map[string]deno.FileEntry{
+			mod: {Deps: []string{dep}},
+			dep: {},
+		},
+		ModuleName:    "oak",
+		ModuleVersion: "v6.5.0",
+	}
+	close(infos)
+
+	done, errs := constellation.InsertFiles(context.Background(), infos)
+	for err := range errs {
+		t.Errorf("unexpected error: %s", err)
+	}
+	<-done
+
+	var linked []string
+	for _, mu := range g.Mutations {
+		var nodes []map[string]interface{}
+		if err := json.Unmarshal(mu.SetJson, &nodes); err != nil {
+			continue
+		}
+		for _, n := range nodes {
+			if n["uid"] == "0x99" {
+				linked = append(linked, fmt.Sprint(nodes[0]["specifier"]))
+			}
+		}
+	}
+	if len(linked) != 1 || linked[0] != mod {
+		t.Errorf("expected only %s to be linked to its version, got %v", mod, linked)
+	}
+}
+
+func TestInsertFilesSkipsExistingNode(t *testing.T) {
+	mod := "https://deno.land/x/oak@v6.5.0/mod.ts"
+	g := NewMemoryDGraph()
+	g.Files[mod] = constellation.File{Uid: "0x50", Specifier: mod, DependsOn: []constellation.File{{Uid: "0x51"}}}
+	defer constellation.UseTxn(func() constellation.Txn { return g })()
+	d := NewMemoryDynamoDB()
+	defer constellation.UseEntryStore(d)()
+
+	infos := make(chan deno.DenoInfo, 1)
+	infos <- deno.DenoInfo{
+		Module: mod,
+		Files: map[string]deno.FileEntry{
+			mod: {Deps: []string{"https://deno.land/x/oak@v6.5.0/deps.ts"}},
+		},
+	}
+	close(infos)
+
+	done, errs := constellation.InsertFiles(context.Background(), infos)
+	for err := range errs {
+		t.Errorf("unexpected error: %s", err)
+	}
+	<-done
+
+	if len(g.Mutations) != 0 {
+		t.Errorf("expected no mutation for an existing node, got %d", len(g.Mutations))
+	}
+	item, err := d.GetEntry(context.Background(), mod)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if item.Uid != "0x50" {
+		t.Errorf("expected the existing uid 0x50 to be cached, got %q", item.Uid)
+	}
+}
+
+func TestInsertFilesCompletesPlaceholderNode(t *testing.T) {
+	mod := "https://deno.land/x/oak@v6.5.0/mod.ts"
+	dep := "https://deno.land/x/oak@v6.5.0/deps.ts"
+	g := NewMemoryDGraph()
+	// both nodes were created as the dependencies of other files
+	g.Files[mod] = constellation.File{Uid: "0x50", Specifier: mod}
+	g.Files[dep] = constellation.File{Uid: "0x51", Specifier: dep}
+	defer constellation.UseTxn(func() constellation.Txn { return g })()
+	d := NewMemoryDynamoDB()
+	defer constellation.UseEntryStore(d)()
+
+	infos := make(chan deno.DenoInfo, 1)
+	infos <- deno.DenoInfo{
+		Module: mod,
+		Files: map[string]deno.FileEntry{
+			mod: {Deps: []string{dep}},
+		},
+	}
+	close(infos)
+
+	done, errs := constellation.InsertFiles(context.Background(), infos)
+	for err := range errs {
+		t.Errorf("unexpected error: %s", err)
+	}
+	<-done
+
+	f := g.Files[mod]
+	if f.Uid != "0x50" || len(f.DependsOn) != 1 || f.DependsOn[0].Uid != "0x51" {
+		t.Errorf("expected the placeholder 0x50 to depend on 0x51, got %+v", f)
+	}
+	if len(g.Files) != 2 {
+		t.Errorf("expected no new node, got %d files", len(g.Files))
+	}
+	for spec, uid := range map[string]string{mod: "0x50", dep: "0x51"} {
+		item, err := d.GetEntry(context.Background(), spec)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if item.Uid != uid {
+			t.Errorf("expected the existing uid %s of %s to be cached, got %q", uid, spec, item.Uid)
+		}
+	}
+}
+
+// slowCommit adds the round trip of a commit to the cluster
+type slowCommit struct {
+	*MemoryDGraph
+}
+
+func (s slowCommit) Commit(ctx context.Context) error {
+	time.Sleep(time.Millisecond)
+	return s.MemoryDGraph.Commit(ctx)
+}
+
+// BenchmarkInsertFilesBatched measures the throughput of InsertFilesBatched
+// for different batch sizes, with modules of 5 files sharing a dependency and
+// commits taking 1ms
+func BenchmarkInsertFilesBatched(b *testing.B) {
+	for _, size := range []int{1, 10, 50} {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			g := NewMemoryDGraph()
+			defer constellation.UseTxn(func() constellation.Txn { return slowCommit{g} })()
+			defer constellation.UseEntryStore(NewMemoryDynamoDB())()
+
+			infos := make(chan deno.DenoInfo, size)
+			done, errs := constellation.InsertFilesBatched(context.Background(), infos, size)
+			go func() {
+				for err := range errs {
+					b.Errorf("unexpected error: %s", err)
+				}
+			}()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				files := make(map[string]deno.FileEntry)
+				for j := 0; j < 5; j++ {
+					files[fmt.Sprintf("https://deno.land/x/mod%d@v1.0.0/file%d.ts", i, j)] = deno.FileEntry{
+						Deps: []string{"https://deno.land/std@0.83.0/fs/mod.ts"},
+					}
+				}
+				infos <- deno.DenoInfo{Module: fmt.Sprintf("https://deno.land/x/mod%d@v1.0.0/file0.ts", i), Files: files}
+			}
+			close(infos)
+			<-done
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "modules/s")
+		})
+	}
+}
+
+// concurrentCreate aborts the first commit as if another worker had committed
+// the node of the specifier in the meantime
+type concurrentCreate struct {
+	*MemoryDGraph
+	specifier string
+	aborted   *bool
+}
+
+func (c concurrentCreate) Commit(ctx context.Context) error {
+	if *c.aborted {
+		return nil
+	}
+	*c.aborted = true
+	c.Files[c.specifier] = constellation.File{Uid: "0x90", Specifier: c.specifier, DependsOn: []constellation.File{{Uid: "0x91"}}}
+	return dgo.ErrAborted
+}
+
+func TestInsertFilesRetriesConcurrentCreate(t *testing.T) {
+	mod := "https://deno.land/x/oak@v6.5.0/mod.ts"
+	g := NewMemoryDGraph()
+	aborted := false
+	defer constellation.UseTxn(func() constellation.Txn { return concurrentCreate{g, mod, &aborted} })()
+	d := NewMemoryDynamoDB()
+	defer constellation.UseEntryStore(d)()
+
+	infos := make(chan deno.DenoInfo, 1)
+	infos <- deno.DenoInfo{
+		Module: mod,
+		Files: map[string]deno.FileEntry{
+			mod: {Deps: []string{"https://deno.land/x/oak@v6.5.0/deps.ts"}},
+		},
+	}
+	close(infos)
+
+	done, errs := constellation.InsertFiles(context.Background(), infos)
+	for err := range errs {
+		t.Errorf("unexpected error: %s", err)
+	}
+	<-done
+
+	if !aborted {
+		t.Fatalf("expected the first commit to be aborted")
+	}
+	item, err := d.GetEntry(context.Background(), mod)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if item.Uid != "0x90" {
+		t.Errorf("expected the retry to reuse the committed node 0x90, got %q", item.Uid)
+	}
+}
+
+// commitCounter counts the transactions committed to the MemoryDGraph
+type commitCounter struct {
+	*MemoryDGraph
+	commits *int32
+}
+
+func (c commitCounter) Commit(ctx context.Context) error {
+	atomic.AddInt32(c.commits, 1)
+	return c.MemoryDGraph.Commit(ctx)
+}
+
+func TestInsertFilesBatchedInMemory(t *testing.T) {
+	var commits int32
+	g := NewMemoryDGraph()
+	defer constellation.UseTxn(func() constellation.Txn { return commitCounter{g, &commits} })()
+	defer constellation.UseEntryStore(NewMemoryDynamoDB())()
+
+	infos := make(chan deno.DenoInfo, 10)
+	for i := 0; i < 10; i++ {
+		mod := fmt.Sprintf("https://deno.land/x/mod%d@v1.0.0/mod.ts", i)
+		infos <- deno.DenoInfo{
+			Module: mod,
+			Files:  map[string]deno.FileEntry{mod: {}},
+		}
+	}
+	close(infos)
+
+	done, errs := constellation.InsertFilesBatched(context.Background(), infos, 4)
+	for err := range errs {
+		t.Errorf("unexpected error: %s", err)
+	}
+	<-done
+
+	if len(g.Files) != 10 {
+		t.Errorf("expected 10 files in the graph, got %d", len(g.Files))
+	}
+	// 10 modules in batches of 4
+	if commits != 3 {
+		t.Errorf("expected 3 commits, got %d", commits)
+	}
+}
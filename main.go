@@ -3,24 +3,73 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/http/pprof"
 	"net/url"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/wperron/depgraph/config"
 	"github.com/wperron/depgraph/constellation"
 	"github.com/wperron/depgraph/deno"
+	"github.com/wperron/depgraph/version"
 )
 
+var enablePprof = flag.Bool("enable-pprof", false, "serve the pprof handlers on debug.pprof_server_addr")
+var logLevel = flag.String("log-level", "info", "minimum level of the logs: debug, info, warn or error")
+
+// Build metadata, injected at build time with
+// -ldflags "-X main.Version=... -X main.Commit=... -X main.Built=..."
+var (
+	Version = "dev"
+	Commit  = "unknown"
+	Built   = "unknown"
+)
+
+func buildInfo() version.BuildInfo {
+	return version.BuildInfo{
+		Version: Version,
+		Commit:  Commit,
+		Built:   Built,
+	}
+}
+
 var specifierDenoInfoHist prometheus.Histogram
+var specifierDenoInfoSummary prometheus.Summary
 var moduleDenoInfoHist prometheus.Histogram
+var denoInfoInFlight prometheus.Gauge
+var specifierBlockedCounter prometheus.Counter
+var staleModuleVersionsGauge prometheus.Gauge
+var featureFlagGauge *prometheus.GaugeVec
+
+// statsReportInterval is how often the graph stats are logged
+const statsReportInterval = 30 * 24 * time.Hour
+
+// staleModulesReportInterval is how often the stale module versions gauge is
+// updated
+const staleModulesReportInterval = 15 * time.Minute
+
+// staleModuleThreshold is the age after which a module version that wasn't
+// re-indexed is counted as stale
+const staleModuleThreshold = 30 * 24 * time.Hour
+
+// incrementalCrawlWindow is how far back the crawler looks for new module
+// versions when the incremental_crawl feature flag is enabled
+const incrementalCrawlWindow = 7 * 24 * time.Hour
 
 func init() {
 	specifierDenoInfoHist = prometheus.NewHistogram(
@@ -30,6 +79,14 @@ func init() {
 		},
 	)
 
+	specifierDenoInfoSummary = prometheus.NewSummary(
+		prometheus.SummaryOpts{
+			Name:       "deno_info_specifier_summary",
+			Help:       "A summary for the duration of `deno info` for a single specifier",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		},
+	)
+
 	moduleDenoInfoHist = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
 			Name: "deno_info_module_hist",
@@ -37,67 +94,378 @@ func init() {
 		},
 	)
 
-	prometheus.MustRegister(specifierDenoInfoHist, moduleDenoInfoHist)
+	denoInfoInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "deno_info_in_flight_subprocesses",
+			Help: "The number of `deno info` subprocesses currently running",
+		},
+	)
+	deno.SetInfoInFlightGauge(denoInfoInFlight)
+
+	specifierBlockedCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "specifier_blocked_total",
+			Help: "A counter of specifiers skipped because they match the blocklist",
+		},
+	)
+
+	staleModuleVersionsGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "stale_module_versions_total",
+			Help: "The number of module versions uploaded and last indexed more than 30 days ago",
+		},
+	)
+
+	featureFlagGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "feature_flag_active",
+			Help: "Whether a feature flag is enabled (1) or not (0)",
+		},
+		[]string{"flag"},
+	)
+
+	prometheus.MustRegister(specifierDenoInfoHist, specifierDenoInfoSummary, moduleDenoInfoHist, denoInfoInFlight, specifierBlockedCounter, staleModuleVersionsGauge, featureFlagGauge)
 }
 
 func main() {
-	log.Println("start.")
+	if len(os.Args) > 1 && os.Args[1] == "version" {
+		fmt.Println(buildInfo())
+		return
+	}
+
+	config.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	if err := initLogger(*logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.Info("start.")
+
+	appCfg, err := config.LoadConfig(flag.CommandLine)
+	if err != nil {
+		slog.Error("failed to load config", "error", err)
+		os.Exit(1)
+	}
+	if err := appCfg.Validate(); err != nil {
+		slog.Error("invalid config", "error", err)
+		os.Exit(1)
+	}
+	if err := setLogLevel(configLogLevel(flag.CommandLine, appCfg)); err != nil {
+		slog.Error("invalid log level", "error", err)
+		os.Exit(1)
+	}
+	for name, active := range appCfg.FeatureFlags.Active() {
+		v := 0.0
+		if active {
+			v = 1
+		}
+		featureFlagGauge.WithLabelValues(name).Set(v)
+	}
+	constellation.SetQueryTimeout(appCfg.Dgraph.QueryTimeout)
+	constellation.SetMutationTimeout(appCfg.Dgraph.MutationTimeout)
+	if !appCfg.FeatureFlags.DGraphUpsert {
+		slog.Warn("dgraph upserts disabled, the files missing from dynamodb always get a new node")
+		constellation.SetFileUpsert(false)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
-		sig := make(chan os.Signal)
+		sig := make(chan os.Signal, 1)
 		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
 		s := <-sig
-		log.Printf("Received signal %s, cancelling context\n", s)
+		slog.Info("received signal, cancelling context", "signal", s.String())
 		cancel()
 	}()
 
-	http.Handle("/metrics", promhttp.HandlerFor(
+	if *enablePprof {
+		go servePprof(appCfg.Debug.PprofServerAddr)
+	}
+
+	// the pprof package registers its handlers on the default mux, a dedicated
+	// mux keeps them off the metrics port
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(
 		prometheus.DefaultGatherer,
 		promhttp.HandlerOpts{
 			EnableOpenMetrics: true,
 		},
 	))
+	mux.HandleFunc("/healthz", healthzHandler)
+
+	// the other endpoints need the dependencies, they answer with a 503 until
+	// the process is connected to all of them
+	app := http.NewServeMux()
+	var started int32
+	mux.Handle("/", startedOnly(&started, app))
+	go http.ListenAndServe(":9093", mux)
+
+	app.HandleFunc("/health", healthHandler)
+	app.HandleFunc("/api/v1/modules/top", topModulesHandler)
+	app.HandleFunc("/api/v1/graph/cytoscape", cytoscapeHandler)
+	app.HandleFunc("/api/v1/graph/export", exportHandler)
+	app.HandleFunc("/api/v1/impact", impactHandler)
+	app.HandleFunc("/api/v1/leaves", leavesHandler)
+	app.HandleFunc("/api/v1/stale-modules", staleModulesHandler)
+	app.HandleFunc("/api/v1/modules/", moduleGraphHandler(appCfg.API.GraphMaxDepth))
 
-	go http.ListenAndServe(":9093", nil)
+	dgraphCfg := constellation.DGraphConfig{
+		Addresses:   appCfg.Dgraph.AlphaAddresses,
+		TLSCertFile: appCfg.Dgraph.TLSCertFile,
+		TLSKeyFile:  appCfg.Dgraph.TLSKeyFile,
+		CAFile:      appCfg.Dgraph.CAFile,
+		MaxRetries:  appCfg.Dgraph.ConnectRetries,
+		AdminURL:    appCfg.Dgraph.AdminURL,
+	}
+	if err := constellation.InitDGraph(ctx, dgraphCfg); err != nil {
+		slog.Error("failed to connect to dgraph", "error", err)
+		os.Exit(1)
+	}
 
-	err := constellation.InitSchema(ctx)
+	err = constellation.InitSchema(ctx)
 	if err != nil {
-		log.Fatalf("failed to initialize schema: %s\n", err)
+		slog.Error("failed to initialize schema", "error", err)
+		os.Exit(1)
 	}
-	log.Println("Successfully initialized schema on startup.")
+	slog.Info("successfully initialized schema on startup")
 
-	if ok := deno.Exists(); !ok {
-		log.Fatal("stopping: executable `deno` not found in PATH")
+	if err := constellation.CheckSchemaCompatibility(ctx, constellation.SchemaVersion); err != nil {
+		slog.Error("stopping, check that the alpha addresses point to the right cluster", "error", err)
+		os.Exit(1)
+	}
+
+	if err := deno.Exists(); err != nil {
+		slog.Error("stopping", "error", err)
+		os.Exit(1)
 	}
 
 	// AWS config
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("us-east-1"))
+	cfg, err := awsconfig.LoadDefaultConfig(context.TODO(),
+		awsconfig.WithRegion(appCfg.AWS.Region),
+		awsconfig.WithEndpointResolver(endpointResolver(appCfg)),
+	)
+	if err != nil {
+		slog.Error("failed to load the AWS config", "error", err)
+		os.Exit(1)
+	}
+	constellation.InitDynamoDB(cfg, appCfg.DynamoDB.Region, appCfg.DynamoDB.TableName)
+	constellation.SetEntryTTL(time.Duration(appCfg.DynamoDB.TTLDays) * 24 * time.Hour)
+
+	q := deno.NewSQSQueueInRegion(ctx, cfg, appCfg.SQS.Region, appCfg.SQS.QueueURL, 0, deno.WithLongPollSeconds(appCfg.SQS.LongPollSeconds))
+	if appCfg.SQS.DLQUrl != "" {
+		q.SetDeadLetterURL(appCfg.SQS.DLQUrl)
+	}
+	app.HandleFunc("/readyz", readyzHandler(map[string]func(context.Context) error{
+		"dgraph":   constellation.PingDGraph,
+		"dynamodb": constellation.PingDynamoDB,
+		"sqs":      q.Ping,
+	}))
+	crawlerOpts := []deno.XQueuedCrawlerOption{
+		deno.WithVersionPruner(constellation.PruneDeletedVersions),
+		deno.WithValidation(deno.ValidationConfig{
+			MaxVersions:        appCfg.Crawler.MaxVersions,
+			MaxFilesPerVersion: appCfg.Crawler.MaxFilesPerVersion,
+		}),
+		deno.WithSpecifierBlocklist(appCfg.Crawler.SpecifierBlocklist),
+	}
+	if appCfg.Crawler.Concurrency > 0 {
+		crawlerOpts = append(crawlerOpts, deno.WithMaxConcurrency(appCfg.Crawler.Concurrency))
+	}
+	if appCfg.Crawler.SpecifierBlocklistFile != "" {
+		crawlerOpts = append(crawlerOpts, deno.WithSpecifierBlocklistFile(appCfg.Crawler.SpecifierBlocklistFile))
+	}
+	if appCfg.FeatureFlags.SkipIndexedVersions {
+		slog.Info("skipping the versions indexed by previous runs")
+		checker := constellation.DynamoDBVersionChecker{Table: appCfg.DynamoDB.IndexedVersionsTable}
+		crawlerOpts = append(crawlerOpts, deno.WithVersionChecker(checker))
+		markIndexed = checker.MarkIndexed
+		clearIndexed = checker.Clear
+	}
+	if appCfg.FeatureFlags.ConditionalRequests {
+		crawlerOpts = append(crawlerOpts, deno.WithConditionalRequests(deno.NewMemoryETagCache()))
+	}
+	if appCfg.FeatureFlags.IncrementalCrawl {
+		slog.Info("incremental crawl enabled", "window", incrementalCrawlWindow.String())
+		crawlerOpts = append(crawlerOpts, deno.WithUploadedAfter(time.Now().Add(-incrementalCrawlWindow)))
+	}
+
+	crawler, err := deno.NewXQueuedCrawler(q, crawlerOpts...)
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("failed to create crawler", "error", err)
+		os.Exit(1)
 	}
+	crawler.SetRequestsPerSecond(appCfg.Crawler.ThrottleRatePerSecond)
+
+	if flag.Lookup("config").Value.String() != "" {
+		go reloadOnSighup(ctx, flag.CommandLine, appCfg, crawler)
+	}
+
+	app.Handle("/api/v1/admin/reindex", adminOnly(reindexHandler(ctx, crawler)))
+	app.Handle("/api/v1/admin/reindex-module", adminOnly(reindexModuleHandler(ctx, crawler)))
+	app.Handle("/api/v1/admin/backup", adminOnly(http.HandlerFunc(backupHandler)))
+	atomic.StoreInt32(&started, 1)
+	slog.Info("started, serving every endpoint")
 
-	q := deno.NewSQSQueue(cfg, "https://sqs.us-east-1.amazonaws.com/831183038069/andromeda-test-1", 0)
-	crawler := deno.NewXQueuedCrawler(q)
+	go reportStats(ctx, statsReportInterval)
+	go reportStaleModules(ctx, staleModulesReportInterval)
 
 	toInsert, errs := crawler.IterateModules(ctx)
 	crawlErrs := WatchQueue(ctx, crawler, q)
 
-	inserted := constellation.InsertModules(ctx, toInsert)
-	infos := IterateModuleInfo(ctx, inserted, q)
-	done := constellation.InsertFiles(ctx, infos)
+	inserted, insertModulesErrs := constellation.InsertModules(ctx, toInsert)
+	if timeout := appCfg.DenoInfo.Timeout; timeout > 0 {
+		slog.Info("timing out deno info", "timeout", timeout.String())
+		execInfo = func(ctx context.Context, target url.URL) (deno.DenoInfo, error) {
+			return deno.ExecInfoWithTrace(ctx, target, timeout)
+		}
+	}
+	if appCfg.DenoInfo.CacheTTL > 0 {
+		slog.Info("caching deno info results", "ttl", appCfg.DenoInfo.CacheTTL.String())
+		execInfo = deno.CachedExecInfo(deno.NewMemoryCache(ctx, appCfg.DenoInfo.CacheTTL), appCfg.DenoInfo.CacheTTL, execInfo)
+	}
+	// the tracker forgets a version once its inserts are reported
+	constellation.SetInsertHook(indexed.inserted)
+	infos := IterateModuleInfo(ctx, inserted, q, crawler.IsBlocked, appCfg.DenoInfo.Workers)
+	var done chan bool
+	var insertFilesErrs chan error
+	if appCfg.FeatureFlags.ParallelInsertFiles {
+		slog.Info("parallel file inserts enabled", "workers", appCfg.Dgraph.InsertWorkers)
+		done, insertFilesErrs = constellation.InsertFilesWorkerPool(ctx, infos, appCfg.Dgraph.InsertWorkers)
+	} else if appCfg.Dgraph.InsertBatchSize > 1 {
+		slog.Info("batching file inserts", "batch_size", appCfg.Dgraph.InsertBatchSize)
+		done, insertFilesErrs = constellation.InsertFilesBatched(ctx, infos, appCfg.Dgraph.InsertBatchSize)
+	} else {
+		done, insertFilesErrs = constellation.InsertFiles(ctx, infos)
+	}
 
-	merged := mergeErrors(errs, crawlErrs)
+	merged := mergeErrors(errs, crawlErrs, insertModulesErrs, insertFilesErrs)
 	go func() {
 		for e := range merged {
-			log.Printf("error: %s\n", e)
+			slog.Error("pipeline error", "error", e)
 		}
 	}()
 
 	<-done
-	log.Println("done.")
+	if err := q.Flush(context.Background()); err != nil {
+		slog.Error("failed to flush pending deletes", "queue_url", q.URL(), "error", err)
+	}
+	slog.Info("done.")
 	os.Exit(0)
 }
 
+// logLevelVar is the minimum level of the default logger, it can be changed
+// at runtime
+var logLevelVar = new(slog.LevelVar)
+
+// initLogger makes a JSON logger writing to stderr the default logger. Records
+// below the level are dropped.
+func initLogger(level string) error {
+	if err := setLogLevel(level); err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevelVar})))
+	return nil
+}
+
+// setLogLevel changes the minimum level of the default logger
+func setLogLevel(level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q: %s", level, err)
+	}
+	logLevelVar.Set(l)
+	return nil
+}
+
+// configLogLevel returns the log level of the config unless the --log-level flag
+// was set on the command line
+func configLogLevel(fs *flag.FlagSet, cfg config.Config) string {
+	level := cfg.Debug.LogLevel
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "log-level" {
+			level = f.Value.String()
+		}
+	})
+	if level == "" {
+		level = "info"
+	}
+	return level
+}
+
+// reportStats logs the number of leaf files out of the total number of files
+// on startup and then at every interval
+func reportStats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		leaves, err := constellation.CountLeafFiles(ctx)
+		if err != nil {
+			slog.Error("failed to report stats", "error", err)
+		} else if total, err := constellation.CountFiles(ctx); err != nil {
+			slog.Error("failed to report stats", "error", err)
+		} else {
+			slog.Info("stats", "leaf_files", leaves, "files", total)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reportStaleModules updates the number of stale module versions on startup
+// and then at every interval
+func reportStaleModules(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if stale, err := constellation.CountStaleModuleVersions(ctx, staleModuleThreshold); err != nil {
+			slog.Error("failed to count stale module versions", "error", err)
+		} else {
+			staleModuleVersionsGauge.Set(float64(stale))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// servePprof serves the pprof handlers on a port separate from the metrics
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	slog.Info("serving pprof", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("pprof server stopped", "error", err)
+	}
+}
+
+// endpointResolver points the SQS and DynamoDB clients to the endpoints set in
+// the config, e.g. a LocalStack container. The default AWS endpoints are used
+// for the services without an endpoint.
+func endpointResolver(cfg config.Config) aws.EndpointResolver {
+	endpoints := map[string]string{
+		dynamodb.ServiceID: cfg.DynamoDB.Endpoint,
+		sqs.ServiceID:      cfg.SQS.Endpoint,
+	}
+
+	return aws.EndpointResolverFunc(func(service, region string) (aws.Endpoint, error) {
+		if u := endpoints[service]; u != "" {
+			return aws.Endpoint{URL: u, SigningRegion: region}, nil
+		}
+		return aws.Endpoint{}, &aws.EndpointNotFoundError{}
+	})
+}
+
 // WatchQueue is an infinite loop that checks the number of messages present in
 // an SQSQueue instance and triggers the Crawler when it gets below a certain
 // threshold
@@ -108,8 +476,9 @@ func WatchQueue(ctx context.Context, crawler *deno.XQueuedCrawler, sq *deno.SQSQ
 		for {
 			select {
 			case <-ctx.Done():
-				log.Println("received cancel signal, closing WatchQueue")
+				slog.Info("received cancel signal, closing WatchQueue")
 				close(errs)
+				return
 			default:
 			}
 
@@ -120,13 +489,11 @@ func WatchQueue(ctx context.Context, crawler *deno.XQueuedCrawler, sq *deno.SQSQ
 			}
 
 			if num < 50 {
-				crawlErrs := crawler.Crawl(ctx)
-				go func() {
-					for e := range crawlErrs {
-						errs <- e
-					}
-				}()
-				<-crawler.Done()
+				slog.Info("queue is running low, starting a crawl", "queue_url", sq.URL(), "approximate_count", num)
+				// the errors channel is closed once the crawl is finished
+				for e := range crawler.Crawl(ctx) {
+					errs <- e
+				}
 			}
 
 			// TODO(wperron) find something better than sleep (timer maybe?)
@@ -137,74 +504,313 @@ func WatchQueue(ctx context.Context, crawler *deno.XQueuedCrawler, sq *deno.SQSQ
 	return errs
 }
 
+// moduleAcker removes the modules from the queue once they are processed and
+// sends the ones that failed to the dead-letter queue
+type moduleAcker interface {
+	Delete(deno.Module) error
+	Nack(deno.Module, error) error
+}
+
+// moduleKeepAliver extends the time a module stays hidden from the other
+// consumers of the queue until the returned channel is closed
+type moduleKeepAliver interface {
+	KeepAlive(context.Context, deno.Module) chan struct{}
+}
+
+// execInfo runs `deno info` on a specifier, tests replace it with fixtures
+var execInfo = deno.ExecInfo
+
+// markIndexed records a version whose files were all inserted, it is a no-op
+// unless the skip_indexed_versions feature flag is set
+var markIndexed = func(ctx context.Context, module, version string) error { return nil }
+
+// clearIndexed forgets every indexed version, it is a no-op unless the
+// skip_indexed_versions feature flag is set
+var clearIndexed = func(ctx context.Context) error { return nil }
+
+// indexed tracks the versions whose files are being inserted
+var indexed = newIndexedTracker()
+
+// indexedTracker calls markIndexed once the files of every entrypoint of a
+// version are inserted. The inserts happen downstream of IterateModuleInfo, so
+// either side may be the last to report on a version.
+type indexedTracker struct {
+	mu       sync.Mutex
+	versions map[string]*versionProgress
+}
+
+// versionProgress counts the inserts of the DenoInfo of a version
+type versionProgress struct {
+	// expected is the number of DenoInfo sent for the version, -1 until all of
+	// its files are processed
+	expected int
+	received int
+	failed   bool
+}
+
+func newIndexedTracker() *indexedTracker {
+	return &indexedTracker{versions: make(map[string]*versionProgress)}
+}
+
+// progress returns the progress of the version, t.mu must be held
+func (t *indexedTracker) progress(module, version string) *versionProgress {
+	key := module + "@" + version
+	p, ok := t.versions[key]
+	if !ok {
+		p = &versionProgress{expected: -1}
+		t.versions[key] = p
+	}
+	return p
+}
+
+// expect records that sent DenoInfo were sent for the version, and whether
+// one of its files failed before being sent
+func (t *indexedTracker) expect(ctx context.Context, module, version string, sent int, failed bool) {
+	t.mu.Lock()
+	p := t.progress(module, version)
+	p.expected = sent
+	p.failed = p.failed || failed
+	t.mu.Unlock()
+	t.check(ctx, module, version)
+}
+
+// inserted records the outcome of the insert of a DenoInfo, it is set as the
+// insert hook of constellation
+func (t *indexedTracker) inserted(ctx context.Context, info deno.DenoInfo, err error) {
+	if info.ModuleName == "" || info.ModuleVersion == "" {
+		return
+	}
+	t.mu.Lock()
+	p := t.progress(info.ModuleName, info.ModuleVersion)
+	p.received++
+	p.failed = p.failed || err != nil
+	t.mu.Unlock()
+	t.check(ctx, info.ModuleName, info.ModuleVersion)
+}
+
+// check marks the version as indexed once every DenoInfo sent for it is
+// inserted, and forgets it once every outcome is known
+func (t *indexedTracker) check(ctx context.Context, module, version string) {
+	key := module + "@" + version
+	t.mu.Lock()
+	p, ok := t.versions[key]
+	if !ok || p.expected < 0 || p.received < p.expected {
+		t.mu.Unlock()
+		return
+	}
+	delete(t.versions, key)
+	t.mu.Unlock()
+
+	if p.failed {
+		return
+	}
+	if err := markIndexed(ctx, module, version); err != nil {
+		slog.Error("failed to mark version as indexed", "module_name", module, "version", version, "error", err)
+	}
+}
+
 // IterateModuleInfo consumes the channel of Module and runs deno.ExecInfo for
-// every source code file of every version
-// TODO(wperron): refactor logic specific to deno.land/x to deno/x.go
-func IterateModuleInfo(ctx context.Context, mods chan deno.Module, sq *deno.SQSQueue) chan deno.DenoInfo {
+// every source code file of every version, with at most workers files of a
+// module processed in parallel. Specifiers for which blocked returns true are
+// skipped. Modules with a file that failed are nacked once all of their files
+// are processed. If sq implements KeepAlive, each module's message is kept
+// hidden from the other consumers while its files are processed.
+func IterateModuleInfo(ctx context.Context, mods chan deno.Module, sq moduleAcker, blocked func(string) bool, workers int) chan deno.DenoInfo {
 	out := make(chan deno.DenoInfo)
+	exec := func(item deno.WorkItem) (deno.DenoInfo, error) {
+		specificerStart := time.Now()
+		info, err := execInfo(ctx, item.URL)
+		elapsed := time.Since(specificerStart).Seconds()
+		specifierDenoInfoHist.Observe(elapsed)
+		specifierDenoInfoSummary.Observe(elapsed)
+		return info, err
+	}
+
 	go func() {
+		defer close(out)
 		for mod := range mods {
 			modStart := time.Now()
-			for v, entrypoints := range mod.Versions {
-				for _, file := range entrypoints {
-					select {
-					case <-ctx.Done():
-						// simply exit as soon as the context is cancelled, as a
-						// side effect the module message doesn't get removed
-						// from the queue. This means the whole module will get
-						// picked up and started from the beginning on the next
-						// run, which is a non issue since the process is
-						// idempotent anyway
-						log.Println("received cancel signal, closing IterateModuleInfo")
-						close(out)
-						return
-					default:
-					}
-
-					var path string
-					if mod.Name == "std" {
-						path = fmt.Sprintf("%s@%s%s", mod.Name, v, file.Path)
-					} else {
-						path = fmt.Sprintf("x/%s@%s%s", mod.Name, v, file.Path)
-					}
-
-					u := url.URL{
-						Scheme: "https",
-						Host:   "deno.land",
-						Path:   path,
-					}
-
-					specificerStart := time.Now()
-					info, err := deno.ExecInfo(ctx, u)
-					specifierDenoInfoHist.Observe(time.Since(specificerStart).Seconds())
-
-					if err != nil {
-						log.Println(fmt.Errorf("failed to run deno exec on path %s: %s", u.String(), err))
-						// TODO(wperron) find a way to represent broken dependencies in tree
-						continue
-					}
-					out <- info
+			stopKeepAlive := func() {}
+			if k, ok := sq.(moduleKeepAliver); ok {
+				stop := k.KeepAlive(ctx, mod)
+				stopKeepAlive = func() { close(stop) }
+			}
+			items := make(chan deno.WorkItem)
+			go enqueueSpecifiers(ctx, mod, items, blocked)
+
+			var failures []string
+			failedVersions := make(map[string]bool)
+			sent := make(map[string]int)
+			for res := range deno.WorkerPool(ctx, workers, items, exec) {
+				u := res.Item.URL.String()
+				if res.Err != nil {
+					slog.Error("failed to run deno exec", "module_name", mod.Name, "version", res.Item.Version, "specifier", u, "error", res.Err)
+					// TODO(wperron) find a way to represent broken dependencies in tree
+					failures = append(failures, fmt.Sprintf("%s: %s", u, res.Err))
+					failedVersions[res.Item.Version] = true
+					continue
+				}
+				if err := deno.ValidateDenoInfo(res.Info); err != nil {
+					slog.Warn("skipping invalid deno info output", "module_name", mod.Name, "version", res.Item.Version, "specifier", u, "error", err)
+					failures = append(failures, fmt.Sprintf("%s: %s", u, err))
+					failedVersions[res.Item.Version] = true
+					continue
+				}
+				info := res.Info
+				info.ModuleName = mod.Name
+				info.ModuleVersion = res.Item.Version
+				select {
+				case <-ctx.Done():
+				case out <- info:
+					sent[res.Item.Version]++
+				}
+			}
+
+			if ctx.Err() != nil {
+				// simply exit as soon as the context is cancelled, as a side
+				// effect the module message doesn't get removed from the
+				// queue. This means the whole module will get picked up and
+				// started from the beginning on the next run, which is a non
+				// issue since the process is idempotent anyway
+				constellation.ItemsAbandoned.WithLabelValues("iterate_module_info").Inc()
+				slog.Info("received cancel signal, closing IterateModuleInfo", "module_name", mod.Name)
+				return
+			}
+			stopKeepAlive()
+
+			// the versions are marked as indexed once their files are inserted
+			for v := range mod.Versions {
+				indexed.expect(ctx, mod.Name, v, sent[v], failedVersions[v])
+			}
+			if len(failures) > 0 {
+				reason := fmt.Errorf("%d files failed: %s", len(failures), strings.Join(failures, "; "))
+				if err := sq.Nack(mod, reason); err != nil {
+					slog.Error("failed to nack module", "module_name", mod.Name, "error", err)
 				}
 			}
 			if err := sq.Delete(mod); err != nil {
-				log.Fatalf("failed to delete %s: %s", mod.Name, err)
+				slog.Error("failed to delete module from the queue", "module_name", mod.Name, "error", err)
+				os.Exit(1)
 			}
 			moduleDenoInfoHist.Observe(time.Since(modStart).Seconds())
 		}
-		close(out)
 	}()
 	return out
 }
 
+// enqueueSpecifiers sends the specifier of every source code file of the module
+// to items, skipping the blocked ones, and closes it
+func enqueueSpecifiers(ctx context.Context, mod deno.Module, items chan<- deno.WorkItem, blocked func(string) bool) {
+	defer close(items)
+	for v, entrypoints := range mod.Versions {
+		for _, file := range entrypoints {
+			u := deno.SpecifierURL(mod.Name, v, file.Path)
+			if blocked != nil && blocked(u.String()) {
+				specifierBlockedCounter.Inc()
+				slog.Info("skipping blocked specifier", "module_name", mod.Name, "version", v, "specifier", u.String())
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case items <- deno.WorkItem{Module: mod.Name, Version: v, URL: u}:
+			}
+		}
+	}
+}
+
+// runtimeFields are the config fields that can be changed without restarting
+// the process
+var runtimeFields = map[string]bool{
+	"dgraph.query_timeout":             true,
+	"dgraph.mutation_timeout":          true,
+	"crawler.throttle_rate_per_second": true,
+	"crawler.concurrency":              true,
+	"debug.log_level":                  true,
+}
+
+// reloadOnSighup re-reads the config file every time the process receives a
+// SIGHUP and applies the changes that are safe to apply at runtime. Changes to
+// any other field are ignored until the process is restarted. The flags set on
+// the command line keep overriding the file.
+func reloadOnSighup(ctx context.Context, fs *flag.FlagSet, current config.Config, crawler *deno.XQueuedCrawler) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+		}
+
+		next, err := config.LoadConfig(fs)
+		if err != nil {
+			slog.Error("failed to reload config file", "path", fs.Lookup("config").Value.String(), "error", err)
+			continue
+		}
+		if err := next.Validate(); err != nil {
+			slog.Warn("invalid config, ignoring reload", "error", err)
+			continue
+		}
+
+		updated, ignored := applyRuntimeConfig(fs, &current, next, crawler)
+		slog.Info("reloaded config", "updated", updated, "ignored_until_restart", ignored)
+	}
+}
+
+// applyRuntimeConfig applies the runtime fields of next and copies them to
+// current. It returns the fields that were updated and the ones that need a
+// restart.
+func applyRuntimeConfig(fs *flag.FlagSet, current *config.Config, next config.Config, crawler *deno.XQueuedCrawler) (updated, ignored []string) {
+	for _, field := range config.Diff(*current, next) {
+		if runtimeFields[field] {
+			updated = append(updated, field)
+		} else {
+			ignored = append(ignored, field)
+		}
+	}
+
+	constellation.SetQueryTimeout(next.Dgraph.QueryTimeout)
+	constellation.SetMutationTimeout(next.Dgraph.MutationTimeout)
+	crawler.SetRequestsPerSecond(next.Crawler.ThrottleRatePerSecond)
+	crawler.SetMaxConcurrency(next.Crawler.Concurrency)
+	if err := setLogLevel(configLogLevel(fs, next)); err != nil {
+		// Validate already checked the level of the config
+		slog.Error("invalid log level", "error", err)
+	}
+
+	// keep the ignored fields at their current value so they are reported
+	// again on the next reload
+	current.Dgraph.QueryTimeout = next.Dgraph.QueryTimeout
+	current.Dgraph.MutationTimeout = next.Dgraph.MutationTimeout
+	current.Crawler.ThrottleRatePerSecond = next.Crawler.ThrottleRatePerSecond
+	current.Crawler.Concurrency = next.Crawler.Concurrency
+	current.Debug.LogLevel = next.Debug.LogLevel
+	return updated, ignored
+}
+
+// mergeErrors forwards the errors of every channel to the returned channel,
+// which is closed once all of them are closed
 func mergeErrors(chans ...chan error) chan error {
 	out := make(chan error)
 
+	wg := &sync.WaitGroup{}
+	wg.Add(len(chans))
 	for _, c := range chans {
 		go func(c <-chan error) {
+			defer wg.Done()
 			for v := range c {
 				out <- v
 			}
 		}(c)
 	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
 	return out
 }
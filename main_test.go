@@ -0,0 +1,122 @@
+//go:build integration
+// +build integration
+
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/wperron/depgraph/config"
+	"github.com/wperron/depgraph/constellation"
+	"github.com/wperron/depgraph/deno"
+	"github.com/wperron/depgraph/internal/testutil"
+)
+
+func TestPipelineEndToEnd(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	endpoint := os.Getenv("LOCALSTACK_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "http://localhost:4566"
+	}
+	appCfg := config.Default()
+	appCfg.DynamoDB.Endpoint = endpoint
+	cfg, err := awsconfig.LoadDefaultConfig(ctx,
+		awsconfig.WithRegion("us-east-1"),
+		awsconfig.WithEndpointResolver(endpointResolver(appCfg)),
+	)
+	if err != nil {
+		t.Fatalf("failed to load AWS config: %s", err)
+	}
+	constellation.InitDynamoDB(cfg, "", "")
+
+	g := testutil.NewMemoryDGraph()
+	defer constellation.UseTxn(func() constellation.Txn { return g })()
+
+	// each file of the module depends on a single other file
+	run := time.Now().UnixNano()
+	mod := fmt.Sprintf("e2e_%d", run)
+	deps := map[string]string{
+		"mod.ts":  "deps.ts",
+		"util.ts": "deps.ts",
+	}
+	origExec := execInfo
+	execInfo = func(ctx context.Context, u url.URL) (deno.DenoInfo, error) {
+		file := u.Path[strings.LastIndex(u.Path, "/")+1:]
+		dep := strings.TrimSuffix(u.String(), file) + deps[file]
+		return deno.DenoInfo{
+			Module:   u.String(),
+			DepCount: 1,
+			Files: map[string]deno.FileEntry{
+				u.String(): {Deps: []string{dep}},
+			},
+		}, nil
+	}
+	defer func() { execInfo = origExec }()
+
+	var m deno.Module
+	raw := fmt.Sprintf(`{"Name": %q, "Versions": {"v1.0.0": [{"path": "mod.ts", "type": "file"}, {"path": "util.ts", "type": "file"}]}}`, mod)
+	if err := json.Unmarshal([]byte(raw), &m); err != nil {
+		t.Fatalf("failed to unmarshal module: %s", err)
+	}
+
+	q := testutil.NewMemoryQueue()
+	if err := q.Put(m); err != nil {
+		t.Fatalf("failed to put module in queue: %s", err)
+	}
+	queued, err := q.Get(ctx)
+	if err != nil {
+		t.Fatalf("failed to get module from queue: %s", err)
+	}
+	mods := make(chan deno.Module, 1)
+	mods <- queued
+	close(mods)
+
+	inserted, insertModulesErrs := constellation.InsertModules(ctx, mods)
+	infos := IterateModuleInfo(ctx, inserted, q, nil, deno.DefaultInfoWorkers)
+	done, insertFilesErrs := constellation.InsertFiles(ctx, infos)
+	go func() {
+		for err := range mergeErrors(insertModulesErrs, insertFilesErrs) {
+			t.Errorf("unexpected pipeline error: %s", err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatalf("pipeline didn't complete: %s", ctx.Err())
+	}
+
+	if deleted := q.Deleted(); len(deleted) != 1 || deleted[0] != mod {
+		t.Errorf("expected %s to be deleted from the queue, got %v", mod, deleted)
+	}
+
+	// one mutation for the module, one for each file
+	if len(g.Mutations) != 3 {
+		t.Fatalf("expected 3 mutations, got %d", len(g.Mutations))
+	}
+	for _, file := range []string{"mod.ts", "util.ts"} {
+		specifier := fmt.Sprintf("https://deno.land/x/%s@v1.0.0/%s", mod, file)
+		if _, ok := g.Files[specifier]; !ok {
+			t.Errorf("expected a mutation for %s", specifier)
+		}
+
+		item, err := constellation.GetEntry(ctx, specifier)
+		if err != nil {
+			t.Fatalf("failed to get entry for %s: %s", specifier, err)
+		}
+		if item.Uid == "" {
+			t.Errorf("expected %s to be stored in DynamoDB", specifier)
+		}
+	}
+}
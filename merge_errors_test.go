@@ -0,0 +1,39 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMergeErrorsCloses(t *testing.T) {
+	a, b := make(chan error), make(chan error)
+	go func() {
+		a <- fmt.Errorf("a")
+		close(a)
+	}()
+	go func() {
+		b <- fmt.Errorf("b1")
+		b <- fmt.Errorf("b2")
+		close(b)
+	}()
+
+	done := make(chan int)
+	go func() {
+		n := 0
+		for range mergeErrors(a, b) {
+			n++
+		}
+		done <- n
+	}()
+
+	select {
+	case n := <-done:
+		if n != 3 {
+			t.Errorf("expected 3 errors, got %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("range over the merged channel didn't terminate")
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"testing"
+
+	"github.com/wperron/depgraph/config"
+	"github.com/wperron/depgraph/deno"
+)
+
+func TestApplyRuntimeConfig(t *testing.T) {
+	defer logLevelVar.Set(logLevelVar.Level())
+	q := deno.NewChanQueue(0)
+	crawler, err := deno.NewXQueuedCrawler(&q)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	current := config.Default()
+	next := current
+	next.Crawler.Concurrency = 5
+	next.Debug.LogLevel = "debug"
+	next.SQS.QueueURL = "https://sqs.example.com/other"
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("log-level", "info", "")
+	updated, ignored := applyRuntimeConfig(fs, &current, next, crawler)
+
+	if fmt.Sprint(updated) != "[crawler.concurrency debug.log_level]" {
+		t.Errorf("expected the concurrency and log level to be updated, got %v", updated)
+	}
+	if fmt.Sprint(ignored) != "[sqs.queue_url]" {
+		t.Errorf("expected the queue url to be ignored, got %v", ignored)
+	}
+	if n := crawler.MaxConcurrency(); n != 5 {
+		t.Errorf("expected a concurrency of 5, got %d", n)
+	}
+	if logLevelVar.Level() != slog.LevelDebug {
+		t.Errorf("expected the debug level, got %s", logLevelVar.Level())
+	}
+	if current.Crawler.Concurrency != 5 || current.SQS.QueueURL == next.SQS.QueueURL {
+		t.Errorf("expected only the runtime fields to be copied, got %+v", current)
+	}
+
+	// the command line keeps overriding the file
+	if err := fs.Parse([]string{"-log-level", "warn"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	applyRuntimeConfig(fs, &current, next, crawler)
+	if logLevelVar.Level() != slog.LevelWarn {
+		t.Errorf("expected the flag's warn level, got %s", logLevelVar.Level())
+	}
+}
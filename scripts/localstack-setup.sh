@@ -0,0 +1,30 @@
+#!/bin/sh
+# Creates the SQS queue and DynamoDB tables used by andromeda in LocalStack
+set -e
+
+ENDPOINT="${LOCALSTACK_ENDPOINT:-http://localhost:4566}"
+
+until aws --endpoint-url "$ENDPOINT" sqs list-queues > /dev/null 2>&1; do
+  echo "waiting for localstack..."
+  sleep 2
+done
+
+aws --endpoint-url "$ENDPOINT" sqs create-queue --queue-name andromeda-test-1
+
+aws --endpoint-url "$ENDPOINT" dynamodb create-table \
+  --table-name andromeda-test-4 \
+  --attribute-definitions AttributeName=specifier,AttributeType=S \
+  --key-schema AttributeName=specifier,KeyType=HASH \
+  --billing-mode PAY_PER_REQUEST || true
+
+aws --endpoint-url "$ENDPOINT" dynamodb update-time-to-live \
+  --table-name andromeda-test-4 \
+  --time-to-live-specification Enabled=true,AttributeName=ttl || true
+
+aws --endpoint-url "$ENDPOINT" dynamodb create-table \
+  --table-name indexed_versions \
+  --attribute-definitions AttributeName=module_version,AttributeType=S \
+  --key-schema AttributeName=module_version,KeyType=HASH \
+  --billing-mode PAY_PER_REQUEST || true
+
+echo "localstack resources created."
@@ -8,6 +8,24 @@ resource "aws_dynamodb_table" "ledger" {
     type = "S"
   }
 
+  ttl {
+    attribute_name = "ttl"
+    enabled        = true
+  }
+
+  tags = local.tags
+}
+
+resource "aws_dynamodb_table" "indexed_versions" {
+  name         = "${local.prefix}-indexed-versions-${local.short_uuid}"
+  hash_key     = "module_version"
+  billing_mode = "PAY_PER_REQUEST"
+
+  attribute {
+    name = "module_version"
+    type = "S"
+  }
+
   tags = local.tags
 }
 
@@ -3,6 +3,10 @@ output "ledger_table" {
   value = aws_dynamodb_table.ledger.name
 }
 
+output "indexed_versions_table" {
+  value = aws_dynamodb_table.indexed_versions.name
+}
+
 output "modules_queue_name" {
   value = aws_sqs_queue.modules.name
 }
@@ -0,0 +1,15 @@
+// Copyright 2020-2021 William Perron. All rights reserved. MIT License.
+package version
+
+import "fmt"
+
+// BuildInfo is the build metadata injected in the binary at build time
+type BuildInfo struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Built   string `json:"built"`
+}
+
+func (b BuildInfo) String() string {
+	return fmt.Sprintf("Version: %s\nCommit: %s\nBuilt: %s", b.Version, b.Commit, b.Built)
+}